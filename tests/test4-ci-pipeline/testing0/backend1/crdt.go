@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Several backend1 replicas can share one counter without a database.
+// Each keeps a PN-Counter, a CRDT (conflict-free replicated data type):
+//
+//	P[r] = how much replica r has added,  N[r] = how much it has subtracted
+//	value = sum(P) - sum(N)
+//
+// A replica only ever changes its own entries, and merging two states takes
+// the max of every entry. Max is commutative, associative and idempotent, so
+// replicas can exchange state in any order, any number of times, and still
+// agree once messages get through again after a network partition.
+//
+// Anti-entropy: every GOSSIP_INTERVAL each replica POSTs its state to every
+// peer's /crdt/merge, and merges the peer's state from the response. The
+// replicas share CRDT_SECRET and send it as a bearer token; anyone else
+// could raise every entry to any value.
+//
+// A replica's own entries only grow while it remembers them. One that
+// restarts at 0 under the same ID would have its new increments swallowed
+// by the larger entry its peers still hold, so a stable ID needs DATA_DIR;
+// without it each boot picks a fresh ID.
+
+// crdtState is a replica's PN-Counter, as exchanged between peers.
+type crdtState struct {
+	Replica string            `json:"replica"`
+	P       map[string]uint64 `json:"p"`
+	N       map[string]uint64 `json:"n"`
+}
+
+// peerSource returns the base URLs of the other replicas.
+type peerSource func(ctx context.Context) ([]string, error)
+
+// replica is this process's copy of the replicated counter.
+type replica struct {
+	id     string
+	secret string // CRDT_SECRET, sent to and required from peers
+	peers  peerSource
+	client *http.Client
+
+	mu sync.Mutex
+	p  map[string]uint64
+	n  map[string]uint64
+}
+
+func newReplica(id, secret string, peers peerSource) *replica {
+	return &replica{
+		id:     id,
+		secret: secret,
+		peers:  peers,
+		client: &http.Client{Timeout: 2 * time.Second},
+		p:      make(map[string]uint64),
+		n:      make(map[string]uint64),
+	}
+}
+
+// add records delta (which may be negative) in this replica's own entries.
+func (r *replica) add(delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if delta >= 0 {
+		r.p[r.id] += uint64(delta)
+	} else {
+		r.n[r.id] += uint64(-delta)
+	}
+}
+
+// value returns the merged counter value.
+func (r *replica) value() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var v int64
+	for _, c := range r.p {
+		v += int64(c)
+	}
+	for _, c := range r.n {
+		v -= int64(c)
+	}
+	return v
+}
+
+// state returns a copy of the PN-Counter.
+func (r *replica) state() crdtState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := crdtState{Replica: r.id, P: make(map[string]uint64, len(r.p)), N: make(map[string]uint64, len(r.n))}
+	for k, v := range r.p {
+		s.P[k] = v
+	}
+	for k, v := range r.n {
+		s.N[k] = v
+	}
+	return s
+}
+
+// merge folds another replica's state into ours, entry by entry.
+func (r *replica) merge(s crdtState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, v := range s.P {
+		if v > r.p[k] {
+			r.p[k] = v
+		}
+	}
+	for k, v := range s.N {
+		if v > r.n[k] {
+			r.n[k] = v
+		}
+	}
+}
+
+// gossipOnce exchanges state with every peer. Unreachable peers are skipped;
+// the next round tries again.
+func (r *replica) gossipOnce(ctx context.Context) {
+	peers, err := r.peers(ctx)
+	if err != nil {
+		log.Printf("CRDT: peer lookup failed: %v\n", err)
+		return
+	}
+	for _, peer := range peers {
+		if err := r.exchange(ctx, peer); err != nil {
+			log.Printf("CRDT: gossip with %s failed: %v\n", peer, err)
+		}
+	}
+}
+
+// exchange pushes our state to peer and merges the state it answers with.
+func (r *replica) exchange(ctx context.Context, peer string) error {
+	body, _ := json.Marshal(r.state())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+"/crdt/merge", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+r.secret)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var theirs crdtState
+	if err := json.NewDecoder(resp.Body).Decode(&theirs); err != nil {
+		return err
+	}
+	r.merge(theirs)
+	return nil
+}
+
+// run gossips every interval until ctx ends.
+func (r *replica) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.gossipOnce(ctx)
+		}
+	}
+}
+
+// authorized reports whether req carries the shared secret.
+func (r *replica) authorized(req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && r.secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(r.secret)) == 1
+}
+
+// mergeHandler handles POST /crdt/merge: merge the caller's state, answer with ours.
+func (r *replica) mergeHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.authorized(req) {
+		http.Error(w, "Forbidden: send the shared CRDT_SECRET as a bearer token", http.StatusForbidden)
+		return
+	}
+	var theirs crdtState
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&theirs); err != nil {
+		http.Error(w, "Invalid CRDT state: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.merge(theirs)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.state())
+}
+
+// stateHandler handles GET /crdt/state, for debugging convergence.
+func (r *replica) stateHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.authorized(req) {
+		http.Error(w, "Forbidden: send the shared CRDT_SECRET as a bearer token", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.state())
+}
+
+// staticPeers always returns the same peer URLs.
+func staticPeers(urls []string) peerSource {
+	return func(context.Context) ([]string, error) { return urls, nil }
+}
+
+// dnsPeers resolves hostPort (e.g. a Kubernetes headless service
+// "backend1:8080") on every round, so replicas can come and go.
+// Our own address is included; merging our own state is a no-op.
+func dnsPeers(hostPort string) (peerSource, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("PEERS_DNS must be host:port: %w", err)
+	}
+	return func(ctx context.Context) ([]string, error) {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		urls := make([]string, len(addrs))
+		for i, addr := range addrs {
+			urls[i] = "http://" + net.JoinHostPort(addr, port)
+		}
+		return urls, nil
+	}, nil
+}
+
+// cluster is the replicated counter, or nil when running standalone.
+var cluster *replica
+
+// replicaID names this replica. With DATA_DIR (persisted is true) it is
+// REPLICA_ID or the hostname, and must be unique and stable across
+// restarts. Without DATA_DIR, REPLICA_ID is refused and every boot gets a
+// fresh ID, the hostname plus a random suffix.
+func replicaID(persisted bool) (string, error) {
+	id := os.Getenv("REPLICA_ID")
+	if id != "" && !persisted {
+		return "", errors.New("REPLICA_ID needs DATA_DIR: a replica that restarts at 0 under the same ID loses its new increments to its peers' copy of the old ones")
+	}
+	if id == "" {
+		var err error
+		if id, err = os.Hostname(); err != nil {
+			return "", fmt.Errorf("REPLICA_ID not set and no hostname: %w", err)
+		}
+	}
+	if !persisted {
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+		id += "-" + hex.EncodeToString(suffix)
+	}
+	return id, nil
+}
+
+// enableReplication starts CRDT replication when PEERS (comma-separated
+// URLs) or PEERS_DNS (host:port) is set. CRDT_SECRET, shared by all
+// replicas, is required; see replicaID for how the replica is named.
+func enableReplication(mux *http.ServeMux) error {
+	var peers peerSource
+	switch {
+	case os.Getenv("PEERS") != "":
+		peers = staticPeers(strings.Split(os.Getenv("PEERS"), ","))
+	case os.Getenv("PEERS_DNS") != "":
+		var err error
+		if peers, err = dnsPeers(os.Getenv("PEERS_DNS")); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	secret := os.Getenv("CRDT_SECRET")
+	if secret == "" {
+		return errors.New("CRDT_SECRET must be set when replicating, to the same value on every replica")
+	}
+	id, err := replicaID(journal != nil)
+	if err != nil {
+		return err
+	}
+	interval := time.Second
+	if raw := os.Getenv("GOSSIP_INTERVAL"); raw != "" {
+		var err error
+		if interval, err = time.ParseDuration(raw); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid GOSSIP_INTERVAL %q", raw)
+		}
+	}
+
+	r := newReplica(id, secret, peers)
+	// Our own increments so far (recovered from DATA_DIR, if set) seed our entry.
+	counterMu.Lock()
+	r.add(int64(counter))
+	cluster = r
+	counterMu.Unlock()
+
+	mux.HandleFunc("/crdt/merge", r.mergeHandler)
+	mux.HandleFunc("/crdt/state", r.stateHandler)
+	go r.run(context.Background(), interval)
+	log.Printf("Replicating as %q, gossiping every %v\n", id, interval)
+	return nil
+}
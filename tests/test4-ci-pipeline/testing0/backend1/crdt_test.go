@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testSecret is the CRDT_SECRET shared by the test replicas.
+const testSecret = "test-secret"
+
+// network connects in-process replicas and can cut links between them.
+type network struct {
+	mu   sync.Mutex
+	urls map[*replica]string
+	cut  map[[2]string]bool // {from URL, to URL}
+}
+
+// linkTransport sends one replica's requests, failing if the link is cut.
+type linkTransport struct {
+	net  *network
+	from *replica
+}
+
+func (t linkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.net.mu.Lock()
+	cut := t.net.cut[[2]string{t.net.urls[t.from], "http://" + req.URL.Host}]
+	t.net.mu.Unlock()
+	if cut {
+		return nil, errors.New("network partition")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newNetwork starts n replicas that all list each other as static peers.
+func newNetwork(t *testing.T, ids ...string) (*network, []*replica) {
+	t.Helper()
+	n := &network{urls: map[*replica]string{}, cut: map[[2]string]bool{}}
+	var all []string
+	replicas := make([]*replica, len(ids))
+	for i, id := range ids {
+		r := newReplica(id, testSecret, nil)
+		r.client = &http.Client{Transport: linkTransport{net: n, from: r}}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/crdt/merge", r.mergeHandler)
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		n.urls[r] = server.URL
+		all = append(all, server.URL)
+		replicas[i] = r
+	}
+	for _, r := range replicas {
+		var others []string
+		for _, u := range all {
+			if u != n.urls[r] {
+				others = append(others, u)
+			}
+		}
+		r.peers = staticPeers(others)
+	}
+	return n, replicas
+}
+
+// partition cuts every link between the two groups, in both directions.
+func (n *network) partition(a, b []*replica, cut bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, x := range a {
+		for _, y := range b {
+			n.cut[[2]string{n.urls[x], n.urls[y]}] = cut
+			n.cut[[2]string{n.urls[y], n.urls[x]}] = cut
+		}
+	}
+}
+
+// gossipRound lets every replica run one anti-entropy round.
+func gossipRound(replicas []*replica) {
+	for _, r := range replicas {
+		r.gossipOnce(context.Background())
+	}
+}
+
+// Test that merging is idempotent and commutative
+func TestPNCounterMerge(t *testing.T) {
+	// Arrange
+	a, b := newReplica("a", testSecret, nil), newReplica("b", testSecret, nil)
+	a.add(5)
+	b.add(3)
+	b.add(-1)
+
+	// Act: merge in both directions, some twice
+	a.merge(b.state())
+	a.merge(b.state())
+	b.merge(a.state())
+
+	// Assert
+	if a.value() != 7 || b.value() != 7 {
+		t.Errorf("Expected both replicas at 7, got %d and %d", a.value(), b.value())
+	}
+}
+
+// Test that replicas diverge during a partition and converge after it heals
+func TestReplicasConvergeAfterPartition(t *testing.T) {
+	// Arrange: {a} | {b, c}
+	net, rs := newNetwork(t, "a", "b", "c")
+	a, b, c := rs[0], rs[1], rs[2]
+	net.partition([]*replica{a}, []*replica{b, c}, true)
+
+	// Act: writes on both sides of the partition
+	a.add(10)
+	b.add(1)
+	c.add(2)
+	c.add(-1)
+	gossipRound(rs)
+
+	// Assert: each side only sees its own writes
+	if a.value() != 10 {
+		t.Errorf("Expected the isolated replica at 10, got %d", a.value())
+	}
+	if b.value() != 2 || c.value() != 2 {
+		t.Errorf("Expected b and c at 2, got %d and %d", b.value(), c.value())
+	}
+
+	// Act: heal and gossip
+	net.partition([]*replica{a}, []*replica{b, c}, false)
+	gossipRound(rs)
+
+	// Assert
+	for _, r := range rs {
+		if r.value() != 12 {
+			t.Errorf("Expected replica %s at 12 after healing, got %d", r.id, r.value())
+		}
+	}
+}
+
+// Test that the counter handlers return the merged value
+func TestCounterHandlersWithReplication(t *testing.T) {
+	// Arrange
+	cluster = newReplica("self", testSecret, nil)
+	defer func() { cluster = nil }()
+	counter = 0
+	peer := newReplica("peer", testSecret, nil)
+	peer.add(4)
+	cluster.merge(peer.state())
+
+	// Act
+	rr := httptest.NewRecorder()
+	incrementCounterHandler(rr, httptest.NewRequest("POST", "/counter/increment", nil))
+
+	// Assert
+	if body := rr.Body.String(); body != "{\"value\":5}\n" {
+		t.Errorf("Expected the merged value 5, got %s", body)
+	}
+	if cluster.state().P["self"] != 1 {
+		t.Errorf("Expected the increment on our own entry, got %v", cluster.state().P)
+	}
+}
+
+// Test that /crdt/merge only accepts callers with the shared secret
+func TestMergeNeedsSecret(t *testing.T) {
+	// Arrange
+	r := newReplica("self", testSecret, nil)
+	server := httptest.NewServer(http.HandlerFunc(r.mergeHandler))
+	defer server.Close()
+	intruder := newReplica("intruder", "guess", nil)
+	intruder.add(1000)
+
+	// Act
+	err := intruder.exchange(context.Background(), server.URL)
+
+	// Assert
+	if err == nil || r.value() != 0 {
+		t.Errorf("Expected the merge to be refused, got %v and value %d", err, r.value())
+	}
+}
+
+// Test that a stable REPLICA_ID is refused without DATA_DIR, and that each
+// boot without one gets a fresh ID
+func TestReplicaIDNeedsPersistence(t *testing.T) {
+	// Act
+	t.Setenv("REPLICA_ID", "a")
+	_, stableErr := replicaID(false)
+	persisted, persistedErr := replicaID(true)
+	t.Setenv("REPLICA_ID", "")
+	first, _ := replicaID(false)
+	second, _ := replicaID(false)
+
+	// Assert
+	if stableErr == nil {
+		t.Errorf("Expected REPLICA_ID without DATA_DIR to be refused")
+	}
+	if persistedErr != nil || persisted != "a" {
+		t.Errorf("Expected REPLICA_ID a with DATA_DIR, got %q (err %v)", persisted, persistedErr)
+	}
+	if first == "" || first == second {
+		t.Errorf("Expected a fresh ID per boot, got %q and %q", first, second)
+	}
+}
@@ -3,13 +3,20 @@ package main
 import (
 	"encoding/json" // For encoding data as JSON
 	"fmt"
+	"log"
 	"net/http"
 	"os" // For reading environment variables
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
 // A global variable used to store the counter value.
-// Works for simple demos, but unsafe when accessed by multiple concurrent requests.
-var counter int
+// counterMu guards it, since every request runs in its own goroutine.
+var (
+	counter   int
+	counterMu sync.Mutex
+)
 
 // CounterResponse defines the JSON structure we send back to clients.
 type CounterResponse struct {
@@ -23,6 +30,32 @@ func main() {
 	// Handle POST /counter/increment
 	http.HandleFunc("/counter/increment", incrementCounterHandler)
 
+	// Optional durability: with DATA_DIR set, increments are written to a
+	// log on disk and the counter is recovered on startup (see persistence.go).
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		if err := enablePersistence(dir); err != nil {
+			log.Fatalf("Unable to open data directory %s: %v\n", dir, err)
+		}
+		// On Ctrl-C or SIGTERM (docker stop), snapshot and close the log.
+		go func() {
+			stop := make(chan os.Signal, 1)
+			signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+			<-stop
+			if err := snapshotCounter(); err != nil {
+				log.Printf("Final snapshot failed, the WAL still has every increment: %v\n", err)
+			}
+			counterMu.Lock() // no increments between closing the log and exiting
+			journal.close()
+			os.Exit(0)
+		}()
+	}
+
+	// Optional replication: with PEERS or PEERS_DNS set, replicas exchange
+	// their counts and converge without a shared database (see crdt.go).
+	if err := enableReplication(http.DefaultServeMux); err != nil {
+		log.Fatalf("Invalid replication configuration: %v\n", err)
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -45,7 +78,14 @@ func getCounterHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// Encode the current counter value as JSON and send it.
-	json.NewEncoder(w).Encode(CounterResponse{Value: counter})
+	// With replication on, that is the merged value across all replicas.
+	counterMu.Lock()
+	value := counter
+	if cluster != nil {
+		value = int(cluster.value())
+	}
+	counterMu.Unlock()
+	json.NewEncoder(w).Encode(CounterResponse{Value: value})
 }
 
 // incrementCounterHandler handles POST /counter/increment
@@ -56,10 +96,25 @@ func incrementCounterHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	counterMu.Lock()
+	// Log the increment before applying it, so an acknowledged increment survives a crash.
+	if journal != nil {
+		if err := journal.appendAdd(1); err != nil {
+			counterMu.Unlock()
+			http.Error(w, "Failed to persist increment: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 	counter++
+	value := counter
+	// With replication on, counter is this replica's own share of the total.
+	if cluster != nil {
+		cluster.add(1)
+		value = int(cluster.value())
+	}
+	counterMu.Unlock()
+
 	// Send the updated value back as JSON.
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(CounterResponse{Value: counter})
-}
-
-// future : add thread safety
\ No newline at end of file
+	json.NewEncoder(w).Encode(CounterResponse{Value: value})
+}
\ No newline at end of file
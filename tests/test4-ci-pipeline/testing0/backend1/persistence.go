@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Durability without a database: every increment is appended to a
+// write-ahead log (WAL) before it is acknowledged, and the counter is
+// snapshotted now and then so the log can be emptied (compaction).
+//
+// On startup the snapshot is loaded and the log replayed on top of it.
+// A crash in the middle of an append leaves a torn last record; recovery
+// notices the bad checksum, drops it and truncates the file there.
+//
+// Files in DATA_DIR:
+//
+//	snapshot.json  {"seq": 41, "value": 41}, replaced atomically via rename
+//	wal.log        fixed-size records: seq, op, value, CRC-32
+
+const (
+	walFile      = "wal.log"
+	snapshotFile = "snapshot.json"
+
+	opAdd      = 1  // add value to the counter
+	recordSize = 21 // 8 seq + 1 op + 8 value + 4 CRC-32
+)
+
+// fsyncPolicy says when appended records are forced to disk.
+type fsyncPolicy string
+
+const (
+	fsyncAlways   fsyncPolicy = "always"   // before every response: nothing acknowledged is ever lost
+	fsyncInterval fsyncPolicy = "interval" // once a second: a crash loses at most ~1s of increments
+	fsyncNever    fsyncPolicy = "never"    // leave it to the OS: fastest, loses whatever it had buffered
+)
+
+// walRecord is one logged operation.
+type walRecord struct {
+	Seq   uint64 // increases by one per record, never reused
+	Op    byte
+	Value int64
+}
+
+func (r walRecord) encode() []byte {
+	b := make([]byte, recordSize)
+	binary.BigEndian.PutUint64(b[0:8], r.Seq)
+	b[8] = r.Op
+	binary.BigEndian.PutUint64(b[9:17], uint64(r.Value))
+	binary.BigEndian.PutUint32(b[17:21], crc32.ChecksumIEEE(b[:17]))
+	return b
+}
+
+// decodeRecord returns false if b is not a valid record (e.g. a torn write).
+func decodeRecord(b []byte) (walRecord, bool) {
+	if len(b) != recordSize || crc32.ChecksumIEEE(b[:17]) != binary.BigEndian.Uint32(b[17:21]) {
+		return walRecord{}, false
+	}
+	return walRecord{
+		Seq:   binary.BigEndian.Uint64(b[0:8]),
+		Op:    b[8],
+		Value: int64(binary.BigEndian.Uint64(b[9:17])),
+	}, true
+}
+
+// snapshot is the counter value after every record up to Seq.
+type snapshot struct {
+	Seq   uint64 `json:"seq"`
+	Value int64  `json:"value"`
+}
+
+// wal is the open write-ahead log. It is safe for concurrent use.
+type wal struct {
+	mu     sync.Mutex
+	dir    string
+	f      *os.File
+	policy fsyncPolicy
+	seq    uint64 // seq of the last record written (or covered by the snapshot)
+	dirty  bool   // records written since the last fsync
+	stop   chan struct{}
+}
+
+// openWAL recovers the counter from dir (creating it if needed) and opens
+// the log for appending. It returns the recovered counter value.
+func openWAL(dir string, policy fsyncPolicy) (*wal, int64, error) {
+	switch policy {
+	case fsyncAlways, fsyncInterval, fsyncNever:
+	default:
+		return nil, 0, fmt.Errorf("unknown fsync policy %q (want always, interval or never)", policy)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, 0, err
+	}
+
+	// 1. Start from the last snapshot, if there is one.
+	var snap snapshot
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, 0, fmt.Errorf("read snapshot: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, 0, err
+	}
+
+	// 2. Replay the log records newer than the snapshot.
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	value, seq := snap.Value, snap.Seq
+	var good int64 // offset just past the last valid record
+	buf := make([]byte, recordSize)
+	for {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			break // io.EOF, or io.ErrUnexpectedEOF for a torn final record
+		}
+		rec, ok := decodeRecord(buf)
+		if !ok {
+			break
+		}
+		good += recordSize
+		// Records up to the snapshot are already counted: the process may
+		// have crashed after writing the snapshot but before compacting.
+		if rec.Seq <= seq {
+			continue
+		}
+		if rec.Op == opAdd {
+			value += rec.Value
+		}
+		seq = rec.Seq
+	}
+
+	// 3. Cut off anything after the last good record so new appends follow it.
+	if size, err := f.Seek(0, io.SeekEnd); err == nil && size > good {
+		log.Printf("WAL: discarding %d bytes of incomplete or corrupt records\n", size-good)
+		if err := f.Truncate(good); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	w := &wal{dir: dir, f: f, policy: policy, seq: seq, stop: make(chan struct{})}
+	if policy == fsyncInterval {
+		go w.syncEvery(time.Second)
+	}
+	return w, value, nil
+}
+
+// appendAdd logs "add delta". It returns once the record is as durable as
+// the fsync policy promises, so the caller may then acknowledge the change.
+func (w *wal) appendAdd(delta int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	rec := walRecord{Seq: w.seq + 1, Op: opAdd, Value: delta}
+	off, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Write(rec.encode()); err != nil {
+		// Drop the partial record so later appends stay aligned.
+		w.f.Truncate(off)
+		w.f.Seek(off, io.SeekStart)
+		return err
+	}
+	w.seq = rec.Seq
+	w.dirty = true
+	if w.policy == fsyncAlways {
+		return w.syncLocked()
+	}
+	return nil
+}
+
+func (w *wal) syncLocked() error {
+	if !w.dirty {
+		return nil
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+func (w *wal) syncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if err := w.syncLocked(); err != nil {
+				log.Printf("WAL fsync failed: %v\n", err)
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// compact writes a snapshot of value (which must include every record
+// appended so far) and then empties the log.
+func (w *wal) compact(value int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// 1. Write the snapshot to a temp file and rename it into place, so a
+	// crash leaves either the old snapshot or the new one, never half of one.
+	data, _ := json.Marshal(snapshot{Seq: w.seq, Value: value})
+	tmp := filepath.Join(w.dir, snapshotFile+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(w.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+
+	// 2. Only now is it safe to drop the log: the snapshot covers it.
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.dirty = true
+	return w.syncLocked()
+}
+
+// size returns how many records are in the log since the last compaction.
+func (w *wal) size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	off, _ := w.f.Seek(0, io.SeekCurrent)
+	return off / recordSize
+}
+
+// close flushes the log to disk and closes it.
+func (w *wal) close() error {
+	close(w.stop)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dirty = true
+	if err := w.syncLocked(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// journal is the open WAL, or nil when DATA_DIR is not set.
+var journal *wal
+
+// enablePersistence recovers the counter from dir and starts logging
+// increments there. The environment picks the fsync policy (WAL_FSYNC,
+// default always) and how often to snapshot (SNAPSHOT_INTERVAL, default 1m).
+func enablePersistence(dir string) error {
+	policy := fsyncPolicy(os.Getenv("WAL_FSYNC"))
+	if policy == "" {
+		policy = fsyncAlways
+	}
+	interval := time.Minute
+	if raw := os.Getenv("SNAPSHOT_INTERVAL"); raw != "" {
+		var err error
+		if interval, err = time.ParseDuration(raw); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid SNAPSHOT_INTERVAL %q", raw)
+		}
+	}
+
+	w, value, err := openWAL(dir, policy)
+	if err != nil {
+		return err
+	}
+	counterMu.Lock()
+	counter = int(value)
+	journal = w
+	counterMu.Unlock()
+	log.Printf("Recovered counter = %d from %s (fsync: %s)\n", value, dir, policy)
+
+	go func() {
+		for range time.Tick(interval) {
+			if err := snapshotCounter(); err != nil {
+				log.Printf("Snapshot failed, keeping the WAL: %v\n", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// snapshotCounter compacts the WAL into a snapshot if anything was logged since the last one.
+func snapshotCounter() error {
+	counterMu.Lock()
+	defer counterMu.Unlock()
+	if journal == nil || journal.size() == 0 {
+		return nil
+	}
+	return journal.compact(int64(counter))
+}
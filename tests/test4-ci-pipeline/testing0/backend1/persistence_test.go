@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestWAL opens the WAL in dir, failing the test on error.
+func openTestWAL(t *testing.T, dir string) (*wal, int64) {
+	t.Helper()
+	w, value, err := openWAL(dir, fsyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, value
+}
+
+// Test that logged increments are replayed after a restart
+func TestWALRecovery(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	w, _ := openTestWAL(t, dir)
+	for i := 0; i < 3; i++ {
+		w.appendAdd(1)
+	}
+	w.close()
+
+	// Act
+	w, value := openTestWAL(t, dir)
+	defer w.close()
+
+	// Assert
+	if value != 3 {
+		t.Errorf("Expected recovered value 3, got %d", value)
+	}
+}
+
+// Test that a torn final record is dropped and appends continue after the last good one
+func TestWALTornRecord(t *testing.T) {
+	// Arrange: two records, then half of a third as if the process died mid-write
+	dir := t.TempDir()
+	w, _ := openTestWAL(t, dir)
+	w.appendAdd(1)
+	w.appendAdd(1)
+	w.close()
+	f, _ := os.OpenFile(filepath.Join(dir, walFile), os.O_APPEND|os.O_WRONLY, 0)
+	f.Write(walRecord{Seq: 3, Op: opAdd, Value: 1}.encode()[:10])
+	f.Close()
+
+	// Act
+	w, value := openTestWAL(t, dir)
+	w.appendAdd(5)
+	w.close()
+	_, after := openTestWAL(t, dir)
+
+	// Assert
+	if value != 2 {
+		t.Errorf("Expected 2 after dropping the torn record, got %d", value)
+	}
+	if after != 7 {
+		t.Errorf("Expected 7 after appending past the truncation, got %d", after)
+	}
+}
+
+// Test that compaction empties the log and the snapshot carries the value
+func TestWALCompaction(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	w, _ := openTestWAL(t, dir)
+	for i := 0; i < 5; i++ {
+		w.appendAdd(1)
+	}
+
+	// Act
+	err := w.compact(5)
+	w.appendAdd(1)
+	size := w.size()
+	w.close()
+	_, value := openTestWAL(t, dir)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 1 {
+		t.Errorf("Expected 1 record in the log after compaction, got %d", size)
+	}
+	if value != 6 {
+		t.Errorf("Expected 6 from snapshot plus log, got %d", value)
+	}
+}
+
+// Test that records already in the snapshot are not counted twice
+// (a crash between writing the snapshot and emptying the log)
+func TestWALSnapshotOverlap(t *testing.T) {
+	// Arrange: log has records 1..3, snapshot already covers 1..2
+	dir := t.TempDir()
+	w, _ := openTestWAL(t, dir)
+	for i := 0; i < 3; i++ {
+		w.appendAdd(1)
+	}
+	w.close()
+	os.WriteFile(filepath.Join(dir, snapshotFile), []byte(`{"seq": 2, "value": 2}`), 0o644)
+
+	// Act
+	_, value := openTestWAL(t, dir)
+
+	// Assert
+	if value != 3 {
+		t.Errorf("Expected 3, got %d", value)
+	}
+}
+
+// Test that an unknown fsync policy is rejected
+func TestWALInvalidPolicy(t *testing.T) {
+	if _, _, err := openWAL(t.TempDir(), "sometimes"); err == nil {
+		t.Error("Expected an error for an unknown fsync policy")
+	}
+}
+
+// Test that the increment handler logs before answering
+func TestIncrementCounterHandlerPersists(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	journal, _ = openTestWAL(t, dir)
+	defer func() { journal.close(); journal = nil }()
+	counter = 0
+
+	// Act
+	incrementCounterHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/counter/increment", nil))
+	journal.close()
+	journal, _ = openTestWAL(t, dir)
+
+	// Assert
+	if journal.size() != 1 {
+		t.Errorf("Expected 1 logged increment, got %d", journal.size())
+	}
+}
@@ -0,0 +1,986 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Alert rules notify a webhook when a counter passes a threshold, e.g.
+// when signups go above 1000 or a balance drops below zero. Rules are
+// checked on every change published on the change hub, so on Postgres
+// every replica sees every write (see listenForChanges) and the replica
+// that flips the rule's firing flag in the database delivers the webhook.
+//
+// A rule fires once when it trips and stays quiet until the value has
+// moved back past the threshold by its hysteresis, so a counter hovering
+// around the threshold does not flap. Webhooks are signed with
+// ALERT_SECRET, retried with exponential backoff and, when every attempt
+// failed, kept in a dead-letter list for GET /admin/alerts/dead-letters.
+// Retries live in process memory: a webhook still being retried at
+// shutdown goes to the dead letters.
+//
+// Rules make the server send requests, so managing them takes
+// ALERT_ADMIN_KEY in X-Admin-Key, and webhooks may not target loopback,
+// private or link-local addresses (checked again on every connection, so
+// a name that later resolves inward is caught too). ALERT_ALLOWED_HOSTS
+// lists internal hosts that may be targeted anyway; the host of
+// ALERT_WEBHOOK_URL always may.
+
+// Alert rule kinds.
+const (
+	alertAbove     = "above"      // the value goes above threshold
+	alertBelow     = "below"      // the value drops below threshold
+	alertRateAbove = "rate_above" // more than threshold increments in the window
+)
+
+// alertTimeout bounds one webhook attempt.
+const alertTimeout = 10 * time.Second
+
+// maxAlertBackoff caps the wait between two attempts.
+const maxAlertBackoff = 5 * time.Minute
+
+// alertReload is how often the rules are re-read, to pick up the rules
+// created and deleted through other replicas.
+const alertReload = 10 * time.Second
+
+var (
+	errAlertRuleNotFound = errors.New("alert rule not found")
+	errWebhookForbidden  = errors.New("webhooks may not target loopback, private or link-local addresses (see ALERT_ALLOWED_HOSTS)")
+	errAlertsUnsupported = errors.New("alert rules are off, set ALERT_SECRET to enable them")
+)
+
+// AlertRule is the JSON representation of an alert rule.
+type AlertRule struct {
+	ID         int64     `json:"id"`
+	CounterID  int64     `json:"counter_id"`
+	Kind       string    `json:"kind"`
+	Threshold  int64     `json:"threshold"`
+	Window     string    `json:"window,omitempty"` // rate_above only
+	Hysteresis int64     `json:"hysteresis"`
+	URL        string    `json:"url"`
+	Firing     bool      `json:"firing"` // tripped and not re-armed yet
+	CreatedAt  time.Time `json:"created_at"`
+
+	window time.Duration
+}
+
+// AlertRuleRequest is the JSON body of POST /alerts.
+type AlertRuleRequest struct {
+	CounterID  int64  `json:"counter_id,omitempty"` // default 1
+	Kind       string `json:"kind"`
+	Threshold  int64  `json:"threshold"`
+	Window     string `json:"window,omitempty"`
+	Hysteresis int64  `json:"hysteresis,omitempty"`
+	URL        string `json:"url,omitempty"` // default ALERT_WEBHOOK_URL
+}
+
+// AlertRuleList is the JSON response of GET /alerts.
+type AlertRuleList struct {
+	Rules []AlertRule `json:"rules"`
+}
+
+// AlertEvent is the JSON body of an alert webhook.
+type AlertEvent struct {
+	ID        string    `json:"id"`   // the same in every attempt, for deduplication
+	Type      string    `json:"type"` // always "alert.fired"
+	RuleID    int64     `json:"rule_id"`
+	CounterID int64     `json:"counter_id"`
+	Kind      string    `json:"kind"`
+	Threshold int64     `json:"threshold"`
+	Window    string    `json:"window,omitempty"`
+	Value     int64     `json:"value"` // the counter value, or the increments in the window for rate_above
+	FiredAt   time.Time `json:"fired_at"`
+}
+
+// DeadLetter is a webhook that could not be delivered.
+type DeadLetter struct {
+	ID       int64      `json:"id"`
+	RuleID   int64      `json:"rule_id"`
+	URL      string     `json:"url"`
+	Event    AlertEvent `json:"event"`
+	Attempts int        `json:"attempts"`
+	Error    string     `json:"error"` // the last attempt's error
+	FailedAt time.Time  `json:"failed_at"`
+}
+
+// DeadLetterList is the JSON response of GET /admin/alerts/dead-letters.
+type DeadLetterList struct {
+	DeadLetters []DeadLetter `json:"dead_letters"`
+}
+
+// alertStore keeps alert rules and dead letters. It is implemented by
+// memoryAlerts and postgresAlerts.
+type alertStore interface {
+	AlertRules(ctx context.Context) ([]AlertRule, error)
+	// CreateAlertRule stores r and returns it with its ID and CreatedAt.
+	CreateAlertRule(ctx context.Context, r AlertRule) (AlertRule, error)
+	DeleteAlertRule(ctx context.Context, id int64) error
+	// SetAlertFiring sets the firing flag of rule id and reports whether
+	// it changed, so only one replica acts on a transition.
+	SetAlertFiring(ctx context.Context, id int64, firing bool) (bool, error)
+	AddDeadLetter(ctx context.Context, d DeadLetter) error
+	// DeadLetters returns the newest limit dead letters, newest first.
+	DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error)
+}
+
+// newAlertRule validates req and turns it into a rule, using defaultURL
+// when the request names no webhook.
+func newAlertRule(req AlertRuleRequest, defaultURL string) (AlertRule, error) {
+	r := AlertRule{
+		CounterID:  req.CounterID,
+		Kind:       req.Kind,
+		Threshold:  req.Threshold,
+		Hysteresis: req.Hysteresis,
+		URL:        req.URL,
+	}
+	if r.CounterID == 0 {
+		r.CounterID = 1
+	}
+	if r.URL == "" {
+		r.URL = defaultURL
+	}
+	if r.CounterID < 1 {
+		return r, fmt.Errorf("invalid counter_id %d, want a positive integer", r.CounterID)
+	}
+	if r.Hysteresis < 0 {
+		return r, fmt.Errorf("invalid hysteresis %d, want 0 or more", r.Hysteresis)
+	}
+
+	switch r.Kind {
+	case alertAbove, alertBelow:
+		if req.Window != "" {
+			return r, fmt.Errorf("window only applies to %s rules", alertRateAbove)
+		}
+	case alertRateAbove:
+		if rates == nil {
+			return r, fmt.Errorf("%s rules need rate windows: %w", alertRateAbove, errRatesUnsupported)
+		}
+		d, err := time.ParseDuration(req.Window)
+		if _, tracked := rates.count(r.CounterID, d, time.Now()); err != nil || !tracked {
+			return r, fmt.Errorf("invalid window %q, want a window tracked for counter %d (see GET /counter/rate)", req.Window, r.CounterID)
+		}
+		if r.Threshold < 0 {
+			return r, fmt.Errorf("invalid threshold %d, want 0 or more increments", r.Threshold)
+		}
+		r.window, r.Window = d, formatWindow(d)
+	default:
+		return r, fmt.Errorf("invalid kind %q, want %s, %s or %s", r.Kind, alertAbove, alertBelow, alertRateAbove)
+	}
+	// The re-arm level must fit in an int64.
+	if r.Kind == alertBelow && r.Threshold > math.MaxInt64-r.Hysteresis ||
+		r.Kind != alertBelow && r.Threshold < math.MinInt64+r.Hysteresis {
+		return r, fmt.Errorf("hysteresis %d is too wide for threshold %d", r.Hysteresis, r.Threshold)
+	}
+
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return r, fmt.Errorf("invalid url %q, want an http or https webhook URL", r.URL)
+	}
+	return r, nil
+}
+
+// check compares what the rule watches against its threshold and reports
+// whether that trips the alert and whether it re-arms a firing one.
+func (r AlertRule) check(observed int64) (trip, rearm bool) {
+	if r.Kind == alertBelow {
+		return observed < r.Threshold, observed >= r.Threshold+r.Hysteresis
+	}
+	return observed > r.Threshold, observed <= r.Threshold-r.Hysteresis
+}
+
+// observe returns what the rule compares against its threshold after ch.
+func (r AlertRule) observe(ch counterChange, now time.Time) int64 {
+	if r.Kind != alertRateAbove {
+		return ch.Value
+	}
+	if rates == nil {
+		return 0
+	}
+	count, _ := rates.count(ch.ID, r.window, now)
+	return count
+}
+
+// signWebhook returns the X-Counter-Signature of a webhook body sent at
+// timestamp: the hex HMAC-SHA256 of "<timestamp>.<body>" under secret.
+// Receivers should recompute it and reject old timestamps.
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// alerter checks the rules against every change and delivers webhooks.
+type alerter struct {
+	store    alertStore
+	secret   []byte
+	url      string          // ALERT_WEBHOOK_URL, the default webhook
+	adminKey string          // ALERT_ADMIN_KEY, required to manage rules
+	allowed  map[string]bool // hosts that may be internal; set before the first rule fires
+	retries  int
+	backoff  time.Duration
+	client   *http.Client
+
+	pending   chan counterChange
+	stop      chan struct{}
+	done      chan struct{}  // closed when run returns
+	wg        sync.WaitGroup // webhooks being delivered
+	closeOnce sync.Once
+
+	mu    sync.Mutex
+	rules map[int64][]AlertRule // by counter id
+
+	fired      prometheus.Counter
+	deliveries *prometheus.CounterVec
+	dropped    prometheus.Counter
+}
+
+// alerts checks alert rules, or is nil without ALERT_SECRET.
+var alerts *alerter
+
+// newAlerter loads the rules from s, observes the change hub and starts
+// checking changes in the background.
+func newAlerter(s alertStore, secret []byte, defaultURL string, retries int, backoff time.Duration) (*alerter, error) {
+	a := &alerter{
+		store:   s,
+		secret:  secret,
+		url:     defaultURL,
+		retries: retries,
+		backoff: backoff,
+		allowed: make(map[string]bool),
+		pending: make(chan counterChange, 1024),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		fired: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_alerts_fired_total",
+			Help: "Alert rules that tripped.",
+		}),
+		deliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "counter_alert_deliveries_total",
+			Help: "Webhook attempts by outcome: delivered, retried or dead_letter.",
+		}, []string{"outcome"}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_alert_changes_dropped_total",
+			Help: "Changes not checked against alert rules because the queue was full.",
+		}),
+	}
+	a.client = &http.Client{Timeout: alertTimeout, Transport: &http.Transport{DialContext: a.dialWebhook}}
+	if u, err := url.Parse(defaultURL); err == nil && defaultURL != "" {
+		a.allowed[strings.ToLower(u.Hostname())] = true
+	}
+	if err := a.reload(context.Background()); err != nil {
+		return nil, fmt.Errorf("load alert rules: %w", err)
+	}
+	changes.observe(func(ch counterChange) {
+		select {
+		case a.pending <- ch:
+		default:
+			a.dropped.Inc()
+		}
+	})
+	go a.run()
+	return a, nil
+}
+
+// alerterFromEnv enables alert rules when ALERT_SECRET is set. Rules and
+// dead letters are kept in Postgres, or in memory with STORE=memory.
+// ALERT_WEBHOOK_URL is the webhook of rules that name none, ALERT_RETRIES
+// (default 5) the retries after a failed attempt and ALERT_BACKOFF
+// (default 1s) the wait before the first retry, doubled for every other.
+// ALERT_ADMIN_KEY guards the rule endpoints and ALERT_ALLOWED_HOSTS, a
+// comma-separated list of hostnames or IPs, lets webhooks reach those
+// internal hosts.
+func alerterFromEnv() (*alerter, error) {
+	secret := os.Getenv("ALERT_SECRET")
+	if secret == "" {
+		return nil, nil
+	}
+	retries := 5
+	if raw := os.Getenv("ALERT_RETRIES"); raw != "" {
+		var err error
+		if retries, err = strconv.Atoi(raw); err != nil || retries < 0 {
+			return nil, fmt.Errorf("invalid ALERT_RETRIES %q, want a count like 5", raw)
+		}
+	}
+	backoff := time.Second
+	if raw := os.Getenv("ALERT_BACKOFF"); raw != "" {
+		var err error
+		if backoff, err = time.ParseDuration(raw); err != nil || backoff <= 0 {
+			return nil, fmt.Errorf("invalid ALERT_BACKOFF %q, want a duration like 1s", raw)
+		}
+	}
+	defaultURL := os.Getenv("ALERT_WEBHOOK_URL")
+	if defaultURL != "" {
+		if u, err := url.Parse(defaultURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid ALERT_WEBHOOK_URL %q, want an http or https URL", defaultURL)
+		}
+	}
+
+	var s alertStore
+	switch {
+	case cluster != nil:
+		// Every node applies every write, so every node would fire.
+		return nil, fmt.Errorf("alert rules are not available with STORE=raft")
+	case db != nil:
+		if err := createAlertTables(context.Background()); err != nil {
+			return nil, fmt.Errorf("create alert tables: %w", err)
+		}
+		s = postgresAlerts{}
+	default:
+		s = newMemoryAlerts()
+	}
+	a, err := newAlerter(s, []byte(secret), defaultURL, retries, backoff)
+	if err != nil {
+		return nil, err
+	}
+	a.adminKey = os.Getenv("ALERT_ADMIN_KEY")
+	if a.adminKey == "" {
+		log.Printf("Alerts: ALERT_ADMIN_KEY is not set, so alert rules cannot be managed over HTTP\n")
+	}
+	for _, host := range strings.Split(os.Getenv("ALERT_ALLOWED_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			a.allowed[strings.ToLower(host)] = true
+		}
+	}
+	return a, nil
+}
+
+// run checks changes until Close.
+func (a *alerter) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(alertReload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case ch := <-a.pending:
+			a.check(context.Background(), ch)
+		case <-ticker.C:
+			if err := a.reload(context.Background()); err != nil {
+				log.Printf("Reloading alert rules failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// reload replaces the rules in memory with the stored ones.
+func (a *alerter) reload(ctx context.Context) error {
+	all, err := a.store.AlertRules(ctx)
+	if err != nil {
+		return err
+	}
+	byCounter := make(map[int64][]AlertRule)
+	for _, r := range all {
+		byCounter[r.CounterID] = append(byCounter[r.CounterID], r)
+	}
+	a.mu.Lock()
+	a.rules = byCounter
+	a.mu.Unlock()
+	return nil
+}
+
+// add starts checking a rule that was just created.
+func (a *alerter) add(r AlertRule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules[r.CounterID] = append(a.rules[r.CounterID], r)
+}
+
+// remove stops checking rule id.
+func (a *alerter) remove(id int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for counterID, rules := range a.rules {
+		for i, r := range rules {
+			if r.ID == id {
+				a.rules[counterID] = append(rules[:i:i], rules[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// check applies ch to the rules of its counter, firing the ones it trips
+// and re-arming the ones it moves back past their hysteresis.
+func (a *alerter) check(ctx context.Context, ch counterChange) {
+	type transition struct {
+		rule     AlertRule
+		observed int64
+		trip     bool
+	}
+	now := time.Now()
+	var flips []transition
+	a.mu.Lock()
+	for _, r := range a.rules[ch.ID] {
+		observed := r.observe(ch, now)
+		trip, rearm := r.check(observed)
+		if trip != r.Firing && (trip || rearm) {
+			flips = append(flips, transition{r, observed, trip})
+		}
+	}
+	a.mu.Unlock()
+
+	// The database round trips happen without a.mu, so the handlers that
+	// add and remove rules do not wait for them.
+	for _, f := range flips {
+		changed, err := a.store.SetAlertFiring(ctx, f.rule.ID, f.trip)
+		if err != nil {
+			log.Printf("Updating alert rule %d failed: %v\n", f.rule.ID, err)
+			continue // try again on the next change
+		}
+		a.setFiring(ch.ID, f.rule.ID, f.trip)
+		if f.trip && changed {
+			f.rule.Firing = true
+			a.fire(f.rule, f.observed, now)
+		}
+	}
+}
+
+// setFiring records the firing flag of a cached rule, if it is still there.
+func (a *alerter) setFiring(counterID, ruleID int64, firing bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rules := a.rules[counterID]
+	for i := range rules {
+		if rules[i].ID == ruleID {
+			rules[i].Firing = firing
+		}
+	}
+}
+
+// fire counts a tripped rule and delivers its webhook in the background.
+func (a *alerter) fire(r AlertRule, observed int64, now time.Time) {
+	a.fired.Inc()
+	event := AlertEvent{
+		ID:        rand.Text(),
+		Type:      "alert.fired",
+		RuleID:    r.ID,
+		CounterID: r.CounterID,
+		Kind:      r.Kind,
+		Threshold: r.Threshold,
+		Window:    r.Window,
+		Value:     observed,
+		FiredAt:   now.UTC(),
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.deliver(r, event)
+	}()
+}
+
+// deliver posts event to the rule's webhook until it is accepted, and
+// keeps it as a dead letter when every attempt failed.
+func (a *alerter) deliver(r AlertRule, event AlertEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Encoding alert %s failed: %v\n", event.ID, err)
+		return
+	}
+	attempts := 0
+	for {
+		attempts++
+		if err = a.post(r.URL, body); err == nil {
+			a.deliveries.WithLabelValues("delivered").Inc()
+			return
+		}
+		if attempts > a.retries {
+			break
+		}
+		a.deliveries.WithLabelValues("retried").Inc()
+		wait := min(a.backoff<<(attempts-1), maxAlertBackoff)
+		if wait <= 0 { // the shift overflowed
+			wait = maxAlertBackoff
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			continue
+		case <-a.stop:
+			timer.Stop()
+			err = fmt.Errorf("shut down before retrying: %w", err)
+		}
+		break
+	}
+
+	a.deliveries.WithLabelValues("dead_letter").Inc()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d := DeadLetter{RuleID: r.ID, URL: r.URL, Event: event, Attempts: attempts, Error: err.Error()}
+	if err := a.store.AddDeadLetter(ctx, d); err != nil {
+		log.Printf("Lost alert %s of rule %d: %v\n", event.ID, r.ID, err)
+	}
+}
+
+// blockedWebhookIP reports whether ip is an address webhooks may not reach
+// unless its host is allowed: loopback, private (including carrier-grade
+// NAT), link-local (including cloud metadata services) and unspecified.
+func blockedWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+// sharedAddressSpace is 100.64.0.0/10 (RFC 6598), used for carrier-grade NAT.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// checkWebhook refuses a rule's webhook URL whose host is, or resolves to,
+// an internal address, unless the host is allowed.
+func (a *alerter) checkWebhook(ctx context.Context, target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	host := strings.ToLower(u.Hostname())
+	if a.allowed[host] {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if blockedWebhookIP(ip) {
+			return errWebhookForbidden
+		}
+		return nil
+	}
+	// A name that does not resolve yet is left to dialWebhook.
+	addrs, _ := net.DefaultResolver.LookupIPAddr(ctx, host)
+	for _, addr := range addrs {
+		if blockedWebhookIP(addr.IP) {
+			return errWebhookForbidden
+		}
+	}
+	return nil
+}
+
+// dialWebhook connects to a webhook, refusing internal addresses after DNS
+// resolution, which also covers redirects and names that changed since
+// the rule was created.
+func (a *alerter) dialWebhook(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: alertTimeout}
+	if !a.allowed[strings.ToLower(host)] {
+		dialer.Control = func(_, resolved string, _ syscall.RawConn) error {
+			ip, _, err := net.SplitHostPort(resolved)
+			if err != nil {
+				return err
+			}
+			if blockedWebhookIP(net.ParseIP(ip)) {
+				return fmt.Errorf("%s resolves to %s: %w", host, ip, errWebhookForbidden)
+			}
+			return nil
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// post makes one signed webhook attempt. Any 2xx answer is a delivery.
+func (a *alerter) post(target string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Counter-Timestamp", timestamp)
+	req.Header.Set("X-Counter-Signature", signWebhook(a.secret, timestamp, body))
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Close stops checking changes and waits for the webhooks in flight.
+// Webhooks waiting for a retry go to the dead letters.
+func (a *alerter) Close(ctx context.Context) error {
+	a.closeOnce.Do(func() { close(a.stop) })
+	done := make(chan struct{})
+	go func() {
+		<-a.done
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("alert webhooks still in flight: %w", ctx.Err())
+	}
+}
+
+// alertsHandler handles /alerts: GET lists the rules, of one counter with
+// ?id=, and POST creates one.
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed, use GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !alertAdmin(w, r) {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req AlertRuleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rule, err := newAlertRule(req, alerts.url)
+		if err == nil {
+			err = alerts.checkWebhook(r.Context(), rule.URL)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// A rule that already holds starts out firing: it alerts when the
+		// counter crosses the threshold, not when the rule is created.
+		value, err := store.Get(r.Context(), rule.CounterID)
+		if err != nil {
+			writeStoreError(w, r, "DB query failed", err)
+			return
+		}
+		rule.Firing, _ = rule.check(rule.observe(counterChange{ID: rule.CounterID, Value: value}, time.Now()))
+		if rule, err = alerts.store.CreateAlertRule(r.Context(), rule); err != nil {
+			writeStoreError(w, r, "DB insert failed", err)
+			return
+		}
+		alerts.add(rule)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+		return
+	}
+
+	all, err := alerts.store.AlertRules(r.Context())
+	if err != nil {
+		writeStoreError(w, r, "DB query failed", err)
+		return
+	}
+	list := AlertRuleList{Rules: []AlertRule{}}
+	if r.URL.Query().Has("id") {
+		id, err := counterIDParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, rule := range all {
+			if rule.CounterID == id {
+				list.Rules = append(list.Rules, rule)
+			}
+		}
+	} else if all != nil {
+		list.Rules = all
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// alertAdmin answers 501 when alerts are off and 403 without
+// ALERT_ADMIN_KEY. It reports whether the handler should go on.
+func alertAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if alerts == nil {
+		http.Error(w, errAlertsUnsupported.Error(), http.StatusNotImplemented)
+		return false
+	}
+	if !hasAdminKey(r, alerts.adminKey) {
+		http.Error(w, "alert rules need ALERT_ADMIN_KEY in "+adminKeyHeader, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// alertHandler handles DELETE /alerts/{id}.
+func alertHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed, use DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	if !alertAdmin(w, r) {
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid alert rule id %q", r.PathValue("id")), http.StatusBadRequest)
+		return
+	}
+	if err := alerts.store.DeleteAlertRule(r.Context(), id); err != nil {
+		if errors.Is(err, errAlertRuleNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeStoreError(w, r, "DB delete failed", err)
+		return
+	}
+	alerts.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deadLettersHandler handles GET /admin/alerts/dead-letters?limit=: the
+// newest webhooks that could not be delivered.
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if !alertAdmin(w, r) {
+		return
+	}
+	limit := 100
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		var err error
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > memoryHistoryLimit {
+			http.Error(w, fmt.Sprintf("invalid limit %q, want 1 to %d", raw, memoryHistoryLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	dead, err := alerts.store.DeadLetters(r.Context(), limit)
+	if err != nil {
+		writeStoreError(w, r, "DB query failed", err)
+		return
+	}
+	if dead == nil {
+		dead = []DeadLetter{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeadLetterList{DeadLetters: dead})
+}
+
+// Describe and Collect export the alert metrics on /metrics.
+func (a *alerter) Describe(ch chan<- *prometheus.Desc) {
+	a.fired.Describe(ch)
+	a.deliveries.Describe(ch)
+	a.dropped.Describe(ch)
+}
+
+func (a *alerter) Collect(ch chan<- prometheus.Metric) {
+	a.fired.Collect(ch)
+	a.deliveries.Collect(ch)
+	a.dropped.Collect(ch)
+}
+
+// memoryAlerts keeps rules and the newest memoryHistoryLimit dead letters
+// in process memory, for STORE=memory.
+type memoryAlerts struct {
+	mu       sync.Mutex
+	nextRule int64
+	nextDead int64
+	rules    map[int64]AlertRule
+	dead     []DeadLetter // oldest first
+}
+
+func newMemoryAlerts() *memoryAlerts {
+	return &memoryAlerts{rules: make(map[int64]AlertRule)}
+}
+
+func (m *memoryAlerts) AlertRules(context.Context) ([]AlertRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	all := make([]AlertRule, 0, len(m.rules))
+	for id := int64(1); id <= m.nextRule; id++ {
+		if r, ok := m.rules[id]; ok {
+			all = append(all, r)
+		}
+	}
+	return all, nil
+}
+
+func (m *memoryAlerts) CreateAlertRule(_ context.Context, r AlertRule) (AlertRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextRule++
+	r.ID, r.CreatedAt = m.nextRule, time.Now().UTC()
+	m.rules[r.ID] = r
+	return r, nil
+}
+
+func (m *memoryAlerts) DeleteAlertRule(_ context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rules[id]; !ok {
+		return errAlertRuleNotFound
+	}
+	delete(m.rules, id)
+	return nil
+}
+
+func (m *memoryAlerts) SetAlertFiring(_ context.Context, id int64, firing bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.rules[id]
+	if !ok || r.Firing == firing {
+		return false, nil
+	}
+	r.Firing = firing
+	m.rules[id] = r
+	return true, nil
+}
+
+func (m *memoryAlerts) AddDeadLetter(_ context.Context, d DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextDead++
+	d.ID, d.FailedAt = m.nextDead, time.Now().UTC()
+	m.dead = append(m.dead, d)
+	if len(m.dead) > memoryHistoryLimit {
+		m.dead = m.dead[len(m.dead)-memoryHistoryLimit:]
+	}
+	return nil
+}
+
+func (m *memoryAlerts) DeadLetters(_ context.Context, limit int) ([]DeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var dead []DeadLetter
+	for i := len(m.dead) - 1; i >= 0 && len(dead) < limit; i-- {
+		dead = append(dead, m.dead[i])
+	}
+	return dead, nil
+}
+
+// postgresAlerts keeps rules and dead letters in the database, shared by
+// every replica.
+type postgresAlerts struct{}
+
+// createAlertTables creates the tables of alert rules and dead letters.
+func createAlertTables(ctx context.Context) error {
+	_, err := db.Exec(ctx,
+		`CREATE TABLE IF NOT EXISTS counter_alert_rules (
+			id             BIGSERIAL PRIMARY KEY,
+			counter_id     INTEGER NOT NULL,
+			kind           TEXT NOT NULL,
+			threshold      BIGINT NOT NULL,
+			window_seconds INTEGER NOT NULL DEFAULT 0,
+			hysteresis     BIGINT NOT NULL DEFAULT 0,
+			url            TEXT NOT NULL,
+			firing         BOOLEAN NOT NULL DEFAULT false,
+			created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE IF NOT EXISTS counter_alert_dead_letters (
+			id        BIGSERIAL PRIMARY KEY,
+			rule_id   BIGINT NOT NULL,
+			url       TEXT NOT NULL,
+			event     JSONB NOT NULL,
+			attempts  INTEGER NOT NULL,
+			error     TEXT NOT NULL,
+			failed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	return err
+}
+
+// scanAlertRule reads a counter_alert_rules row.
+func scanAlertRule(row pgx.CollectableRow) (AlertRule, error) {
+	var r AlertRule
+	var windowSeconds int64
+	err := row.Scan(&r.ID, &r.CounterID, &r.Kind, &r.Threshold, &windowSeconds, &r.Hysteresis, &r.URL, &r.Firing, &r.CreatedAt)
+	if windowSeconds > 0 {
+		r.window = time.Duration(windowSeconds) * time.Second
+		r.Window = formatWindow(r.window)
+	}
+	r.CreatedAt = r.CreatedAt.UTC()
+	return r, err
+}
+
+func (postgresAlerts) AlertRules(ctx context.Context) ([]AlertRule, error) {
+	rows, err := db.Query(ctx,
+		`SELECT id, counter_id, kind, threshold, window_seconds, hysteresis, url, firing, created_at
+		 FROM counter_alert_rules ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanAlertRule)
+}
+
+func (postgresAlerts) CreateAlertRule(ctx context.Context, r AlertRule) (AlertRule, error) {
+	err := db.QueryRow(ctx,
+		`INSERT INTO counter_alert_rules (counter_id, kind, threshold, window_seconds, hysteresis, url, firing)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`,
+		r.CounterID, r.Kind, r.Threshold, int64(r.window/time.Second), r.Hysteresis, r.URL, r.Firing,
+	).Scan(&r.ID, &r.CreatedAt)
+	r.CreatedAt = r.CreatedAt.UTC()
+	return r, err
+}
+
+func (postgresAlerts) DeleteAlertRule(ctx context.Context, id int64) error {
+	tag, err := db.Exec(ctx, "DELETE FROM counter_alert_rules WHERE id=$1", id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return errAlertRuleNotFound
+	}
+	return err
+}
+
+func (postgresAlerts) SetAlertFiring(ctx context.Context, id int64, firing bool) (bool, error) {
+	tag, err := db.Exec(ctx,
+		"UPDATE counter_alert_rules SET firing=$2 WHERE id=$1 AND firing <> $2", id, firing)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (postgresAlerts) AddDeadLetter(ctx context.Context, d DeadLetter) error {
+	_, err := db.Exec(ctx,
+		`INSERT INTO counter_alert_dead_letters (rule_id, url, event, attempts, error)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		d.RuleID, d.URL, d.Event, d.Attempts, d.Error)
+	return err
+}
+
+func (postgresAlerts) DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	rows, err := db.Query(ctx,
+		`SELECT id, rule_id, url, event, attempts, error, failed_at
+		 FROM counter_alert_dead_letters ORDER BY id DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (DeadLetter, error) {
+		var d DeadLetter
+		err := row.Scan(&d.ID, &d.RuleID, &d.URL, &d.Event, &d.Attempts, &d.Error, &d.FailedAt)
+		d.FailedAt = d.FailedAt.UTC()
+		return d, err
+	})
+}
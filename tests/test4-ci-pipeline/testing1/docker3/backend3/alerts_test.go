@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var testAlertSecret = []byte("test-secret")
+
+const testAlertAdminKey = "test-alert-admin"
+
+// useAlerts installs an alerter backed by memory for the duration of the
+// test. The webhook receivers run on 127.0.0.1, so that host is allowed.
+func useAlerts(t *testing.T, retries int) *alerter {
+	t.Helper()
+	a, err := newAlerter(newMemoryAlerts(), testAlertSecret, "", retries, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.adminKey = testAlertAdminKey
+	a.allowed["127.0.0.1"] = true
+	alerts = a
+	t.Cleanup(func() {
+		alerts = nil
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		a.Close(ctx)
+	})
+	return a
+}
+
+// webhookReceiver records the alerts posted to it, failing the first
+// failures attempts with 503.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	attempts int
+	events   []AlertEvent
+	unsigned int // requests with a missing or wrong signature
+}
+
+func newWebhookReceiver(t *testing.T, failures int) *webhookReceiver {
+	t.Helper()
+	rcv := &webhookReceiver{}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := signWebhook(testAlertSecret, r.Header.Get("X-Counter-Timestamp"), body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.attempts++
+		if !hmac.Equal([]byte(r.Header.Get("X-Counter-Signature")), []byte(want)) {
+			rcv.unsigned++
+		}
+		if rcv.attempts <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event AlertEvent
+		json.Unmarshal(body, &event)
+		rcv.events = append(rcv.events, event)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *webhookReceiver) received() ([]AlertEvent, int) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]AlertEvent(nil), rcv.events...), rcv.attempts
+}
+
+// addRule stores and starts checking a rule.
+func addRule(t *testing.T, a *alerter, req AlertRuleRequest) AlertRule {
+	t.Helper()
+	r, err := newAlertRule(req, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err = a.store.CreateAlertRule(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	a.add(r)
+	return r
+}
+
+// Test the trip and re-arm levels of each rule kind
+func TestAlertRuleCheck(t *testing.T) {
+	cases := []struct {
+		rule          AlertRule
+		observed      int64
+		trip, rearmed bool
+	}{
+		{AlertRule{Kind: alertAbove, Threshold: 1000, Hysteresis: 50}, 1001, true, false},
+		{AlertRule{Kind: alertAbove, Threshold: 1000, Hysteresis: 50}, 1000, false, false},
+		{AlertRule{Kind: alertAbove, Threshold: 1000, Hysteresis: 50}, 950, false, true},
+		{AlertRule{Kind: alertBelow, Threshold: 0}, -1, true, false},
+		{AlertRule{Kind: alertBelow, Threshold: 0}, 0, false, true},
+		{AlertRule{Kind: alertBelow, Threshold: 0, Hysteresis: 10}, 5, false, false},
+		{AlertRule{Kind: alertRateAbove, Threshold: 100}, 101, true, false},
+	}
+	for _, c := range cases {
+		if trip, rearm := c.rule.check(c.observed); trip != c.trip || rearm != c.rearmed {
+			t.Errorf("%s %d at %d: expected trip %v rearm %v, got %v %v",
+				c.rule.Kind, c.rule.Threshold, c.observed, c.trip, c.rearmed, trip, rearm)
+		}
+	}
+}
+
+// Test that a value hovering around the threshold fires once until it
+// moves back past the hysteresis, and that webhooks are signed
+func TestAlertHysteresis(t *testing.T) {
+	// Arrange
+	a := useAlerts(t, 0)
+	rcv := newWebhookReceiver(t, 0)
+	rule := addRule(t, a, AlertRuleRequest{CounterID: 41, Kind: alertAbove, Threshold: 10, Hysteresis: 5, URL: rcv.URL})
+
+	// Act
+	for _, value := range []int64{11, 12, 8, 11, 4, 11} {
+		a.check(context.Background(), counterChange{ID: 41, Value: value})
+	}
+	a.Close(context.Background())
+
+	// Assert
+	events, _ := rcv.received()
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 alerts (the second after re-arming at 4), got %+v", events)
+	}
+	if events[0].RuleID != rule.ID || events[0].Value != 11 || events[0].Type != "alert.fired" || events[0].ID == events[1].ID {
+		t.Errorf("Expected distinct alert.fired events of rule %d at 11, got %+v", rule.ID, events)
+	}
+	if rcv.unsigned != 0 {
+		t.Errorf("Expected every webhook to carry a valid signature, got %d bad ones", rcv.unsigned)
+	}
+	if rules, _ := a.store.AlertRules(context.Background()); !rules[0].Firing {
+		t.Errorf("Expected the stored rule to be firing, got %+v", rules[0])
+	}
+}
+
+// Test that failed attempts are retried and end up as dead letters when
+// every attempt failed
+func TestAlertRetriesAndDeadLetters(t *testing.T) {
+	// Arrange
+	a := useAlerts(t, 2)
+	flaky := newWebhookReceiver(t, 1)
+	down := newWebhookReceiver(t, 100)
+	addRule(t, a, AlertRuleRequest{CounterID: 42, Kind: alertBelow, Threshold: 0, URL: flaky.URL})
+	deadRule := addRule(t, a, AlertRuleRequest{CounterID: 42, Kind: alertBelow, Threshold: 0, URL: down.URL})
+
+	// Act
+	a.check(context.Background(), counterChange{ID: 42, Value: -1})
+	waitFor(t, "both webhooks to settle", func() bool {
+		delivered, _ := flaky.received()
+		dead, _ := a.store.DeadLetters(context.Background(), 10)
+		return len(delivered) == 1 && len(dead) == 1
+	})
+
+	// Assert
+	delivered, flakyAttempts := flaky.received()
+	_, downAttempts := down.received()
+	if len(delivered) != 1 || flakyAttempts != 2 {
+		t.Errorf("Expected the flaky webhook to get the alert on the 2nd attempt, got %d event(s) in %d attempts", len(delivered), flakyAttempts)
+	}
+	dead, _ := a.store.DeadLetters(context.Background(), 10)
+	if downAttempts != 3 || len(dead) != 1 || dead[0].RuleID != deadRule.ID || dead[0].Attempts != 3 || dead[0].Event.Value != -1 {
+		t.Errorf("Expected one dead letter after 3 attempts, got %d attempts and %+v", downAttempts, dead)
+	}
+	if got := testutil.ToFloat64(a.deliveries.WithLabelValues("retried")); got != 3 {
+		t.Errorf("Expected 3 retries, got %v", got)
+	}
+}
+
+// Test POST, GET and DELETE /alerts, with a rule fired by a real write
+func TestAlertsHTTP(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	useAlerts(t, 0)
+	rcv := newWebhookReceiver(t, 0)
+	created := sendWithHeader(t, "POST", server.URL+"/alerts", adminKeyHeader, testAlertAdminKey, `{"kind": "below", "threshold": 0, "url": "`+rcv.URL+`"}`)
+	badKind := sendWithHeader(t, "POST", server.URL+"/alerts", adminKeyHeader, testAlertAdminKey, `{"kind": "sideways", "url": "`+rcv.URL+`"}`)
+	noRates := sendWithHeader(t, "POST", server.URL+"/alerts", adminKeyHeader, testAlertAdminKey, `{"kind": "rate_above", "threshold": 5, "window": "1m", "url": "`+rcv.URL+`"}`)
+	noCounter := sendWithHeader(t, "POST", server.URL+"/alerts", adminKeyHeader, testAlertAdminKey, `{"counter_id": 99, "kind": "above", "url": "`+rcv.URL+`"}`)
+
+	// Act
+	sendWithHeader(t, "POST", server.URL+"/counter/add", "", "", `{"delta": -1}`)
+	waitFor(t, "the alert webhook", func() bool {
+		events, _ := rcv.received()
+		return len(events) == 1
+	})
+	req, _ := http.NewRequest("GET", server.URL+"/alerts?id=1", nil)
+	req.Header.Set(adminKeyHeader, testAlertAdminKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list AlertRuleList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	deleted := sendWithHeader(t, "DELETE", server.URL+"/alerts/1", adminKeyHeader, testAlertAdminKey, "")
+	gone := sendWithHeader(t, "DELETE", server.URL+"/alerts/1", adminKeyHeader, testAlertAdminKey, "")
+
+	// Assert
+	if created.StatusCode != http.StatusCreated || badKind.StatusCode != http.StatusBadRequest ||
+		noRates.StatusCode != http.StatusBadRequest || noCounter.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 201, 400, 400 and 404, got %d, %d, %d and %d",
+			created.StatusCode, badKind.StatusCode, noRates.StatusCode, noCounter.StatusCode)
+	}
+	if len(list.Rules) != 1 || !list.Rules[0].Firing {
+		t.Errorf("Expected the rule to be listed as firing, got %+v", list.Rules)
+	}
+	if deleted.StatusCode != http.StatusNoContent || gone.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 204 then 404, got %d and %d", deleted.StatusCode, gone.StatusCode)
+	}
+}
+
+// Test that rules need the admin key and webhooks may not target internal
+// addresses, neither when the rule is created nor when it fires
+func TestAlertWebhookTargets(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	a := useAlerts(t, 0)
+	rcv := newWebhookReceiver(t, 0)
+	rule := func(url string) string { return `{"kind": "below", "url": "` + url + `"}` }
+
+	// Act
+	anonymous := sendWithHeader(t, "POST", server.URL+"/alerts", "", "", rule(rcv.URL))
+	var internal []int
+	for _, url := range []string{"http://localhost:9000/", "http://10.0.0.7/hook", "http://169.254.169.254/latest", "http://[::1]/"} {
+		resp := sendWithHeader(t, "POST", server.URL+"/alerts", adminKeyHeader, testAlertAdminKey, rule(url))
+		internal = append(internal, resp.StatusCode)
+	}
+	allowed := sendWithHeader(t, "POST", server.URL+"/alerts", adminKeyHeader, testAlertAdminKey, rule(rcv.URL))
+	delete(a.allowed, "127.0.0.1")
+	refused := a.post(rcv.URL, []byte("{}"))
+
+	// Assert
+	if anonymous.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 without the admin key, got %d", anonymous.StatusCode)
+	}
+	for _, code := range internal {
+		if code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for internal webhook targets, got %v", internal)
+			break
+		}
+	}
+	if allowed.StatusCode != http.StatusCreated {
+		t.Errorf("Expected an allowed host to be accepted, got %d", allowed.StatusCode)
+	}
+	if !errors.Is(refused, errWebhookForbidden) {
+		t.Errorf("Expected the connection to an internal address to be refused, got %v", refused)
+	}
+	if _, attempts := rcv.received(); attempts != 0 {
+		t.Errorf("Expected no request to reach the receiver, got %d", attempts)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Bounded counters keep their value within [min, max]. A write that would
+// leave the range is handled by the counter's overflow policy:
+//
+//	reject  fail with 409 Conflict and leave the counter alone (default)
+//	clamp   store min or max instead
+//	wrap    wrap around, like an odometer: max + 1 becomes min
+//
+// Without bounds a counter spans the 64-bit range, so an add that would
+// overflow int64 is rejected (or clamped or wrapped) the same way. The
+// policy is applied in Go by counterBounds for every store, so the memory
+// and Postgres stores agree to the last digit.
+//
+// Postgres writes to unbounded counters stay single statements; writes to
+// bounded counters lock the counter and its shard rows (see writeLocked),
+// so sharding a bounded counter gains nothing.
+
+// Overflow policies.
+const (
+	overflowReject = "reject"
+	overflowClamp  = "clamp"
+	overflowWrap   = "wrap"
+)
+
+// errOutOfBounds is returned when a write would take a counter outside its
+// bounds and its policy is reject.
+var errOutOfBounds = errors.New("counter value out of bounds")
+
+// errBoundsUnsupported is returned by stores that cannot bound counters.
+var errBoundsUnsupported = errors.New("counter bounds are not available with STORE=raft")
+
+// counterBounds are the bounds of one counter; nil means no bound on that side.
+type counterBounds struct {
+	Min, Max *int64
+	Overflow string // overflowReject, overflowClamp or overflowWrap; "" means reject
+}
+
+// boundedStore is implemented by stores that keep counter bounds.
+type boundedStore interface {
+	// Bounds returns the bounds of counter id.
+	Bounds(ctx context.Context, id int64) (counterBounds, error)
+	// SetBounds replaces the bounds of counter id. It fails with
+	// errOutOfBounds if the current value lies outside them.
+	SetBounds(ctx context.Context, id int64, bounds counterBounds) error
+}
+
+// limits returns the bounds as a closed range, filling in the int64 limits.
+func (b counterBounds) limits() (lo, hi *big.Int) {
+	lo, hi = big.NewInt(math.MinInt64), big.NewInt(math.MaxInt64)
+	if b.Min != nil {
+		lo.SetInt64(*b.Min)
+	}
+	if b.Max != nil {
+		hi.SetInt64(*b.Max)
+	}
+	return lo, hi
+}
+
+// isZero reports whether b are the default bounds: none, and reject.
+func (b counterBounds) isZero() bool {
+	return b.Min == nil && b.Max == nil && (b.Overflow == "" || b.Overflow == overflowReject)
+}
+
+// validate checks the bounds of a PUT /counter/bounds.
+func (b counterBounds) validate() error {
+	switch b.Overflow {
+	case "", overflowReject, overflowClamp, overflowWrap:
+	default:
+		return fmt.Errorf("overflow must be %s, %s or %s", overflowReject, overflowClamp, overflowWrap)
+	}
+	lo, hi := b.limits()
+	if lo.Cmp(hi) > 0 {
+		return errors.New("min must not be greater than max")
+	}
+	// A wrapped write moves the counter by less than max - min, which must
+	// fit in an int64 history delta.
+	if b.Overflow == overflowWrap && (b.Min == nil || b.Max == nil || !new(big.Int).Sub(hi, lo).IsInt64()) {
+		return fmt.Errorf("wrap needs both min and max, at most %d apart", int64(math.MaxInt64))
+	}
+	return nil
+}
+
+// contains reports whether value lies within the bounds.
+func (b counterBounds) contains(value int64) bool {
+	lo, hi := b.limits()
+	v := big.NewInt(value)
+	return v.Cmp(lo) >= 0 && v.Cmp(hi) <= 0
+}
+
+// fit applies the bounds to target, the exact value a write asks for, and
+// returns the value to store.
+func (b counterBounds) fit(target *big.Int) (int64, error) {
+	lo, hi := b.limits()
+	switch {
+	case target.Cmp(lo) >= 0 && target.Cmp(hi) <= 0:
+		return target.Int64(), nil
+	case b.Overflow == overflowClamp && target.Cmp(lo) < 0:
+		return lo.Int64(), nil
+	case b.Overflow == overflowClamp:
+		return hi.Int64(), nil
+	case b.Overflow == overflowWrap:
+		span := new(big.Int).Sub(hi, lo)
+		span.Add(span, big.NewInt(1))
+		offset := new(big.Int).Sub(target, lo)
+		return offset.Mod(offset, span).Add(offset, lo).Int64(), nil // Mod is never negative
+	}
+	return 0, fmt.Errorf("%w: %s is outside [%s, %s]", errOutOfBounds, target, lo, hi)
+}
+
+// add returns the value after adding delta to value.
+func (b counterBounds) add(value, delta int64) (int64, error) {
+	return b.fit(new(big.Int).Add(big.NewInt(value), big.NewInt(delta)))
+}
+
+// set returns the value to store when value is written.
+func (b counterBounds) set(value int64) (int64, error) {
+	return b.fit(big.NewInt(value))
+}
+
+// BoundsRequest is the body of PUT /counter/bounds. Leave min or max out
+// for no bound on that side.
+type BoundsRequest struct {
+	Min      *int64 `json:"min,omitempty"`
+	Max      *int64 `json:"max,omitempty"`
+	Overflow string `json:"overflow,omitempty"` // reject (default), clamp or wrap
+}
+
+// BoundsResponse is the response of GET and PUT /counter/bounds.
+type BoundsResponse struct {
+	ID       int64  `json:"id"`
+	Min      *int64 `json:"min,omitempty"`
+	Max      *int64 `json:"max,omitempty"`
+	Overflow string `json:"overflow"`
+}
+
+// boundsHandler handles /counter/bounds: GET reads a counter's bounds, PUT
+// replaces them. The counter's value must already lie within the new bounds.
+func boundsHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed, use GET or PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := counterIDParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bounded, ok := capability[boundedStore](store)
+	if !ok {
+		http.Error(w, errBoundsUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req BoundsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		bounds := counterBounds{Min: req.Min, Max: req.Max, Overflow: req.Overflow}
+		if err := bounds.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := bounded.SetBounds(r.Context(), id, bounds); err != nil {
+			writeBoundsError(w, r, "DB update failed", err)
+			return
+		}
+	}
+
+	bounds, err := bounded.Bounds(r.Context(), id)
+	if err != nil {
+		writeBoundsError(w, r, "DB query failed", err)
+		return
+	}
+	overflow := bounds.Overflow
+	if overflow == "" {
+		overflow = overflowReject
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BoundsResponse{ID: id, Min: bounds.Min, Max: bounds.Max, Overflow: overflow})
+}
+
+// writeBoundsError is writeStoreError plus 501 for stores without bounds.
+func writeBoundsError(w http.ResponseWriter, r *http.Request, prefix string, err error) {
+	if errors.Is(err, errBoundsUnsupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	writeStoreError(w, r, prefix, err)
+}
+
+// createBoundsColumns widens counters.value to BIGINT and adds the bounds
+// columns. bounded caches "has non-default bounds" so the single-statement
+// writes can skip bounded counters (see addVersioned).
+func createBoundsColumns(ctx context.Context) error {
+	_, err := db.Exec(ctx,
+		`ALTER TABLE counters ADD COLUMN IF NOT EXISTS min_value BIGINT;
+		ALTER TABLE counters ADD COLUMN IF NOT EXISTS max_value BIGINT;
+		ALTER TABLE counters ADD COLUMN IF NOT EXISTS overflow TEXT NOT NULL DEFAULT 'reject';
+		ALTER TABLE counters ADD COLUMN IF NOT EXISTS bounded BOOLEAN NOT NULL DEFAULT false;
+		DO $$ BEGIN
+			-- Only rewrite the table once, on the first start after the upgrade.
+			IF (SELECT data_type FROM information_schema.columns
+			    WHERE table_name = 'counters' AND column_name = 'value') = 'integer' THEN
+				ALTER TABLE counters ALTER COLUMN value TYPE BIGINT;
+			END IF;
+		END $$`)
+	return err
+}
+
+// isNumericOverflow reports whether err is Postgres' "bigint out of range".
+func isNumericOverflow(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "22003"
+}
+
+// lockedCounter is a counter read by lockCounter.
+type lockedCounter struct {
+	value, version int64
+	exists         bool
+	bounds         counterBounds
+}
+
+// lockCounter locks the row of counter id and all of its shard rows, so no
+// other write can land until tx ends, and returns its state. (SetShards
+// creates every shard row up front, so a concurrent increment cannot slip
+// in through a brand-new shard row.)
+func lockCounter(ctx context.Context, tx pgx.Tx, id int64) (lockedCounter, error) {
+	var c lockedCounter
+	err := tx.QueryRow(ctx,
+		"SELECT value, version, min_value, max_value, overflow FROM counters WHERE id=$1 FOR UPDATE",
+		id).Scan(&c.value, &c.version, &c.bounds.Min, &c.bounds.Max, &c.bounds.Overflow)
+	c.exists = err == nil
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return c, err
+	}
+	rows, err := tx.Query(ctx, "SELECT value FROM counter_shards WHERE counter_id=$1 FOR UPDATE", id)
+	if err != nil {
+		return c, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value int64
+		if err := rows.Scan(&value); err != nil {
+			return c, err
+		}
+		c.value += value
+	}
+	return c, rows.Err()
+}
+
+func (postgresStore) Bounds(ctx context.Context, id int64) (counterBounds, error) {
+	var b counterBounds
+	err := db.QueryRow(ctx, "SELECT min_value, max_value, overflow FROM counters WHERE id=$1", id).
+		Scan(&b.Min, &b.Max, &b.Overflow)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return b, errCounterNotFound
+	}
+	return b, err
+}
+
+func (postgresStore) SetBounds(ctx context.Context, id int64, bounds counterBounds) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	current, err := lockCounter(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if !current.exists {
+		return errCounterNotFound
+	}
+	if !bounds.contains(current.value) {
+		return fmt.Errorf("%w: the counter is at %d, set it within the new bounds first", errOutOfBounds, current.value)
+	}
+	overflow := bounds.Overflow
+	if overflow == "" {
+		overflow = overflowReject
+	}
+	if _, err := tx.Exec(ctx,
+		"UPDATE counters SET min_value=$2, max_value=$3, overflow=$4, bounded=$5 WHERE id=$1",
+		id, bounds.Min, bounds.Max, overflow, !bounds.isZero()); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (m *memoryStore) Bounds(_ context.Context, id int64) (counterBounds, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.values[id]; !ok {
+		return counterBounds{}, errCounterNotFound
+	}
+	return m.bounds[id], nil
+}
+
+func (m *memoryStore) SetBounds(_ context.Context, id int64, bounds counterBounds) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.values[id]
+	if !ok {
+		return errCounterNotFound
+	}
+	if !bounds.contains(value) {
+		return fmt.Errorf("%w: the counter is at %d, set it within the new bounds first", errOutOfBounds, value)
+	}
+	m.bounds[id] = bounds
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"testing"
+)
+
+// ptr returns a pointer to v, for optional bounds.
+func ptr(v int64) *int64 { return &v }
+
+// Test each overflow policy, with and without explicit bounds
+func TestCounterBoundsAdd(t *testing.T) {
+	cases := []struct {
+		name         string
+		bounds       counterBounds
+		value, delta int64
+		want         int64
+		rejected     bool
+	}{
+		{"inside", counterBounds{Min: ptr(0), Max: ptr(10)}, 5, 5, 10, false},
+		{"reject above max", counterBounds{Min: ptr(0), Max: ptr(10)}, 5, 6, 0, true},
+		{"reject below min", counterBounds{Min: ptr(0)}, 0, -1, 0, true},
+		{"clamp", counterBounds{Min: ptr(0), Max: ptr(10), Overflow: overflowClamp}, 8, 5, 10, false},
+		{"clamp below", counterBounds{Min: ptr(0), Overflow: overflowClamp}, 2, -5, 0, false},
+		{"wrap", counterBounds{Min: ptr(0), Max: ptr(9), Overflow: overflowWrap}, 8, 5, 3, false},
+		{"wrap below", counterBounds{Min: ptr(1), Max: ptr(12), Overflow: overflowWrap}, 1, -1, 12, false},
+		{"int64 overflow", counterBounds{}, math.MaxInt64, 1, 0, true},
+		{"int64 clamp", counterBounds{Overflow: overflowClamp}, math.MinInt64, -1, math.MinInt64, false},
+	}
+	for _, c := range cases {
+		got, err := c.bounds.add(c.value, c.delta)
+		if rejected := errors.Is(err, errOutOfBounds); rejected != c.rejected || got != c.want {
+			t.Errorf("%s: expected %d (rejected %v), got %d (err %v)", c.name, c.want, c.rejected, got, err)
+		}
+	}
+}
+
+// Test that bounds a write could not honor are refused up front
+func TestCounterBoundsValidate(t *testing.T) {
+	invalid := map[string]counterBounds{
+		"min above max":  {Min: ptr(5), Max: ptr(1)},
+		"unknown policy": {Overflow: "saturate"},
+		"wrap open":      {Min: ptr(0), Overflow: overflowWrap},
+		"wrap too wide":  {Min: ptr(-1), Max: ptr(math.MaxInt64), Overflow: overflowWrap},
+	}
+	for name, b := range invalid {
+		if err := b.validate(); err == nil {
+			t.Errorf("%s: expected the bounds to be refused", name)
+		}
+	}
+	if err := (counterBounds{Min: ptr(0), Max: ptr(math.MaxInt64), Overflow: overflowWrap}).validate(); err != nil {
+		t.Errorf("Expected [0, MaxInt64] to wrap, got %v", err)
+	}
+}
+
+// Test that the memory store applies bounds to adds and sets, and refuses
+// bounds the current value does not fit
+func TestMemoryStoreBounds(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	m := newMemoryStore()
+	m.Set(ctx, 1, 7)
+	tooTight := m.SetBounds(ctx, 1, counterBounds{Max: ptr(5)})
+	if err := m.SetBounds(ctx, 1, counterBounds{Min: ptr(0), Max: ptr(10), Overflow: overflowClamp}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	added, addErr := m.Add(ctx, 1, 100)
+	set, setErr := m.Set(ctx, 1, -3)
+	history, _ := m.History(ctx, 1, 1)
+
+	// Assert
+	if !errors.Is(tooTight, errOutOfBounds) {
+		t.Errorf("Expected bounds excluding the current value to be refused, got %v", tooTight)
+	}
+	if addErr != nil || added != 10 {
+		t.Errorf("Expected the add to clamp at 10, got %d (err %v)", added, addErr)
+	}
+	if setErr != nil || set != 0 {
+		t.Errorf("Expected the set to clamp at 0, got %d (err %v)", set, setErr)
+	}
+	if len(history) != 1 || history[0].Delta != -10 {
+		t.Errorf("Expected the history to record the applied delta -10, got %+v", history)
+	}
+}
+
+// Test PUT and GET /counter/bounds and the 409 of a rejected increment
+func TestBoundsHTTP(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	put := sendWithHeader(t, "PUT", server.URL+"/counter/bounds", "", "", `{"min": 0, "max": 2}`)
+	badPolicy := sendWithHeader(t, "PUT", server.URL+"/counter/bounds", "", "", `{"overflow": "saturate"}`)
+
+	// Act
+	var statuses []int
+	for range 3 {
+		statuses = append(statuses, sendWithHeader(t, "POST", server.URL+"/counter/increment", "", "", "").StatusCode)
+	}
+	resp, err := http.Get(server.URL + "/counter/bounds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var bounds BoundsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&bounds); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	if put.StatusCode != http.StatusOK || badPolicy.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 200 for the bounds and 400 for an unknown policy, got %d and %d", put.StatusCode, badPolicy.StatusCode)
+	}
+	if statuses[0] != http.StatusOK || statuses[1] != http.StatusOK || statuses[2] != http.StatusConflict {
+		t.Errorf("Expected 200, 200, 409, got %v", statuses)
+	}
+	if bounds.Min == nil || *bounds.Min != 0 || bounds.Max == nil || *bounds.Max != 2 || bounds.Overflow != overflowReject {
+		t.Errorf("Expected bounds [0, 2] with reject, got %+v", bounds)
+	}
+}
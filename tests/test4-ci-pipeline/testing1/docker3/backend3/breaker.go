@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// breakerStore is a circuit breaker around the Postgres store. When the
+// database is down, every query would otherwise wait for its own timeout
+// before failing with a 500.
+//
+//   - closed: calls go through. After BREAKER_FAILURES consecutive failures
+//     the breaker opens.
+//   - open: calls fail at once with errCircuitOpen (503 with Retry-After).
+//     GET /counter answers with the last value it saw, marked stale.
+//   - half-open: after BREAKER_OPEN_FOR, up to BREAKER_PROBES calls go
+//     through. If that many succeed the breaker closes; one failure opens
+//     it again.
+//
+// Only database trouble counts as a failure: not-found, failed If-Match
+// and the like are answers, not outages.
+type breakerStore struct {
+	counterStore // the durable store
+	failures     int
+	openFor      time.Duration
+	probes       int
+
+	mu          sync.Mutex
+	state       breakerState
+	consecutive int       // failures in a row while closed
+	openUntil   time.Time // when an open breaker lets probes through
+	inFlight    int       // probes running while half-open
+	succeeded   int       // probes that succeeded while half-open
+
+	lastMu    sync.Mutex
+	lastKnown map[int64]staleValue
+
+	stateGauge  prometheus.GaugeFunc
+	transitions *prometheus.CounterVec
+	rejected    prometheus.Counter
+	staleReads  prometheus.Counter
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "open"
+}
+
+// staleValue is the last value the store returned for a counter.
+type staleValue struct {
+	value int64
+	at    time.Time
+}
+
+// errCircuitOpen is returned without asking the store while the breaker is open.
+var errCircuitOpen = errors.New("database unavailable (circuit breaker open), try again later")
+
+// breaker is the store's circuit breaker, or nil when there is none.
+var breaker *breakerStore
+
+// newBreakerStore wraps durable. It opens after failures consecutive
+// failures, stays open for openFor, then needs probes successful calls to close.
+func newBreakerStore(durable counterStore, failures int, openFor time.Duration, probes int) *breakerStore {
+	b := &breakerStore{
+		counterStore: durable,
+		failures:     failures,
+		openFor:      openFor,
+		probes:       probes,
+		lastKnown:    make(map[int64]staleValue),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "counter_breaker_transitions_total",
+			Help: "Circuit breaker state changes, by the state entered.",
+		}, []string{"to"}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_breaker_rejected_total",
+			Help: "Store calls failed fast because the circuit breaker was open.",
+		}),
+		staleReads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_breaker_stale_reads_total",
+			Help: "GET /counter answers served from the last known value while the breaker was open.",
+		}),
+	}
+	b.stateGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "counter_breaker_state",
+		Help: "Circuit breaker state: 0 closed, 1 half-open, 2 open.",
+	}, func() float64 { return float64(b.currentState()) })
+	// Writes by other replicas keep the fallback values fresh too.
+	changes.observe(func(ch counterChange) { b.remember(ch.ID, ch.Value) })
+	return b
+}
+
+// breakerFromEnv returns a breaker around durable configured by
+// BREAKER_FAILURES (default 5, 0 turns the breaker off), BREAKER_OPEN_FOR
+// (default 10s) and BREAKER_PROBES (default 1).
+func breakerFromEnv(durable counterStore) (*breakerStore, error) {
+	failures, probes := 5, 1
+	openFor := 10 * time.Second
+	var err error
+	if raw := os.Getenv("BREAKER_FAILURES"); raw != "" {
+		if failures, err = strconv.Atoi(raw); err != nil || failures < 0 {
+			return nil, fmt.Errorf("invalid BREAKER_FAILURES %q, want a count like 5", raw)
+		}
+	}
+	if failures == 0 {
+		return nil, nil
+	}
+	if raw := os.Getenv("BREAKER_OPEN_FOR"); raw != "" {
+		if openFor, err = time.ParseDuration(raw); err != nil || openFor <= 0 {
+			return nil, fmt.Errorf("invalid BREAKER_OPEN_FOR %q, want a duration like 10s", raw)
+		}
+	}
+	if raw := os.Getenv("BREAKER_PROBES"); raw != "" {
+		if probes, err = strconv.Atoi(raw); err != nil || probes < 1 {
+			return nil, fmt.Errorf("invalid BREAKER_PROBES %q, want a count like 1", raw)
+		}
+	}
+	return newBreakerStore(durable, failures, openFor, probes), nil
+}
+
+// isStoreFailure reports whether err means the store is in trouble.
+func isStoreFailure(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, errCounterNotFound),
+		errors.Is(err, errVersionMismatch),
+		errors.Is(err, errVersionsUnsupported),
+		errors.Is(err, errShardingUnsupported),
+		errors.Is(err, errOutOfBounds),
+		errors.Is(err, errBoundsUnsupported),
+		errors.Is(err, errScheduleNotFound),
+		errors.Is(err, errSchedulesUnsupported),
+		errors.Is(err, context.Canceled): // the client went away
+		return false
+	}
+	return true
+}
+
+func (b *breakerStore) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// setState moves to state s. The caller must hold b.mu.
+func (b *breakerStore) setState(s breakerState) {
+	if b.state == s {
+		return
+	}
+	log.Printf("Circuit breaker %s -> %s\n", b.state, s)
+	b.state = s
+	b.transitions.WithLabelValues(s.String()).Inc()
+	switch s {
+	case breakerOpen:
+		b.openUntil = time.Now().Add(b.openFor)
+	case breakerHalfOpen:
+		b.inFlight, b.succeeded = 0, 0
+	case breakerClosed:
+		b.consecutive = 0
+	}
+}
+
+// allow decides whether a call may go to the store. probe reports whether
+// it is one of the half-open trial calls.
+func (b *breakerStore) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen {
+		if time.Now().Before(b.openUntil) {
+			b.rejected.Inc()
+			return false, errCircuitOpen
+		}
+		b.setState(breakerHalfOpen)
+	}
+	if b.state == breakerHalfOpen {
+		if b.inFlight >= b.probes {
+			b.rejected.Inc()
+			return false, errCircuitOpen
+		}
+		b.inFlight++
+		return true, nil
+	}
+	return false, nil
+}
+
+// done records the outcome of a call that allow let through.
+func (b *breakerStore) done(probe bool, err error) {
+	failed := isStoreFailure(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case probe && b.state == breakerHalfOpen:
+		b.inFlight--
+		if failed {
+			b.setState(breakerOpen)
+			return
+		}
+		b.succeeded++
+		if b.succeeded >= b.probes {
+			b.setState(breakerClosed)
+		}
+	case b.state == breakerClosed:
+		if !failed {
+			b.consecutive = 0
+			return
+		}
+		b.consecutive++
+		if b.consecutive >= b.failures {
+			b.setState(breakerOpen)
+		}
+	}
+	// Calls admitted before the breaker opened don't change its state.
+}
+
+// retryAfter is how many seconds until the breaker lets probes through.
+func (b *breakerStore) retryAfter() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return max(1, int(math.Ceil(time.Until(b.openUntil).Seconds())))
+}
+
+// guard runs fn through breaker b.
+func guard[T any](b *breakerStore, fn func() (T, error)) (T, error) {
+	probe, err := b.allow()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	v, err := fn()
+	b.done(probe, err)
+	return v, err
+}
+
+// remember records value as the last known value of counter id.
+func (b *breakerStore) remember(id, value int64) {
+	b.lastMu.Lock()
+	defer b.lastMu.Unlock()
+	b.lastKnown[id] = staleValue{value: value, at: time.Now()}
+}
+
+// stale returns the last known value of counter id.
+func (b *breakerStore) stale(id int64) (staleValue, bool) {
+	b.lastMu.Lock()
+	defer b.lastMu.Unlock()
+	v, ok := b.lastKnown[id]
+	return v, ok
+}
+
+// guardValue is guard for calls that return a counter's value, which it remembers.
+func (b *breakerStore) guardValue(id int64, fn func() (int64, error)) (int64, error) {
+	value, err := guard(b, fn)
+	if err == nil {
+		b.remember(id, value)
+	}
+	return value, err
+}
+
+// guardVersioned is guardValue for versionedStore calls.
+func (b *breakerStore) guardVersioned(id int64, fn func(vs versionedStore) (int64, int64, error)) (int64, int64, error) {
+	vs, ok := b.counterStore.(versionedStore)
+	if !ok {
+		return 0, 0, errVersionsUnsupported
+	}
+	var version int64
+	value, err := b.guardValue(id, func() (int64, error) {
+		value, v, err := fn(vs)
+		version = v
+		return value, err
+	})
+	return value, version, err
+}
+
+func (b *breakerStore) Get(ctx context.Context, id int64) (int64, error) {
+	return b.guardValue(id, func() (int64, error) { return b.counterStore.Get(ctx, id) })
+}
+
+func (b *breakerStore) Add(ctx context.Context, id int64, delta int64) (int64, error) {
+	return b.guardValue(id, func() (int64, error) { return b.counterStore.Add(ctx, id, delta) })
+}
+
+func (b *breakerStore) Set(ctx context.Context, id int64, value int64) (int64, error) {
+	return b.guardValue(id, func() (int64, error) { return b.counterStore.Set(ctx, id, value) })
+}
+
+func (b *breakerStore) List(ctx context.Context) ([]CounterResponse, error) {
+	counters, err := guard(b, func() ([]CounterResponse, error) { return b.counterStore.List(ctx) })
+	for _, c := range counters {
+		b.remember(c.ID, c.Value)
+	}
+	return counters, err
+}
+
+func (b *breakerStore) History(ctx context.Context, id int64, limit int) ([]HistoryEntry, error) {
+	return guard(b, func() ([]HistoryEntry, error) { return b.counterStore.History(ctx, id, limit) })
+}
+
+func (b *breakerStore) GetVersion(ctx context.Context, id int64) (int64, int64, error) {
+	return b.guardVersioned(id, func(vs versionedStore) (int64, int64, error) { return vs.GetVersion(ctx, id) })
+}
+
+func (b *breakerStore) AddIfVersion(ctx context.Context, id, delta, ifVersion int64) (int64, int64, error) {
+	return b.guardVersioned(id, func(vs versionedStore) (int64, int64, error) {
+		return vs.AddIfVersion(ctx, id, delta, ifVersion)
+	})
+}
+
+func (b *breakerStore) SetIfVersion(ctx context.Context, id, value, ifVersion int64) (int64, int64, error) {
+	return b.guardVersioned(id, func(vs versionedStore) (int64, int64, error) {
+		return vs.SetIfVersion(ctx, id, value, ifVersion)
+	})
+}
+
+// unwrap exposes the durable store to capability. The breaker implements
+// the capabilities it guards itself, so the lookup stops here for them.
+func (b *breakerStore) unwrap() counterStore { return b.counterStore }
+
+// Shards and SetShards pass through to the wrapped store when it shards.
+func (b *breakerStore) Shards(ctx context.Context, id int64) (int, error) {
+	sharded, ok := capability[shardedStore](b.counterStore)
+	if !ok {
+		return 0, errShardingUnsupported
+	}
+	return guard(b, func() (int, error) { return sharded.Shards(ctx, id) })
+}
+
+func (b *breakerStore) SetShards(ctx context.Context, id int64, shards int) error {
+	sharded, ok := capability[shardedStore](b.counterStore)
+	if !ok {
+		return errShardingUnsupported
+	}
+	_, err := guard(b, func() (struct{}, error) { return struct{}{}, sharded.SetShards(ctx, id, shards) })
+	return err
+}
+
+// Bounds and SetBounds pass through to the wrapped store when it bounds counters.
+func (b *breakerStore) Bounds(ctx context.Context, id int64) (counterBounds, error) {
+	bounded, ok := capability[boundedStore](b.counterStore)
+	if !ok {
+		return counterBounds{}, errBoundsUnsupported
+	}
+	return guard(b, func() (counterBounds, error) { return bounded.Bounds(ctx, id) })
+}
+
+func (b *breakerStore) SetBounds(ctx context.Context, id int64, bounds counterBounds) error {
+	bounded, ok := capability[boundedStore](b.counterStore)
+	if !ok {
+		return errBoundsUnsupported
+	}
+	_, err := guard(b, func() (struct{}, error) { return struct{}{}, bounded.SetBounds(ctx, id, bounds) })
+	return err
+}
+
+// Schedule, SetSchedule and DeleteSchedule pass through to the wrapped store
+// when it keeps reset schedules.
+func (b *breakerStore) Schedule(ctx context.Context, id int64) (ResetSchedule, error) {
+	schedules, ok := capability[scheduleStore](b.counterStore)
+	if !ok {
+		return ResetSchedule{}, errSchedulesUnsupported
+	}
+	return guard(b, func() (ResetSchedule, error) { return schedules.Schedule(ctx, id) })
+}
+
+func (b *breakerStore) SetSchedule(ctx context.Context, s ResetSchedule) error {
+	schedules, ok := capability[scheduleStore](b.counterStore)
+	if !ok {
+		return errSchedulesUnsupported
+	}
+	_, err := guard(b, func() (struct{}, error) { return struct{}{}, schedules.SetSchedule(ctx, s) })
+	return err
+}
+
+func (b *breakerStore) DeleteSchedule(ctx context.Context, id int64) error {
+	schedules, ok := capability[scheduleStore](b.counterStore)
+	if !ok {
+		return errSchedulesUnsupported
+	}
+	_, err := guard(b, func() (struct{}, error) { return struct{}{}, schedules.DeleteSchedule(ctx, id) })
+	return err
+}
+
+// serveStale answers GET /counter with the last known value of counter id
+// while the breaker is open. It reports whether it did.
+func serveStale(w http.ResponseWriter, id int64) bool {
+	if breaker == nil {
+		return false
+	}
+	last, ok := breaker.stale(id)
+	if !ok {
+		return false
+	}
+	breaker.staleReads.Inc()
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(last.at).Seconds())))
+	writeCounter(w, id, last.value)
+	return true
+}
+
+// ReadyResponse is the response of GET /ready.
+type ReadyResponse struct {
+	Ready   bool   `json:"ready"`
+	Breaker string `json:"breaker,omitempty"` // closed, half-open or open
+}
+
+// readyHandler handles GET /ready for load balancers and orchestrators:
+// 503 while the circuit breaker is open, so traffic can go elsewhere.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := ReadyResponse{Ready: true}
+	if breaker != nil {
+		if breaker.currentState() != breakerClosed {
+			// Once the breaker has been open long enough this is the probe,
+			// so an instance taken out of rotation can still recover.
+			breaker.Get(r.Context(), defaultCounterID)
+		}
+		state := breaker.currentState()
+		resp.Ready, resp.Breaker = state != breakerOpen, state.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Ready {
+		w.Header().Set("Retry-After", strconv.Itoa(breaker.retryAfter()))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Describe and Collect export the breaker metrics on /metrics.
+func (b *breakerStore) Describe(ch chan<- *prometheus.Desc) {
+	b.stateGauge.Describe(ch)
+	b.transitions.Describe(ch)
+	b.rejected.Describe(ch)
+	b.staleReads.Describe(ch)
+}
+
+func (b *breakerStore) Collect(ch chan<- prometheus.Metric) {
+	b.stateGauge.Collect(ch)
+	b.transitions.Collect(ch)
+	b.rejected.Collect(ch)
+	b.staleReads.Collect(ch)
+}
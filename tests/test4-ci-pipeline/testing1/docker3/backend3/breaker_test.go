@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// flakyStore is a memory store that fails every call while down is set,
+// and counts the calls that reach it.
+type flakyStore struct {
+	*memoryStore
+	down  atomic.Bool
+	calls atomic.Int64
+}
+
+var errConnectionRefused = errors.New("dial tcp: connection refused")
+
+func (s *flakyStore) Get(ctx context.Context, id int64) (int64, error) {
+	s.calls.Add(1)
+	if s.down.Load() {
+		return 0, errConnectionRefused
+	}
+	return s.memoryStore.Get(ctx, id)
+}
+
+func (s *flakyStore) GetVersion(ctx context.Context, id int64) (int64, int64, error) {
+	s.calls.Add(1)
+	if s.down.Load() {
+		return 0, 0, errConnectionRefused
+	}
+	return s.memoryStore.GetVersion(ctx, id)
+}
+
+func (s *flakyStore) Add(ctx context.Context, id int64, delta int64) (int64, error) {
+	s.calls.Add(1)
+	if s.down.Load() {
+		return 0, errConnectionRefused
+	}
+	return s.memoryStore.Add(ctx, id, delta)
+}
+
+func (s *flakyStore) AddIfVersion(ctx context.Context, id, delta, ifVersion int64) (int64, int64, error) {
+	s.calls.Add(1)
+	if s.down.Load() {
+		return 0, 0, errConnectionRefused
+	}
+	return s.memoryStore.AddIfVersion(ctx, id, delta, ifVersion)
+}
+
+// useBreaker makes b the global breaker and store for one test.
+func useBreaker(t *testing.T, b *breakerStore) {
+	previousStore, previousBreaker := store, breaker
+	store, breaker = b, b
+	t.Cleanup(func() { store, breaker = previousStore, previousBreaker })
+}
+
+// Test that the breaker opens after repeated failures and fails fast
+func TestBreakerOpensAfterFailures(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	durable := &flakyStore{memoryStore: newMemoryStore()}
+	b := newBreakerStore(durable, 3, time.Minute, 1)
+	durable.down.Store(true)
+
+	// Act
+	for range 3 {
+		b.Add(ctx, 1, 1)
+	}
+	_, err := b.Add(ctx, 1, 1)
+
+	// Assert
+	if err != errCircuitOpen {
+		t.Errorf("Expected errCircuitOpen after 3 failures, got %v", err)
+	}
+	if calls := durable.calls.Load(); calls != 3 {
+		t.Errorf("Expected the open breaker to spare the store, got %d calls", calls)
+	}
+	if got := testutil.ToFloat64(b.stateGauge); got != float64(breakerOpen) {
+		t.Errorf("Expected the state gauge at %d, got %v", breakerOpen, got)
+	}
+}
+
+// Test that answers such as not-found do not count as failures
+func TestBreakerIgnoresNotFound(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	b := newBreakerStore(newMemoryStore(), 2, time.Minute, 1)
+
+	// Act
+	for range 5 {
+		b.Add(ctx, 99, 1)
+	}
+
+	// Assert
+	if state := b.currentState(); state != breakerClosed {
+		t.Errorf("Expected the breaker to stay closed, got %s", state)
+	}
+}
+
+// Test that a half-open breaker closes on a good probe and reopens on a bad one
+func TestBreakerHalfOpen(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	durable := &flakyStore{memoryStore: newMemoryStore()}
+	b := newBreakerStore(durable, 1, 20*time.Millisecond, 1)
+	durable.down.Store(true)
+	b.Get(ctx, 1)
+
+	// Act: a failed probe, then a good one
+	time.Sleep(30 * time.Millisecond)
+	b.Get(ctx, 1)
+	afterFailedProbe := b.currentState()
+	durable.down.Store(false)
+	time.Sleep(30 * time.Millisecond)
+	_, err := b.Get(ctx, 1)
+
+	// Assert
+	if afterFailedProbe != breakerOpen {
+		t.Errorf("Expected a failed probe to reopen the breaker, got %s", afterFailedProbe)
+	}
+	if err != nil || b.currentState() != breakerClosed {
+		t.Errorf("Expected a good probe to close the breaker, got %s (err %v)", b.currentState(), err)
+	}
+}
+
+// Test the HTTP behavior while the breaker is open: stale reads, failing
+// writes and readiness
+func TestBreakerOpenHTTP(t *testing.T) {
+	// Arrange: read the counter once, then lose the database
+	server := newTestServer(t)
+	durable := &flakyStore{memoryStore: newMemoryStore()}
+	durable.memoryStore.Set(context.Background(), 1, 7)
+	b := newBreakerStore(durable, 1, time.Minute, 1)
+	useBreaker(t, b)
+	sendWithHeader(t, "GET", server.URL+"/counter", "", "", "")
+	durable.down.Store(true)
+	sendWithHeader(t, "GET", server.URL+"/counter", "", "", "") // trips the breaker
+
+	// Act
+	read, err := http.Get(server.URL + "/counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer read.Body.Close()
+	var counter CounterResponse
+	if err := json.NewDecoder(read.Body).Decode(&counter); err != nil {
+		t.Fatal(err)
+	}
+	write := sendWithHeader(t, "POST", server.URL+"/counter/increment", "", "", "")
+	ready := sendWithHeader(t, "GET", server.URL+"/ready", "", "", "")
+
+	// Assert
+	if read.StatusCode != http.StatusOK || counter.Value != 7 || read.Header.Get("Warning") == "" {
+		t.Errorf("Expected the stale value 7 with a Warning, got %d %v %q", read.StatusCode, counter.Value, read.Header.Get("Warning"))
+	}
+	if write.StatusCode != http.StatusServiceUnavailable || write.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After for a write, got %d %q", write.StatusCode, write.Header.Get("Retry-After"))
+	}
+	if ready.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected /ready to fail while open, got %d", ready.StatusCode)
+	}
+	if got := testutil.ToFloat64(b.staleReads); got != 1 {
+		t.Errorf("Expected 1 stale read, got %v", got)
+	}
+}
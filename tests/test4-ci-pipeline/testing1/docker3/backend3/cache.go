@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+)
+
+// cachedStore keeps recently read counter values in memory for a short
+// TTL, so a dashboard polled by thousands of browsers costs one query per
+// counter per TTL instead of one per poll.
+//
+// Concurrent misses for the same counter share a single query
+// (singleflight), unless the counter was written in between: a read after
+// a write never joins a query that may have started before it. Entries are dropped on our own writes and whenever the
+// change hub reports a write, which includes other replicas' writes
+// (Postgres NOTIFY, see listenForChanges). Without those notifications a
+// read can be up to one TTL stale.
+type cachedStore struct {
+	counterStore // writes, List and History go straight through
+	ttl          time.Duration
+
+	mu      sync.Mutex
+	entries map[int64]cacheEntry
+	// generation counts invalidations per counter. A query that started
+	// before an invalidation must not cache its (possibly stale) result.
+	generation map[int64]uint64
+
+	group singleflight.Group
+
+	hits      prometheus.Counter
+	misses    prometheus.Counter
+	coalesced prometheus.Counter
+}
+
+type cacheEntry struct {
+	value   int64
+	version int64 // anyVersion if the wrapped store keeps none
+	expires time.Time
+}
+
+// newCachedStore wraps durable and starts listening for changes.
+func newCachedStore(durable counterStore, ttl time.Duration) *cachedStore {
+	c := &cachedStore{
+		counterStore: durable,
+		ttl:          ttl,
+		entries:      make(map[int64]cacheEntry),
+		generation:   make(map[int64]uint64),
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_cache_hits_total",
+			Help: "Counter reads answered from the in-process cache.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_cache_misses_total",
+			Help: "Counter reads that went to the store.",
+		}),
+		coalesced: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_cache_coalesced_total",
+			Help: "Misses that shared another request's in-flight query instead of running their own.",
+		}),
+	}
+	changes.observe(func(ch counterChange) { c.invalidate(ch.ID) })
+	return c
+}
+
+// invalidate drops the cached value of counter id.
+func (c *cachedStore) invalidate(id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+	c.generation[id]++
+}
+
+func (c *cachedStore) Get(ctx context.Context, id int64) (int64, error) {
+	entry, err := c.load(ctx, id)
+	return entry.value, err
+}
+
+// GetVersion serves ETag revalidation (If-None-Match) from the cache too.
+func (c *cachedStore) GetVersion(ctx context.Context, id int64) (int64, int64, error) {
+	if _, ok := c.counterStore.(versionedStore); !ok {
+		return 0, 0, errVersionsUnsupported
+	}
+	entry, err := c.load(ctx, id)
+	return entry.value, entry.version, err
+}
+
+// load returns the cached entry for counter id, reading it on a miss.
+func (c *cachedStore) load(ctx context.Context, id int64) (cacheEntry, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[id]
+	gen := c.generation[id]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		c.hits.Inc()
+		return entry, nil
+	}
+
+	c.misses.Inc()
+	// The generation is part of the key, so a query that started before the
+	// last invalidation is not shared with readers that came after it.
+	key := strconv.FormatInt(id, 10) + "|" + strconv.FormatUint(gen, 10)
+	// The query runs without the caller's context: it is shared, and one
+	// caller giving up must not fail the others.
+	v, err, shared := c.group.Do(key, func() (any, error) {
+		entry, err := c.fetch(context.WithoutCancel(ctx), id)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		if c.generation[id] == gen {
+			c.entries[id] = entry
+		}
+		c.mu.Unlock()
+		return entry, nil
+	})
+	if shared {
+		c.coalesced.Inc()
+	}
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	return v.(cacheEntry), nil
+}
+
+// fetch reads counter id, with its version if the wrapped store has one.
+func (c *cachedStore) fetch(ctx context.Context, id int64) (cacheEntry, error) {
+	entry := cacheEntry{version: anyVersion, expires: time.Now().Add(c.ttl)}
+	var err error
+	if vs, ok := c.counterStore.(versionedStore); ok {
+		entry.value, entry.version, err = vs.GetVersion(ctx, id)
+	} else {
+		entry.value, err = c.counterStore.Get(ctx, id)
+	}
+	return entry, err
+}
+
+func (c *cachedStore) Add(ctx context.Context, id int64, delta int64) (int64, error) {
+	defer c.invalidate(id)
+	return c.counterStore.Add(ctx, id, delta)
+}
+
+func (c *cachedStore) Set(ctx context.Context, id int64, value int64) (int64, error) {
+	defer c.invalidate(id)
+	return c.counterStore.Set(ctx, id, value)
+}
+
+// AddIfVersion and SetIfVersion pass through to the wrapped store when it
+// keeps versions. Conditional writes are never answered from the cache.
+func (c *cachedStore) AddIfVersion(ctx context.Context, id, delta, ifVersion int64) (int64, int64, error) {
+	vs, ok := c.counterStore.(versionedStore)
+	if !ok {
+		return 0, 0, errVersionsUnsupported
+	}
+	defer c.invalidate(id)
+	return vs.AddIfVersion(ctx, id, delta, ifVersion)
+}
+
+func (c *cachedStore) SetIfVersion(ctx context.Context, id, value, ifVersion int64) (int64, int64, error) {
+	vs, ok := c.counterStore.(versionedStore)
+	if !ok {
+		return 0, 0, errVersionsUnsupported
+	}
+	defer c.invalidate(id)
+	return vs.SetIfVersion(ctx, id, value, ifVersion)
+}
+
+// unwrap lets shards, bounds, schedules and series pass through to the
+// wrapped store (see capability); none of them changes a cached value.
+func (c *cachedStore) unwrap() counterStore { return c.counterStore }
+
+// Describe and Collect export the cache metrics on /metrics.
+func (c *cachedStore) Describe(ch chan<- *prometheus.Desc) {
+	c.hits.Describe(ch)
+	c.misses.Describe(ch)
+	c.coalesced.Describe(ch)
+}
+
+func (c *cachedStore) Collect(ch chan<- prometheus.Metric) {
+	c.hits.Collect(ch)
+	c.misses.Collect(ch)
+	c.coalesced.Collect(ch)
+}
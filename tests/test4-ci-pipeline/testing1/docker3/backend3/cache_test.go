@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingStore counts reads on a memory store and can hold them until released.
+type countingStore struct {
+	*memoryStore
+	gets atomic.Int64
+	gate chan struct{} // if set, reads wait for it to close
+}
+
+func (s *countingStore) read() {
+	s.gets.Add(1)
+	if s.gate != nil {
+		<-s.gate
+	}
+}
+
+func (s *countingStore) Get(ctx context.Context, id int64) (int64, error) {
+	s.read()
+	return s.memoryStore.Get(ctx, id)
+}
+
+func (s *countingStore) GetVersion(ctx context.Context, id int64) (int64, int64, error) {
+	s.read()
+	return s.memoryStore.GetVersion(ctx, id)
+}
+
+// Test that repeated reads are served from the cache until the TTL runs out
+func TestCachedStoreHitsAndExpiry(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	durable := &countingStore{memoryStore: newMemoryStore()}
+	c := newCachedStore(durable, 50*time.Millisecond)
+
+	// Act
+	for range 3 {
+		c.Get(ctx, 1)
+	}
+	time.Sleep(60 * time.Millisecond)
+	c.Get(ctx, 1)
+
+	// Assert
+	if got := durable.gets.Load(); got != 2 {
+		t.Errorf("Expected 2 store reads (first read and after expiry), got %d", got)
+	}
+	if hits, misses := testutil.ToFloat64(c.hits), testutil.ToFloat64(c.misses); hits != 2 || misses != 2 {
+		t.Errorf("Expected 2 hits and 2 misses, got %v and %v", hits, misses)
+	}
+}
+
+// Test that concurrent misses for one counter share a single store read
+func TestCachedStoreCoalescesMisses(t *testing.T) {
+	// Arrange: the store read blocks until every reader has missed
+	ctx := context.Background()
+	durable := &countingStore{memoryStore: newMemoryStore(), gate: make(chan struct{})}
+	durable.memoryStore.Set(ctx, 1, 7)
+	c := newCachedStore(durable, time.Minute)
+
+	// Act
+	var wg sync.WaitGroup
+	values := make([]int64, 10)
+	for i := range values {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			values[i], _ = c.Get(ctx, 1)
+		}()
+	}
+	waitFor(t, "every reader to miss", func() bool { return testutil.ToFloat64(c.misses) == 10 })
+	time.Sleep(10 * time.Millisecond) // let the last reader join the in-flight read
+	close(durable.gate)
+	wg.Wait()
+
+	// Assert
+	if got := durable.gets.Load(); got != 1 {
+		t.Errorf("Expected 1 store read for 10 concurrent misses, got %d", got)
+	}
+	for _, v := range values {
+		if v != 7 {
+			t.Errorf("Expected every reader to get 7, got %v", values)
+			break
+		}
+	}
+}
+
+// Test that a read after a write runs its own query instead of joining one that started before the write
+func TestCachedStoreReadAfterWriteDoesNotJoinOlderQuery(t *testing.T) {
+	// Arrange: a read is in flight when the counter is written
+	ctx := context.Background()
+	durable := &countingStore{memoryStore: newMemoryStore(), gate: make(chan struct{})}
+	c := newCachedStore(durable, time.Minute)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.Get(ctx, 1)
+	}()
+	waitFor(t, "the first read to reach the store", func() bool { return durable.gets.Load() == 1 })
+	c.Add(ctx, 1, 5)
+
+	// Act
+	var after int64
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		after, _ = c.Get(ctx, 1)
+	}()
+	waitFor(t, "the read after the write to run its own query", func() bool { return durable.gets.Load() == 2 })
+	close(durable.gate)
+	wg.Wait()
+
+	// Assert
+	if after != 5 {
+		t.Errorf("Expected 5 after the write, got %d", after)
+	}
+}
+
+// Test that local writes and change notifications drop the cached value
+func TestCachedStoreInvalidation(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	durable := newMemoryStore()
+	c := newCachedStore(durable, time.Minute)
+	c.Get(ctx, 1)
+
+	// Act: a local write, then a write that bypasses the cache (another replica)
+	afterAdd, _ := c.Add(ctx, 1, 1)
+	readAfterAdd, _ := c.Get(ctx, 1)
+	durable.Add(ctx, 1, 10) // publishes on the change hub, like a NOTIFY would
+	readAfterNotify, _ := c.Get(ctx, 1)
+
+	// Assert
+	if afterAdd != 1 || readAfterAdd != 1 {
+		t.Errorf("Expected 1 after the local write, got %d and %d", afterAdd, readAfterAdd)
+	}
+	if readAfterNotify != 11 {
+		t.Errorf("Expected 11 after the change notification, got %d", readAfterNotify)
+	}
+}
+
+// Test that optional capabilities are found through the decorators that do
+// not implement them, and are missing when no store in the chain has them
+func TestCapabilityThroughDecorators(t *testing.T) {
+	// Arrange
+	w := newWriteBehindStore(newMemoryStore(), time.Hour)
+	defer w.Close(context.Background())
+	c := newCachedStore(w, time.Minute)
+
+	// Act
+	_, bounded := capability[boundedStore](c)
+	_, series := capability[seriesStore](c)
+	_, sharded := capability[shardedStore](c)
+
+	// Assert
+	if !bounded || !series {
+		t.Errorf("Expected bounds and series of the memory store, got %v and %v", bounded, series)
+	}
+	if sharded {
+		t.Errorf("Expected no sharding, the memory store does not shard")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// errClusterUnsupported is returned by the /cluster endpoints without STORE=raft.
+var errClusterUnsupported = errors.New("cluster administration needs STORE=raft")
+
+// cluster is this node's Raft store, or nil when not running in cluster mode.
+var cluster *raftStore
+
+// JoinRequest is the body of POST /cluster/join.
+type JoinRequest struct {
+	ID       string `json:"id"`        // the new node's RAFT_ID
+	RaftAddr string `json:"raft_addr"` // host:port its Raft transport listens on
+	HTTPAddr string `json:"http_addr"` // base URL of its HTTP API
+}
+
+// RemoveRequest is the body of POST /cluster/remove.
+type RemoveRequest struct {
+	ID string `json:"id"`
+}
+
+// ClusterMember is one node in the Raft configuration.
+type ClusterMember struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raft_addr"`
+	HTTPAddr string `json:"http_addr,omitempty"`
+	Voter    bool   `json:"voter"`
+	Leader   bool   `json:"leader"`
+}
+
+// ClusterStatus is the response of GET /cluster.
+type ClusterStatus struct {
+	ID           string          `json:"id"`    // the node that answered
+	State        string          `json:"state"` // Leader, Follower, Candidate or Shutdown
+	LeaderID     string          `json:"leader_id,omitempty"`
+	AppliedIndex uint64          `json:"applied_index"`
+	Members      []ClusterMember `json:"members"`
+}
+
+// clusterHandler handles GET /cluster: this node's view of the cluster.
+// Any node answers; the leader's view is the authoritative one.
+func clusterHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if cluster == nil {
+		http.Error(w, errClusterUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+	writeClusterStatus(w)
+}
+
+// writeClusterStatus sends this node's ClusterStatus as JSON.
+func writeClusterStatus(w http.ResponseWriter) {
+	future := cluster.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		http.Error(w, "Reading the cluster configuration failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, leaderID := cluster.raft.LeaderWithID()
+	status := ClusterStatus{
+		ID:           string(cluster.id),
+		State:        cluster.raft.State().String(),
+		LeaderID:     string(leaderID),
+		AppliedIndex: cluster.raft.AppliedIndex(),
+		Members:      []ClusterMember{},
+	}
+	for _, srv := range future.Configuration().Servers {
+		status.Members = append(status.Members, ClusterMember{
+			ID:       string(srv.ID),
+			RaftAddr: string(srv.Address),
+			HTTPAddr: cluster.fsm.httpAddr(srv.ID),
+			Voter:    srv.Suffrage == raft.Voter,
+			Leader:   srv.ID == leaderID,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// joinClusterHandler handles POST /cluster/join: add a node as a voter.
+// Only the leader can change membership; other nodes redirect there.
+// Membership changes need RAFT_ADMIN_KEY in X-Admin-Key: whoever can add a
+// voter can outvote the cluster.
+func joinClusterHandler(w http.ResponseWriter, r *http.Request) {
+	var req JoinRequest
+	if !beginMembershipChange(w, r, &req) {
+		return
+	}
+	if req.ID == "" || req.RaftAddr == "" || req.HTTPAddr == "" {
+		http.Error(w, "id, raft_addr and http_addr are required", http.StatusBadRequest)
+		return
+	}
+
+	err := cluster.raft.AddVoter(raft.ServerID(req.ID), raft.ServerAddress(req.RaftAddr), 0, cluster.timeout).Error()
+	if err == nil {
+		_, err = cluster.apply(raftCommand{Op: "member", Node: raft.ServerID(req.ID), HTTPAddr: req.HTTPAddr})
+	}
+	if err != nil {
+		writeStoreError(w, r, "Adding the node failed", err)
+		return
+	}
+	logf(r.Context(), "Raft: added node %s at %s\n", req.ID, req.RaftAddr)
+	writeClusterStatus(w)
+}
+
+// removeClusterHandler handles POST /cluster/remove: take a node out of the
+// cluster, e.g. before decommissioning it. Removing the leader makes it step down.
+func removeClusterHandler(w http.ResponseWriter, r *http.Request) {
+	var req RemoveRequest
+	if !beginMembershipChange(w, r, &req) {
+		return
+	}
+	if req.ID == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	// Forget the HTTP address first: once the leader removes itself it can
+	// no longer write to the log.
+	_, err := cluster.apply(raftCommand{Op: "member", Node: raft.ServerID(req.ID)})
+	if err == nil {
+		err = cluster.raft.RemoveServer(raft.ServerID(req.ID), 0, cluster.timeout).Error()
+	}
+	if err != nil {
+		writeStoreError(w, r, "Removing the node failed", err)
+		return
+	}
+	logf(r.Context(), "Raft: removed node %s\n", req.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// beginMembershipChange checks the method, cluster mode and admin key,
+// redirects to the leader if needed, and decodes the JSON body into req. It
+// reports whether the handler should go on. There are no CORS headers: no
+// browser page has any business changing membership.
+func beginMembershipChange(w http.ResponseWriter, r *http.Request, req any) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+		return false
+	}
+	if cluster == nil {
+		http.Error(w, errClusterUnsupported.Error(), http.StatusNotImplemented)
+		return false
+	}
+	if !hasAdminKey(r, cluster.adminKey) {
+		http.Error(w, "membership changes need the cluster's RAFT_ADMIN_KEY in "+adminKeyHeader, http.StatusForbidden)
+		return false
+	}
+	if cluster.raft.State() != raft.Leader {
+		url, err := cluster.leaderURL()
+		if err != nil {
+			writeStoreError(w, r, "No leader", err)
+			return false
+		}
+		http.Redirect(w, r, url+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// joinCluster asks an existing member (any node; followers redirect to the
+// leader) to add us with adminKey, retrying until it succeeds.
+func joinCluster(memberURL, adminKey string, req JoinRequest) {
+	body, _ := json.Marshal(req)
+	url := strings.TrimSuffix(memberURL, "/") + "/cluster/join"
+	for {
+		err := postJoin(url, adminKey, body)
+		if err == nil {
+			log.Printf("Raft: joined the cluster through %s\n", memberURL)
+			return
+		}
+		log.Printf("Raft: joining through %s failed, retrying in 2s: %v\n", memberURL, err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func postJoin(url, adminKey string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(adminKeyHeader, adminKey)
+	// http.Client follows the 307 from a follower and resends the body and
+	// the key (it only drops Authorization and cookies on redirects).
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
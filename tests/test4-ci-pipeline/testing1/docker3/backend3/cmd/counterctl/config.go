@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// profile is one named connection in the config file.
+type profile struct {
+	URL      string `json:"url"`
+	APIKey   string `json:"api_key,omitempty"`
+	CAFile   string `json:"ca_file,omitempty"`   // trust this CA for HTTPS
+	CertFile string `json:"cert_file,omitempty"` // client certificate for mTLS
+	KeyFile  string `json:"key_file,omitempty"`
+}
+
+// config is the file at $COUNTERCTL_CONFIG or ~/.config/counterctl/config.json:
+//
+//	{
+//	  "current": "local",
+//	  "profiles": {
+//	    "local": { "url": "http://localhost:8080" },
+//	    "prod":  { "url": "https://counter.internal", "api_key": "...",
+//	               "cert_file": "ops.crt", "key_file": "ops.key", "ca_file": "ca.crt" }
+//	  }
+//	}
+type config struct {
+	Current  string             `json:"current"`
+	Profiles map[string]profile `json:"profiles"`
+}
+
+// defaultConfigPath returns where the config file lives unless -config is given.
+func defaultConfigPath() string {
+	if path := os.Getenv("COUNTERCTL_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "counterctl", "config.json")
+}
+
+// loadProfile reads the named profile (or the file's current one).
+// A missing config file is fine: the caller falls back to flags and defaults.
+func loadProfile(path, name string) (profile, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && name == "" {
+		return profile{}, nil
+	}
+	if err != nil {
+		return profile{}, fmt.Errorf("read config: %w", err)
+	}
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return profile{}, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if name == "" {
+		name = cfg.Current
+	}
+	if name == "" {
+		return profile{}, nil
+	}
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		return profile{}, fmt.Errorf("profile %q not found in %s", name, path)
+	}
+	return p, nil
+}
+
+// tlsConfig builds the client TLS settings for a profile, or nil if it needs none.
+func (p profile) tlsConfig() (*tls.Config, error) {
+	if p.CAFile == "" && p.CertFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if p.CAFile != "" {
+		pem, err := os.ReadFile(p.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", p.CAFile)
+		}
+	}
+	if p.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
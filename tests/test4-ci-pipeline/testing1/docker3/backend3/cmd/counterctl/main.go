@@ -0,0 +1,331 @@
+// Command counterctl manages counters from the shell, built on the counterclient package.
+//
+//	counterctl get -id 2
+//	counterctl -profile prod -o json inc
+//	counterctl add -id 3 -- -5
+//	counterctl list -o csv > counters.csv
+//	counterctl import counters.csv
+//
+// The exit code says what went wrong, so CI scripts can branch on it
+// without parsing error messages (see the exit* constants).
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend2/counterclient"
+)
+
+// Exit codes.
+const (
+	exitOK          = 0
+	exitError       = 1 // anything not covered below
+	exitUsage       = 2 // bad flags or arguments
+	exitNotFound    = 3 // 404
+	exitConflict    = 4 // 409 or 412
+	exitRateLimited = 5 // 429
+	exitServer      = 6 // 5xx
+	exitNetwork     = 7 // could not reach the server
+	exitAuth        = 8 // 401 or 403
+)
+
+// usageError marks errors caused by how counterctl was invoked.
+type usageError struct{ msg string }
+
+func (e usageError) Error() string { return e.msg }
+
+func usagef(format string, args ...any) error {
+	return usageError{fmt.Sprintf(format, args...)}
+}
+
+const usage = `Usage: counterctl [global flags] <command> [flags] [args]
+
+Commands:
+  get                 print a counter
+  inc                 add one to a counter
+  add <delta>         add delta (may be negative, use -- before it) to a counter
+  set <value>         overwrite a counter, creating it if needed
+  reset               set a counter back to zero
+  list                print every counter
+  history             print recent writes to a counter (-limit N)
+  watch               print every change to a counter until interrupted
+  export [file]       write every counter as JSON or CSV (stdout if no file)
+  import <file>       set counters from a JSON or CSV export
+
+Global flags:
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes one counterctl invocation and returns its exit code.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	global := flag.NewFlagSet("counterctl", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	global.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		global.PrintDefaults()
+	}
+	configPath := global.String("config", defaultConfigPath(), "config file with connection profiles")
+	profileName := global.String("profile", "", "profile from the config file (default: the file's current profile)")
+	baseURL := global.String("url", "", "backend URL, overrides the profile")
+	apiKey := global.String("api-key", "", "API key, overrides the profile")
+	output := global.String("o", "table", "output format: table, json or csv")
+	timeout := global.Duration("timeout", 30*time.Second, "timeout per command (watch has none)")
+	retries := global.Int("retries", 3, "retries for 429, 5xx gateway and network errors")
+	if err := global.Parse(args); err != nil {
+		return exitUsage
+	}
+	if global.NArg() == 0 {
+		global.Usage()
+		return exitUsage
+	}
+
+	err := func() error {
+		cmd := global.Arg(0)
+		fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		id := fs.Int64("id", 1, "counter id")
+		limit := fs.Int("limit", 50, "number of history entries")
+		fs.StringVar(output, "o", *output, "output format: table, json or csv")
+		if err := fs.Parse(global.Args()[1:]); err != nil {
+			return usageError{err.Error()}
+		}
+		if !validFormat(*output) {
+			return usagef("unknown output format %q", *output)
+		}
+
+		client, err := newClient(*configPath, *profileName, *baseURL, *apiKey, *retries)
+		if err != nil {
+			return err
+		}
+		if cmd != "watch" {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *timeout)
+			defer cancel()
+		}
+		return runCommand(ctx, client, cmd, *id, *limit, fs.Args(), printer{w: stdout, format: *output})
+	}()
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintln(stderr, "counterctl:", err)
+	return exitCode(err)
+}
+
+// newClient builds a client from the profile, with flags taking precedence.
+func newClient(configPath, profileName, baseURL, apiKey string, retries int) (*counterclient.Client, error) {
+	p, err := loadProfile(configPath, profileName)
+	if err != nil {
+		return nil, err
+	}
+	if baseURL != "" {
+		p.URL = baseURL
+	}
+	if apiKey != "" {
+		p.APIKey = apiKey
+	}
+	if p.URL == "" {
+		p.URL = "http://localhost:8080"
+	}
+
+	opts := []counterclient.Option{
+		counterclient.WithUserAgent("counterctl"),
+		counterclient.WithRetries(retries, 100*time.Millisecond, 5*time.Second),
+	}
+	if p.APIKey != "" {
+		opts = append(opts, counterclient.WithAPIKey(p.APIKey))
+	}
+	tlsConfig, err := p.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, counterclient.WithTLSConfig(tlsConfig))
+	}
+	return counterclient.New(p.URL, opts...)
+}
+
+// runCommand dispatches cmd with its remaining positional args.
+func runCommand(ctx context.Context, client *counterclient.Client, cmd string, id int64, limit int, args []string, out printer) error {
+	switch cmd {
+	case "get", "inc", "reset", "list", "history", "watch":
+		if len(args) != 0 {
+			return usagef("%s takes no arguments", cmd)
+		}
+	case "add", "set":
+		if len(args) != 1 {
+			return usagef("%s needs exactly one number", cmd)
+		}
+	case "import":
+		if len(args) != 1 {
+			return usagef("import needs a file")
+		}
+	case "export":
+		if len(args) > 1 {
+			return usagef("export takes at most one file")
+		}
+	default:
+		return usagef("unknown command %q (run counterctl -h for help)", cmd)
+	}
+
+	switch cmd {
+	case "get":
+		return printCounter(out)(client.Get(ctx, id))
+	case "inc":
+		return printCounter(out)(client.Increment(ctx, id))
+	case "add", "set":
+		n, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return usagef("%q is not an integer", args[0])
+		}
+		if cmd == "add" {
+			return printCounter(out)(client.Add(ctx, id, n))
+		}
+		return printCounter(out)(client.Set(ctx, id, n))
+	case "reset":
+		return printCounter(out)(client.Reset(ctx, id))
+	case "list":
+		list, err := client.List(ctx)
+		if err != nil {
+			return err
+		}
+		return out.counters(list)
+	case "history":
+		entries, err := client.History(ctx, id, limit)
+		if err != nil {
+			return err
+		}
+		return out.history(entries)
+	case "watch":
+		return watch(ctx, client, id, out)
+	case "export":
+		return export(ctx, client, args, out)
+	default: // import
+		return importCounters(ctx, client, args[0], out)
+	}
+}
+
+// printCounter adapts a client call's (Counter, error) result for printing.
+func printCounter(out printer) func(counterclient.Counter, error) error {
+	return func(c counterclient.Counter, err error) error {
+		if err != nil {
+			return err
+		}
+		return out.counter(c)
+	}
+}
+
+// watch prints updates until ctx is cancelled (Ctrl-C), which counts as success.
+func watch(ctx context.Context, client *counterclient.Client, id int64, out printer) error {
+	w, err := client.Watch(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for {
+		c, err := w.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err := out.watchUpdate(c); err != nil {
+			return err
+		}
+	}
+}
+
+// export writes every counter to the named file (or stdout). A table is not
+// a re-importable format, so export writes JSON unless -o csv is given or
+// the file name ends in .csv.
+func export(ctx context.Context, client *counterclient.Client, args []string, out printer) error {
+	list, err := client.List(ctx)
+	if err != nil {
+		return err
+	}
+	if out.format == "table" {
+		out.format = "json"
+	}
+	if len(args) == 0 {
+		return out.counters(list)
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(args[0]), ".csv") {
+		out.format = "csv"
+	}
+	out.w = f
+	if err := out.counters(list); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// importCounters sets every counter in the file and prints the result.
+// It stops at the first failure, so a partial import is reported by its exit code.
+func importCounters(ctx context.Context, client *counterclient.Client, path string, out printer) error {
+	list, err := readCounters(path)
+	if err != nil {
+		return err
+	}
+	imported := make([]counterclient.Counter, 0, len(list))
+	for _, c := range list {
+		if c.ID < 1 {
+			return fmt.Errorf("invalid counter id %d in %s", c.ID, path)
+		}
+		set, err := client.Set(ctx, c.ID, c.Value)
+		if err != nil {
+			return fmt.Errorf("counter %d: %w", c.ID, err)
+		}
+		imported = append(imported, set)
+	}
+	return out.counters(imported)
+}
+
+// exitCode maps an error to one of the exit* codes.
+func exitCode(err error) int {
+	var uerr usageError
+	if errors.As(err, &uerr) {
+		return exitUsage
+	}
+	var apiErr *counterclient.Error
+	if errors.As(err, &apiErr) {
+		switch code := apiErr.StatusCode; {
+		case code == http.StatusNotFound:
+			return exitNotFound
+		case code == http.StatusConflict || code == http.StatusPreconditionFailed:
+			return exitConflict
+		case code == http.StatusTooManyRequests:
+			return exitRateLimited
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return exitAuth
+		case code >= 500:
+			return exitServer
+		}
+		return exitError
+	}
+	var netErr interface{ Timeout() bool }
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return exitNetwork
+	}
+	return exitError
+}
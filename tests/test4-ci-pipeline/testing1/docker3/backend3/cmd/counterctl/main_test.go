@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBackend is a tiny stand-in for the counter API: counters 1 and 2 exist,
+// and ?id=9 answers with the status in failStatus.
+func fakeBackend(t *testing.T, failStatus int) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	values := map[string]int64{"1": 5, "2": 7}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/counter", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		id := r.URL.Query().Get("id")
+		if id == "9" {
+			http.Error(w, "failing on purpose", failStatus)
+			return
+		}
+		if r.Method == http.MethodPut {
+			var body struct{ Value int64 }
+			json.NewDecoder(r.Body).Decode(&body)
+			values[id] = body.Value
+		}
+		value, ok := values[id]
+		if !ok {
+			http.Error(w, "counter not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"id": json.Number(id), "value": value})
+	})
+	mux.HandleFunc("/counters", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"counters": []map[string]int64{
+			{"id": 1, "value": values["1"]},
+			{"id": 2, "value": values["2"]},
+		}})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func runCLI(args ...string) (code int, stdout, stderr string) {
+	var out, errOut bytes.Buffer
+	code = run(context.Background(), args, &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+// Test that each output format renders the same counters
+func TestListOutputFormats(t *testing.T) {
+	// Arrange
+	url := fakeBackend(t, 0).URL
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"table", "ID  VALUE\n1   5\n2   7\n"},
+		{"csv", "ID,VALUE\n1,5\n2,7\n"},
+		{"json", `"value": 7`},
+	}
+	for _, tt := range tests {
+		// Act
+		code, stdout, stderr := runCLI("-config", "", "-url", url, "-o", tt.format, "list")
+
+		// Assert
+		if code != exitOK {
+			t.Fatalf("%s: expected exit 0, got %d (%s)", tt.format, code, stderr)
+		}
+		if !strings.Contains(stdout, tt.want) {
+			t.Errorf("%s: expected output containing %q, got %q", tt.format, tt.want, stdout)
+		}
+	}
+}
+
+// Test that errors map to the documented exit codes
+func TestExitCodes(t *testing.T) {
+	tests := []struct {
+		name       string
+		failStatus int
+		args       []string
+		want       int
+	}{
+		{"ok", 0, []string{"get"}, exitOK},
+		{"unknown command", 0, []string{"frobnicate"}, exitUsage},
+		{"bad number", 0, []string{"add", "x"}, exitUsage},
+		{"not found", 0, []string{"get", "-id", "404"}, exitNotFound},
+		{"conflict", http.StatusPreconditionFailed, []string{"get", "-id", "9"}, exitConflict},
+		{"rate limited", http.StatusTooManyRequests, []string{"get", "-id", "9"}, exitRateLimited},
+		{"forbidden", http.StatusForbidden, []string{"get", "-id", "9"}, exitAuth},
+		{"server error", http.StatusInternalServerError, []string{"get", "-id", "9"}, exitServer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Arrange
+			url := fakeBackend(t, tt.failStatus).URL
+
+			// Act
+			code, _, stderr := runCLI(append([]string{"-config", "", "-url", url, "-retries", "0"}, tt.args...)...)
+
+			// Assert
+			if code != tt.want {
+				t.Errorf("Expected exit code %d, got %d (%s)", tt.want, code, stderr)
+			}
+		})
+	}
+}
+
+// Test that an unreachable server exits with the network code
+func TestExitCodeNetwork(t *testing.T) {
+	// Arrange: a server that is already gone
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	// Act
+	code, _, _ := runCLI("-config", "", "-url", server.URL, "-retries", "0", "get")
+
+	// Assert
+	if code != exitNetwork {
+		t.Errorf("Expected exit code %d, got %d", exitNetwork, code)
+	}
+}
+
+// Test that the profile from the config file supplies the URL
+func TestConfigProfile(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	cfg := `{"current": "broken", "profiles": {
+		"broken": {"url": "http://127.0.0.1:1"},
+		"local":  {"url": "` + fakeBackend(t, 0).URL + `"}}}`
+	os.WriteFile(path, []byte(cfg), 0o600)
+
+	// Act
+	code, stdout, stderr := runCLI("-config", path, "-profile", "local", "-o", "csv", "get", "-id", "2")
+	_, _, missing := runCLI("-config", path, "-profile", "nope", "get")
+
+	// Assert
+	if code != exitOK || stdout != "ID,VALUE\n2,7\n" {
+		t.Errorf("Expected counter 2 from the local profile, got %q (exit %d, %s)", stdout, code, stderr)
+	}
+	if !strings.Contains(missing, `profile "nope" not found`) {
+		t.Errorf("Expected an unknown-profile error, got %q", missing)
+	}
+}
+
+// Test that an export can be imported again
+func TestExportImport(t *testing.T) {
+	// Arrange
+	url := fakeBackend(t, 0).URL
+	file := filepath.Join(t.TempDir(), "counters.csv")
+
+	// Act
+	exportCode, _, _ := runCLI("-config", "", "-url", url, "export", file)
+	runCLI("-config", "", "-url", url, "set", "-id", "2", "0")
+	importCode, stdout, stderr := runCLI("-config", "", "-url", url, "-o", "csv", "import", file)
+
+	// Assert
+	if exportCode != exitOK || importCode != exitOK {
+		t.Fatalf("Expected export and import to succeed, got %d and %d (%s)", exportCode, importCode, stderr)
+	}
+	if stdout != "ID,VALUE\n1,5\n2,7\n" {
+		t.Errorf("Expected counter 2 restored to 7, got %q", stdout)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"backend2/counterclient"
+)
+
+// printer writes results in the format chosen with -o.
+type printer struct {
+	w      io.Writer
+	format string // "table", "json" or "csv"
+}
+
+func validFormat(format string) bool {
+	return format == "table" || format == "json" || format == "csv"
+}
+
+// rows writes a header and rows as a table or CSV, or v as JSON.
+func (p printer) rows(v any, header []string, rows [][]string) error {
+	switch p.format {
+	case "json":
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "csv":
+		cw := csv.NewWriter(p.w)
+		cw.Write(header)
+		cw.WriteAll(rows)
+		return cw.Error()
+	default:
+		tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	}
+}
+
+func counterRow(c counterclient.Counter) []string {
+	return []string{strconv.FormatInt(c.ID, 10), strconv.FormatInt(c.Value, 10)}
+}
+
+// counter prints a single counter.
+func (p printer) counter(c counterclient.Counter) error {
+	return p.rows(c, []string{"ID", "VALUE"}, [][]string{counterRow(c)})
+}
+
+// counters prints a list of counters.
+func (p printer) counters(list []counterclient.Counter) error {
+	rows := make([][]string, len(list))
+	for i, c := range list {
+		rows[i] = counterRow(c)
+	}
+	if list == nil {
+		list = []counterclient.Counter{}
+	}
+	return p.rows(list, []string{"ID", "VALUE"}, rows)
+}
+
+// history prints history entries.
+func (p printer) history(entries []counterclient.HistoryEntry) error {
+	rows := make([][]string, len(entries))
+	for i, e := range entries {
+		rows[i] = []string{
+			e.At.Format(time.RFC3339),
+			e.Op,
+			strconv.FormatInt(e.Delta, 10),
+			strconv.FormatInt(e.Value, 10),
+		}
+	}
+	if entries == nil {
+		entries = []counterclient.HistoryEntry{}
+	}
+	return p.rows(entries, []string{"AT", "OP", "DELTA", "VALUE"}, rows)
+}
+
+// watchUpdate prints one update from a watch stream on a single line,
+// so the output can be piped into other tools.
+func (p printer) watchUpdate(c counterclient.Counter) error {
+	switch p.format {
+	case "json":
+		return json.NewEncoder(p.w).Encode(c)
+	case "csv":
+		cw := csv.NewWriter(p.w)
+		cw.Write(counterRow(c))
+		cw.Flush()
+		return cw.Error()
+	default:
+		_, err := fmt.Fprintf(p.w, "%s\tcounter %d = %d\n", time.Now().Format(time.TimeOnly), c.ID, c.Value)
+		return err
+	}
+}
+
+// readCounters parses an export file. The format comes from the file
+// extension (.csv or .json), defaulting to JSON.
+func readCounters(path string) ([]counterclient.Counter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		records, err := csv.NewReader(f).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		var list []counterclient.Counter
+		for i, rec := range records {
+			if i == 0 && len(rec) > 0 && strings.EqualFold(rec[0], "id") {
+				continue // header row
+			}
+			if len(rec) != 2 {
+				return nil, fmt.Errorf("line %d: want 2 columns (id,value), got %d", i+1, len(rec))
+			}
+			id, err1 := strconv.ParseInt(rec[0], 10, 64)
+			value, err2 := strconv.ParseInt(rec[1], 10, 64)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("line %d: id and value must be integers", i+1)
+			}
+			list = append(list, counterclient.Counter{ID: id, Value: value})
+		}
+		return list, nil
+	}
+
+	var list []counterclient.Counter
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return list, nil
+}
@@ -0,0 +1,389 @@
+// Package counterclient is a Go client for the counter backend's HTTP API.
+//
+// Instead of hand-writing http.Get calls and decoding CounterResponse in every
+// service, import this package:
+//
+//	client, err := counterclient.New("http://localhost:8080", counterclient.WithAPIKey(key))
+//	counter, err := client.Increment(ctx, 1)
+//
+// Requests that fail with a retryable error (network errors, 429, 502, 503,
+// 504, and 409 with Retry-After) are retried with exponential backoff.
+// Mutations carry an automatic Idempotency-Key so a retry never applies the
+// same change twice.
+package counterclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Counter is a counter and its current value.
+type Counter struct {
+	ID    int64 `json:"id"`
+	Value int64 `json:"value"`
+	// ETag identifies this version of the counter (from the ETag header;
+	// empty from List). Pass it to SetIfMatch or AddIfMatch.
+	ETag string `json:"-"`
+	// Queued is set by Increment when the server's store was down and it
+	// spooled the increment for later; Value is not meaningful then.
+	Queued bool `json:"queued,omitempty"`
+}
+
+// Error is returned when the server answers with a non-2xx status.
+type Error struct {
+	StatusCode int
+	Message    string        // the response body, trimmed
+	RetryAfter time.Duration // from the Retry-After header, if any
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("counter API: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether err means the counter does not exist.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsPreconditionFailed reports whether err means a SetIfMatch or AddIfMatch
+// lost the race: the counter changed since its ETag was read.
+func IsPreconditionFailed(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusPreconditionFailed
+}
+
+// IsConflict reports whether err is a 409: usually a write that would take
+// a bounded counter outside its bounds.
+func IsConflict(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict
+}
+
+// Client talks to one counter backend. It is safe for concurrent use.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	apiKey     string
+	userAgent  string
+
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient replaces the default http.Client (e.g. to set timeouts or a transport).
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithAPIKey sends key in the X-API-Key header on every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithTLSConfig uses cfg for HTTPS, e.g. to present a client certificate
+// to a server that requires mutual TLS, or to trust a private CA.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Client) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = cfg
+		c.httpClient = &http.Client{Transport: transport}
+	}
+}
+
+// WithRetries sets how many times a retryable request is retried and the
+// backoff range. Backoff doubles from min up to max, with jitter.
+// maxRetries 0 disables retries.
+func WithRetries(maxRetries int, min, max time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries, c.minBackoff, c.maxBackoff = maxRetries, min, max
+	}
+}
+
+// WithUserAgent sets the User-Agent header.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) { c.userAgent = ua }
+}
+
+// New returns a client for the backend at baseURL, e.g. "http://localhost:8080".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("counterclient: invalid base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("counterclient: base URL must be http or https, got %q", baseURL)
+	}
+	c := &Client{
+		baseURL:    u,
+		httpClient: http.DefaultClient,
+		userAgent:  "counterclient-go",
+		maxRetries: 3,
+		minBackoff: 100 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Get returns counter id.
+func (c *Client) Get(ctx context.Context, id int64) (Counter, error) {
+	var out Counter
+	err := c.do(ctx, http.MethodGet, "/counter", idQuery(id), nil, &out)
+	return out, err
+}
+
+// Increment adds one to counter id and returns the new value.
+func (c *Client) Increment(ctx context.Context, id int64) (Counter, error) {
+	var out Counter
+	err := c.do(ctx, http.MethodPost, "/counter/increment", idQuery(id), nil, &out)
+	return out, err
+}
+
+// Add adds delta (which may be negative) to counter id and returns the new value.
+func (c *Client) Add(ctx context.Context, id, delta int64) (Counter, error) {
+	var out Counter
+	err := c.do(ctx, http.MethodPost, "/counter/add", idQuery(id), map[string]int64{"delta": delta}, &out)
+	return out, err
+}
+
+// Set overwrites counter id with value, creating it if needed.
+func (c *Client) Set(ctx context.Context, id, value int64) (Counter, error) {
+	var out Counter
+	err := c.do(ctx, http.MethodPut, "/counter", idQuery(id), map[string]int64{"value": value}, &out)
+	return out, err
+}
+
+// SetIfMatch is Set, but only if the counter still has the given ETag
+// (from an earlier Get or write). Otherwise it fails without writing, and
+// IsPreconditionFailed(err) is true: read the counter again and retry.
+func (c *Client) SetIfMatch(ctx context.Context, id, value int64, etag string) (Counter, error) {
+	var out Counter
+	err := c.doWithHeader(ctx, http.MethodPut, "/counter", idQuery(id), ifMatch(etag), map[string]int64{"value": value}, &out)
+	return out, err
+}
+
+// AddIfMatch is Add, but only if the counter still has the given ETag.
+func (c *Client) AddIfMatch(ctx context.Context, id, delta int64, etag string) (Counter, error) {
+	var out Counter
+	err := c.doWithHeader(ctx, http.MethodPost, "/counter/add", idQuery(id), ifMatch(etag), map[string]int64{"delta": delta}, &out)
+	return out, err
+}
+
+func ifMatch(etag string) http.Header {
+	return http.Header{"If-Match": {etag}}
+}
+
+// Reset sets counter id back to zero.
+func (c *Client) Reset(ctx context.Context, id int64) (Counter, error) {
+	var out Counter
+	err := c.do(ctx, http.MethodPost, "/counter/reset", idQuery(id), nil, &out)
+	return out, err
+}
+
+// List returns every counter, ordered by id.
+func (c *Client) List(ctx context.Context) ([]Counter, error) {
+	var out struct {
+		Counters []Counter `json:"counters"`
+	}
+	err := c.do(ctx, http.MethodGet, "/counters", nil, nil, &out)
+	return out.Counters, err
+}
+
+// HistoryEntry records one write to a counter.
+type HistoryEntry struct {
+	At    time.Time `json:"at"`
+	Op    string    `json:"op"`    // "add" or "set"
+	Delta int64     `json:"delta"` // change applied by this write
+	Value int64     `json:"value"` // value after the write
+}
+
+// History returns up to limit of the most recent writes to counter id, newest first.
+func (c *Client) History(ctx context.Context, id int64, limit int) ([]HistoryEntry, error) {
+	var out struct {
+		Entries []HistoryEntry `json:"entries"`
+	}
+	query := idQuery(id)
+	query.Set("limit", strconv.Itoa(limit))
+	err := c.do(ctx, http.MethodGet, "/counter/history", query, nil, &out)
+	return out.Entries, err
+}
+
+// OpenAPI returns the server's OpenAPI document as raw JSON.
+func (c *Client) OpenAPI(ctx context.Context) (json.RawMessage, error) {
+	var out json.RawMessage
+	err := c.do(ctx, http.MethodGet, "/openapi.json", nil, nil, &out)
+	return out, err
+}
+
+func idQuery(id int64) url.Values {
+	return url.Values{"id": {strconv.FormatInt(id, 10)}}
+}
+
+// do sends one API call, retrying retryable failures.
+// body (if any) is encoded as JSON, and the response is decoded into out.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	return c.doWithHeader(ctx, method, path, query, nil, body, out)
+}
+
+// doWithHeader is do with extra request headers.
+func (c *Client) doWithHeader(ctx context.Context, method, path string, query url.Values, header http.Header, body, out any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	// One key per logical call, reused by every retry of that call.
+	var idempotencyKey string
+	if method == http.MethodPost || method == http.MethodPut {
+		idempotencyKey = newIdempotencyKey()
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, query, header, payload, idempotencyKey)
+		if err == nil {
+			err = decodeResponse(resp, out)
+		}
+		if counter, ok := out.(*Counter); ok && err == nil {
+			counter.ETag = resp.Header.Get("ETag")
+		}
+		if err == nil || attempt >= c.maxRetries || !retryable(ctx, err) {
+			return err
+		}
+		if err := sleep(ctx, c.backoff(attempt, err)); err != nil {
+			return err
+		}
+	}
+}
+
+// send builds and sends a single HTTP request.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, header http.Header, payload []byte, idempotencyKey string) (*http.Response, error) {
+	u := *c.baseURL
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	// Continue the caller's trace, if it has one (a no-op without OpenTelemetry set up).
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return c.httpClient.Do(req)
+}
+
+// decodeResponse turns a non-2xx response into *Error and decodes the rest into out.
+func decodeResponse(resp *http.Response, out any) error {
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		apiErr := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(secs) * time.Second
+		}
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("counterclient: decode response: %w", err)
+	}
+	return nil
+}
+
+// retryable reports whether err is worth another attempt.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		case http.StatusConflict:
+			// A retry that overtook the first attempt of the same
+			// Idempotency-Key; other conflicts carry no Retry-After.
+			return apiErr.RetryAfter > 0
+		}
+		return false
+	}
+	// Anything else is a network-level failure (connection refused, reset, ...).
+	return true
+}
+
+// backoff returns how long to wait before retry number attempt+1.
+// A Retry-After header from the server takes precedence.
+func (c *Client) backoff(attempt int, err error) time.Duration {
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter
+	}
+	d := time.Duration(float64(c.minBackoff) * math.Pow(2, float64(attempt)))
+	if d > c.maxBackoff || d <= 0 {
+		d = c.maxBackoff
+	}
+	// Random jitter between d/2 and d spreads out clients that failed together.
+	return d/2 + time.Duration(mathrand.Int64N(int64(d/2)+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,93 @@
+package counterclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test that retryable errors are retried with the same Idempotency-Key
+func TestRetriesReuseIdempotencyKey(t *testing.T) {
+	// Arrange: a server that fails twice with 503, then succeeds
+	var calls atomic.Int32
+	keys := make(chan string, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys <- r.Header.Get("Idempotency-Key")
+		if calls.Add(1) <= 2 {
+			http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":1,"value":7}`))
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL, WithRetries(3, time.Millisecond, 5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	c, err := client.Increment(context.Background(), 1)
+
+	// Assert
+	if err != nil || c.Value != 7 {
+		t.Fatalf("Expected value 7, got %v (err %v)", c, err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls.Load())
+	}
+	first := <-keys
+	if first == "" || <-keys != first || <-keys != first {
+		t.Error("Expected every retry to reuse the same non-empty Idempotency-Key")
+	}
+}
+
+// Test that client errors are returned immediately as *Error
+func TestNoRetryOnClientError(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "counter not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client, _ := New(server.URL, WithRetries(3, time.Millisecond, time.Millisecond))
+	_, err := client.Get(context.Background(), 42)
+
+	if !IsNotFound(err) {
+		t.Errorf("Expected a not-found error, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected exactly 1 attempt, got %d", calls.Load())
+	}
+}
+
+// Test that a Retry-After header overrides the computed backoff
+func TestBackoffHonorsRetryAfter(t *testing.T) {
+	client, _ := New("http://localhost", WithRetries(3, time.Millisecond, time.Second))
+	d := client.backoff(0, &Error{StatusCode: http.StatusTooManyRequests, RetryAfter: 2 * time.Second})
+	if d != 2*time.Second {
+		t.Errorf("Expected 2s backoff, got %v", d)
+	}
+	d = client.backoff(10, &Error{StatusCode: http.StatusServiceUnavailable})
+	if d < 500*time.Millisecond || d > time.Second {
+		t.Errorf("Expected backoff capped between 0.5s and 1s, got %v", d)
+	}
+}
+
+// Test that a 409 is retried only with Retry-After, which the server sends
+// while the first attempt of the same Idempotency-Key is still running
+func TestRetryInProgressConflict(t *testing.T) {
+	// Act
+	inProgress := retryable(context.Background(), &Error{StatusCode: http.StatusConflict, RetryAfter: time.Second})
+	outOfBounds := retryable(context.Background(), &Error{StatusCode: http.StatusConflict})
+
+	// Assert
+	if !inProgress || outOfBounds {
+		t.Errorf("Expected only the 409 with Retry-After to be retryable, got %v and %v", inProgress, outOfBounds)
+	}
+}
@@ -0,0 +1,74 @@
+package counterclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Watcher receives counter updates from GET /counter/watch (Server-Sent Events).
+type Watcher struct {
+	resp    *http.Response
+	scanner *bufio.Scanner
+}
+
+// Watch opens an event stream for counter id. The first call to Next returns
+// the current value; later calls block until the counter changes.
+// Cancel ctx or call Close to stop watching.
+func (c *Client) Watch(ctx context.Context, id int64) (*Watcher, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, http.MethodGet, "/counter/watch", idQuery(id), nil, nil, "")
+		if err == nil && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+			err = decodeResponse(resp, nil)
+		}
+		if err == nil {
+			return &Watcher{resp: resp, scanner: bufio.NewScanner(resp.Body)}, nil
+		}
+		if attempt >= c.maxRetries || !retryable(ctx, err) {
+			return nil, err
+		}
+		if err := sleep(ctx, c.backoff(attempt, err)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Next blocks until the next counter event and returns it.
+// It returns an error when the stream ends or the context is cancelled;
+// callers that want to keep watching should call Client.Watch again.
+func (w *Watcher) Next() (Counter, error) {
+	var event, data string
+	for w.scanner.Scan() {
+		line := w.scanner.Text()
+		switch {
+		case line == "":
+			// A blank line ends an event.
+			if event == "counter" && data != "" {
+				var c Counter
+				if err := json.Unmarshal([]byte(data), &c); err != nil {
+					return Counter{}, fmt.Errorf("counterclient: decode event: %w", err)
+				}
+				return c, nil
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, ":"):
+			// Comment lines are heartbeats.
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	if err := w.scanner.Err(); err != nil {
+		return Counter{}, err
+	}
+	return Counter{}, fmt.Errorf("counterclient: watch stream closed by server")
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	return w.resp.Body.Close()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"backend2/counterclient"
+)
+
+// newTestServer serves the real routes from an in-memory store.
+// The global store is restored when the test ends.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	previous := store
+	store = newMemoryStore()
+	t.Cleanup(func() { store = previous })
+
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	server := httptest.NewServer(newIdempotencyCache(defaultIdempotencyMaxBytes).middleware(clientIdentity{}, mux))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Test every client method against the real handlers
+func TestCounterClientEndpoints(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	client, err := counterclient.New(newTestServer(t).URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act + Assert
+	c, err := client.Increment(ctx, 1)
+	if err != nil || c.Value != 1 {
+		t.Fatalf("Expected value 1 after Increment, got %v (err %v)", c, err)
+	}
+	c, err = client.Add(ctx, 1, -5)
+	if err != nil || c.Value != -4 {
+		t.Errorf("Expected value -4 after Add, got %v (err %v)", c, err)
+	}
+	c, err = client.Set(ctx, 3, 100)
+	if err != nil || c.ID != 3 || c.Value != 100 {
+		t.Errorf("Expected counter 3 = 100 after Set, got %v (err %v)", c, err)
+	}
+	c, err = client.Get(ctx, 3)
+	if err != nil || c.Value != 100 {
+		t.Errorf("Expected Get to return 100, got %v (err %v)", c, err)
+	}
+	if _, err := client.Get(ctx, 404); !counterclient.IsNotFound(err) {
+		t.Errorf("Expected not-found error, got %v", err)
+	}
+	c, err = client.Reset(ctx, 3)
+	if err != nil || c.Value != 0 {
+		t.Errorf("Expected 0 after Reset, got %v (err %v)", c, err)
+	}
+	list, err := client.List(ctx)
+	if err != nil || len(list) != 2 || list[0].ID != 1 || list[1].ID != 3 {
+		t.Errorf("Expected counters 1 and 3, got %v (err %v)", list, err)
+	}
+	history, err := client.History(ctx, 3, 10)
+	if err != nil || len(history) != 2 || history[0].Delta != -100 || history[1].Value != 100 {
+		t.Errorf("Expected reset then set in history, got %v (err %v)", history, err)
+	}
+	if spec, err := client.OpenAPI(ctx); err != nil || len(spec) == 0 {
+		t.Errorf("Expected the OpenAPI document, got err %v", err)
+	}
+}
+
+// Test that a replayed Idempotency-Key does not increment twice
+func TestIdempotencyKeyReplay(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	send := func() *http.Response {
+		req, _ := http.NewRequest("POST", server.URL+"/counter/increment", nil)
+		req.Header.Set("Idempotency-Key", "abc")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Act: the same request twice
+	send()
+	replay := send()
+
+	// Assert
+	if replay.Header.Get("Idempotent-Replayed") != "true" {
+		t.Error("Expected the second response to be a replay")
+	}
+	if value, _ := store.Get(context.Background(), 1); value != 1 {
+		t.Errorf("Expected the counter to be incremented once, got %d", value)
+	}
+}
+
+// Test that Watch receives the current value and later changes over SSE
+func TestCounterClientWatch(t *testing.T) {
+	// Arrange
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, _ := counterclient.New(newTestServer(t).URL)
+
+	watcher, err := client.Watch(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	if c, err := watcher.Next(); err != nil || c.Value != 0 {
+		t.Fatalf("Expected initial value 0, got %v (err %v)", c, err)
+	}
+
+	// Act
+	client.Add(ctx, 1, 3)
+
+	// Assert
+	if c, err := watcher.Next(); err != nil || c.Value != 3 {
+		t.Errorf("Expected watched value 3, got %v (err %v)", c, err)
+	}
+}
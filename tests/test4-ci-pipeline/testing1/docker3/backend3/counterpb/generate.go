@@ -0,0 +1,4 @@
+// Package counterpb holds the protobuf messages and gRPC stubs for CounterService.
+package counterpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative counter.proto
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"backend2/counterpb"
+)
+
+// counterService implements counterpb.CounterServiceServer with the same
+// store helpers as the HTTP handlers, so versions, bounds and the spool
+// apply to gRPC writes too. Like the HTTP API it takes If-Match from the
+// request metadata and answers with the counter's ETag in the "etag"
+// header. An increment spooled while the store is down is answered with
+// queued set and its op ID, like the HTTP API's 202.
+type counterService struct {
+	counterpb.UnimplementedCounterServiceServer
+}
+
+// counterID maps the proto default (0) to the default counter.
+func counterID(id int64) int64 {
+	if id == 0 {
+		return defaultCounterID
+	}
+	return id
+}
+
+// grpcError turns a store error into a gRPC status.
+func grpcError(err error) error {
+	if errors.Is(err, errCounterNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	if errors.Is(err, errOutOfBounds) {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	if errors.Is(err, errVersionMismatch) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if errors.Is(err, errVersionsUnsupported) {
+		return status.Error(codes.Unimplemented, err.Error())
+	}
+	if errors.Is(err, errNoLeader) || errors.Is(err, errCircuitOpen) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if ctxErr := status.FromContextError(err); ctxErr.Code() != codes.Unknown {
+		return ctxErr.Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// grpcIfMatch reads the if-match metadata, which works like the If-Match header.
+func grpcIfMatch(ctx context.Context) (int64, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var header string
+	if values := md.Get("if-match"); len(values) > 0 {
+		header = values[0]
+	}
+	version, err := parseIfMatch(header)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return version, nil
+}
+
+// grpcCounter sends the ETag header, if the store reported a version, and
+// returns the counter.
+func grpcCounter(ctx context.Context, id, value, version int64) (*counterpb.Counter, error) {
+	if version >= 0 {
+		grpc.SetHeader(ctx, metadata.Pairs("etag", formatETag(version)))
+	}
+	return &counterpb.Counter{Id: id, Value: value}, nil
+}
+
+func (s *counterService) Get(ctx context.Context, req *counterpb.GetRequest) (*counterpb.Counter, error) {
+	id := counterID(req.GetId())
+	value, version, err := getCounter(ctx, id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcCounter(ctx, id, value, version)
+}
+
+func (s *counterService) Increment(ctx context.Context, req *counterpb.IncrementRequest) (*counterpb.Counter, error) {
+	id := counterID(req.GetId())
+	ifVersion, err := grpcIfMatch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	value, version, err := addCounter(ctx, id, 1, ifVersion)
+	if err != nil && ifVersion == anyVersion {
+		if opID := spoolFailed(ctx, id, err); opID != "" {
+			return &counterpb.Counter{Id: id, Queued: true, OpId: opID}, nil
+		}
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcCounter(ctx, id, value, version)
+}
+
+func (s *counterService) Add(ctx context.Context, req *counterpb.AddRequest) (*counterpb.Counter, error) {
+	id := counterID(req.GetId())
+	ifVersion, err := grpcIfMatch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	value, version, err := addCounter(ctx, id, req.GetDelta(), ifVersion)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcCounter(ctx, id, value, version)
+}
+
+func (s *counterService) Set(ctx context.Context, req *counterpb.SetRequest) (*counterpb.Counter, error) {
+	id := counterID(req.GetId())
+	ifVersion, err := grpcIfMatch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	value, version, err := setCounter(ctx, id, req.GetValue(), ifVersion)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcCounter(ctx, id, value, version)
+}
+
+// Watch sends the current value, then every change until the client cancels.
+func (s *counterService) Watch(req *counterpb.WatchRequest, stream grpc.ServerStreamingServer[counterpb.Counter]) error {
+	ctx := stream.Context()
+	id := counterID(req.GetId())
+
+	// Subscribe before reading so no change can slip in between.
+	updates, stop := changes.subscribe(id)
+	defer stop()
+
+	value, err := store.Get(ctx, id)
+	if err != nil {
+		return grpcError(err)
+	}
+	if err := stream.Send(&counterpb.Counter{Id: id, Value: value}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-closingStreams:
+			return nil
+		case c := <-updates:
+			if err := stream.Send(&counterpb.Counter{Id: c.ID, Value: c.Value}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// withCertPrincipal puts the client certificate's principal on the
+// context, like clientCertMiddleware does for HTTP.
+func withCertPrincipal(ctx context.Context) context.Context {
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			return withPrincipal(ctx, clientCertPrincipal(info.State.VerifiedChains[0][0]))
+		}
+	}
+	return ctx
+}
+
+// grpcRoutes maps the writing RPCs to the HTTP routes whose rate limit
+// buckets they spend, so a client cannot dodge its limit by switching
+// APIs. Other RPCs are limited under their full method name, e.g.
+// RATE_LIMITS=/counter.v1.CounterService/Watch=1:5.
+var grpcRoutes = map[string]string{
+	counterpb.CounterService_Increment_FullMethodName: "POST /counter/increment",
+	counterpb.CounterService_Add_FullMethodName:       "POST /counter/add",
+	counterpb.CounterService_Set_FullMethodName:       "PUT /counter",
+}
+
+// grpcRateLimit spends a token for method, answering ResourceExhausted
+// once the client's bucket is empty.
+func grpcRateLimit(ctx context.Context, limits *rateLimiterConfig, method string) error {
+	if limits == nil {
+		return nil
+	}
+	route, ok := grpcRoutes[method]
+	if !ok {
+		route = method
+	}
+	d := limits.allow(ctx, route, limits.grpcClientKey(ctx))
+	if d.Allowed {
+		return nil
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(ceilSeconds(d.RetryAfter))))
+	return status.Error(codes.ResourceExhausted, "Too many requests, slow down")
+}
+
+// unaryInterceptor identifies the caller and applies the rate limit.
+func unaryInterceptor(limits *rateLimiterConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx = withCertPrincipal(ctx)
+		if err := grpcRateLimit(ctx, limits, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// streamInterceptor does the same for streams, charging one token per stream.
+func streamInterceptor(limits *rateLimiterConfig) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := withCertPrincipal(ss.Context())
+		if err := grpcRateLimit(ctx, limits, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// contextStream is a ServerStream with a replaced context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context { return s.ctx }
+
+// newGRPCServer builds a gRPC server with CounterService, the standard
+// health service, and reflection (so tools like grpcurl can list methods).
+// Calls are rate limited by limits (nil for none). When the server shares
+// the HTTP port, net/http terminates TLS, so the gRPC server itself must
+// not be given credentials.
+func newGRPCServer(tlsConfig *tls.Config, sharedPort bool, limits *rateLimiterConfig) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(unaryInterceptor(limits)),
+		grpc.StreamInterceptor(streamInterceptor(limits)),
+	}
+	if tlsConfig != nil && !sharedPort {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+
+	counterpb.RegisterCounterServiceServer(server, &counterService{})
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(counterpb.CounterService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+
+	reflection.Register(server)
+	return server
+}
+
+// serveGRPC runs server on its own port. It exits the program if the port is unavailable.
+func serveGRPC(server *grpc.Server, port string) {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatalf("Unable to listen for gRPC on port %s: %v\n", port, err)
+	}
+	log.Printf("gRPC server running on port %s\n", port)
+	if err := server.Serve(lis); err != nil {
+		log.Fatalf("gRPC server stopped: %v\n", err)
+	}
+}
+
+// grpcMultiplexer sends gRPC requests (HTTP/2 with an application/grpc
+// content type) to the gRPC server and everything else to the HTTP handler,
+// so both APIs can share one port.
+func grpcMultiplexer(grpcServer *grpc.Server, httpHandler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+		httpHandler.ServeHTTP(w, r)
+	})
+}
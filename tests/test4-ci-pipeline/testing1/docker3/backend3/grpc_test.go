@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"backend2/counterpb"
+)
+
+// startGRPC makes s the store, serves CounterService over an in-memory
+// connection with the given rate limits, and returns a client.
+func startGRPC(t *testing.T, s counterStore, limits *rateLimiterConfig) *grpc.ClientConn {
+	t.Helper()
+	previous := store
+	store = s
+	t.Cleanup(func() { store = previous })
+	lis := bufconn.Listen(1 << 20)
+	server := newGRPCServer(nil, false, limits)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Test the unary RPCs against the in-memory store
+func TestGRPCCounterService(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	client := counterpb.NewCounterServiceClient(startGRPC(t, newMemoryStore(), nil))
+
+	// Act + Assert: id 0 means the default counter
+	c, err := client.Increment(ctx, &counterpb.IncrementRequest{})
+	if err != nil || c.GetId() != 1 || c.GetValue() != 1 {
+		t.Fatalf("Expected counter 1 with value 1, got %v (err %v)", c, err)
+	}
+	c, _ = client.Add(ctx, &counterpb.AddRequest{Id: 1, Delta: 10})
+	if c.GetValue() != 11 {
+		t.Errorf("Expected value 11 after Add, got %d", c.GetValue())
+	}
+	c, _ = client.Set(ctx, &counterpb.SetRequest{Id: 7, Value: 42})
+	if c.GetValue() != 42 {
+		t.Errorf("Expected value 42 after Set, got %d", c.GetValue())
+	}
+	c, _ = client.Get(ctx, &counterpb.GetRequest{Id: 7})
+	if c.GetValue() != 42 {
+		t.Errorf("Expected Get to return 42, got %d", c.GetValue())
+	}
+
+	// Unknown counters map to NotFound
+	_, err = client.Get(ctx, &counterpb.GetRequest{Id: 99})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+}
+
+// Test that Watch streams the current value and then every change
+func TestGRPCWatch(t *testing.T) {
+	// Arrange
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := newMemoryStore()
+	client := counterpb.NewCounterServiceClient(startGRPC(t, s, nil))
+
+	stream, err := client.Watch(ctx, &counterpb.WatchRequest{Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := stream.Recv()
+	if err != nil || first.GetValue() != 0 {
+		t.Fatalf("Expected initial value 0, got %v (err %v)", first, err)
+	}
+
+	// Act: write through the store, as an HTTP handler would
+	s.Add(ctx, 1, 5)
+
+	// Assert
+	next, err := stream.Recv()
+	if err != nil || next.GetValue() != 5 {
+		t.Errorf("Expected streamed value 5, got %v (err %v)", next, err)
+	}
+}
+
+// Test that the standard health service reports SERVING
+func TestGRPCHealth(t *testing.T) {
+	health := healthpb.NewHealthClient(startGRPC(t, newMemoryStore(), nil))
+	resp, err := health.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "counter.v1.CounterService"})
+	if err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected SERVING, got %v (err %v)", resp, err)
+	}
+}
+
+// Test that writes honor if-match metadata and answer with an etag header
+func TestGRPCConditionalWrites(t *testing.T) {
+	// Arrange
+	client := counterpb.NewCounterServiceClient(startGRPC(t, newMemoryStore(), nil))
+	var header metadata.MD
+	if _, err := client.Increment(context.Background(), &counterpb.IncrementRequest{}, grpc.Header(&header)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	stale := metadata.AppendToOutgoingContext(context.Background(), "if-match", `"0"`)
+	_, staleErr := client.Set(stale, &counterpb.SetRequest{Value: 5})
+	current := metadata.AppendToOutgoingContext(context.Background(), "if-match", header.Get("etag")[0])
+	c, err := client.Add(current, &counterpb.AddRequest{Delta: 2})
+
+	// Assert
+	if got := header.Get("etag"); len(got) != 1 || got[0] != `"1"` {
+		t.Errorf("Expected etag \"1\", got %v", got)
+	}
+	if status.Code(staleErr) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition for a stale if-match, got %v", staleErr)
+	}
+	if err != nil || c.GetValue() != 3 {
+		t.Errorf("Expected value 3 with a current if-match, got %v (err %v)", c, err)
+	}
+}
+
+// Test that gRPC writes spend the HTTP route's rate limit, and streams are limited too
+func TestGRPCRateLimit(t *testing.T) {
+	// Arrange: one increment and one watch per client, and no refill
+	routes, _ := parseRateLimits("/counter/increment=0.001:1,/counter.v1.CounterService/Watch=0.001:1")
+	limits := &rateLimiterConfig{limiter: newMemoryRateLimiter(), routes: routes}
+	client := counterpb.NewCounterServiceClient(startGRPC(t, newMemoryStore(), limits))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Act
+	_, first := client.Increment(ctx, &counterpb.IncrementRequest{})
+	_, second := client.Increment(ctx, &counterpb.IncrementRequest{})
+	_, add := client.Add(ctx, &counterpb.AddRequest{Delta: 5})
+	watches := make([]error, 2)
+	for i := range watches {
+		stream, err := client.Watch(ctx, &counterpb.WatchRequest{})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		watches[i] = err
+	}
+
+	// Assert
+	if first != nil || add != nil {
+		t.Errorf("Expected the first increment and the unlimited add to succeed, got %v and %v", first, add)
+	}
+	if status.Code(second) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted for the second increment, got %v", second)
+	}
+	if watches[0] != nil || status.Code(watches[1]) != codes.ResourceExhausted {
+		t.Errorf("Expected only the second watch to be refused, got %v", watches)
+	}
+}
+
+// Test that an increment spooled while the store is down says so in the response
+func TestGRPCIncrementSpooledWhileDown(t *testing.T) {
+	// Arrange
+	durable := &flakyStore{memoryStore: newMemoryStore()}
+	client := counterpb.NewCounterServiceClient(startGRPC(t, durable, nil))
+	offline = newTestSpool(t, filepath.Join(t.TempDir(), "spool.jsonl"), durable)
+	t.Cleanup(func() { offline = nil })
+	durable.down.Store(true)
+
+	// Act
+	c, err := client.Increment(context.Background(), &counterpb.IncrementRequest{})
+
+	// Assert
+	if err != nil || !c.GetQueued() || c.GetOpId() == "" {
+		t.Errorf("Expected a queued increment with an op ID, got %v (err %v)", c, err)
+	}
+}
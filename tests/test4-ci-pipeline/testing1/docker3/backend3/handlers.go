@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// setCORSHeaders lets the Flutter web app (served from another origin) call the API.
+func setCORSHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-API-Key, If-Match, If-None-Match, Prefer, traceparent, tracestate")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag, Warning, Age, Retry-After, Location, Preference-Applied")
+}
+
+// counterIDParam reads the optional ?id= query parameter (default: the default counter).
+func counterIDParam(r *http.Request) (int64, error) {
+	raw := r.URL.Query().Get("id")
+	if raw == "" {
+		return defaultCounterID, nil
+	}
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid counter id %q", raw)
+	}
+	return id, nil
+}
+
+// writeCounter sends a CounterResponse as JSON.
+func writeCounter(w http.ResponseWriter, id, value int64) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CounterResponse{ID: id, Value: value})
+}
+
+// writeCounterVersion is writeCounter with the counter's version, if known.
+func writeCounterVersion(w http.ResponseWriter, id, value, version int64) {
+	resp := CounterResponse{ID: id, Value: value}
+	if version >= 0 {
+		resp.Version = &version
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeStoreError maps a store error to an HTTP status. Unexpected errors
+// are logged with r's trace (see logf) and answered with 500.
+func writeStoreError(w http.ResponseWriter, r *http.Request, prefix string, err error) {
+	if errors.Is(err, errCounterNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errVersionMismatch) {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if errors.Is(err, errOutOfBounds) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errVersionsUnsupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if errors.Is(err, errCircuitOpen) {
+		w.Header().Set("Retry-After", strconv.Itoa(breaker.retryAfter()))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errNoLeader) {
+		// A leader election usually takes well under a second.
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	logf(r.Context(), "%s %s: %s: %v\n", r.Method, r.URL.Path, prefix, err)
+	http.Error(w, prefix+": "+err.Error(), http.StatusInternalServerError)
+}
+
+// counterHandler serves the /counter path: GET reads the counter, PUT overwrites it.
+func counterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		setCounterHandler(w, r)
+		return
+	}
+	getCounterHandler(w, r)
+}
+
+// AddRequest is the body of POST /counter/add.
+type AddRequest struct {
+	Delta int64 `json:"delta"`
+}
+
+// SetRequest is the body of PUT /counter.
+type SetRequest struct {
+	Value int64 `json:"value"`
+}
+
+// addCounterHandler handles POST /counter/add.
+// It adds the (possibly negative) delta from the JSON body and returns the new value.
+// With ?async=true it queues the write instead (see operations.go).
+func addCounterHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := counterIDParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ifVersion, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req AddRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if wantsAsync(r) {
+		acceptOperation(w, r, "add", id, func(ctx context.Context) (int64, int64, error) {
+			return addCounter(ctx, id, req.Delta, ifVersion)
+		})
+		return
+	}
+	value, version, err := addCounter(r.Context(), id, req.Delta, ifVersion)
+	if err != nil {
+		writeStoreError(w, r, "DB update failed", err)
+		return
+	}
+	setETag(w, version)
+	writeCounter(w, id, value)
+}
+
+// setCounterHandler handles PUT /counter.
+// It overwrites the counter with the value from the JSON body, creating it if needed.
+// With If-Match it fails with 412 if someone else wrote the counter since
+// the client read it, instead of silently overwriting their change.
+// With ?async=true it queues the write instead (see operations.go).
+func setCounterHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	id, err := counterIDParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ifVersion, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req SetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if wantsAsync(r) {
+		acceptOperation(w, r, "set", id, func(ctx context.Context) (int64, int64, error) {
+			return setCounter(ctx, id, req.Value, ifVersion)
+		})
+		return
+	}
+	value, version, err := setCounter(r.Context(), id, req.Value, ifVersion)
+	if err != nil {
+		writeStoreError(w, r, "DB update failed", err)
+		return
+	}
+	setETag(w, version)
+	writeCounter(w, id, value)
+}
+
+// sseHeartbeat is how often an idle watch stream sends a comment line,
+// so proxies do not close the connection for inactivity.
+const sseHeartbeat = 15 * time.Second
+
+// closingStreams is closed when the server begins a graceful shutdown, so
+// watch streams end instead of holding it up until the timeout.
+var closingStreams = make(chan struct{})
+
+// watchCounterHandler handles GET /counter/watch.
+// It streams the counter as Server-Sent Events: one "counter" event with the
+// current value, then one per change, until the client disconnects.
+func watchCounterHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := counterIDParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Subscribe before reading so no change can slip in between.
+	updates, stop := changes.subscribe(id)
+	defer stop()
+
+	value, err := store.Get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, "DB query failed", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	rc := http.NewResponseController(w)
+	send := func(value int64) error {
+		data, _ := json.Marshal(CounterResponse{ID: id, Value: value})
+		if _, err := fmt.Fprintf(w, "event: counter\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	if send(value) != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-closingStreams:
+			return
+		case c := <-updates:
+			if send(c.Value) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// CounterList is the response of GET /counters.
+type CounterList struct {
+	Counters []CounterResponse `json:"counters"`
+}
+
+// HistoryResponse is the response of GET /counter/history.
+type HistoryResponse struct {
+	ID      int64          `json:"id"`
+	Entries []HistoryEntry `json:"entries"`
+}
+
+// Limits for GET /counter/history?limit=N.
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 1000
+)
+
+// resetCounterHandler handles POST /counter/reset.
+// It sets the counter back to zero; the old value stays visible in the history.
+// With ?async=true it queues the reset instead (see operations.go).
+func resetCounterHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := counterIDParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ifVersion, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if wantsAsync(r) {
+		acceptOperation(w, r, "reset", id, func(ctx context.Context) (int64, int64, error) {
+			return resetCounter(ctx, id, ifVersion)
+		})
+		return
+	}
+	value, version, err := resetCounter(r.Context(), id, ifVersion)
+	if err != nil {
+		writeStoreError(w, r, "DB update failed", err)
+		return
+	}
+	setETag(w, version)
+	writeCounter(w, id, value)
+}
+
+// resetCounter sets counter id back to zero if its version matches ifVersion.
+func resetCounter(ctx context.Context, id, ifVersion int64) (int64, int64, error) {
+	// Only reset counters that exist; Set on its own would create one.
+	if _, err := store.Get(ctx, id); err != nil {
+		return 0, 0, err
+	}
+	return setCounter(ctx, id, 0, ifVersion)
+}
+
+// listCountersHandler handles GET /counters.
+// It returns every counter and its value.
+func listCountersHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	counters, err := store.List(r.Context())
+	if err != nil {
+		writeStoreError(w, r, "DB query failed", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CounterList{Counters: counters})
+}
+
+// historyHandler handles GET /counter/history.
+// It returns the most recent writes to the counter, newest first (?limit=N, default 50).
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := counterIDParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultHistoryLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxHistoryLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := store.History(r.Context(), id, limit)
+	if err != nil {
+		writeStoreError(w, r, "DB query failed", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HistoryResponse{ID: id, Entries: entries})
+}
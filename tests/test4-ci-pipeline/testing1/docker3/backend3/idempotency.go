@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// idempotencyTTL is how long a stored response can be replayed.
+const idempotencyTTL = 24 * time.Hour
+
+// defaultIdempotencyMaxBytes is the default of IDEMPOTENCY_MAX_BYTES.
+const defaultIdempotencyMaxBytes = 64 << 20
+
+// replayedHeaders are the response headers stored with the body and sent
+// again on replay, besides Content-Type.
+var replayedHeaders = []string{"ETag", "Location", "Retry-After", "Preference-Applied"}
+
+// storedResponse is a response recorded for an Idempotency-Key.
+type storedResponse struct {
+	done    bool // false while the first request is still running
+	status  int
+	header  http.Header // Content-Type and replayedHeaders
+	body    []byte
+	size    int64 // key, header and body bytes, once done
+	expires time.Time
+	elem    *list.Element // in idempotencyCache.order, once done
+}
+
+// idempotencyCache remembers responses to POST/PUT requests that carried an
+// Idempotency-Key header, so a client retrying after a timeout gets the
+// original answer instead of incrementing twice.
+// Responses live in process memory: a retry that lands on another replica
+// is not deduplicated. They take at most maxBytes; beyond that the oldest
+// are forgotten early, and their keys run again if retried.
+type idempotencyCache struct {
+	mu        sync.Mutex
+	responses map[string]*storedResponse
+	order     *list.List // keys of done responses, oldest (first to expire) first
+	bytes     int64      // total size of done responses
+	maxBytes  int64
+}
+
+func newIdempotencyCache(maxBytes int64) *idempotencyCache {
+	return &idempotencyCache{
+		responses: make(map[string]*storedResponse),
+		order:     list.New(),
+		maxBytes:  maxBytes,
+	}
+}
+
+// idempotencyCacheFromEnv reads the memory stored responses may take from
+// IDEMPOTENCY_MAX_BYTES (default 64 MiB).
+func idempotencyCacheFromEnv() (*idempotencyCache, error) {
+	maxBytes := int64(defaultIdempotencyMaxBytes)
+	if raw := os.Getenv("IDEMPOTENCY_MAX_BYTES"); raw != "" {
+		var err error
+		if maxBytes, err = strconv.ParseInt(raw, 10, 64); err != nil || maxBytes < 1 {
+			return nil, fmt.Errorf("invalid IDEMPOTENCY_MAX_BYTES %q, want a size in bytes like 67108864", raw)
+		}
+	}
+	return newIdempotencyCache(maxBytes), nil
+}
+
+// recordingWriter captures what a handler writes while passing it through.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(p)
+	return rw.ResponseWriter.Write(p)
+}
+
+// middleware replays stored responses for repeated Idempotency-Keys.
+// Keys are scoped to the caller, method and URL so two clients picking the
+// same key do not see each other's responses.
+func (c *idempotencyCache) middleware(identity clientIdentity, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPut) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scoped := identity.clientKey(r) + "|" + r.Method + " " + r.URL.String() + "|" + key
+
+		c.mu.Lock()
+		c.sweep(time.Now())
+		if stored, ok := c.responses[scoped]; ok {
+			c.mu.Unlock()
+			if !stored.done {
+				// Retryable: the answer will be there once the first request ends.
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+				return
+			}
+			for name, values := range stored.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.status)
+			w.Write(stored.body)
+			return
+		}
+		entry := &storedResponse{}
+		c.responses[scoped] = entry
+		c.mu.Unlock()
+
+		rec := &recordingWriter{ResponseWriter: w}
+		defer c.finish(scoped, entry, rec)
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// finish stores the recorded response once the handler returns.
+// It runs deferred so a panicking handler does not leave the key stuck "in progress".
+func (c *idempotencyCache) finish(scoped string, entry *storedResponse, rec *recordingWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p := recover(); p != nil {
+		delete(c.responses, scoped)
+		panic(p)
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusOK // the handler returned without writing anything
+	}
+	if rec.status >= 500 {
+		// Server errors are not final: let the retry run the request again.
+		delete(c.responses, scoped)
+		return
+	}
+	entry.done = true
+	entry.status = rec.status
+	entry.header = make(http.Header)
+	entry.size = int64(len(scoped) + rec.body.Len())
+	for _, name := range append(replayedHeaders, "Content-Type") {
+		if values := rec.Header().Values(name); len(values) > 0 {
+			entry.header[name] = values
+			for _, v := range values {
+				entry.size += int64(len(name) + len(v))
+			}
+		}
+	}
+	entry.body = rec.body.Bytes()
+	entry.expires = time.Now().Add(idempotencyTTL)
+	entry.elem = c.order.PushBack(scoped)
+	c.bytes += entry.size
+	for c.bytes > c.maxBytes {
+		c.forget(c.order.Front())
+	}
+}
+
+// sweep drops expired responses. They all live idempotencyTTL, so the
+// expired ones are at the front of c.order. The caller must hold c.mu.
+func (c *idempotencyCache) sweep(now time.Time) {
+	for e := c.order.Front(); e != nil && now.After(c.responses[e.Value.(string)].expires); e = c.order.Front() {
+		c.forget(e)
+	}
+}
+
+// forget drops the done response at e. The caller must hold c.mu.
+func (c *idempotencyCache) forget(e *list.Element) {
+	scoped := c.order.Remove(e).(string)
+	c.bytes -= c.responses[scoped].size
+	delete(c.responses, scoped)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// idempotentPost sends POST url with an Idempotency-Key and returns the
+// response and its body.
+func idempotentPost(t *testing.T, url, key string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, nil)
+	req.Header.Set("Idempotency-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+// Test that a replay carries the original ETag, Location and Retry-After
+func TestIdempotencyReplaysHeaders(t *testing.T) {
+	// Arrange
+	calls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/op", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("ETag", `"7"`)
+		w.Header().Set("Location", "/operations/abc")
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "accepted")
+	})
+	server := httptest.NewServer(newIdempotencyCache(defaultIdempotencyMaxBytes).middleware(clientIdentity{}, mux))
+	defer server.Close()
+
+	// Act
+	idempotentPost(t, server.URL+"/op", "k1")
+	resp, body := idempotentPost(t, server.URL+"/op", "k1")
+
+	// Assert
+	if calls != 1 || resp.StatusCode != http.StatusAccepted || body != "accepted" || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected one call and a replayed 202, got %d calls and %d %q", calls, resp.StatusCode, body)
+	}
+	if resp.Header.Get("ETag") != `"7"` || resp.Header.Get("Location") != "/operations/abc" || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("Expected the original headers, got %v", resp.Header)
+	}
+}
+
+// Test that a retry overtaking the first request is told to retry later
+func TestIdempotencyInProgress(t *testing.T) {
+	// Arrange
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/op", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	server := httptest.NewServer(newIdempotencyCache(defaultIdempotencyMaxBytes).middleware(clientIdentity{}, mux))
+	defer server.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		idempotentPost(t, server.URL+"/op", "k1")
+	}()
+	<-started
+
+	// Act
+	resp, _ := idempotentPost(t, server.URL+"/op", "k1")
+	close(release)
+	<-done
+
+	// Assert
+	if resp.StatusCode != http.StatusConflict || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected 409 with Retry-After, got %d %v", resp.StatusCode, resp.Header)
+	}
+}
+
+// Test that the oldest responses are forgotten once the cache is full
+func TestIdempotencyEvictsOldest(t *testing.T) {
+	// Arrange
+	calls := map[string]int{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/op", func(w http.ResponseWriter, r *http.Request) {
+		calls[r.Header.Get("Idempotency-Key")]++
+		fmt.Fprint(w, strings.Repeat("x", 100))
+	})
+	cache := newIdempotencyCache(350)
+	server := httptest.NewServer(cache.middleware(clientIdentity{}, mux))
+	defer server.Close()
+
+	// Act
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k1", "k4"} {
+		idempotentPost(t, server.URL+"/op", key)
+	}
+
+	// Assert
+	if calls["k1"] != 2 || calls["k4"] != 1 {
+		t.Errorf("Expected k1 to run again after eviction and k4 to be replayed, got %v", calls)
+	}
+	if cache.bytes > 350 || len(cache.responses) != cache.order.Len() {
+		t.Errorf("Expected at most 350 bytes in sync with the order list, got %d bytes, %d responses and %d keys", cache.bytes, len(cache.responses), cache.order.Len())
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GET /counter?wait=30s&since_version=N is a long poll, for clients that
+// cannot keep /counter/watch or /ws open (typically behind a proxy that
+// buffers or cuts streamed responses). If the counter's version is already
+// past N the answer comes at once; otherwise the request is held until the
+// change hub reports a write that moves it past N, or until wait runs out.
+// Either way the answer is the counter with its version, which the client
+// passes as since_version on its next poll:
+//
+//	GET /counter?wait=30s&since_version=7  -> {"id": 1, "value": 42, "version": 8}
+//	GET /counter?wait=30s&since_version=8  -> (30s later) {"id": 1, "value": 42, "version": 8}
+//
+// Without since_version the request waits for the next write. Every held
+// request takes one of LONG_POLL_MAX_WAITERS slots; when they are all taken
+// further polls get 503 with Retry-After instead of piling up goroutines.
+
+// Defaults for LONG_POLL_MAX_WAITERS and LONG_POLL_MAX_WAIT.
+const (
+	defaultLongPollWaiters = 1000
+	defaultLongPollMaxWait = 60 * time.Second
+)
+
+// longPoller bounds the requests waiting for a change.
+type longPoller struct {
+	slots   chan struct{} // one per waiting request
+	maxWait time.Duration // longer waits are cut to this
+
+	waiters prometheus.Gauge
+	polls   *prometheus.CounterVec
+}
+
+// longPolls serves GET /counter?wait=. main always sets it.
+var longPolls *longPoller
+
+func newLongPoller(maxWaiters int, maxWait time.Duration) *longPoller {
+	return &longPoller{
+		slots:   make(chan struct{}, maxWaiters),
+		maxWait: maxWait,
+		waiters: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "counter_long_poll_waiters",
+			Help: "Requests waiting in GET /counter?wait= for a change.",
+		}),
+		polls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "counter_long_polls_total",
+			Help: "Long polls by outcome: changed (at once or after waiting), timeout or rejected (no free slot).",
+		}, []string{"outcome"}),
+	}
+}
+
+// longPollerFromEnv reads the number of requests that may wait at once
+// from LONG_POLL_MAX_WAITERS (default 1000) and the longest wait a client
+// may ask for from LONG_POLL_MAX_WAIT (default 60s).
+func longPollerFromEnv() (*longPoller, error) {
+	maxWaiters := defaultLongPollWaiters
+	if raw := os.Getenv("LONG_POLL_MAX_WAITERS"); raw != "" {
+		var err error
+		if maxWaiters, err = strconv.Atoi(raw); err != nil || maxWaiters < 1 {
+			return nil, fmt.Errorf("invalid LONG_POLL_MAX_WAITERS %q, want a count like 1000", raw)
+		}
+	}
+	maxWait := defaultLongPollMaxWait
+	if raw := os.Getenv("LONG_POLL_MAX_WAIT"); raw != "" {
+		var err error
+		if maxWait, err = time.ParseDuration(raw); err != nil || maxWait <= 0 {
+			return nil, fmt.Errorf("invalid LONG_POLL_MAX_WAIT %q, want a duration like 60s", raw)
+		}
+	}
+	return newLongPoller(maxWaiters, maxWait), nil
+}
+
+// acquire takes a slot if one is free.
+func (p *longPoller) acquire() bool {
+	select {
+	case p.slots <- struct{}{}:
+		p.waiters.Inc()
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *longPoller) release() {
+	<-p.slots
+	p.waiters.Dec()
+}
+
+// wantsLongPoll reports whether a GET /counter asks to wait for a change.
+func wantsLongPoll(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Has("wait") || q.Has("since_version")
+}
+
+// longPollParams reads ?wait= (cut to maxWait) and ?since_version=, which
+// is anyVersion when absent.
+func longPollParams(r *http.Request, maxWait time.Duration) (time.Duration, int64, error) {
+	q := r.URL.Query()
+	raw := q.Get("wait")
+	if raw == "" {
+		return 0, 0, fmt.Errorf("since_version needs wait, like ?wait=30s&since_version=N")
+	}
+	wait, err := time.ParseDuration(raw)
+	if err != nil || wait <= 0 {
+		return 0, 0, fmt.Errorf("invalid wait %q, want a duration like 30s", raw)
+	}
+	wait = min(wait, maxWait)
+
+	since := anyVersion
+	if raw := q.Get("since_version"); raw != "" {
+		if since, err = strconv.ParseInt(raw, 10, 64); err != nil || since < 0 {
+			return 0, 0, fmt.Errorf("invalid since_version %q, want a version like 7", raw)
+		}
+	}
+	return wait, since, nil
+}
+
+// longPollCounter answers GET /counter?wait= for counter id once its
+// version passes since_version, wait runs out or the server shuts down.
+func longPollCounter(w http.ResponseWriter, r *http.Request, id int64) {
+	p := longPolls
+	wait, since, err := longPollParams(r, p.maxWait)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Subscribe before reading so no change can slip in between.
+	updates, stop := changes.subscribe(id)
+	defer stop()
+
+	value, version, err := getCounter(r.Context(), id)
+	if err == nil && version < 0 {
+		err = errVersionsUnsupported
+	}
+	if err != nil {
+		writeStoreError(w, r, "DB query failed", err)
+		return
+	}
+	if since == anyVersion {
+		since = version
+	}
+
+	outcome := "changed"
+	if version <= since {
+		if !p.acquire() {
+			p.polls.WithLabelValues("rejected").Inc()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests are waiting for changes", http.StatusServiceUnavailable)
+			return
+		}
+		defer p.release()
+
+		timeout := time.NewTimer(wait)
+		defer timeout.Stop()
+	waiting:
+		for version <= since {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-closingStreams:
+				outcome = "timeout"
+				break waiting
+			case <-timeout.C:
+				outcome = "timeout"
+				break waiting
+			case c := <-updates:
+				value, version = c.Value, c.Version
+			}
+		}
+	}
+	p.polls.WithLabelValues(outcome).Inc()
+
+	setETag(w, version)
+	writeCounterVersion(w, id, value, version)
+}
+
+func (p *longPoller) Describe(ch chan<- *prometheus.Desc) {
+	p.waiters.Describe(ch)
+	p.polls.Describe(ch)
+}
+
+func (p *longPoller) Collect(ch chan<- prometheus.Metric) {
+	p.waiters.Collect(ch)
+	p.polls.Collect(ch)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// useLongPolls turns long polling on for the duration of the test.
+func useLongPolls(t *testing.T, maxWaiters int) *longPoller {
+	t.Helper()
+	p, prev := newLongPoller(maxWaiters, 5*time.Second), longPolls
+	longPolls = p
+	t.Cleanup(func() { longPolls = prev })
+	return p
+}
+
+// poll sends GET url and decodes the counter it answers with.
+func poll(t *testing.T, url string) (*http.Response, CounterResponse) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Error(err)
+		return nil, CounterResponse{}
+	}
+	defer resp.Body.Close()
+	var counter CounterResponse
+	if resp.StatusCode == http.StatusOK {
+		json.NewDecoder(resp.Body).Decode(&counter)
+	}
+	return resp, counter
+}
+
+// Test that a waiting poll is answered by a write, and one already behind
+// is answered at once
+func TestLongPollWakesOnChange(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	p := useLongPolls(t, 10)
+	done := make(chan CounterResponse)
+	go func() {
+		_, counter := poll(t, server.URL+"/counter?wait=5s&since_version=0")
+		done <- counter
+	}()
+	waitFor(t, "the poll to wait", func() bool { return testutil.ToFloat64(p.waiters) == 1 })
+
+	// Act
+	sendWithHeader(t, "POST", server.URL+"/counter/increment", "", "", "")
+	woken := <-done
+	start := time.Now()
+	resp, behind := poll(t, server.URL+"/counter?wait=5s&since_version=0")
+
+	// Assert
+	if woken.Value != 1 || woken.Version == nil || *woken.Version != 1 {
+		t.Errorf("Expected value 1 at version 1, got %+v", woken)
+	}
+	if behind.Version == nil || *behind.Version != 1 || resp.Header.Get("ETag") != `"1"` || time.Since(start) > time.Second {
+		t.Errorf("Expected version 1 at once, got %+v (ETag %s) after %v", behind, resp.Header.Get("ETag"), time.Since(start))
+	}
+	if got := testutil.ToFloat64(p.polls.WithLabelValues("changed")); got != 2 || testutil.ToFloat64(p.waiters) != 0 {
+		t.Errorf("Expected 2 changed polls and no waiters, got %v and %v", got, testutil.ToFloat64(p.waiters))
+	}
+}
+
+// Test that a poll without a change answers with the same version when
+// wait runs out
+func TestLongPollTimeout(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	p := useLongPolls(t, 10)
+
+	// Act
+	start := time.Now()
+	resp, counter := poll(t, server.URL+"/counter?wait=50ms")
+
+	// Assert
+	if resp.StatusCode != http.StatusOK || counter.Version == nil || *counter.Version != 0 {
+		t.Errorf("Expected 200 with version 0, got %d %+v", resp.StatusCode, counter)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the poll to wait 50ms, got %v", elapsed)
+	}
+	if got := testutil.ToFloat64(p.polls.WithLabelValues("timeout")); got != 1 {
+		t.Errorf("Expected 1 timed out poll, got %v", got)
+	}
+}
+
+// Test that polls beyond LONG_POLL_MAX_WAITERS are turned away, and that
+// bad parameters are rejected
+func TestLongPollLimits(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	p := useLongPolls(t, 1)
+	done := make(chan struct{})
+	go func() {
+		poll(t, server.URL+"/counter?wait=5s")
+		close(done)
+	}()
+	waitFor(t, "the poll to wait", func() bool { return testutil.ToFloat64(p.waiters) == 1 })
+
+	// Act
+	full, _ := poll(t, server.URL+"/counter?wait=5s")
+	sendWithHeader(t, "POST", server.URL+"/counter/increment", "", "", "")
+	<-done
+	badWait, _ := poll(t, server.URL+"/counter?wait=soon")
+	noWait, _ := poll(t, server.URL+"/counter?since_version=3")
+	missing, _ := poll(t, server.URL+"/counter?id=99&wait=1s")
+
+	// Assert
+	if full.StatusCode != http.StatusServiceUnavailable || full.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After while the only slot is taken, got %d", full.StatusCode)
+	}
+	if badWait.StatusCode != http.StatusBadRequest || noWait.StatusCode != http.StatusBadRequest || missing.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 400, 400 and 404, got %d, %d and %d", badWait.StatusCode, noWait.StatusCode, missing.StatusCode)
+	}
+	if got := testutil.ToFloat64(p.polls.WithLabelValues("rejected")); got != 1 {
+		t.Errorf("Expected 1 rejected poll, got %v", got)
+	}
+}
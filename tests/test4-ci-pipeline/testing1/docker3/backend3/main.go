@@ -2,25 +2,31 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // CounterResponse defines the JSON structure returned to clients.
-// Example response: { "value": 5 }
+// Example response: { "id": 1, "value": 5 }
 type CounterResponse struct {
-	Value int `json:"value"`
+	ID      int64  `json:"id"`
+	Value   int64  `json:"value"`
+	Version *int64 `json:"version,omitempty"` // GET /counter only, when the store tracks versions
 }
 
-// db is our global database connection.
-// In production you’d usually use a connection pool, but here a single
-// connection is enough for learning purposes.
-var db *pgx.Conn
+// db is our global database connection pool.
+// A single pgx.Conn is not safe for concurrent use, and every request (plus
+// the rate limiter) talks to Postgres at the same time, so we use a pool.
+var db *pgxpool.Pool
 
 func main() {
 	// 1. Load environment variables from .env file (for local dev).
@@ -31,32 +37,332 @@ func main() {
 		log.Println("No .env file found, falling back to system environment variables")
 	}
 
-	// 2. Read database connection string from environment.
+	// 2. Set up tracing (see tracing.go). Buffered spans are flushed on shutdown.
+	shutdownTracing, err := tracingFromEnv(context.Background())
+	if err != nil {
+		log.Fatalf("Invalid tracing configuration: %v\n", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// Read server port from environment (default: 8080). Cluster mode
+	// needs it to tell other nodes where our HTTP API is.
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	// Keep rollup buckets (see series.go) as long as configured.
+	if err := rollupRetentionFromEnv(); err != nil {
+		log.Fatalf("Invalid rollup configuration: %v\n", err)
+	}
+
+	// 3. Pick where counters live: Postgres (default), process memory, or a
+	// Raft cluster of backend instances (see raft.go).
+	// STORE=memory needs no database, which is handy for demos and tests.
+	var schedules scheduleRunner // fires scheduled resets, unless STORE=raft
+	var feed outboxStore         // queues change events, unless STORE=raft
+	switch os.Getenv("STORE") {
+	case "memory":
+		memory := newMemoryStore()
+		store, schedules, feed = memory, memory, memory
+		log.Println("Using the in-memory store, counters reset on restart")
+	case "raft":
+		cluster, err = raftStoreFromEnv(port)
+		if err != nil {
+			log.Fatalf("Failed to start the Raft node: %v\n", err)
+		}
+		store = cluster
+	default:
+		connectDatabase()
+		defer db.Close()
+		// Forward writes made by other replicas to our watchers.
+		go listenForChanges(context.Background())
+		// Roll the history up into time series buckets (see series.go).
+		rollupInterval := time.Minute
+		if raw := os.Getenv("ROLLUP_INTERVAL"); raw != "" {
+			rollupInterval, err = time.ParseDuration(raw)
+			if err != nil || rollupInterval <= 0 {
+				log.Fatalf("Invalid ROLLUP_INTERVAL %q, want a duration like 1m\n", raw)
+			}
+		}
+		go rollUpEvery(context.Background(), rollupInterval)
+		schedules, feed = postgresStore{}, postgresStore{}
+		// Fail fast while the database is down (see breaker.go).
+		breaker, err = breakerFromEnv(store)
+		if err != nil {
+			log.Fatalf("Invalid circuit breaker configuration: %v\n", err)
+		}
+		if breaker != nil {
+			prometheus.MustRegister(breaker)
+			store = breaker
+		}
+	}
+
+	// Reset counters on their cron schedules (see schedules.go).
+	if schedules != nil {
+		scheduler, err := schedulerFromEnv(schedules)
+		if err != nil {
+			log.Fatalf("Invalid reset schedule configuration: %v\n", err)
+		}
+		prometheus.MustRegister(scheduler)
+		go scheduler.run(context.Background())
+	}
+
+	// Optionally keep increments in a local file while the store is down,
+	// and replay them once it is back (see spool.go).
+	offline, err = spoolFromEnv(store)
+	if err != nil {
+		log.Fatalf("Invalid spool configuration: %v\n", err)
+	}
+	if offline != nil {
+		prometheus.MustRegister(offline)
+		log.Printf("Spooling increments to %s while the store is down\n", offline.path)
+	}
+
+	// Queue writes sent with ?async=true (see operations.go).
+	operations, err = operationQueueFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid async operation configuration: %v\n", err)
+	}
+	if operations != nil {
+		prometheus.MustRegister(operations)
+	}
+
+	// Count increments in sliding windows for GET /counter/rate (see rates.go).
+	rates, err = rateTrackerFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid rate window configuration: %v\n", err)
+	}
+	if rates != nil {
+		prometheus.MustRegister(rates)
+	}
+
+	// Notify webhooks when counters cross alert thresholds (see alerts.go).
+	alerts, err = alerterFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid alert configuration: %v\n", err)
+	}
+	if alerts != nil {
+		prometheus.MustRegister(alerts)
+	}
+
+	// Watch and increment counters over one WebSocket (see websocket.go).
+	websockets, err = wsServerFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid WebSocket configuration: %v\n", err)
+	}
+	prometheus.MustRegister(websockets)
+
+	// Let GET /counter?wait= hold requests until a change (see longpoll.go).
+	longPolls, err = longPollerFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid long poll configuration: %v\n", err)
+	}
+	prometheus.MustRegister(longPolls)
+
+	// Publish every change as a CloudEvent through the outbox (see outbox.go).
+	outbox, err = outboxRelayFromEnv(feed)
+	if err != nil {
+		log.Fatalf("Invalid outbox configuration: %v\n", err)
+	}
+	if outbox != nil {
+		if err := feed.EnableOutbox(context.Background()); err != nil {
+			log.Fatalf("Failed to turn the outbox on: %v\n", err)
+		}
+		prometheus.MustRegister(outbox)
+		go outbox.run(context.Background())
+	}
+
+	// Optionally buffer increments and write them in batches (see writebehind.go).
+	var writeBehind *writeBehindStore
+	if raw := os.Getenv("WRITE_BEHIND_INTERVAL"); raw != "" {
+		interval, err := time.ParseDuration(raw)
+		if err != nil || interval <= 0 {
+			log.Fatalf("Invalid WRITE_BEHIND_INTERVAL %q, want a duration like 250ms\n", raw)
+		}
+		writeBehind = newWriteBehindStore(store, interval)
+		prometheus.MustRegister(writeBehind)
+		store = writeBehind
+		log.Printf("Buffering increments, writing them every %v\n", interval)
+	}
+
+	// Optionally answer repeated reads from memory (see cache.go).
+	if raw := os.Getenv("CACHE_TTL"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl <= 0 {
+			log.Fatalf("Invalid CACHE_TTL %q, want a duration like 1s\n", raw)
+		}
+		cache := newCachedStore(store, ttl)
+		prometheus.MustRegister(cache)
+		store = cache
+		log.Printf("Caching counter reads for %v\n", ttl)
+	}
+
+	// 4. Load the TLS settings and the per-client rate limits shared by the
+	// HTTP and gRPC servers (and /ws).
+	tlsConfig, err := tlsConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %v\n", err)
+	}
+	identity, err := clientIdentityFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid client identity configuration: %v\n", err)
+	}
+	rateLimits, err = rateLimiterFromEnv(identity)
+	if err != nil {
+		log.Fatalf("Invalid rate limit configuration: %v\n", err)
+	}
+	websockets.limits = rateLimits // /ws increments spend the same tokens
+	if rateLimits != nil && cluster != nil {
+		rateLimits.forwardKey = cluster.apiKey // followers limited these already
+	}
+
+	// 5. Serve the gRPC API (see grpc.go) on GRPC_PORT, or on the HTTP port
+	// when GRPC_PORT is "shared".
+	grpcPort := os.Getenv("GRPC_PORT")
+	grpcServer := newGRPCServer(tlsConfig, grpcPort == "shared", rateLimits)
+	if grpcPort != "" && grpcPort != "shared" {
+		go serveGRPC(grpcServer, grpcPort)
+	}
+
+	// 6. Register HTTP routes (see routes.go for the full list).
+	registerRoutes(http.DefaultServeMux)
+
+	// 7. Replay responses for retried requests (Idempotency-Key header), and
+	// wrap every route with per-client rate limiting.
+	idempotency, err := idempotencyCacheFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid idempotency configuration: %v\n", err)
+	}
+	handler := idempotency.middleware(identity, http.DefaultServeMux)
+	if rateLimits != nil {
+		handler = rateLimitMiddleware(rateLimits, handler)
+	}
+
+	// 8. Identify callers by their client certificate when mTLS is enabled.
+	// This runs first so the rate limiter can key on the principal.
+	handler = clientCertMiddleware(handler)
+
+	// 9. Trace every HTTP request, continuing the caller's trace if it sent
+	// a traceparent header. gRPC calls on the shared port skip this.
+	handler = tracingMiddleware(handler)
+
+	// 10. Send gRPC calls on the shared port to the gRPC server.
+	if grpcPort == "shared" {
+		handler = grpcMultiplexer(grpcServer, handler)
+	}
+
+	// 11. In cluster mode, send HTTP clients to the leader instead of
+	// forwarding their requests, if RAFT_FOLLOWERS=redirect.
+	if cluster != nil && cluster.redirect {
+		handler = cluster.redirectMiddleware(handler)
+	}
+
+	// 12. Start the server, over TLS when a certificate is configured.
+	server := &http.Server{Addr: ":" + port, Handler: handler, TLSConfig: tlsConfig}
+	if grpcPort == "shared" {
+		// gRPC needs HTTP/2; allow it without TLS too (h2c).
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			log.Printf("Server running at https://localhost:%s\n", port)
+			// The certificate comes from TLSConfig, so the file arguments stay empty.
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Server running at http://localhost:%s\n", port)
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// 13. On Ctrl-C or SIGTERM (docker stop), finish in-flight requests, end
+	// watch streams, and apply queued operations and buffered increments
+	// before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	close(closingStreams)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Graceful shutdown timed out: %v\n", err)
+	}
+	if grpcPort != "" && grpcPort != "shared" {
+		grpcServer.GracefulStop()
+	}
+	if operations != nil {
+		if err := operations.Close(shutdownCtx); err != nil {
+			log.Printf("Lost async operations: %v\n", err)
+		}
+	}
+	if writeBehind != nil {
+		if err := writeBehind.Close(shutdownCtx); err != nil {
+			log.Printf("Lost buffered increments: %v\n", err)
+		}
+	}
+	if outbox != nil {
+		if err := outbox.Close(shutdownCtx); err != nil {
+			log.Printf("Stopping the outbox relay failed: %v\n", err)
+		}
+	}
+	if alerts != nil {
+		if err := alerts.Close(shutdownCtx); err != nil {
+			log.Printf("Lost alert webhooks: %v\n", err)
+		}
+	}
+	if offline != nil {
+		if err := offline.Close(); err != nil {
+			log.Printf("Closing the spool failed: %v\n", err)
+		}
+	}
+	if cluster != nil {
+		if err := cluster.Close(); err != nil {
+			log.Printf("Raft shutdown failed: %v\n", err)
+		}
+	}
+}
+
+// connectDatabase opens the global db pool and makes sure the counters table
+// exists with a row for the default counter. It exits the program on failure.
+func connectDatabase() {
+	// 1. Read database connection string from environment.
 	dsn := os.Getenv("DATABASE_URL")
 	if dsn == "" {
 		log.Fatal("❌ DATABASE_URL environment variable not set")
 	}
 
-	// 3. Connect to Postgres using pgx.
-	var err error
-	db, err = pgx.Connect(context.Background(), dsn)
+	// 2. Connect to Postgres using a pgx connection pool.
+	// Every query gets a tracing span (see queryTracer in tracing.go).
+	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		log.Fatalf("Invalid DATABASE_URL: %v\n", err)
+	}
+	config.ConnConfig.Tracer = queryTracer{}
+	db, err = pgxpool.NewWithConfig(context.Background(), config)
 	if err != nil {
 		log.Fatalf("Unable to connect to database: %v\n", err)
 	}
-	defer db.Close(context.Background())
 	log.Println("Connected to Postgres")
 
-	// 4. Create the counters table if it doesn't exist
+	// 3. Create the counters table if it doesn't exist
 	_, err = db.Exec(context.Background(),
 		`CREATE TABLE IF NOT EXISTS counters (
 			id INTEGER PRIMARY KEY,
-			value INTEGER NOT NULL
+			value BIGINT NOT NULL
 		)`)
 	if err != nil {
 		log.Fatalf("Failed to create counters table: %v\n", err)
 	}
 
-	// 5. Ensure the counters table has at least one row with id=1.
+	// 4. Ensure the counters table has at least one row with id=1.
 	// This way our GET/POST endpoints always have something to work with.
 	_, err = db.Exec(context.Background(),
 		`INSERT INTO counters (id, value) VALUES (1, 0)
@@ -65,28 +371,59 @@ func main() {
 		log.Fatalf("Failed to initialize counters table: %v\n", err)
 	}
 
-	// 5. Register HTTP routes.
-	http.HandleFunc("/counter", getCounterHandler)
-	http.HandleFunc("/counter/increment", incrementCounterHandler)
+	// 5. Create the history table that logs every write.
+	if err := createHistoryTable(context.Background()); err != nil {
+		log.Fatalf("Failed to create counter_history table: %v\n", err)
+	}
+
+	// 6. Add the tables for sharded counters (see shards.go).
+	if err := createShardTable(context.Background()); err != nil {
+		log.Fatalf("Failed to create counter_shards table: %v\n", err)
+	}
 
-	// 6. Read server port from environment (default: 8080).
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// 7. Add the version columns behind ETags and If-Match (see versions.go).
+	if err := createVersionColumns(context.Background()); err != nil {
+		log.Fatalf("Failed to add counter version columns: %v\n", err)
+	}
+
+	// 8. Add the table that makes spool replays apply once (see spool.go).
+	if err := createAppliedOpsTable(context.Background()); err != nil {
+		log.Fatalf("Failed to create counter_applied_ops table: %v\n", err)
 	}
 
-	// 7. Start the HTTP server.
-	log.Printf("Server running at http://localhost:%s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	// 9. Add the tables behind GET /counter/series (see series.go).
+	if err := createRollupTables(context.Background()); err != nil {
+		log.Fatalf("Failed to create counter rollup tables: %v\n", err)
+	}
+
+	// 10. Widen counters.value to BIGINT and add the bounds columns (see bounds.go).
+	if err := createBoundsColumns(context.Background()); err != nil {
+		log.Fatalf("Failed to add the counter bounds columns: %v\n", err)
+	}
+
+	// 11. Add the table of reset schedules (see schedules.go).
+	if err := createScheduleTable(context.Background()); err != nil {
+		log.Fatalf("Failed to create counter_schedules table: %v\n", err)
+	}
+
+	// 12. Add the change event outbox (see outbox.go). Writes queue events
+	// once a replica with OUTBOX_SINKS turned it on, but their statement
+	// names the tables either way.
+	if err := createOutboxTables(context.Background()); err != nil {
+		log.Fatalf("Failed to create counter_outbox tables: %v\n", err)
+	}
 }
 
 // getCounterHandler handles GET /counter.
-// It queries the database and returns the current counter value as JSON.
+// It reads the store and returns the current counter value as JSON.
+// Pass ?id=N to read a counter other than the default one.
+// The ETag header carries the counter's version; If-None-Match gets a 304
+// when the counter has not changed. While the circuit breaker is open it
+// answers with the last known value and a Warning header. With ?wait= it
+// long-polls for a change instead (see longpoll.go).
 func getCounterHandler(w http.ResponseWriter, r *http.Request) {
     // Add CORS headers
-    w.Header().Set("Access-Control-Allow-Origin", "*")
-    w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-    w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+    setCORSHeaders(w)
     
     if r.Method == http.MethodOptions {
         return // Handle preflight requests
@@ -97,23 +434,41 @@ func getCounterHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    var value int
-    err := db.QueryRow(context.Background(),
-        "SELECT value FROM counters WHERE id=1").Scan(&value)
+    id, err := counterIDParam(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if wantsLongPoll(r) {
+        longPollCounter(w, r, id)
+        return
+    }
+
+    value, version, err := getCounter(r.Context(), id)
+    if errors.Is(err, errCircuitOpen) && serveStale(w, id) {
+        return
+    }
     if err != nil {
-        http.Error(w, "DB query failed: "+err.Error(), http.StatusInternalServerError)
+        writeStoreError(w, r, "DB query failed", err)
         return
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(CounterResponse{Value: value})
+    setETag(w, version)
+    if notModified(w, r, version) {
+        return
+    }
+    writeCounterVersion(w, id, value, version)
 }
 
+// incrementCounterHandler handles POST /counter/increment.
+// It adds one to the counter (?id=N, default 1) and returns the new value.
+// With If-Match it only increments if the counter still has that ETag.
+// With SPOOL_FILE set, an increment the store cannot take right now is
+// spooled and answered with 202. With ?async=true it is queued instead
+// (see operations.go).
 func incrementCounterHandler(w http.ResponseWriter, r *http.Request) {
     // Add CORS headers
-    w.Header().Set("Access-Control-Allow-Origin", "*")
-    w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-    w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+    setCORSHeaders(w)
     
     if r.Method == http.MethodOptions {
         return // Handle preflight requests
@@ -124,14 +479,33 @@ func incrementCounterHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    var value int
-    err := db.QueryRow(context.Background(),
-        "UPDATE counters SET value = value + 1 WHERE id=1 RETURNING value").Scan(&value)
+    id, err := counterIDParam(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    ifVersion, err := ifMatchVersion(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if wantsAsync(r) {
+        acceptOperation(w, r, "increment", id, func(ctx context.Context) (int64, int64, error) {
+            return addCounter(ctx, id, 1, ifVersion)
+        })
+        return
+    }
+    value, version, err := addCounter(r.Context(), id, 1, ifVersion)
+    if err != nil && ifVersion == anyVersion && spoolIncrement(w, r, id, err) {
+        return
+    }
     if err != nil {
-        http.Error(w, "DB update failed: "+err.Error(), http.StatusInternalServerError)
+        writeStoreError(w, r, "DB update failed", err)
         return
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(CounterResponse{Value: value})
+    setETag(w, version)
+    writeCounter(w, id, value)
 }
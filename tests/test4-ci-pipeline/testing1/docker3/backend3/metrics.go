@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics serves everything registered with the default Prometheus
+// registry: Go runtime and process stats, plus the collectors main
+// registers (e.g. the write-behind buffer, the read cache, the circuit
+// breaker and the increment spool).
+var metrics = promhttp.Handler()
+
+// metricsHandler handles GET /metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics.ServeHTTP(w, r)
+}
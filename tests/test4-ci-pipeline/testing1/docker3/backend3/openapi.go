@@ -0,0 +1,42 @@
+package main
+
+import (
+	_ "embed" // For embedding the spec and docs page into the binary
+	"net/http"
+)
+
+// The OpenAPI document and docs page are compiled into the binary,
+// so the Docker image does not need any extra files.
+var (
+	//go:embed openapi.json
+	openAPISpec []byte
+
+	//go:embed docs.html
+	docsPage []byte
+)
+
+// openAPIHandler handles GET /openapi.json.
+// It serves the hand-maintained OpenAPI 3 document describing every endpoint.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// docsHandler handles GET /docs.
+// It serves a self-contained page that renders /openapi.json. The page
+// loads nothing from other hosts, and its Content-Security-Policy keeps it
+// that way.
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// schemaStructs maps every schema in components.schemas to the Go type
+// the handlers encode or decode. Add new types here and to openapi.json.
+var schemaStructs = map[string]any{
+	"CounterResponse":  CounterResponse{},
+	"CounterList":      CounterList{},
+	"HistoryEntry":     HistoryEntry{},
+	"HistoryResponse":  HistoryResponse{},
+	"AddRequest":       AddRequest{},
+	"SetRequest":       SetRequest{},
+	"ShardsRequest":    ShardsRequest{},
+	"ShardsResponse":   ShardsResponse{},
+	"JoinRequest":      JoinRequest{},
+	"RemoveRequest":    RemoveRequest{},
+	"ClusterMember":    ClusterMember{},
+	"ClusterStatus":    ClusterStatus{},
+	"ReadyResponse":    ReadyResponse{},
+	"QueuedResponse":   QueuedResponse{},
+	"SpoolStatus":      SpoolStatus{},
+	"Operation":        Operation{},
+	"SeriesPoint":      SeriesPoint{},
+	"SeriesResponse":   SeriesResponse{},
+	"RateResponse":     RateResponse{},
+	"BoundsRequest":    BoundsRequest{},
+	"BoundsResponse":   BoundsResponse{},
+	"ResetSchedule":    ResetSchedule{},
+	"ScheduleRequest":  ScheduleRequest{},
+	"AlertRule":        AlertRule{},
+	"AlertRuleRequest": AlertRuleRequest{},
+	"AlertRuleList":    AlertRuleList{},
+	"AlertEvent":       AlertEvent{},
+	"DeadLetter":       DeadLetter{},
+	"DeadLetterList":   DeadLetterList{},
+	"WSMessage":        WSMessage{},
+}
+
+// openAPIDoc is the subset of the OpenAPI document the tests look at.
+type openAPIDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]openAPISchema `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPISchema struct {
+	Type       string                   `json:"type"`
+	Ref        string                   `json:"$ref"`
+	Required   []string                 `json:"required"`
+	Properties map[string]openAPISchema `json:"properties"`
+	Items      *openAPISchema           `json:"items"`
+}
+
+// httpMethods are the operation keys allowed in an OpenAPI path item.
+var httpMethods = map[string]bool{
+	"get": true, "put": true, "post": true, "delete": true,
+	"options": true, "head": true, "patch": true, "trace": true,
+}
+
+func loadSpec(t *testing.T) openAPIDoc {
+	t.Helper()
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+	return doc
+}
+
+// Test that every registered route is documented, and nothing else is
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	doc := loadSpec(t)
+
+	registered := make(map[string]bool)
+	for _, rt := range apiRoutes() {
+		registered[rt.path] = true
+		ops, ok := doc.Paths[rt.path]
+		if !ok {
+			t.Errorf("Route %s is registered but missing from openapi.json", rt.path)
+			continue
+		}
+		var want []string
+		for _, m := range rt.methods {
+			want = append(want, strings.ToLower(m))
+		}
+		var got []string
+		for m := range ops {
+			if httpMethods[m] { // skip path-level keys like "parameters"
+				got = append(got, m)
+			}
+		}
+		sort.Strings(want)
+		sort.Strings(got)
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("Route %s: registered methods %v, documented methods %v", rt.path, want, got)
+		}
+	}
+
+	for path := range doc.Paths {
+		if !registered[path] {
+			t.Errorf("openapi.json documents %s but no such route is registered", path)
+		}
+	}
+}
+
+// Test that each request/response struct has exactly the documented JSON fields and types
+func TestOpenAPIMatchesSchemaStructs(t *testing.T) {
+	doc := loadSpec(t)
+
+	for name := range doc.Components.Schemas {
+		if _, ok := schemaStructs[name]; !ok {
+			t.Errorf("Schema %s has no Go struct in schemaStructs", name)
+		}
+	}
+	for name, value := range schemaStructs {
+		schema, ok := doc.Components.Schemas[name]
+		if !ok {
+			t.Errorf("Struct %s is missing from components.schemas", name)
+			continue
+		}
+		compareSchema(t, name, reflect.TypeOf(value), schema, doc)
+	}
+}
+
+// compareSchema checks that a Go type and an OpenAPI schema describe the same JSON.
+func compareSchema(t *testing.T, where string, typ reflect.Type, schema openAPISchema, doc openAPIDoc) {
+	t.Helper()
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		schema = doc.Components.Schemas[name]
+	}
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	if want := jsonType(typ); want != schema.Type {
+		t.Errorf("%s: Go type %s encodes as %q, spec says %q", where, typ, want, schema.Type)
+		return
+	}
+	switch {
+	case typ.Kind() == reflect.Slice && schema.Items != nil:
+		compareSchema(t, where+"[]", typ.Elem(), *schema.Items, doc)
+	case typ.Kind() == reflect.Struct && typ != reflect.TypeOf(time.Time{}):
+		fields := make(map[string]bool)
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			tag := f.Tag.Get("json")
+			fieldName, opts, _ := strings.Cut(tag, ",")
+			if !f.IsExported() || fieldName == "-" {
+				continue
+			}
+			if fieldName == "" {
+				fieldName = f.Name
+			}
+			fields[fieldName] = true
+
+			prop, ok := schema.Properties[fieldName]
+			if !ok {
+				t.Errorf("%s.%s is not documented", where, fieldName)
+				continue
+			}
+			compareSchema(t, where+"."+fieldName, f.Type, prop, doc)
+
+			required := false
+			for _, r := range schema.Required {
+				required = required || r == fieldName
+			}
+			if omitted := strings.Contains(opts, "omitempty"); omitted == required {
+				t.Errorf("%s.%s: omitempty=%v but required=%v in the spec", where, fieldName, omitted, required)
+			}
+		}
+		for prop := range schema.Properties {
+			if !fields[prop] {
+				t.Errorf("%s.%s is documented but not in the Go struct", where, prop)
+			}
+		}
+	}
+}
+
+// jsonType returns the JSON schema type encoding/json produces for typ.
+func jsonType(typ reflect.Type) string {
+	if typ == reflect.TypeOf(time.Time{}) {
+		return "string"
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// Test that the spec and docs page are actually served
+func TestOpenAPIHandlers(t *testing.T) {
+	req := httptest.NewRequest("GET", "/openapi.json", nil)
+	rr := httptest.NewRecorder()
+	openAPIHandler(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected 200 application/json, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	req = httptest.NewRequest("GET", "/docs", nil)
+	rr = httptest.NewRecorder()
+	docsHandler(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "/openapi.json") {
+		t.Errorf("Expected docs page pointing at /openapi.json, got %d", rr.Code)
+	}
+	if page := rr.Body.String(); strings.Contains(page, "https://") || strings.Contains(page, "http://") {
+		t.Errorf("Expected a self-contained docs page, got one loading from other hosts")
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Asynchronous writes: with ?async=true, or a "Prefer: respond-async"
+// header, the mutating counter endpoints queue the write and answer
+//
+//	202 Accepted
+//	Location: /operations/3FQZ...
+//	{"id": "3FQZ...", "status": "pending", ...}
+//
+// right away. A fixed pool of workers applies queued writes in the
+// background; clients poll GET /operations/{id} until the status is
+// "applied" (with the new value) or "failed" (with the error). When the
+// queue is full the write is refused with 429, so a burst cannot pile up
+// unbounded work in memory.
+
+// Operation statuses.
+const (
+	operationPending = "pending"
+	operationApplied = "applied"
+	operationFailed  = "failed"
+)
+
+// Operation is the status of an asynchronous write, as returned by
+// GET /operations/{id}.
+type Operation struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"` // pending, applied or failed
+	Op          string     `json:"op"`     // increment, add, set or reset
+	CounterID   int64      `json:"counter_id"`
+	Value       *int64     `json:"value,omitempty"` // the counter after the write, once applied
+	ETag        string     `json:"etag,omitempty"`  // its version, for a following If-Match
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// operationFunc applies a queued write and returns the new value and version.
+type operationFunc func(ctx context.Context) (int64, int64, error)
+
+type queuedOperation struct {
+	op  *Operation
+	ctx context.Context
+	run operationFunc
+}
+
+// operationQueue is the bounded queue of asynchronous writes and the
+// workers that apply them. Finished operations are kept for retention, and
+// at most maxFinished of them, so clients can still read their outcome.
+type operationQueue struct {
+	jobs        chan queuedOperation
+	retention   time.Duration
+	maxFinished int
+	wg          sync.WaitGroup
+	closeOnce   sync.Once
+
+	mu       sync.Mutex
+	ops      map[string]*Operation
+	retained []*Operation // finished ones, oldest first, so prune stops at the first one it keeps
+	closed   bool         // jobs is closed
+
+	depth    prometheus.GaugeFunc
+	rejected prometheus.Counter
+	finished *prometheus.CounterVec
+}
+
+// errQueueFull is returned when the operation queue has no room.
+var errQueueFull = errors.New("too many asynchronous operations queued, try again later")
+
+// errAsyncUnsupported is returned for async requests when no queue is configured.
+var errAsyncUnsupported = errors.New("asynchronous operations are off (ASYNC_QUEUE_SIZE=0)")
+
+// operations is the server's queue of asynchronous writes, or nil when they are off.
+var operations *operationQueue
+
+// newOperationQueue starts workers that apply writes from a queue of size slots.
+func newOperationQueue(size, workers int, retention time.Duration, maxFinished int) *operationQueue {
+	q := &operationQueue{
+		jobs:        make(chan queuedOperation, size),
+		retention:   retention,
+		maxFinished: maxFinished,
+		ops:         make(map[string]*Operation),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_async_rejected_total",
+			Help: "Asynchronous writes refused with 429 because the queue was full.",
+		}),
+		finished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "counter_async_operations_total",
+			Help: "Asynchronous writes finished, by outcome (applied or failed).",
+		}, []string{"status"}),
+	}
+	q.depth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "counter_async_queue_depth",
+		Help: "Asynchronous writes waiting for a worker.",
+	}, func() float64 { return float64(len(q.jobs)) })
+	for range workers {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// operationQueueFromEnv sizes the queue from ASYNC_QUEUE_SIZE (default
+// 1000, 0 turns async writes off) and ASYNC_WORKERS (default 4). Finished
+// operations are kept for ASYNC_RETENTION (default 10m), and at most
+// ASYNC_MAX_FINISHED (default 100000) of them.
+func operationQueueFromEnv() (*operationQueue, error) {
+	size, workers, maxFinished := 1000, 4, 100000
+	retention := 10 * time.Minute
+	var err error
+	if raw := os.Getenv("ASYNC_QUEUE_SIZE"); raw != "" {
+		if size, err = strconv.Atoi(raw); err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid ASYNC_QUEUE_SIZE %q, want a count like 1000", raw)
+		}
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	if raw := os.Getenv("ASYNC_WORKERS"); raw != "" {
+		if workers, err = strconv.Atoi(raw); err != nil || workers < 1 {
+			return nil, fmt.Errorf("invalid ASYNC_WORKERS %q, want a count like 4", raw)
+		}
+	}
+	if raw := os.Getenv("ASYNC_RETENTION"); raw != "" {
+		if retention, err = time.ParseDuration(raw); err != nil || retention <= 0 {
+			return nil, fmt.Errorf("invalid ASYNC_RETENTION %q, want a duration like 10m", raw)
+		}
+	}
+	if raw := os.Getenv("ASYNC_MAX_FINISHED"); raw != "" {
+		if maxFinished, err = strconv.Atoi(raw); err != nil || maxFinished < 1 {
+			return nil, fmt.Errorf("invalid ASYNC_MAX_FINISHED %q, want a count like 100000", raw)
+		}
+	}
+	return newOperationQueue(size, workers, retention, maxFinished), nil
+}
+
+// enqueue queues run as operation kind on counter id. It fails with
+// errQueueFull instead of waiting for room.
+func (q *operationQueue) enqueue(ctx context.Context, kind string, id int64, run operationFunc) (Operation, error) {
+	op := &Operation{
+		ID:        rand.Text(),
+		Status:    operationPending,
+		Op:        kind,
+		CounterID: id,
+		CreatedAt: time.Now().UTC(),
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
+	if q.closed {
+		return Operation{}, errQueueFull
+	}
+	select {
+	case q.jobs <- queuedOperation{op: op, ctx: ctx, run: run}:
+	default:
+		q.rejected.Inc()
+		return Operation{}, errQueueFull
+	}
+	q.ops[op.ID] = op
+	return *op, nil
+}
+
+// prune forgets operations that finished more than retention ago, and
+// the oldest ones beyond maxFinished. It only looks at those it forgets.
+// The caller must hold q.mu.
+func (q *operationQueue) prune() {
+	cutoff := time.Now().Add(-q.retention)
+	n := 0
+	for n < len(q.retained) && (len(q.retained)-n > q.maxFinished || q.retained[n].CompletedAt.Before(cutoff)) {
+		delete(q.ops, q.retained[n].ID)
+		q.retained[n] = nil
+		n++
+	}
+	q.retained = q.retained[n:]
+}
+
+// get returns a copy of operation id.
+func (q *operationQueue) get(id string) (Operation, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	op, ok := q.ops[id]
+	if !ok {
+		return Operation{}, false
+	}
+	return *op, true
+}
+
+func (q *operationQueue) work() {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		value, version, err := job.run(job.ctx)
+
+		q.mu.Lock()
+		now := time.Now().UTC() // under q.mu, so retained stays in order
+		job.op.CompletedAt = &now
+		if err != nil {
+			job.op.Status, job.op.Error = operationFailed, err.Error()
+		} else {
+			job.op.Status, job.op.Value = operationApplied, &value
+			if version >= 0 {
+				job.op.ETag = formatETag(version)
+			}
+		}
+		q.retained = append(q.retained, job.op)
+		q.prune()
+		q.mu.Unlock()
+		q.finished.WithLabelValues(job.op.Status).Inc()
+	}
+}
+
+// Close stops taking operations and waits until the queued ones are
+// applied or ctx ends. It is safe to call more than once.
+func (q *operationQueue) Close(ctx context.Context) error {
+	q.closeOnce.Do(func() {
+		q.mu.Lock()
+		q.closed = true
+		close(q.jobs) // under q.mu, so no enqueue sends on the closed channel
+		q.mu.Unlock()
+	})
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d queued operation(s) not applied: %w", len(q.jobs), ctx.Err())
+	}
+}
+
+// wantsAsync reports whether the client asked for an asynchronous write.
+func wantsAsync(r *http.Request) bool {
+	if r.URL.Query().Get("async") == "true" {
+		return true
+	}
+	for _, prefer := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(prefer, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptOperation queues run and answers 202 with the operation's URL, or
+// 429 if the queue is full. The write runs without the request's
+// cancellation, since the client is not going to wait for it.
+func acceptOperation(w http.ResponseWriter, r *http.Request, kind string, id int64, run operationFunc) {
+	if operations == nil {
+		http.Error(w, errAsyncUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+	op, err := operations.enqueue(context.WithoutCancel(r.Context()), kind, id, run)
+	if err != nil {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if r.Header.Get("Prefer") != "" {
+		w.Header().Set("Preference-Applied", "respond-async")
+	}
+	w.Header().Set("Location", "/operations/"+op.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(op)
+}
+
+// operationHandler handles GET /operations/{id}: the status of an
+// asynchronous write. Operations are forgotten ASYNC_RETENTION after they
+// finish, or sooner once more than ASYNC_MAX_FINISHED have finished.
+func operationHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if operations == nil {
+		http.Error(w, errAsyncUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+	op, ok := operations.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "operation not found (or finished too long ago)", http.StatusNotFound)
+		return
+	}
+	if op.Status == operationPending {
+		w.Header().Set("Retry-After", "1")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(op)
+}
+
+// Describe and Collect export the queue metrics on /metrics.
+func (q *operationQueue) Describe(ch chan<- *prometheus.Desc) {
+	q.depth.Describe(ch)
+	q.rejected.Describe(ch)
+	q.finished.Describe(ch)
+}
+
+func (q *operationQueue) Collect(ch chan<- prometheus.Metric) {
+	q.depth.Collect(ch)
+	q.rejected.Collect(ch)
+	q.finished.Collect(ch)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useOperations gives the test server a queue of asynchronous writes.
+// Call it after newTestServer: cleanups run last-registered first, so the
+// workers are drained before the test server restores store. t.Context()
+// is already canceled by then, so Close gets a context of its own.
+func useOperations(t *testing.T, size, workers int) *operationQueue {
+	t.Helper()
+	q := newOperationQueue(size, workers, time.Minute, 1000)
+	operations = q
+	t.Cleanup(func() {
+		operations = nil
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := q.Close(ctx); err != nil {
+			t.Errorf("Expected the queue to drain, got %v", err)
+		}
+	})
+	return q
+}
+
+// pollOperation reads url until the operation is no longer pending.
+func pollOperation(t *testing.T, url string) Operation {
+	t.Helper()
+	var op Operation
+	waitFor(t, "the operation to finish", func() bool {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 from %s, got %d", url, resp.StatusCode)
+		}
+		json.NewDecoder(resp.Body).Decode(&op)
+		return op.Status != operationPending
+	})
+	return op
+}
+
+// Test that ?async=true answers 202 and the operation reports the outcome
+func TestAsyncIncrement(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	useOperations(t, 10, 1)
+
+	// Act
+	resp, err := http.Post(server.URL+"/counter/increment?async=true", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var accepted Operation
+	json.NewDecoder(resp.Body).Decode(&accepted)
+	op := pollOperation(t, server.URL+resp.Header.Get("Location"))
+
+	// Assert
+	if resp.StatusCode != http.StatusAccepted || accepted.Status != operationPending {
+		t.Errorf("Expected 202 with a pending operation, got %d %+v", resp.StatusCode, accepted)
+	}
+	if resp.Header.Get("Location") != "/operations/"+accepted.ID {
+		t.Errorf("Expected Location /operations/%s, got %q", accepted.ID, resp.Header.Get("Location"))
+	}
+	if op.Status != operationApplied || op.Value == nil || *op.Value != 1 || op.ETag != `"1"` {
+		t.Errorf(`Expected the operation applied with value 1 and ETag "1", got %+v`, op)
+	}
+}
+
+// Test that Prefer: respond-async works too, and failures are reported
+func TestAsyncPreferFailure(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	useOperations(t, 10, 1)
+
+	// Act: counter 9 does not exist
+	resp := sendWithHeader(t, "POST", server.URL+"/counter/add?id=9", "Prefer", "respond-async", `{"delta": 5}`)
+	op := pollOperation(t, server.URL+resp.Header.Get("Location"))
+
+	// Assert
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Preference-Applied") != "respond-async" {
+		t.Errorf("Expected 202 with Preference-Applied, got %d %q", resp.StatusCode, resp.Header.Get("Preference-Applied"))
+	}
+	if op.Status != operationFailed || !strings.Contains(op.Error, "not found") {
+		t.Errorf("Expected a failed operation, got %+v", op)
+	}
+}
+
+// Test that a full queue refuses more work with 429
+func TestAsyncQueueFull(t *testing.T) {
+	// Arrange: one worker stuck on a slow read, one operation waiting behind it
+	server := newTestServer(t)
+	durable := &countingStore{memoryStore: newMemoryStore(), gate: make(chan struct{})}
+	store = durable
+	useOperations(t, 1, 1)
+	t.Cleanup(func() { close(durable.gate) }) // before the queue drains
+	sendWithHeader(t, "POST", server.URL+"/counter/reset?async=true", "", "", "")
+	waitFor(t, "the worker to start", func() bool { return durable.gets.Load() == 1 })
+	second := sendWithHeader(t, "POST", server.URL+"/counter/reset?async=true", "", "", "")
+
+	// Act
+	third := sendWithHeader(t, "POST", server.URL+"/counter/reset?async=true", "", "", "")
+
+	// Assert
+	if second.StatusCode != http.StatusAccepted {
+		t.Errorf("Expected the second operation to be queued, got %d", second.StatusCode)
+	}
+	if third.StatusCode != http.StatusTooManyRequests || third.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After, got %d", third.StatusCode)
+	}
+}
+
+// Test that async writes are refused when the queue is off
+func TestAsyncWithoutQueue(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+
+	// Act
+	resp := sendWithHeader(t, "POST", server.URL+"/counter/increment?async=true", "", "", "")
+
+	// Assert
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected 501, got %d", resp.StatusCode)
+	}
+}
+
+// Test that the oldest finished operations are forgotten beyond the cap
+func TestOperationQueueCapsFinished(t *testing.T) {
+	// Arrange: room for two finished operations
+	q := newOperationQueue(10, 1, time.Hour, 2)
+	defer q.Close(context.Background())
+	run := func(context.Context) (int64, int64, error) { return 1, anyVersion, nil }
+
+	// Act
+	var ids []string
+	for range 3 {
+		op, err := q.enqueue(context.Background(), "increment", 1, run)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, op.ID)
+	}
+	waitFor(t, "every operation to finish", func() bool {
+		op, ok := q.get(ids[2])
+		return ok && op.Status == operationApplied
+	})
+
+	// Assert
+	if _, ok := q.get(ids[0]); ok {
+		t.Errorf("Expected the oldest operation to be forgotten")
+	}
+	for _, id := range ids[1:] {
+		if op, ok := q.get(id); !ok || op.Status != operationApplied {
+			t.Errorf("Expected operation %s to be kept as applied, got %+v (%v)", id, op, ok)
+		}
+	}
+}
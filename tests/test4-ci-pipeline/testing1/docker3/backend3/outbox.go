@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The outbox feeds every counter change to downstream systems as
+// CloudEvents. Each write queues its event in counter_outbox in the same
+// statement as the UPDATE (see addVersioned and setVersioned), so a change
+// is never committed without its event. A relay reads the outbox in order,
+// hands each batch to every sink and deletes it once all of them accepted
+// it: delivery is at-least-once, and a batch a sink failed is sent again
+// to every sink. Consumers deduplicate on the event id.
+//
+// Events of one counter are numbered by counter_outbox_seq, whose row the
+// write locks before queuing its event, so they leave the outbox in the
+// order they were committed. Writes of one counter are already serialized
+// on its counters row by the version bump (see addVersioned), so this lock
+// adds no wait of its own.
+//
+// Whether writes queue events is recorded in the database, not decided by
+// each replica: the first replica started with OUTBOX_SINKS turns on
+// counter_outbox_config (see EnableOutbox), and from then on every
+// replica's writes queue events, with or without sinks of its own. It
+// stays on until turned off by hand:
+//
+//	UPDATE counter_outbox_config SET enabled = false;
+//
+// Only one replica relays at a time (see RelayOutbox). With write-behind
+// (see writebehind.go) there is one event per flushed delta.
+
+// outboxLockClass is the advisory lock held by the relaying replica.
+const outboxLockClass = 0x4f42 // "OB"
+
+// memoryOutboxLimit bounds the events the memory store keeps while the
+// sinks are down; the oldest are dropped beyond it.
+const memoryOutboxLimit = 100000
+
+// outboxEvent is a queued change.
+type outboxEvent struct {
+	ID        int64 // position in the outbox
+	CounterID int64
+	Seq       int64 // per counter, from 1
+	Op        string
+	Delta     int64
+	Value     int64
+	Version   int64
+	At        time.Time
+}
+
+// outboxStore is implemented by the stores that queue events.
+type outboxStore interface {
+	// RelayOutbox passes the oldest limit events to publish, in order, and
+	// removes them if publish succeeds. It returns how many were removed,
+	// 0 when another replica is relaying.
+	RelayOutbox(ctx context.Context, limit int, publish func([]outboxEvent) error) (int, error)
+	// EnableOutbox makes every later write queue its event.
+	EnableOutbox(ctx context.Context) error
+}
+
+// CounterEvent is the data of a counter change event.
+type CounterEvent struct {
+	ID      int64  `json:"id"`
+	Op      string `json:"op"` // "add" or "set"
+	Delta   int64  `json:"delta"`
+	Value   int64  `json:"value"`
+	Version int64  `json:"version"`
+}
+
+// CloudEvent is a change in the CloudEvents 1.0 JSON format, with the
+// partitioning and sequence extensions.
+type CloudEvent struct {
+	SpecVersion     string       `json:"specversion"`
+	ID              string       `json:"id"` // "<counter id>-<sequence>"
+	Source          string       `json:"source"`
+	Type            string       `json:"type"`    // "counter.add" or "counter.set"
+	Subject         string       `json:"subject"` // the counter id
+	Time            time.Time    `json:"time"`
+	DataContentType string       `json:"datacontenttype"`
+	PartitionKey    string       `json:"partitionkey"` // the counter id
+	Sequence        string       `json:"sequence"`     // zero-padded, so it sorts as a string too
+	Data            CounterEvent `json:"data"`
+}
+
+// cloudEvent converts e for a relay whose CloudEvents source is source.
+func (e outboxEvent) cloudEvent(source string) CloudEvent {
+	counter := strconv.FormatInt(e.CounterID, 10)
+	return CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              fmt.Sprintf("%d-%d", e.CounterID, e.Seq),
+		Source:          source,
+		Type:            "counter." + e.Op,
+		Subject:         counter,
+		Time:            e.At.UTC(),
+		DataContentType: "application/json",
+		PartitionKey:    counter,
+		Sequence:        fmt.Sprintf("%020d", e.Seq),
+		Data:            CounterEvent{ID: e.CounterID, Op: e.Op, Delta: e.Delta, Value: e.Value, Version: e.Version},
+	}
+}
+
+// eventSink is where the relay publishes events.
+type eventSink interface {
+	Name() string
+	// Publish must return only once every event is stored or delivered.
+	Publish(ctx context.Context, events []CloudEvent) error
+	Close() error
+}
+
+// writerSink writes one JSON event per line, to stdout.
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerSink) Name() string { return "stdout" }
+func (s *writerSink) Close() error { return nil }
+
+func (s *writerSink) Publish(_ context.Context, events []CloudEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	enc := json.NewEncoder(s.w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileSink appends one JSON event per line to a file. When the file
+// would grow past maxBytes it is renamed to path.1 (path.1 to path.2, and
+// so on) and a new one is started; only keep rotated files are kept.
+type fileSink struct {
+	path     string
+	maxBytes int64
+	keep     int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newFileSink(path string, maxBytes int64, keep int) (*fileSink, error) {
+	s := &fileSink{path: path, maxBytes: maxBytes, keep: keep}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) Name() string { return "file" }
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.size = f, info.Size()
+	return nil
+}
+
+// rotate closes the file and shifts it and the rotated ones up by one.
+// The caller must hold s.mu.
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.keep))
+	for i := s.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if s.keep > 0 {
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) Publish(_ context.Context, events []CloudEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := bufio.NewWriter(s.file)
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		if s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			if err := s.rotate(); err != nil {
+				return err
+			}
+			w.Reset(s.file)
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		s.size += int64(len(line))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// httpSink POSTs every batch to an endpoint as one
+// application/cloudevents-batch+json request. Any 2xx answer accepts it.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpSink) Name() string { return "http" }
+func (s *httpSink) Close() error { return nil }
+
+func (s *httpSink) Publish(ctx context.Context, events []CloudEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents-batch+json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// outboxRelay moves events from the outbox to the sinks.
+type outboxRelay struct {
+	store    outboxStore
+	sinks    []eventSink
+	source   string // the CloudEvents source attribute
+	batch    int
+	interval time.Duration
+
+	wake      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	published prometheus.Counter
+	failures  *prometheus.CounterVec
+}
+
+// outbox relays the change feed, or is nil when OUTBOX_SINKS is unset.
+var outbox *outboxRelay
+
+// newOutboxRelay relays from s to sinks, waking on every change and at
+// least every interval.
+func newOutboxRelay(s outboxStore, sinks []eventSink, source string, batch int, interval time.Duration) *outboxRelay {
+	r := &outboxRelay{
+		store:    s,
+		sinks:    sinks,
+		source:   source,
+		batch:    batch,
+		interval: interval,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		published: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_outbox_published_total",
+			Help: "Change events accepted by every sink.",
+		}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "counter_outbox_failures_total",
+			Help: "Batches a sink failed to publish, by sink.",
+		}, []string{"sink"}),
+	}
+	changes.observe(func(counterChange) {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	})
+	return r
+}
+
+// outboxRelayFromEnv reads the sinks from OUTBOX_SINKS, a comma-separated
+// list of "stdout", "file:<path>" and http(s) URLs. The file sink rotates
+// at OUTBOX_FILE_MAX_BYTES (default 100 MiB) and keeps OUTBOX_FILE_KEEP
+// rotated files (default 5). OUTBOX_BATCH (default 100) bounds a batch,
+// OUTBOX_INTERVAL (default 1s) is the longest wait between two polls and
+// OUTBOX_SOURCE (default "/counters") is the CloudEvents source.
+func outboxRelayFromEnv(s outboxStore) (*outboxRelay, error) {
+	spec := os.Getenv("OUTBOX_SINKS")
+	if spec == "" {
+		return nil, nil
+	}
+	if s == nil {
+		return nil, errors.New("the outbox is not available with STORE=raft")
+	}
+
+	maxBytes := int64(100 << 20)
+	if raw := os.Getenv("OUTBOX_FILE_MAX_BYTES"); raw != "" {
+		var err error
+		if maxBytes, err = strconv.ParseInt(raw, 10, 64); err != nil || maxBytes < 1 {
+			return nil, fmt.Errorf("invalid OUTBOX_FILE_MAX_BYTES %q, want a size in bytes like 104857600", raw)
+		}
+	}
+	keep := 5
+	if raw := os.Getenv("OUTBOX_FILE_KEEP"); raw != "" {
+		var err error
+		if keep, err = strconv.Atoi(raw); err != nil || keep < 0 {
+			return nil, fmt.Errorf("invalid OUTBOX_FILE_KEEP %q, want a count like 5", raw)
+		}
+	}
+	batch := 100
+	if raw := os.Getenv("OUTBOX_BATCH"); raw != "" {
+		var err error
+		if batch, err = strconv.Atoi(raw); err != nil || batch < 1 {
+			return nil, fmt.Errorf("invalid OUTBOX_BATCH %q, want a count like 100", raw)
+		}
+	}
+	interval := time.Second
+	if raw := os.Getenv("OUTBOX_INTERVAL"); raw != "" {
+		var err error
+		if interval, err = time.ParseDuration(raw); err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid OUTBOX_INTERVAL %q, want a duration like 1s", raw)
+		}
+	}
+	source := os.Getenv("OUTBOX_SOURCE")
+	if source == "" {
+		source = "/counters"
+	}
+
+	var sinks []eventSink
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "":
+			continue
+		case part == "stdout":
+			sinks = append(sinks, &writerSink{w: os.Stdout})
+		case strings.HasPrefix(part, "file:"):
+			sink, err := newFileSink(strings.TrimPrefix(part, "file:"), maxBytes, keep)
+			if err != nil {
+				return nil, fmt.Errorf("open outbox file: %w", err)
+			}
+			sinks = append(sinks, sink)
+		case strings.HasPrefix(part, "http://") || strings.HasPrefix(part, "https://"):
+			if _, err := url.Parse(part); err != nil {
+				return nil, fmt.Errorf("invalid outbox sink %q: %w", part, err)
+			}
+			sinks = append(sinks, &httpSink{url: part, client: &http.Client{Timeout: 10 * time.Second}})
+		default:
+			return nil, fmt.Errorf("invalid outbox sink %q, want stdout, file:<path> or an http(s) URL", part)
+		}
+	}
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("invalid OUTBOX_SINKS %q, want at least one sink", spec)
+	}
+	return newOutboxRelay(s, sinks, source, batch, interval), nil
+}
+
+// relayOnce publishes one batch and returns how many events it held.
+func (r *outboxRelay) relayOnce(ctx context.Context) (int, error) {
+	return r.store.RelayOutbox(ctx, r.batch, func(events []outboxEvent) error {
+		ces := make([]CloudEvent, len(events))
+		for i, e := range events {
+			ces[i] = e.cloudEvent(r.source)
+		}
+		for _, sink := range r.sinks {
+			if err := sink.Publish(ctx, ces); err != nil {
+				r.failures.WithLabelValues(sink.Name()).Inc()
+				return fmt.Errorf("%s sink: %w", sink.Name(), err)
+			}
+		}
+		r.published.Add(float64(len(events)))
+		return nil
+	})
+}
+
+// drain relays full batches until the outbox is empty or a batch fails.
+func (r *outboxRelay) drain(ctx context.Context) error {
+	for {
+		n, err := r.relayOnce(ctx)
+		if err != nil || n < r.batch {
+			return err
+		}
+	}
+}
+
+// run relays until Close, then drains what is left.
+func (r *outboxRelay) run(ctx context.Context) {
+	defer close(r.done)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.drain(ctx); err != nil {
+			log.Printf("Relaying the outbox failed: %v\n", err)
+		}
+		select {
+		case <-r.stop:
+			if err := r.drain(ctx); err != nil {
+				log.Printf("Events left in the outbox: %v\n", err)
+			}
+			return
+		case <-r.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the relay after a last drain and closes the sinks.
+func (r *outboxRelay) Close(ctx context.Context) error {
+	r.closeOnce.Do(func() { close(r.stop) })
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return fmt.Errorf("the outbox relay did not stop: %w", ctx.Err())
+	}
+	var errs []error
+	for _, sink := range r.sinks {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Describe and Collect export the relay metrics on /metrics.
+func (r *outboxRelay) Describe(ch chan<- *prometheus.Desc) {
+	r.published.Describe(ch)
+	r.failures.Describe(ch)
+}
+
+func (r *outboxRelay) Collect(ch chan<- prometheus.Metric) {
+	r.published.Collect(ch)
+	r.failures.Collect(ch)
+}
+
+// createOutboxTables creates the outbox, the per-counter event sequences
+// and the single-row switch that tells writes whether to queue events.
+func createOutboxTables(ctx context.Context) error {
+	_, err := db.Exec(ctx,
+		`CREATE TABLE IF NOT EXISTS counter_outbox (
+			id         BIGSERIAL PRIMARY KEY,
+			counter_id INTEGER NOT NULL,
+			seq        BIGINT NOT NULL,
+			op         TEXT NOT NULL,
+			delta      BIGINT NOT NULL,
+			value      BIGINT NOT NULL,
+			version    BIGINT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE IF NOT EXISTS counter_outbox_seq (
+			counter_id INTEGER PRIMARY KEY,
+			seq        BIGINT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS counter_outbox_config (
+			singleton BOOLEAN PRIMARY KEY DEFAULT true CHECK (singleton),
+			enabled   BOOLEAN NOT NULL
+		)`)
+	return err
+}
+
+func (postgresStore) EnableOutbox(ctx context.Context) error {
+	_, err := db.Exec(ctx,
+		`INSERT INTO counter_outbox_config (enabled) VALUES (true)
+		 ON CONFLICT (singleton) DO UPDATE SET enabled = true`)
+	return err
+}
+
+// RelayOutbox holds an advisory lock while it publishes and deletes a
+// batch, so replicas take turns and a batch is deleted only if publish
+// succeeded. A replica that dies mid-batch leaves it to be sent again.
+func (postgresStore) RelayOutbox(ctx context.Context, limit int, publish func([]outboxEvent) error) (int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1, 0)", outboxLockClass).Scan(&locked); err != nil || !locked {
+		return 0, err
+	}
+	rows, err := tx.Query(ctx,
+		`SELECT id, counter_id, seq, op, delta, value, version, created_at
+		 FROM counter_outbox ORDER BY id LIMIT $1`, limit)
+	if err != nil {
+		return 0, err
+	}
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (outboxEvent, error) {
+		var e outboxEvent
+		err := row.Scan(&e.ID, &e.CounterID, &e.Seq, &e.Op, &e.Delta, &e.Value, &e.Version, &e.At)
+		return e, err
+	})
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+	if err := publish(events); err != nil {
+		return 0, err
+	}
+	// Delete by id: a row below the last one may have been committed
+	// after the SELECT, and must wait for the next batch.
+	ids := make([]int64, len(events))
+	for i, e := range events {
+		ids[i] = e.ID
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM counter_outbox WHERE id = ANY($1)", ids); err != nil {
+		return 0, err
+	}
+	return len(events), tx.Commit(ctx)
+}
+
+// queueEvent appends a change to the memory outbox while the relay is on.
+// The caller must hold m.mu.
+func (m *memoryStore) queueEvent(id int64, op string, delta, value int64, at time.Time) {
+	if !m.queuing {
+		return
+	}
+	m.outboxSeq[id]++
+	m.outboxNext++
+	m.outbox = append(m.outbox, outboxEvent{
+		ID: m.outboxNext, CounterID: id, Seq: m.outboxSeq[id],
+		Op: op, Delta: delta, Value: value, Version: m.versions[id], At: at,
+	})
+	if len(m.outbox) > memoryOutboxLimit {
+		m.outbox = m.outbox[len(m.outbox)-memoryOutboxLimit:]
+	}
+}
+
+// EnableOutbox needs no shared switch: nothing else writes to the memory store.
+func (m *memoryStore) EnableOutbox(context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queuing = true
+	return nil
+}
+
+// RelayOutbox publishes without holding m.mu, so writes go on meanwhile.
+// Only the relay removes events, so the batch is still at the front after
+// publish unless it was dropped by memoryOutboxLimit.
+func (m *memoryStore) RelayOutbox(_ context.Context, limit int, publish func([]outboxEvent) error) (int, error) {
+	m.mu.Lock()
+	events := append([]outboxEvent(nil), m.outbox[:min(limit, len(m.outbox))]...)
+	m.mu.Unlock()
+	if len(events) == 0 {
+		return 0, nil
+	}
+	if err := publish(events); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	last := events[len(events)-1].ID
+	for len(m.outbox) > 0 && m.outbox[0].ID <= last {
+		m.outbox = m.outbox[1:]
+	}
+	return len(events), nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// useOutbox turns the outbox on for the duration of the test. The relay
+// is not started; tests call drain.
+func useOutbox(t *testing.T, s outboxStore, sinks ...eventSink) *outboxRelay {
+	t.Helper()
+	r := newOutboxRelay(s, sinks, "/test", 2, time.Hour)
+	if err := s.EnableOutbox(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	outbox = r
+	t.Cleanup(func() { outbox = nil })
+	return r
+}
+
+// flakySink fails its first failures batches.
+type flakySink struct{ failures int }
+
+func (s *flakySink) Name() string { return "flaky" }
+func (s *flakySink) Close() error { return nil }
+
+func (s *flakySink) Publish(context.Context, []CloudEvent) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("sink unavailable")
+	}
+	return nil
+}
+
+// readEvents decodes one CloudEvent per line.
+func readEvents(t *testing.T, data []byte) []CloudEvent {
+	t.Helper()
+	var events []CloudEvent
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var e CloudEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// Test that a batch a sink failed is sent again, in order, and leaves the
+// outbox only once every sink accepted it
+func TestOutboxRelayAtLeastOnce(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	m := newMemoryStore()
+	var out bytes.Buffer
+	r := useOutbox(t, m, &writerSink{w: &out}, &flakySink{failures: 1})
+	m.Add(ctx, 1, 2)
+	m.Set(ctx, 7, 5)
+	m.Set(ctx, 1, 10)
+
+	// Act
+	failed := r.drain(ctx)
+	retried := r.drain(ctx)
+
+	// Assert
+	if failed == nil || retried != nil {
+		t.Fatalf("Expected the first drain to fail and the second to succeed, got %v and %v", failed, retried)
+	}
+	events := readEvents(t, out.Bytes())
+	var ids []string
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	if want := "1-1 7-1 1-1 7-1 1-2"; strings.Join(ids, " ") != want {
+		t.Errorf("Expected the failed batch again, then the rest: %s, got %s", want, strings.Join(ids, " "))
+	}
+	last := events[len(events)-1]
+	if last.SpecVersion != "1.0" || last.Type != "counter.set" || last.Source != "/test" || last.PartitionKey != "1" ||
+		last.Sequence != "00000000000000000002" || last.Data.Value != 10 || last.Data.Delta != 8 || last.Data.Version != 2 {
+		t.Errorf("Expected a counter.set CloudEvent of counter 1 to 10, got %+v", last)
+	}
+	if len(m.outbox) != 0 || testutil.ToFloat64(r.published) != 3 {
+		t.Errorf("Expected an empty outbox after publishing 3 events, got %d left and %v published", len(m.outbox), testutil.ToFloat64(r.published))
+	}
+}
+
+// Test that the file sink rotates before a file outgrows its limit and
+// keeps only the newest rotated files
+func TestFileSinkRotates(t *testing.T) {
+	// Arrange
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	line, _ := json.Marshal(outboxEvent{CounterID: 1, Seq: 1, Op: "add"}.cloudEvent("/test"))
+	sink, err := newFileSink(path, int64(2*(len(line)+1)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	// Act
+	for seq := int64(1); seq <= 5; seq++ {
+		event := outboxEvent{CounterID: 1, Seq: seq, Op: "add"}.cloudEvent("/test")
+		if err := sink.Publish(context.Background(), []CloudEvent{event}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Assert
+	current, _ := os.ReadFile(path)
+	rotated, _ := os.ReadFile(path + ".1")
+	if events := readEvents(t, current); len(events) != 1 || events[0].ID != "1-5" {
+		t.Errorf("Expected the current file to hold event 1-5, got %+v", events)
+	}
+	if events := readEvents(t, rotated); len(events) != 2 || events[0].ID != "1-3" {
+		t.Errorf("Expected the rotated file to hold events 1-3 and 1-4, got %+v", events)
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Errorf("Expected only one rotated file to be kept, got %v", err)
+	}
+}
+
+// Test that the HTTP sink posts a CloudEvents batch and fails on errors
+func TestHTTPSink(t *testing.T) {
+	// Arrange
+	var contentType string
+	var received []CloudEvent
+	status := http.StatusAccepted
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	sink := &httpSink{url: server.URL, client: server.Client()}
+	events := []CloudEvent{
+		outboxEvent{CounterID: 3, Seq: 1, Op: "add"}.cloudEvent("/test"),
+		outboxEvent{CounterID: 3, Seq: 2, Op: "add"}.cloudEvent("/test"),
+	}
+
+	// Act
+	err := sink.Publish(context.Background(), events)
+	status = http.StatusServiceUnavailable
+	failed := sink.Publish(context.Background(), events)
+
+	// Assert
+	if err != nil || contentType != "application/cloudevents-batch+json" || len(received) != 2 || received[1].ID != "3-2" {
+		t.Errorf("Expected a batch of 2 events, got %q %+v (err %v)", contentType, received, err)
+	}
+	if failed == nil {
+		t.Errorf("Expected a 503 to fail the batch")
+	}
+}
+
+// Test the OUTBOX_SINKS configuration
+func TestOutboxRelayFromEnv(t *testing.T) {
+	t.Setenv("OUTBOX_SINKS", "")
+	if r, err := outboxRelayFromEnv(newMemoryStore()); r != nil || err != nil {
+		t.Errorf("Expected the outbox to be off without OUTBOX_SINKS, got %v %v", r, err)
+	}
+
+	t.Setenv("OUTBOX_SINKS", "stdout, file:"+filepath.Join(t.TempDir(), "events.jsonl")+", http://sink.example/events")
+	r, err := outboxRelayFromEnv(newMemoryStore())
+	if err != nil || len(r.sinks) != 3 {
+		t.Fatalf("Expected 3 sinks, got %v", err)
+	}
+	go r.run(context.Background())
+	if err := r.Close(t.Context()); err != nil {
+		t.Error(err)
+	}
+	if _, err := outboxRelayFromEnv(nil); err == nil {
+		t.Errorf("Expected STORE=raft to be refused")
+	}
+
+	t.Setenv("OUTBOX_SINKS", "kafka://broker:9092")
+	if _, err := outboxRelayFromEnv(newMemoryStore()); err == nil {
+		t.Errorf("Expected an unknown sink to be refused")
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+)
+
+// principalKey is the context key under which the authenticated caller is stored.
+// Using an unexported type means no other package can accidentally collide with it.
+type principalKey struct{}
+
+// withPrincipal returns a copy of ctx that carries the authenticated caller's name.
+func withPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalFromContext returns the authenticated caller, or "" for anonymous requests.
+func principalFromContext(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
+
+// adminKeyHeader carries the shared secret that guards admin endpoints:
+// Raft membership changes (RAFT_ADMIN_KEY) and alert rules (ALERT_ADMIN_KEY).
+const adminKeyHeader = "X-Admin-Key"
+
+// hasAdminKey reports whether r presents key in X-Admin-Key. An empty key
+// admits nobody, so an endpoint stays locked until its secret is configured.
+func hasAdminKey(r *http.Request, key string) bool {
+	return key != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(adminKeyHeader)), []byte(key)) == 1
+}
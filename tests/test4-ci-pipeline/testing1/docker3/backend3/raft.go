@@ -0,0 +1,698 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"backend2/counterclient"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// STORE=raft replicates counters across 3-5 backend instances with Raft,
+// for counters that must never go backwards or count a write twice
+// (invoice numbers and the like). Every write is an entry in the Raft log,
+// committed once a majority has it, and applied to an in-memory copy of the
+// counters (counterFSM) on every node.
+//
+// Only the leader answers. A follower forwards reads and writes to the
+// leader's HTTP API, or, with RAFT_FOLLOWERS=redirect, sends HTTP clients a
+// 307 to the leader instead (gRPC calls are always forwarded).
+//
+// The log lives in RAFT_DIR/raft.db. Every RAFT_SNAPSHOT_THRESHOLD entries
+// the counters are snapshotted and older log entries dropped; a node that
+// falls too far behind is sent the snapshot instead of the log.
+// Nodes are added and removed at runtime through /cluster/join and
+// /cluster/remove (see cluster.go).
+
+var (
+	// errNoLeader means the cluster is electing a leader (or has lost quorum).
+	errNoLeader = errors.New("no cluster leader, try again shortly")
+	// errNotLeader means this node cannot answer from its own state.
+	errNotLeader = errors.New("not the cluster leader")
+)
+
+// raftCommand is one entry in the replicated log.
+// The leader fills in At, so every node records the same history.
+type raftCommand struct {
+	Op    string    `json:"op"` // "add", "set" or "member"
+	ID    int64     `json:"id,omitempty"`
+	Value int64     `json:"value,omitempty"` // delta for "add", new value for "set"
+	At    time.Time `json:"at"`
+	// IfVersion makes "add" and "set" conditional (If-Match, see versions.go).
+	IfVersion *int64 `json:"if_version,omitempty"`
+
+	// For "member": the node's HTTP base URL, or "" when it leaves.
+	Node     raft.ServerID `json:"node,omitempty"`
+	HTTPAddr string        `json:"http_addr,omitempty"`
+}
+
+// raftResult is what counterFSM.Apply returns for a command.
+type raftResult struct {
+	Value   int64
+	Version int64
+	Err     error
+}
+
+// counterFSM is the replicated state: counters, their history, and where
+// each node serves HTTP (so followers know where to forward).
+type counterFSM struct {
+	mu        sync.Mutex
+	values    map[int64]int64
+	versions  map[int64]int64
+	history   map[int64][]HistoryEntry // oldest first
+	httpAddrs map[raft.ServerID]string
+}
+
+func newCounterFSM() *counterFSM {
+	return &counterFSM{
+		values:    map[int64]int64{defaultCounterID: 0},
+		versions:  make(map[int64]int64),
+		history:   make(map[int64][]HistoryEntry),
+		httpAddrs: make(map[raft.ServerID]string),
+	}
+}
+
+// Apply runs a committed command. It must be deterministic: every node
+// applies the same commands in the same order and must end up identical.
+func (f *counterFSM) Apply(entry *raft.Log) any {
+	var cmd raftCommand
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return raftResult{Err: fmt.Errorf("corrupt log entry %d: %w", entry.Index, err)}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	value, exists := f.values[cmd.ID]
+	if cmd.IfVersion != nil && !versionMatches(*cmd.IfVersion, f.versions[cmd.ID], exists) {
+		return raftResult{Err: errVersionMismatch}
+	}
+	switch cmd.Op {
+	case "add":
+		if !exists {
+			return raftResult{Err: errCounterNotFound}
+		}
+		// No bounds in cluster mode, but an add must not overflow int64.
+		next, err := counterBounds{}.add(value, cmd.Value)
+		if err != nil {
+			return raftResult{Err: err}
+		}
+		f.values[cmd.ID] = next
+		f.record(cmd.ID, "add", cmd.Value, next, cmd.At)
+		return raftResult{Value: next, Version: f.versions[cmd.ID]}
+	case "set":
+		f.values[cmd.ID] = cmd.Value
+		f.record(cmd.ID, "set", cmd.Value-value, cmd.Value, cmd.At)
+		return raftResult{Value: cmd.Value, Version: f.versions[cmd.ID]}
+	case "member":
+		if cmd.HTTPAddr == "" {
+			delete(f.httpAddrs, cmd.Node)
+		} else {
+			f.httpAddrs[cmd.Node] = cmd.HTTPAddr
+		}
+		return raftResult{}
+	}
+	return raftResult{Err: fmt.Errorf("unknown command %q", cmd.Op)}
+}
+
+// record bumps the version, appends a history entry and publishes the
+// change, so watchers on every node hear about it. The caller must hold f.mu.
+func (f *counterFSM) record(id int64, op string, delta, value int64, at time.Time) {
+	f.versions[id]++
+	h := append(f.history[id], HistoryEntry{At: at, Op: op, Delta: delta, Value: value})
+	if len(h) > memoryHistoryLimit {
+		h = h[len(h)-memoryHistoryLimit:]
+	}
+	f.history[id] = h
+	c := counterChange{ID: id, Value: value, Version: f.versions[id]}
+	if op == "add" {
+		c.Added = delta
+	}
+	changes.publish(c)
+}
+
+func (f *counterFSM) get(id int64) (int64, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.values[id]
+	if !ok {
+		return 0, 0, errCounterNotFound
+	}
+	return value, f.versions[id], nil
+}
+
+func (f *counterFSM) list() []CounterResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := make([]CounterResponse, 0, len(f.values))
+	for id, value := range f.values {
+		list = append(list, CounterResponse{ID: id, Value: value})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (f *counterFSM) recent(id int64, limit int) ([]HistoryEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.values[id]; !ok {
+		return nil, errCounterNotFound
+	}
+	h := f.history[id]
+	entries := make([]HistoryEntry, 0, min(limit, len(h)))
+	for i := len(h) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, h[i])
+	}
+	return entries, nil
+}
+
+func (f *counterFSM) httpAddr(id raft.ServerID) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.httpAddrs[id]
+}
+
+// fsmState is the snapshot format.
+type fsmState struct {
+	Values    map[int64]int64          `json:"values"`
+	Versions  map[int64]int64          `json:"versions"`
+	History   map[int64][]HistoryEntry `json:"history"`
+	HTTPAddrs map[raft.ServerID]string `json:"http_addrs"`
+}
+
+// Snapshot copies the state; Raft writes it out in the background while
+// new commands keep being applied.
+func (f *counterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := fsmState{
+		Values:    make(map[int64]int64, len(f.values)),
+		Versions:  make(map[int64]int64, len(f.versions)),
+		History:   make(map[int64][]HistoryEntry, len(f.history)),
+		HTTPAddrs: make(map[raft.ServerID]string, len(f.httpAddrs)),
+	}
+	for id, v := range f.values {
+		s.Values[id] = v
+	}
+	for id, v := range f.versions {
+		s.Versions[id] = v
+	}
+	for id, h := range f.history {
+		s.History[id] = append([]HistoryEntry(nil), h...)
+	}
+	for id, addr := range f.httpAddrs {
+		s.HTTPAddrs[id] = addr
+	}
+	return s, nil
+}
+
+// Restore replaces the state with a snapshot (on restart, or when the
+// leader sends one to a node that is too far behind).
+func (f *counterFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var s fsmState
+	if err := json.NewDecoder(rc).Decode(&s); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values, f.versions, f.history, f.httpAddrs = s.Values, s.Versions, s.History, s.HTTPAddrs
+	if f.versions == nil {
+		f.versions = make(map[int64]int64)
+	}
+	if f.history == nil {
+		f.history = make(map[int64][]HistoryEntry)
+	}
+	if f.httpAddrs == nil {
+		f.httpAddrs = make(map[raft.ServerID]string)
+	}
+	return nil
+}
+
+func (s fsmState) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (fsmState) Release() {}
+
+// raftStore is a counterStore backed by a Raft node.
+type raftStore struct {
+	raft     *raft.Raft
+	fsm      *counterFSM
+	id       raft.ServerID
+	httpAddr string        // our HTTP base URL, as other nodes reach it
+	timeout  time.Duration // for log applies and forwarded requests
+	redirect bool          // RAFT_FOLLOWERS=redirect
+	apiKey   string        // sent on forwarded requests
+	adminKey string        // required by /cluster/join and /cluster/remove
+
+	// ready is set once we are leader and have applied everything committed
+	// by earlier leaders, so reads from the FSM are up to date.
+	ready     atomic.Bool
+	stop      chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	clients map[string]*counterclient.Client // leader URL -> client
+}
+
+// newRaftStore starts a Raft node with the given storage and transport.
+// config.LocalID names the node.
+func newRaftStore(config *raft.Config, logs raft.LogStore, stable raft.StableStore,
+	snaps raft.SnapshotStore, transport raft.Transport, httpAddr string) (*raftStore, error) {
+	fsm := newCounterFSM()
+	r, err := raft.NewRaft(config, fsm, logs, stable, snaps, transport)
+	if err != nil {
+		return nil, err
+	}
+	s := &raftStore{
+		raft:     r,
+		fsm:      fsm,
+		id:       config.LocalID,
+		httpAddr: httpAddr,
+		timeout:  5 * time.Second,
+		stop:     make(chan struct{}),
+		clients:  make(map[string]*counterclient.Client),
+	}
+	go s.watchLeadership()
+	return s, nil
+}
+
+// watchLeadership gets a new leader ready to serve reads, and records its
+// HTTP address so followers can forward to it.
+func (s *raftStore) watchLeadership() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case leader := <-s.raft.LeaderCh():
+			s.ready.Store(false)
+			if !leader {
+				continue
+			}
+			if !s.barrier() {
+				continue // no longer leader; LeaderCh says what comes next
+			}
+			if s.httpAddr != "" && s.fsm.httpAddr(s.id) != s.httpAddr {
+				cmd := raftCommand{Op: "member", Node: s.id, HTTPAddr: s.httpAddr}
+				if _, err := s.apply(cmd); err != nil {
+					log.Printf("Raft: recording our HTTP address failed: %v\n", err)
+				}
+			}
+			s.ready.Store(true)
+		}
+	}
+}
+
+// barrier waits until every entry committed by earlier leaders is applied
+// here. A failed barrier is retried for as long as we lead: giving up would
+// leave reads failing with 503 until the next election, since leaderURL has
+// nowhere else to send them. It reports false if we lost leadership or the
+// node is shutting down.
+func (s *raftStore) barrier() bool {
+	backoff := 100 * time.Millisecond
+	for {
+		err := s.raft.Barrier(s.timeout).Error()
+		if err == nil {
+			return true
+		}
+		if s.raft.State() != raft.Leader {
+			return false
+		}
+		log.Printf("Raft: barrier after election failed, retrying in %v: %v\n", backoff, err)
+		select {
+		case <-s.stop:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 5*time.Second)
+	}
+}
+
+// Close stops this node; the rest of the cluster carries on without it.
+// It is safe to call more than once.
+func (s *raftStore) Close() error {
+	s.closeOnce.Do(func() { close(s.stop) })
+	return s.raft.Shutdown().Error()
+}
+
+// apply appends cmd to the log and waits until it is committed and applied.
+// If leadership is lost while waiting the write may or may not have been
+// committed, so it is reported as failed rather than retried.
+func (s *raftStore) apply(cmd raftCommand) (raftResult, error) {
+	if s.raft.State() != raft.Leader {
+		return raftResult{}, errNoLeader
+	}
+	cmd.At = time.Now().UTC()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return raftResult{}, err
+	}
+	future := s.raft.Apply(data, s.timeout)
+	if err := future.Error(); errors.Is(err, raft.ErrNotLeader) {
+		return raftResult{}, errNoLeader // rejected before it reached the log: safe to retry
+	} else if err != nil {
+		return raftResult{}, err
+	}
+	res := future.Response().(raftResult)
+	return res, res.Err
+}
+
+// applyWrite applies an "add" or "set", conditional unless ifVersion is anyVersion.
+func (s *raftStore) applyWrite(op string, id, value, ifVersion int64) (int64, int64, error) {
+	cmd := raftCommand{Op: op, ID: id, Value: value}
+	if ifVersion != anyVersion {
+		cmd.IfVersion = &ifVersion
+	}
+	res, err := s.apply(cmd)
+	return res.Value, res.Version, err
+}
+
+// leaderReady returns nil if this node may answer from its FSM: it is the
+// leader, is caught up, and a majority still agrees it is the leader.
+func (s *raftStore) leaderReady() error {
+	if !s.ready.Load() {
+		return errNotLeader
+	}
+	return s.raft.VerifyLeader().Error()
+}
+
+// leaderURL returns the leader's HTTP base URL.
+func (s *raftStore) leaderURL() (string, error) {
+	_, id := s.raft.LeaderWithID()
+	if id == "" {
+		return "", errNoLeader
+	}
+	url := s.fsm.httpAddr(id)
+	if url == "" || id == s.id {
+		return "", errNoLeader // not announced yet, or we are mid-election
+	}
+	return url, nil
+}
+
+// leader returns a client for the current leader's HTTP API.
+func (s *raftStore) leader() (*counterclient.Client, error) {
+	url, err := s.leaderURL()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.clients[url]; ok {
+		return c, nil
+	}
+	// No retries: a write that timed out may have been applied, and after a
+	// leader change a retry could apply it twice. The follower's own client
+	// decides whether to try again.
+	c, err := counterclient.New(url,
+		counterclient.WithHTTPClient(&http.Client{Timeout: s.timeout}),
+		counterclient.WithRetries(0, 0, 0),
+		counterclient.WithAPIKey(s.apiKey),
+		counterclient.WithUserAgent("backend-raft-forwarder"))
+	if err != nil {
+		return nil, err
+	}
+	s.clients[url] = c
+	return c, nil
+}
+
+// forwardError maps the leader's answer back to store errors.
+func forwardError(err error) error {
+	if counterclient.IsNotFound(err) {
+		return errCounterNotFound
+	}
+	if counterclient.IsPreconditionFailed(err) {
+		return errVersionMismatch
+	}
+	if counterclient.IsConflict(err) {
+		return errOutOfBounds
+	}
+	return err
+}
+
+// forwardedCounter returns the value and version of the leader's answer.
+func forwardedCounter(counter counterclient.Counter, err error) (int64, int64, error) {
+	if err != nil {
+		return 0, 0, forwardError(err)
+	}
+	version, ok := parseETag(counter.ETag)
+	if !ok {
+		version = anyVersion
+	}
+	return counter.Value, version, nil
+}
+
+// ifMatchHeader is the If-Match value the leader needs for ifVersion.
+func ifMatchHeader(ifVersion int64) string {
+	if ifVersion == anyExistingVersion {
+		return "*"
+	}
+	return formatETag(ifVersion)
+}
+
+func (s *raftStore) Get(ctx context.Context, id int64) (int64, error) {
+	value, _, err := s.GetVersion(ctx, id)
+	return value, err
+}
+
+func (s *raftStore) Add(ctx context.Context, id int64, delta int64) (int64, error) {
+	value, _, err := s.AddIfVersion(ctx, id, delta, anyVersion)
+	return value, err
+}
+
+func (s *raftStore) Set(ctx context.Context, id int64, value int64) (int64, error) {
+	value, _, err := s.SetIfVersion(ctx, id, value, anyVersion)
+	return value, err
+}
+
+func (s *raftStore) GetVersion(ctx context.Context, id int64) (int64, int64, error) {
+	if s.leaderReady() == nil {
+		return s.fsm.get(id)
+	}
+	c, err := s.leader()
+	if err != nil {
+		return 0, 0, err
+	}
+	return forwardedCounter(c.Get(ctx, id))
+}
+
+func (s *raftStore) AddIfVersion(ctx context.Context, id, delta, ifVersion int64) (int64, int64, error) {
+	if s.raft.State() == raft.Leader {
+		return s.applyWrite("add", id, delta, ifVersion)
+	}
+	c, err := s.leader()
+	if err != nil {
+		return 0, 0, err
+	}
+	if ifVersion == anyVersion {
+		return forwardedCounter(c.Add(ctx, id, delta))
+	}
+	return forwardedCounter(c.AddIfMatch(ctx, id, delta, ifMatchHeader(ifVersion)))
+}
+
+func (s *raftStore) SetIfVersion(ctx context.Context, id, value, ifVersion int64) (int64, int64, error) {
+	if s.raft.State() == raft.Leader {
+		return s.applyWrite("set", id, value, ifVersion)
+	}
+	c, err := s.leader()
+	if err != nil {
+		return 0, 0, err
+	}
+	if ifVersion == anyVersion {
+		return forwardedCounter(c.Set(ctx, id, value))
+	}
+	return forwardedCounter(c.SetIfMatch(ctx, id, value, ifMatchHeader(ifVersion)))
+}
+
+func (s *raftStore) List(ctx context.Context) ([]CounterResponse, error) {
+	if s.leaderReady() == nil {
+		return s.fsm.list(), nil
+	}
+	c, err := s.leader()
+	if err != nil {
+		return nil, err
+	}
+	counters, err := c.List(ctx)
+	if err != nil {
+		return nil, forwardError(err)
+	}
+	list := make([]CounterResponse, len(counters))
+	for i, counter := range counters {
+		list[i] = CounterResponse{ID: counter.ID, Value: counter.Value}
+	}
+	return list, nil
+}
+
+func (s *raftStore) History(ctx context.Context, id int64, limit int) ([]HistoryEntry, error) {
+	if s.leaderReady() == nil {
+		return s.fsm.recent(id, limit)
+	}
+	c, err := s.leader()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := c.History(ctx, id, limit)
+	if err != nil {
+		return nil, forwardError(err)
+	}
+	entries := make([]HistoryEntry, len(remote))
+	for i, e := range remote {
+		entries[i] = HistoryEntry{At: e.At, Op: e.Op, Delta: e.Delta, Value: e.Value}
+	}
+	return entries, nil
+}
+
+// redirectMiddleware answers counter API requests on a follower with a
+// 307 to the same URL on the leader (RAFT_FOLLOWERS=redirect). Watch
+// streams stay local: every node applies, and publishes, every write.
+func (s *raftStore) redirectMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isCounterAPIPath(r.URL.Path) || r.Method == http.MethodOptions || s.raft.State() == raft.Leader {
+			next.ServeHTTP(w, r)
+			return
+		}
+		url, err := s.leaderURL()
+		if err != nil {
+			writeStoreError(w, r, "No leader", err)
+			return
+		}
+		http.Redirect(w, r, url+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
+
+// isCounterAPIPath reports whether path reads or writes counter values.
+func isCounterAPIPath(path string) bool {
+	switch path {
+	case "/counter", "/counter/increment", "/counter/add", "/counter/reset", "/counter/history", "/counters":
+		return true
+	}
+	return false
+}
+
+// raftStoreFromEnv starts this node from the environment:
+//
+//	RAFT_ID                 unique, stable node name (default: hostname)
+//	RAFT_ADDR               Raft bind address (default :7000)
+//	RAFT_ADVERTISE          address other nodes dial for Raft (default: hostname + RAFT_ADDR port)
+//	RAFT_HTTP_ADDR          our HTTP base URL for forwarding (default: http://hostname:PORT)
+//	RAFT_DIR                log, stable store and snapshots (default raft-data)
+//	RAFT_BOOTSTRAP=true     start a new single-node cluster (first node only)
+//	RAFT_JOIN               HTTP URL of a member to join through on first start
+//	RAFT_FOLLOWERS          forward (default) or redirect
+//	RAFT_SNAPSHOT_THRESHOLD log entries between snapshots (default 8192)
+//	RAFT_API_KEY            X-API-Key sent on forwarded requests; the leader does not rate-limit requests carrying it
+//	RAFT_ADMIN_KEY          shared secret for membership changes, also sent with RAFT_JOIN
+func raftStoreFromEnv(port string) (*raftStore, error) {
+	hostname, _ := os.Hostname()
+	id := envOr("RAFT_ID", hostname)
+	bind := envOr("RAFT_ADDR", ":7000")
+	_, raftPort, err := net.SplitHostPort(bind)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RAFT_ADDR %q: %w", bind, err)
+	}
+	advertise := envOr("RAFT_ADVERTISE", net.JoinHostPort(hostname, raftPort))
+	httpAddr := envOr("RAFT_HTTP_ADDR", "http://"+net.JoinHostPort(hostname, port))
+	dir := envOr("RAFT_DIR", "raft-data")
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(id)
+	config.Logger = hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Info})
+	if raw := os.Getenv("RAFT_SNAPSHOT_THRESHOLD"); raw != "" {
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid RAFT_SNAPSHOT_THRESHOLD %q", raw)
+		}
+		config.SnapshotThreshold = n
+	}
+	var redirect bool
+	switch mode := envOr("RAFT_FOLLOWERS", "forward"); mode {
+	case "forward":
+	case "redirect":
+		redirect = true
+	default:
+		return nil, fmt.Errorf("invalid RAFT_FOLLOWERS %q, want forward or redirect", mode)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(dir, 2, config.Logger)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveTCPAddr("tcp", advertise)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RAFT_ADVERTISE %q: %w", advertise, err)
+	}
+	transport, err := raft.NewTCPTransportWithLogger(bind, addr, 3, 10*time.Second, config.Logger)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := raft.HasExistingState(logs, logs, snaps)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newRaftStore(config, logs, logs, snaps, transport, httpAddr)
+	if err != nil {
+		return nil, err
+	}
+	s.redirect = redirect
+	s.apiKey = os.Getenv("RAFT_API_KEY")
+	if s.apiKey == "" {
+		log.Printf("Raft: RAFT_API_KEY is not set, so the leader rate-limits forwarded requests as their follower's\n")
+	}
+	s.adminKey = os.Getenv("RAFT_ADMIN_KEY")
+	if s.adminKey == "" {
+		log.Printf("Raft: RAFT_ADMIN_KEY is not set, so /cluster/join and /cluster/remove refuse every request\n")
+	}
+
+	switch {
+	case existing:
+		log.Printf("Raft node %s rejoining with its existing log in %s\n", id, dir)
+	case os.Getenv("RAFT_BOOTSTRAP") == "true":
+		err := s.raft.BootstrapCluster(raft.Configuration{Servers: []raft.Server{
+			{ID: config.LocalID, Address: transport.LocalAddr()},
+		}}).Error()
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap: %w", err)
+		}
+		log.Printf("Raft node %s bootstrapped a new cluster\n", id)
+	case os.Getenv("RAFT_JOIN") != "":
+		go joinCluster(os.Getenv("RAFT_JOIN"), s.adminKey, JoinRequest{ID: id, RaftAddr: advertise, HTTPAddr: httpAddr})
+	default:
+		log.Printf("Raft node %s waiting to be added with POST /cluster/join\n", id)
+	}
+	return s, nil
+}
+
+// envOr returns the environment variable key, or fallback if it is unset.
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// testAdminKey is every test node's RAFT_ADMIN_KEY.
+const testAdminKey = "test-admin-key"
+
+// testNode is one member of an in-process Raft cluster.
+type testNode struct {
+	*raftStore
+	transport *raft.InmemTransport
+}
+
+// startTestNode starts a Raft node on in-memory storage and transport,
+// connected to every node in peers.
+func startTestNode(t *testing.T, id, httpAddr string, peers []testNode) testNode {
+	t.Helper()
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(id)
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.CommitTimeout = 5 * time.Millisecond
+	config.TrailingLogs = 2 // compact aggressively so snapshots get exercised
+	config.Logger = hclog.NewNullLogger()
+
+	_, transport := raft.NewInmemTransport("")
+	for _, peer := range peers {
+		transport.Connect(peer.transport.LocalAddr(), peer.transport)
+		peer.transport.Connect(transport.LocalAddr(), transport)
+	}
+	logs := raft.NewInmemStore()
+	s, err := newRaftStore(config, logs, logs, raft.NewInmemSnapshotStore(), transport, httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.adminKey = testAdminKey
+	t.Cleanup(func() { s.Close() })
+	return testNode{raftStore: s, transport: transport}
+}
+
+// newTestCluster bootstraps a cluster on node-0, serves the HTTP API from
+// it (through the global store, so followers can forward to it), and adds
+// n-1 more nodes with POST /cluster/join.
+func newTestCluster(t *testing.T, n int) ([]testNode, *httptest.Server) {
+	t.Helper()
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	first := startTestNode(t, "node-0", server.URL, nil)
+	err := first.raft.BootstrapCluster(raft.Configuration{Servers: []raft.Server{
+		{ID: "node-0", Address: first.transport.LocalAddr()},
+	}}).Error()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousStore, previousCluster := store, cluster
+	store, cluster = first, first.raftStore
+	t.Cleanup(func() { store, cluster = previousStore, previousCluster })
+	waitFor(t, "node-0 to lead", first.ready.Load)
+
+	nodes := []testNode{first}
+	for i := 1; i < n; i++ {
+		nodes = append(nodes, joinTestNode(t, server.URL, fmt.Sprintf("node-%d", i), nodes))
+	}
+	return nodes, server
+}
+
+// joinTestNode starts a node and asks the cluster at url to add it.
+func joinTestNode(t *testing.T, url, id string, peers []testNode) testNode {
+	t.Helper()
+	node := startTestNode(t, id, "http://"+id+".invalid", peers)
+	body := fmt.Sprintf(`{"id": %q, "raft_addr": %q, "http_addr": %q}`, id, node.transport.LocalAddr(), node.httpAddr)
+	resp := sendWithHeader(t, "POST", url+"/cluster/join", adminKeyHeader, testAdminKey, body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 from /cluster/join, got %d", resp.StatusCode)
+	}
+	return node
+}
+
+// waitFor polls cond until it is true, failing the test after 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test that writes on the leader and on followers reach every node
+func TestRaftClusterReplicatesWrites(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	nodes, server := newTestCluster(t, 3)
+	leader, follower := nodes[0], nodes[1]
+
+	// Act: two writes on the leader, one forwarded by a follower
+	leader.Add(ctx, 1, 1)
+	leader.Add(ctx, 1, 1)
+	value, err := follower.Add(ctx, 1, 1)
+
+	// Assert
+	if err != nil || value != 3 {
+		t.Fatalf("Expected the forwarded write to return 3, got %d (err %v)", value, err)
+	}
+	for _, node := range nodes {
+		waitFor(t, string(node.id)+" to apply every write", func() bool {
+			v, _, _ := node.fsm.get(1)
+			return v == 3
+		})
+	}
+	if got, err := follower.Get(ctx, 1); err != nil || got != 3 {
+		t.Errorf("Expected a forwarded read of 3, got %d (err %v)", got, err)
+	}
+	if _, err := follower.Add(ctx, 99, 1); err != errCounterNotFound {
+		t.Errorf("Expected errCounterNotFound through the leader, got %v", err)
+	}
+	resp, err := http.Get(server.URL + "/cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status ClusterStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.State != "Leader" || len(status.Members) != 3 || status.Members[1].HTTPAddr != follower.httpAddr {
+		t.Errorf("Expected a leader with 3 members, got %+v", status)
+	}
+}
+
+// Test that the counter survives losing the leader and never goes backwards
+func TestRaftLeaderFailover(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	nodes, _ := newTestCluster(t, 3)
+	for range 5 {
+		nodes[0].Add(ctx, 1, 1)
+	}
+
+	// Act: stop the leader and wait for the others to elect a new one
+	nodes[0].Close()
+	var next testNode
+	waitFor(t, "a new leader", func() bool {
+		for _, node := range nodes[1:] {
+			if node.ready.Load() {
+				next = node
+				return true
+			}
+		}
+		return false
+	})
+	value, err := next.Add(ctx, 1, 1)
+
+	// Assert
+	if err != nil || value != 6 {
+		t.Errorf("Expected the new leader to continue at 6, got %d (err %v)", value, err)
+	}
+	history, _ := next.History(ctx, 1, 10)
+	if len(history) != 6 {
+		t.Errorf("Expected 6 history entries on the new leader, got %d", len(history))
+	}
+}
+
+// Test that a node joining after log compaction catches up from a snapshot
+func TestRaftSnapshotCatchUp(t *testing.T) {
+	// Arrange: ten writes, snapshotted, with the log compacted behind them
+	ctx := context.Background()
+	nodes, server := newTestCluster(t, 1)
+	for range 10 {
+		nodes[0].Add(ctx, 1, 1)
+	}
+	nodes[0].Set(ctx, 2, 42)
+	if err := nodes[0].raft.Snapshot().Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	late := joinTestNode(t, server.URL, "node-late", nodes)
+
+	// Assert
+	waitFor(t, "the new node to catch up", func() bool {
+		v, _, _ := late.fsm.get(1)
+		return v == 10
+	})
+	if v, _, _ := late.fsm.get(2); v != 42 {
+		t.Errorf("Expected counter 2 at 42 on the new node, got %d", v)
+	}
+	if h, _ := late.fsm.recent(1, 100); len(h) != 10 {
+		t.Errorf("Expected the snapshot to carry 10 history entries, got %d", len(h))
+	}
+	if late.raft.Stats()["last_snapshot_index"] == "0" {
+		t.Error("Expected the new node to have installed a snapshot")
+	}
+}
+
+// Test that a follower in redirect mode sends HTTP clients to the leader
+func TestRaftRedirectMiddleware(t *testing.T) {
+	// Arrange
+	nodes, server := newTestCluster(t, 2)
+	follower := nodes[1]
+	handler := follower.redirectMiddleware(http.NotFoundHandler())
+
+	// Act
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/counter/increment?id=1", nil))
+	watch := httptest.NewRecorder()
+	handler.ServeHTTP(watch, httptest.NewRequest("GET", "/counter/watch", nil))
+
+	// Assert
+	if rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != server.URL+"/counter/increment?id=1" {
+		t.Errorf("Expected 307 to the leader, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if watch.Code != http.StatusNotFound {
+		t.Errorf("Expected watch streams to stay on the follower, got %d", watch.Code)
+	}
+}
+
+// Test that removing a node takes it out of the configuration
+func TestRaftRemoveNode(t *testing.T) {
+	// Arrange
+	nodes, server := newTestCluster(t, 3)
+
+	// Act
+	resp := sendWithHeader(t, "POST", server.URL+"/cluster/remove", adminKeyHeader, testAdminKey, `{"id": "node-2"}`)
+
+	// Assert
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", resp.StatusCode)
+	}
+	servers := nodes[0].raft.GetConfiguration().Configuration().Servers
+	if len(servers) != 2 {
+		t.Errorf("Expected 2 members left, got %v", servers)
+	}
+	if nodes[0].fsm.httpAddr("node-2") != "" {
+		t.Error("Expected the removed node's HTTP address to be forgotten")
+	}
+}
+
+// Test that membership changes without the admin key are refused and
+// carry no CORS headers
+func TestRaftMembershipNeedsAdminKey(t *testing.T) {
+	// Arrange
+	nodes, server := newTestCluster(t, 1)
+	body := `{"id": "intruder", "raft_addr": "10.0.0.66:7000", "http_addr": "http://10.0.0.66"}`
+
+	// Act
+	anonymous := sendWithHeader(t, "POST", server.URL+"/cluster/join", "", "", body)
+	wrongKey := sendWithHeader(t, "POST", server.URL+"/cluster/join", adminKeyHeader, "guess", body)
+	remove := sendWithHeader(t, "POST", server.URL+"/cluster/remove", "", "", `{"id": "node-0"}`)
+
+	// Assert
+	for _, resp := range []*http.Response{anonymous, wrongKey, remove} {
+		if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("Expected 403 without CORS headers, got %d (%q)", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+		}
+	}
+	if servers := nodes[0].raft.GetConfiguration().Configuration().Servers; len(servers) != 1 {
+		t.Errorf("Expected the configuration to be untouched, got %v", servers)
+	}
+}
+
+// Test that the cluster endpoints refuse to work without STORE=raft
+func TestClusterHandlersWithoutRaft(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+
+	// Act
+	status, _ := http.Get(server.URL + "/cluster")
+	join, _ := http.Post(server.URL+"/cluster/join", "application/json", strings.NewReader(`{}`))
+
+	// Assert
+	if status.StatusCode != http.StatusNotImplemented || join.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected 501 from both, got %d and %d", status.StatusCode, join.StatusCode)
+	}
+}
+
+// Test that conditional writes forwarded by a follower check the leader's version
+func TestRaftConditionalWrites(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	nodes, _ := newTestCluster(t, 2)
+	follower := nodes[1]
+	nodes[0].Add(ctx, 1, 1)
+	_, version, err := follower.GetVersion(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	value, next, err := follower.SetIfVersion(ctx, 1, 10, version)
+	_, _, stale := follower.AddIfVersion(ctx, 1, 1, version)
+
+	// Assert
+	if err != nil || value != 10 || next != version+1 {
+		t.Errorf("Expected 10 at version %d, got %d at %d (err %v)", version+1, value, next, err)
+	}
+	if stale != errVersionMismatch {
+		t.Errorf("Expected errVersionMismatch for the stale version, got %v", stale)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// rateLimit describes a token bucket: it refills at Rate tokens per second
+// and holds at most Burst tokens. Every request spends one token.
+type rateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// rateDecision is the outcome of asking a limiter for one token.
+type rateDecision struct {
+	Allowed    bool
+	Remaining  int           // whole tokens left after this request
+	RetryAfter time.Duration // how long until one token is available (only when denied)
+	Reset      time.Duration // how long until the bucket is full again
+}
+
+// rateLimiter is implemented by the in-memory and Postgres-backed limiters.
+type rateLimiter interface {
+	Allow(ctx context.Context, key string, limit rateLimit) (rateDecision, error)
+}
+
+// refill applies the token bucket arithmetic shared by both limiters.
+// Given the tokens left at the last visit and the seconds since then, it
+// returns the decision and the number of tokens to store.
+func refill(tokens, elapsed float64, limit rateLimit) (rateDecision, float64) {
+	burst := float64(limit.Burst)
+	tokens = math.Min(burst, tokens+elapsed*limit.Rate)
+
+	var d rateDecision
+	if tokens >= 1 {
+		tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = secondsToDuration((1 - tokens) / limit.Rate)
+	}
+	d.Remaining = int(math.Floor(tokens))
+	d.Reset = secondsToDuration((burst - tokens) / limit.Rate)
+	return d, tokens
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// memoryBucket is one client's token bucket.
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// memoryRateLimiter keeps buckets in process memory.
+// It is fast but every replica counts on its own, so with N replicas a
+// client effectively gets N times the configured limit.
+type memoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+	now       func() time.Time // swapped out in tests
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{buckets: make(map[string]*memoryBucket), now: time.Now}
+}
+
+func (m *memoryRateLimiter) Allow(_ context.Context, key string, limit rateLimit) (rateDecision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(limit.Burst), last: now}
+		m.buckets[key] = b
+	}
+	d, tokens := refill(b.tokens, now.Sub(b.last).Seconds(), limit)
+	b.tokens, b.last = tokens, now
+	return d, nil
+}
+
+// sweep forgets buckets that have been idle for a while so memory does not
+// grow with every client IP we have ever seen. An idle bucket is full anyway,
+// so dropping it does not change any decision.
+func (m *memoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for key, b := range m.buckets {
+		if now.Sub(b.last) > 10*time.Minute {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// postgresRateLimiter keeps buckets in the rate_limits table so that every
+// replica shares the same limit for a client.
+type postgresRateLimiter struct{}
+
+// createRateLimitTable creates the table used by postgresRateLimiter.
+func createRateLimitTable(ctx context.Context) error {
+	_, err := db.Exec(ctx,
+		`CREATE TABLE IF NOT EXISTS rate_limits (
+			key        TEXT PRIMARY KEY,
+			tokens     DOUBLE PRECISION NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		)`)
+	return err
+}
+
+func (postgresRateLimiter) Allow(ctx context.Context, key string, limit rateLimit) (rateDecision, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return rateDecision{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// 1. Make sure the bucket exists (a new client starts with a full bucket).
+	_, err = tx.Exec(ctx,
+		`INSERT INTO rate_limits (key, tokens, updated_at) VALUES ($1, $2, clock_timestamp())
+		 ON CONFLICT (key) DO NOTHING`, key, float64(limit.Burst))
+	if err != nil {
+		return rateDecision{}, err
+	}
+
+	// 2. Lock the row so concurrent requests from other replicas wait for us.
+	// The elapsed time comes from the database clock, so replicas with
+	// slightly different clocks still agree. Every step reads clock_timestamp():
+	// now() is the start of the transaction, which may be before the lock
+	// was granted, and mixing the two would let time run backwards.
+	var tokens, elapsed float64
+	err = tx.QueryRow(ctx,
+		`SELECT tokens, GREATEST(EXTRACT(EPOCH FROM clock_timestamp() - updated_at), 0)::float8
+		 FROM rate_limits WHERE key = $1 FOR UPDATE`, key).Scan(&tokens, &elapsed)
+	if err != nil {
+		return rateDecision{}, err
+	}
+
+	// 3. Spend a token (if there is one) and store the new bucket state.
+	d, tokens := refill(tokens, elapsed, limit)
+	_, err = tx.Exec(ctx,
+		`UPDATE rate_limits SET tokens = $2, updated_at = clock_timestamp() WHERE key = $1`,
+		key, tokens)
+	if err != nil {
+		return rateDecision{}, err
+	}
+	return d, tx.Commit(ctx)
+}
+
+// trustedProxies lists the networks whose X-Forwarded-For header we believe.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma-separated list of IPs and CIDRs,
+// e.g. "10.0.0.0/8, 127.0.0.1".
+func parseTrustedProxies(s string) (trustedProxies, error) {
+	var nets trustedProxies
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			if ip := net.ParseIP(part); ip != nil && ip.To4() != nil {
+				part += "/32"
+			} else {
+				part += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", part, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (t trustedProxies) contains(ip net.IP) bool {
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the real client.
+// X-Forwarded-For is only honored when the direct peer is a trusted proxy,
+// otherwise any client could claim to be someone else. The header is read
+// right to left, skipping our own proxies, so the first untrusted hop wins.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !t.contains(peer) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !t.contains(ip) {
+			return ip.String()
+		}
+		host = ip.String()
+	}
+	return host
+}
+
+// clientIdentity works out who sent a request, for rate limiting and
+// idempotency keys.
+type clientIdentity struct {
+	proxies trustedProxies
+	apiKeys map[string]bool
+}
+
+// clientIdentityFromEnv reads:
+//
+//	TRUSTED_PROXIES  IPs/CIDRs allowed to set X-Forwarded-For
+//	API_KEYS         comma-separated API keys that identify a client
+func clientIdentityFromEnv() (clientIdentity, error) {
+	proxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return clientIdentity{}, err
+	}
+	id := clientIdentity{proxies: proxies, apiKeys: make(map[string]bool)}
+	for _, key := range strings.Split(os.Getenv("API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			id.apiKeys[key] = true
+		}
+	}
+	return id, nil
+}
+
+// rateLimiterConfig holds everything the middleware needs.
+type rateLimiterConfig struct {
+	clientIdentity
+	limiter rateLimiter
+	routes  map[string]rateLimit // keyed by "<METHOD> <path>" or "<path>" (any method)
+
+	// forwardKey is RAFT_API_KEY, the X-API-Key of requests a Raft follower
+	// forwards to us. Those were charged to their client on the follower,
+	// so they are not charged again, all to the follower, here.
+	forwardKey string
+}
+
+// rateLimits is the limiter behind the HTTP middleware, or nil with
+// RATE_LIMITS=off. Writes that do not arrive as HTTP requests (/ws
+// messages, gRPC calls) are charged to the same buckets through allow.
+var rateLimits *rateLimiterConfig
+
+// defaultRateLimits protects the write endpoints when RATE_LIMITS is not set.
+// GET /counter is the hot read path and stays unlimited.
+const defaultRateLimits = "/counter/increment=10:20,/counter/add=10:20,PUT /counter=10:20,/counter/reset=10:20"
+
+// parseRateLimits parses RATE_LIMITS, a comma-separated list of
+// "[<METHOD> ]<path>=<tokens per second>:<burst>", e.g.
+// "/counter/increment=5:10,PUT /counter=1:5". Without a method the limit
+// applies to every method of the path.
+func parseRateLimits(s string) (map[string]rateLimit, error) {
+	routes := make(map[string]rateLimit)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		path, spec, ok := strings.Cut(part, "=")
+		rateStr, burstStr, ok2 := strings.Cut(spec, ":")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("rate limit %q: want <path>=<rate>:<burst>", part)
+		}
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("rate limit %q: rate must be a positive number", part)
+		}
+		burst, err := strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("rate limit %q: burst must be at least 1", part)
+		}
+		route := strings.Join(strings.Fields(path), " ")
+		if method, rest, ok := strings.Cut(route, " "); ok && (method != strings.ToUpper(method) || !strings.HasPrefix(rest, "/")) {
+			return nil, fmt.Errorf("rate limit %q: want an upper-case method and a path, like PUT /counter", part)
+		}
+		routes[route] = rateLimit{Rate: rate, Burst: burst}
+	}
+	return routes, nil
+}
+
+// rateLimiterFromEnv builds the rate limiter from:
+//
+//	RATE_LIMITS       per-route limits (default: 10/s with bursts of 20 on every write endpoint, "off" disables)
+//	RATE_LIMIT_STORE  "memory" (default, per replica) or "postgres" (shared by all replicas)
+//
+// It returns nil with RATE_LIMITS=off.
+func rateLimiterFromEnv(identity clientIdentity) (*rateLimiterConfig, error) {
+	spec := os.Getenv("RATE_LIMITS")
+	if spec == "" {
+		spec = defaultRateLimits
+	}
+	if spec == "off" {
+		return nil, nil
+	}
+	routes, err := parseRateLimits(spec)
+	if err != nil {
+		return nil, err
+	}
+	cfg := rateLimiterConfig{clientIdentity: identity, routes: routes}
+
+	store := os.Getenv("RATE_LIMIT_STORE")
+	switch store {
+	case "", "memory":
+		store = "memory"
+		cfg.limiter = newMemoryRateLimiter()
+	case "postgres":
+		if db == nil {
+			return nil, fmt.Errorf("RATE_LIMIT_STORE=postgres needs DATABASE_URL (STORE=memory has no database)")
+		}
+		if err := createRateLimitTable(context.Background()); err != nil {
+			return nil, fmt.Errorf("create rate_limits table: %w", err)
+		}
+		cfg.limiter = postgresRateLimiter{}
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_STORE %q", store)
+	}
+	log.Printf("Rate limiting %d route(s) using the %s limiter\n", len(routes), store)
+	return &cfg, nil
+}
+
+// clientKey picks the identity a request is counted against:
+// a known API key first, then the authenticated principal, then the client IP.
+// Unknown API keys are ignored so a client cannot dodge its limit by
+// sending a fresh random key with every request.
+func (c clientIdentity) clientKey(r *http.Request) string {
+	return c.keyFor(r.Header.Get("X-API-Key"), principalFromContext(r.Context()), func() string {
+		return c.proxies.clientIP(r)
+	})
+}
+
+// grpcClientKey is clientKey for a gRPC call: the x-api-key metadata, then
+// the principal, then the peer's address. X-Forwarded-For is not consulted;
+// gRPC clients are expected to connect directly.
+func (c clientIdentity) grpcClientKey(ctx context.Context) string {
+	var apiKey string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if keys := md.Get("x-api-key"); len(keys) > 0 {
+			apiKey = keys[0]
+		}
+	}
+	return c.keyFor(apiKey, principalFromContext(ctx), func() string {
+		p, ok := peer.FromContext(ctx)
+		if !ok {
+			return ""
+		}
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			return p.Addr.String()
+		}
+		return host
+	})
+}
+
+func (c clientIdentity) keyFor(apiKey, principal string, ip func() string) string {
+	if apiKey != "" && c.apiKeys[apiKey] {
+		// Hash the key so raw secrets never end up in the rate_limits table.
+		sum := sha256.Sum256([]byte(apiKey))
+		return "apikey:" + hex.EncodeToString(sum[:8])
+	}
+	if principal != "" {
+		return "principal:" + principal
+	}
+	return "ip:" + ip()
+}
+
+// limitFor finds the limit of route, "<METHOD> <path>" or a bare name:
+// the limit of that method and path if there is one, else the limit of the
+// path for any method. It returns the matched entry, which names the bucket.
+func (cfg *rateLimiterConfig) limitFor(route string) (string, rateLimit, bool) {
+	if limit, ok := cfg.routes[route]; ok {
+		return route, limit, true
+	}
+	if _, path, ok := strings.Cut(route, " "); ok {
+		if limit, ok := cfg.routes[path]; ok {
+			return path, limit, true
+		}
+	}
+	return "", rateLimit{}, false
+}
+
+// take spends one of client's tokens for route (see limitFor). It reports
+// false, letting the request through, when the route is not limited or the
+// limiter fails.
+func (cfg *rateLimiterConfig) take(ctx context.Context, route, client string) (rateLimit, rateDecision, bool) {
+	matched, limit, ok := cfg.limitFor(route)
+	if !ok {
+		return rateLimit{}, rateDecision{}, false
+	}
+	key := matched + "|" + client
+	d, err := cfg.limiter.Allow(ctx, key, limit)
+	if err != nil {
+		// Fail open: a broken limiter should not take the whole API down.
+		logf(ctx, "rate limiter error for %s: %v\n", key, err)
+		return rateLimit{}, rateDecision{}, false
+	}
+	return limit, d, true
+}
+
+// allow charges a write that does not come through the middleware to the
+// bucket the HTTP request for route would use, so a client cannot dodge
+// its limit by switching transports. client is a clientKey. It allows
+// everything when cfg is nil (RATE_LIMITS=off).
+func (cfg *rateLimiterConfig) allow(ctx context.Context, route, client string) rateDecision {
+	if cfg == nil {
+		return rateDecision{Allowed: true}
+	}
+	if _, d, ok := cfg.take(ctx, route, client); ok {
+		return d
+	}
+	return rateDecision{Allowed: true}
+}
+
+// rateLimitMiddleware rejects requests with 429 once a client has used up its bucket.
+// Every limited response carries the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers so well-behaved clients can slow down on their own.
+func rateLimitMiddleware(cfg *rateLimiterConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || cfg.forwarded(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limit, d, ok := cfg.take(r.Context(), r.Method+" "+r.URL.Path, cfg.clientKey(r))
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+		if !d.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+			http.Error(w, "Too many requests, slow down", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwarded reports whether r was forwarded by a Raft follower (see
+// forwardKey). An empty forwardKey matches nothing.
+func (cfg *rateLimiterConfig) forwarded(r *http.Request) bool {
+	return cfg.forwardKey != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(cfg.forwardKey)) == 1
+}
+
+// ceilSeconds rounds a duration up to whole seconds, as the headers require.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test that a bucket allows a burst, then refills over time
+func TestMemoryRateLimiterBurstAndRefill(t *testing.T) {
+	// Arrange: a fake clock so the test does not need to sleep
+	now := time.Unix(1000, 0)
+	limiter := newMemoryRateLimiter()
+	limiter.now = func() time.Time { return now }
+	limit := rateLimit{Rate: 1, Burst: 2}
+
+	// Act + Assert: two requests fit in the burst, the third is denied
+	for i := 0; i < 2; i++ {
+		d, _ := limiter.Allow(context.Background(), "client", limit)
+		if !d.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+	d, _ := limiter.Allow(context.Background(), "client", limit)
+	if d.Allowed {
+		t.Fatal("Expected third request to be denied")
+	}
+	if d.RetryAfter != time.Second {
+		t.Errorf("Expected Retry-After of 1s, got %v", d.RetryAfter)
+	}
+
+	// One second later a single token has been refilled
+	now = now.Add(time.Second)
+	d, _ = limiter.Allow(context.Background(), "client", limit)
+	if !d.Allowed {
+		t.Error("Expected request to be allowed after refill")
+	}
+
+	// Other clients have their own bucket
+	d, _ = limiter.Allow(context.Background(), "other", limit)
+	if !d.Allowed {
+		t.Error("Expected a different client to be allowed")
+	}
+}
+
+// Test that X-Forwarded-For is only trusted from configured proxies
+func TestClientIPTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"direct client", "203.0.113.5:4000", "", "203.0.113.5"},
+		{"spoofed header from untrusted peer", "203.0.113.5:4000", "1.2.3.4", "203.0.113.5"},
+		{"trusted proxy", "10.0.0.1:4000", "198.51.100.7", "198.51.100.7"},
+		{"client spoofs, proxy appends", "10.0.0.1:4000", "1.2.3.4, 198.51.100.7", "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.1:4000", "198.51.100.7, 10.0.0.2", "198.51.100.7"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/counter/increment", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := proxies.clientIP(req); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+// Test that the middleware answers 429 with the rate limit headers
+func TestRateLimitMiddleware(t *testing.T) {
+	// Arrange: one request per route, API key "secret" is known
+	routes, err := parseRateLimits("/counter/increment=1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &rateLimiterConfig{
+		clientIdentity: clientIdentity{apiKeys: map[string]bool{"secret": true}},
+		limiter:        newMemoryRateLimiter(),
+		routes:         routes,
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := rateLimitMiddleware(cfg, ok)
+
+	send := func(path, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.RemoteAddr = "203.0.113.5:4000"
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Act + Assert
+	if rr := send("/counter/increment", ""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	rr := send("/counter/increment", "")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", rr.Header().Get("Retry-After"))
+	}
+	if rr.Header().Get("RateLimit-Limit") != "1" || rr.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Unexpected RateLimit headers: %v", rr.Header())
+	}
+
+	// A known API key gets its own bucket, an unknown one falls back to the IP
+	if rr := send("/counter/increment", "secret"); rr.Code != http.StatusOK {
+		t.Errorf("Expected API key request to be allowed, got %d", rr.Code)
+	}
+	if rr := send("/counter/increment", "made-up"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected unknown API key to share the IP bucket, got %d", rr.Code)
+	}
+
+	// Routes without a limit are untouched
+	if rr := send("/counter", ""); rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("Expected /counter to be unlimited, got %d %v", rr.Code, rr.Header())
+	}
+
+	// Requests a Raft follower forwards were limited there
+	cfg.forwardKey = "raft-forward"
+	for range 3 {
+		if rr := send("/counter/increment", "raft-forward"); rr.Code != http.StatusOK {
+			t.Errorf("Expected forwarded requests to be exempt, got %d", rr.Code)
+		}
+	}
+}
+
+// Test that the default limits cover every write, and that a limit with a
+// method applies to that method only
+func TestDefaultRateLimitsCoverWrites(t *testing.T) {
+	// Arrange
+	routes, err := parseRateLimits(defaultRateLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &rateLimiterConfig{routes: routes}
+
+	// Act + Assert
+	for _, route := range []string{"POST /counter/increment", "POST /counter/add", "PUT /counter", "POST /counter/reset"} {
+		if _, _, ok := cfg.limitFor(route); !ok {
+			t.Errorf("Expected a default limit for %s", route)
+		}
+	}
+	if _, _, ok := cfg.limitFor("GET /counter"); ok {
+		t.Errorf("Expected GET /counter to stay unlimited")
+	}
+	if _, err := parseRateLimits("put /counter=1:1"); err == nil {
+		t.Errorf("Expected a lower-case method to be rejected")
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sliding-window rates answer "how many increments in the last minute?"
+// for dashboards and abuse detection, which the cumulative value and the
+// minute rollups (see series.go) cannot: a rollup bucket starts on the
+// minute, a sliding window ends now.
+//
+// Each window is a ring of rateSlots sub-windows, so a counter costs a
+// fixed amount of memory per configured window however fast it is
+// incremented, and the count is exact to within one sub-window. The
+// tracker is fed from the change hub, so on Postgres it also counts the
+// increments made through other replicas (see listenForChanges). Only
+// positive adds count; resets, PUTs and decrements are not increments.
+// With write-behind (see writebehind.go) increments count once flushed.
+
+// rateSlots is the number of sub-windows a window is divided into.
+const rateSlots = 60
+
+// maxRateWindows bounds the windows configured for one counter.
+const maxRateWindows = 8
+
+// defaultRateWindows are tracked for every counter without RATE_WINDOWS_<id>.
+var defaultRateWindows = []time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+
+// errRatesUnsupported is returned by GET /counter/rate when tracking is off.
+var errRatesUnsupported = errors.New("rate windows are off (RATE_WINDOWS=off)")
+
+// slidingWindow counts increments over the last size, in rateSlots slots.
+type slidingWindow struct {
+	size  time.Duration
+	width time.Duration // size / rateSlots
+	slots [rateSlots]int64
+	last  int64 // index of the newest slot, in widths since the Unix epoch
+}
+
+func newSlidingWindow(size time.Duration) *slidingWindow {
+	return &slidingWindow{size: size, width: size / rateSlots}
+}
+
+// advance moves the ring to now, clearing the slots that fell out of it.
+func (w *slidingWindow) advance(now time.Time) {
+	index := now.UnixNano() / int64(w.width)
+	if index <= w.last {
+		return
+	}
+	if index-w.last >= rateSlots {
+		w.slots = [rateSlots]int64{}
+	} else {
+		for i := w.last + 1; i <= index; i++ {
+			w.slots[i%rateSlots] = 0
+		}
+	}
+	w.last = index
+}
+
+func (w *slidingWindow) add(now time.Time, n int64) {
+	w.advance(now)
+	w.slots[w.last%rateSlots] += n
+}
+
+func (w *slidingWindow) count(now time.Time) int64 {
+	w.advance(now)
+	var total int64
+	for _, n := range w.slots {
+		total += n
+	}
+	return total
+}
+
+// trackedRates are the windows of one counter.
+type trackedRates struct {
+	id      int64
+	windows []*slidingWindow // shortest first
+}
+
+// rateTracker keeps the sliding windows of every counter that was
+// incremented recently. At most maxCounters are tracked at once; to make
+// room for another, the least recently incremented counter is dropped if
+// its windows are all empty. Only that one is looked at, so a full tracker
+// costs the same per increment as an empty one.
+type rateTracker struct {
+	defaults    []time.Duration
+	overrides   map[int64][]time.Duration // RATE_WINDOWS_<id>
+	maxCounters int
+
+	mu       sync.Mutex
+	counters map[int64]*list.Element // of recent
+	recent   *list.List              // *trackedRates, least recently incremented first
+
+	tracked   prometheus.GaugeFunc
+	untracked prometheus.Counter
+}
+
+// rates tracks sliding-window rates, or is nil when RATE_WINDOWS=off.
+var rates *rateTracker
+
+// newRateTracker tracks windows of defaults for every counter, or of
+// overrides[id] for counter id, and observes the change hub.
+func newRateTracker(defaults []time.Duration, overrides map[int64][]time.Duration, maxCounters int) *rateTracker {
+	t := &rateTracker{
+		defaults:    defaults,
+		overrides:   overrides,
+		maxCounters: maxCounters,
+		counters:    make(map[int64]*list.Element),
+		recent:      list.New(),
+		untracked: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_rate_untracked_total",
+			Help: "Increments not counted in rate windows because too many counters were tracked.",
+		}),
+	}
+	t.tracked = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "counter_rate_tracked_counters",
+		Help: "Counters with sliding-window rates in memory.",
+	}, func() float64 {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return float64(len(t.counters))
+	})
+	changes.observe(func(ch counterChange) {
+		if ch.Added > 0 {
+			t.add(ch.ID, ch.Added, time.Now())
+		}
+	})
+	return t
+}
+
+// rateTrackerFromEnv reads the windows tracked for every counter from
+// RATE_WINDOWS (default "1m,5m,1h", "off" turns tracking off), the windows
+// of single counters from RATE_WINDOWS_<id>, and the most counters tracked
+// at once from RATE_MAX_COUNTERS (default 10000).
+func rateTrackerFromEnv() (*rateTracker, error) {
+	defaults := defaultRateWindows
+	if raw := os.Getenv("RATE_WINDOWS"); raw == "off" {
+		return nil, nil
+	} else if raw != "" {
+		var err error
+		if defaults, err = parseRateWindows(raw); err != nil {
+			return nil, fmt.Errorf("invalid RATE_WINDOWS %q, want durations like 1m,5m,1h: %w", raw, err)
+		}
+	}
+
+	overrides := make(map[int64][]time.Duration)
+	for _, env := range os.Environ() {
+		name, raw, _ := strings.Cut(env, "=")
+		idStr, ok := strings.CutPrefix(name, "RATE_WINDOWS_")
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil || id < 1 {
+			return nil, fmt.Errorf("invalid %s, want RATE_WINDOWS_<counter id>", name)
+		}
+		if overrides[id], err = parseRateWindows(raw); err != nil {
+			return nil, fmt.Errorf("invalid %s %q, want durations like 10s,1m: %w", name, raw, err)
+		}
+	}
+
+	maxCounters := 10000
+	if raw := os.Getenv("RATE_MAX_COUNTERS"); raw != "" {
+		var err error
+		if maxCounters, err = strconv.Atoi(raw); err != nil || maxCounters < 1 {
+			return nil, fmt.Errorf("invalid RATE_MAX_COUNTERS %q, want a count like 10000", raw)
+		}
+	}
+	return newRateTracker(defaults, overrides, maxCounters), nil
+}
+
+// parseRateWindows parses a comma-separated list of whole-second windows,
+// e.g. "10s,1m,1h", and returns them shortest first.
+func parseRateWindows(s string) ([]time.Duration, error) {
+	var windows []time.Duration
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		d, err := time.ParseDuration(part)
+		if err != nil || d < time.Second || d%time.Second != 0 {
+			return nil, fmt.Errorf("window %q is not a whole number of seconds", part)
+		}
+		windows = append(windows, d)
+	}
+	if len(windows) == 0 || len(windows) > maxRateWindows {
+		return nil, fmt.Errorf("want 1 to %d windows", maxRateWindows)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+	return windows, nil
+}
+
+// formatWindow formats d the way it is usually written: "1m", not "1m0s".
+func formatWindow(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// windows returns the windows tracked for counter id, shortest first.
+func (t *rateTracker) windows(id int64) []time.Duration {
+	if w, ok := t.overrides[id]; ok {
+		return w
+	}
+	return t.defaults
+}
+
+// add counts n increments of counter id at now.
+func (t *rateTracker) add(id, n int64, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elem, ok := t.counters[id]
+	if ok {
+		t.recent.MoveToBack(elem)
+	} else {
+		if len(t.counters) >= t.maxCounters && !t.dropIdle(now) {
+			t.untracked.Add(float64(n))
+			return
+		}
+		tracked := &trackedRates{id: id}
+		for _, size := range t.windows(id) {
+			tracked.windows = append(tracked.windows, newSlidingWindow(size))
+		}
+		elem = t.recent.PushBack(tracked)
+		t.counters[id] = elem
+	}
+	for _, w := range elem.Value.(*trackedRates).windows {
+		w.add(now, n)
+	}
+}
+
+// dropIdle forgets the least recently incremented counter if its longest
+// window is empty, and reports whether it did. The caller must hold t.mu.
+func (t *rateTracker) dropIdle(now time.Time) bool {
+	oldest := t.recent.Front()
+	if oldest == nil {
+		return false
+	}
+	tracked := oldest.Value.(*trackedRates)
+	if tracked.windows[len(tracked.windows)-1].count(now) != 0 {
+		return false
+	}
+	t.recent.Remove(oldest)
+	delete(t.counters, tracked.id)
+	return true
+}
+
+// count returns the increments of counter id in the window of the given
+// size, and false if that window is not tracked for the counter.
+func (t *rateTracker) count(id int64, size time.Duration, now time.Time) (int64, bool) {
+	tracked := false
+	for _, w := range t.windows(id) {
+		tracked = tracked || w == size
+	}
+	if !tracked {
+		return 0, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elem, ok := t.counters[id]
+	if !ok {
+		return 0, true // not incremented recently
+	}
+	for _, w := range elem.Value.(*trackedRates).windows {
+		if w.size == size {
+			return w.count(now), true
+		}
+	}
+	return 0, true
+}
+
+// RateResponse is the JSON response of GET /counter/rate.
+type RateResponse struct {
+	ID            int64    `json:"id"`
+	Window        string   `json:"window"`
+	WindowSeconds int64    `json:"window_seconds"`
+	Count         int64    `json:"count"`      // increments in the window
+	PerSecond     float64  `json:"per_second"` // count / window_seconds
+	Windows       []string `json:"windows"`    // every window tracked for the counter
+}
+
+// rateHandler handles GET /counter/rate?id=&window=: the increments of a
+// counter in a sliding window (default: its shortest window). Counters that
+// do not exist get 404, not a count of 0.
+func rateHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if rates == nil {
+		http.Error(w, errRatesUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	id, err := counterIDParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tracked := rates.windows(id)
+	names := make([]string, len(tracked))
+	for i, d := range tracked {
+		names[i] = formatWindow(d)
+	}
+	size := tracked[0]
+	if raw := r.URL.Query().Get("window"); raw != "" {
+		if size, err = time.ParseDuration(raw); err != nil {
+			http.Error(w, fmt.Sprintf("invalid window %q, want one of %s", raw, strings.Join(names, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+	count, ok := rates.count(id, size, time.Now())
+	if !ok {
+		http.Error(w, fmt.Sprintf("window %s is not tracked for counter %d, want one of %s",
+			formatWindow(size), id, strings.Join(names, ", ")), http.StatusBadRequest)
+		return
+	}
+	if _, err := store.Get(r.Context(), id); err != nil {
+		writeStoreError(w, r, "DB query failed", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RateResponse{
+		ID:            id,
+		Window:        formatWindow(size),
+		WindowSeconds: int64(size / time.Second),
+		Count:         count,
+		PerSecond:     float64(count) / size.Seconds(),
+		Windows:       names,
+	})
+}
+
+// Describe and Collect export the tracker metrics on /metrics.
+func (t *rateTracker) Describe(ch chan<- *prometheus.Desc) {
+	t.tracked.Describe(ch)
+	t.untracked.Describe(ch)
+}
+
+func (t *rateTracker) Collect(ch chan<- prometheus.Metric) {
+	t.tracked.Collect(ch)
+	t.untracked.Collect(ch)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// useRates makes a tracker of windows (plus overrides) the global one for one test.
+func useRates(t *testing.T, windows []time.Duration, overrides map[int64][]time.Duration) *rateTracker {
+	t.Helper()
+	r := newRateTracker(windows, overrides, 100)
+	rates = r
+	t.Cleanup(func() { rates = nil })
+	return r
+}
+
+// Test that old increments slide out of the window one slot at a time
+func TestSlidingWindow(t *testing.T) {
+	// Arrange
+	w := newSlidingWindow(time.Minute)
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	w.add(start, 3)
+	w.add(start.Add(30*time.Second), 2)
+
+	// Act
+	inside := w.count(start.Add(59 * time.Second))
+	half := w.count(start.Add(75 * time.Second))
+	gone := w.count(start.Add(10 * time.Minute))
+
+	// Assert
+	if inside != 5 {
+		t.Errorf("Expected 5 increments within the minute, got %d", inside)
+	}
+	if half != 2 {
+		t.Errorf("Expected only the later 2 increments after 75s, got %d", half)
+	}
+	if gone != 0 {
+		t.Errorf("Expected an empty window after 10 minutes, got %d", gone)
+	}
+}
+
+// Test that the tracker makes room by dropping idle counters, and counts
+// what it cannot track
+func TestRateTrackerBounded(t *testing.T) {
+	// Arrange
+	r := newRateTracker([]time.Duration{time.Minute}, nil, 1)
+	now := time.Now()
+	r.add(1, 1, now.Add(-2*time.Minute))
+
+	// Act
+	r.add(2, 4, now) // counter 1 is idle, so it is dropped
+	r.add(3, 7, now) // counter 2 is not
+	count, _ := r.count(2, time.Minute, now)
+
+	// Assert
+	if count != 4 {
+		t.Errorf("Expected counter 2 to be tracked with 4, got %d", count)
+	}
+	if _, ok := r.counters[3]; ok {
+		t.Errorf("Expected counter 3 to stay untracked")
+	}
+	if got := len(r.counters); got != 1 {
+		t.Errorf("Expected 1 tracked counter, got %d", got)
+	}
+}
+
+// Test that the tracker drops the least recently incremented counter, not
+// the first one it tracked
+func TestRateTrackerDropsLeastRecent(t *testing.T) {
+	// Arrange
+	r := newRateTracker([]time.Duration{time.Minute}, nil, 2)
+	now := time.Now()
+	r.add(1, 1, now.Add(-3*time.Minute))
+	r.add(2, 1, now.Add(-2*time.Minute))
+	r.add(1, 1, now)
+
+	// Act
+	r.add(3, 5, now)
+
+	// Assert
+	if _, ok := r.counters[2]; ok {
+		t.Errorf("Expected idle counter 2 to be dropped")
+	}
+	if count, _ := r.count(1, time.Minute, now); count != 1 || len(r.counters) != 2 || r.recent.Len() != 2 {
+		t.Errorf("Expected counters 1 and 3 tracked with 1 increment of counter 1, got %d and %d tracked", count, len(r.counters))
+	}
+}
+
+// Test GET /counter/rate after a few increments, including per-counter windows
+func TestRateHandler(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	useRates(t, []time.Duration{time.Minute, time.Hour}, map[int64][]time.Duration{2: {10 * time.Second}})
+	for range 3 {
+		sendWithHeader(t, "POST", server.URL+"/counter/increment", "", "", "")
+	}
+	sendWithHeader(t, "PUT", server.URL+"/counter", "Content-Type", "application/json", `{"value": 100}`)
+
+	// Act
+	resp, err := http.Get(server.URL + "/counter/rate?window=1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var rate RateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rate); err != nil {
+		t.Fatal(err)
+	}
+	untracked := sendWithHeader(t, "GET", server.URL+"/counter/rate?id=2&window=1m", "", "", "")
+	missing := sendWithHeader(t, "GET", server.URL+"/counter/rate?id=99", "", "", "")
+
+	// Assert
+	if rate.Count != 3 || rate.WindowSeconds != 60 || rate.PerSecond != 0.05 {
+		t.Errorf("Expected 3 increments in 60s (0.05/s), got %+v", rate)
+	}
+	if len(rate.Windows) != 2 || rate.Windows[1] != "1h" {
+		t.Errorf("Expected windows [1m 1h], got %v", rate.Windows)
+	}
+	if untracked.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a window counter 2 does not track, got %d", untracked.StatusCode)
+	}
+	if missing.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a counter that does not exist, got %d", missing.StatusCode)
+	}
+}
+
+// Test that NOTIFY payloads carry the version, and the delta of adds but
+// not of sets
+func TestParseChangePayloadDelta(t *testing.T) {
+	// Act
+	add, addErr := parseChangePayload("7:12:5:3")
+	set, setErr := parseChangePayload("7:100:6")
+	_, shortErr := parseChangePayload("7:100")
+
+	// Assert
+	if addErr != nil || add != (counterChange{ID: 7, Value: 12, Version: 5, Added: 3}) {
+		t.Errorf("Expected an add of 3 at version 5, got %+v (err %v)", add, addErr)
+	}
+	if setErr != nil || set != (counterChange{ID: 7, Value: 100, Version: 6}) {
+		t.Errorf("Expected a set without delta at version 6, got %+v (err %v)", set, setErr)
+	}
+	if shortErr == nil {
+		t.Errorf("Expected a payload without version to be rejected")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "net/http"
+
+// route describes one HTTP endpoint.
+// Keeping the routes in a table (instead of scattered HandleFunc calls) lets
+// the OpenAPI test check that every route is documented in openapi.json.
+type route struct {
+	path    string
+	methods []string // methods documented in the spec (OPTIONS preflight is implied)
+	handler http.HandlerFunc
+}
+
+// apiRoutes returns every endpoint served by the backend.
+func apiRoutes() []route {
+	return []route{
+		{"/counter", []string{http.MethodGet, http.MethodPut}, counterHandler},
+		{"/counter/increment", []string{http.MethodPost}, incrementCounterHandler},
+		{"/counter/add", []string{http.MethodPost}, addCounterHandler},
+		{"/counter/reset", []string{http.MethodPost}, resetCounterHandler},
+		{"/counter/history", []string{http.MethodGet}, historyHandler},
+		{"/counter/series", []string{http.MethodGet}, seriesHandler},
+		{"/counter/rate", []string{http.MethodGet}, rateHandler},
+		{"/counter/watch", []string{http.MethodGet}, watchCounterHandler},
+		{"/ws", []string{http.MethodGet}, wsHandler},
+		{"/counter/shards", []string{http.MethodGet, http.MethodPut}, shardsHandler},
+		{"/counter/bounds", []string{http.MethodGet, http.MethodPut}, boundsHandler},
+		{"/counter/schedule", []string{http.MethodGet, http.MethodPut, http.MethodDelete}, scheduleHandler},
+		{"/operations/{id}", []string{http.MethodGet}, operationHandler},
+		{"/alerts", []string{http.MethodGet, http.MethodPost}, alertsHandler},
+		{"/alerts/{id}", []string{http.MethodDelete}, alertHandler},
+		{"/counters", []string{http.MethodGet}, listCountersHandler},
+		{"/cluster", []string{http.MethodGet}, clusterHandler},
+		{"/cluster/join", []string{http.MethodPost}, joinClusterHandler},
+		{"/cluster/remove", []string{http.MethodPost}, removeClusterHandler},
+		{"/admin/spool", []string{http.MethodGet}, spoolHandler},
+		{"/admin/alerts/dead-letters", []string{http.MethodGet}, deadLettersHandler},
+		{"/ready", []string{http.MethodGet}, readyHandler},
+		{"/metrics", []string{http.MethodGet}, metricsHandler},
+		{"/openapi.json", []string{http.MethodGet}, openAPIHandler},
+		{"/docs", []string{http.MethodGet}, docsHandler},
+	}
+}
+
+// registerRoutes adds every route to mux.
+func registerRoutes(mux *http.ServeMux) {
+	for _, rt := range apiRoutes() {
+		mux.HandleFunc(rt.path, rt.handler)
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+)
+
+// Scheduled resets: a counter can carry a cron schedule, such as
+//
+//	PUT /counter/schedule?id=7  {"cron": "0 0 * * *", "timezone": "Europe/Berlin"}
+//
+// for "today's visitors". When the schedule fires, the backend writes the
+// counter's value to its history as an "archive" entry and resets it to 0
+// (or to the nearest bound, see bounds.go), in one transaction.
+//
+// Every replica runs the scheduler. On Postgres each firing takes an
+// advisory lock on the counter and checks that the run is still due, so a
+// schedule fires on exactly one replica. Runs missed while the backend was
+// down are handled by the schedule's catch-up policy:
+//
+//	once  reset once as soon as the backend is back, however many runs were missed (default)
+//	skip  drop runs that are more than the grace period late and wait for the next one
+
+// Catch-up policies.
+const (
+	catchUpOnce = "once"
+	catchUpSkip = "skip"
+)
+
+// scheduleLockClass is the first key of the per-counter advisory locks.
+const scheduleLockClass = 0x5343 // "SC"
+
+var (
+	// errScheduleNotFound is returned for counters without a reset schedule.
+	errScheduleNotFound = errors.New("counter has no reset schedule")
+	// errSchedulesUnsupported is returned by stores that cannot keep schedules.
+	errSchedulesUnsupported = errors.New("reset schedules are not available with STORE=raft")
+)
+
+// ResetSchedule is when counter ID is reset, as returned by GET /counter/schedule.
+type ResetSchedule struct {
+	ID       int64      `json:"id"`
+	Cron     string     `json:"cron"`     // five fields, or a descriptor such as @daily
+	Timezone string     `json:"timezone"` // IANA name the cron fields are read in
+	CatchUp  string     `json:"catch_up"` // once or skip
+	NextRun  time.Time  `json:"next_run"`
+	LastRun  *time.Time `json:"last_run,omitempty"`
+}
+
+// ScheduleRequest is the body of PUT /counter/schedule.
+type ScheduleRequest struct {
+	Cron     string `json:"cron"`
+	Timezone string `json:"timezone,omitempty"` // default UTC
+	CatchUp  string `json:"catch_up,omitempty"` // once (default) or skip
+}
+
+// scheduleStore is implemented by stores that keep reset schedules.
+type scheduleStore interface {
+	// Schedule returns the reset schedule of counter id.
+	Schedule(ctx context.Context, id int64) (ResetSchedule, error)
+	// SetSchedule creates or replaces the reset schedule of counter s.ID.
+	SetSchedule(ctx context.Context, s ResetSchedule) error
+	// DeleteSchedule removes the reset schedule of counter id.
+	DeleteSchedule(ctx context.Context, id int64) error
+}
+
+// scheduleRunner is implemented by stores the scheduler can fire schedules on.
+type scheduleRunner interface {
+	// DueSchedules returns the schedules whose next run is at or before now.
+	DueSchedules(ctx context.Context, now time.Time) ([]ResetSchedule, error)
+	// FireSchedule archives and resets the counter of s if reset is set, and
+	// moves s on to next. It reports false, without doing anything, if s is
+	// no longer due as read (another replica fired it).
+	FireSchedule(ctx context.Context, s ResetSchedule, reset bool, next time.Time) (bool, error)
+}
+
+// parseSchedule parses a standard cron expression read in timezone tz.
+func parseSchedule(expr, tz string) (cron.Schedule, *time.Location, error) {
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unknown timezone %q", tz)
+	}
+	schedule, err := cron.ParseStandard(expr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+	}
+	return schedule, loc, nil
+}
+
+// newResetSchedule validates req and returns the schedule of counter id as
+// of now.
+func newResetSchedule(id int64, req ScheduleRequest, now time.Time) (ResetSchedule, error) {
+	s := ResetSchedule{ID: id, Cron: req.Cron, Timezone: req.Timezone, CatchUp: req.CatchUp}
+	if s.Timezone == "" {
+		s.Timezone = "UTC"
+	}
+	switch s.CatchUp {
+	case "":
+		s.CatchUp = catchUpOnce
+	case catchUpOnce, catchUpSkip:
+	default:
+		return s, fmt.Errorf("catch_up must be %s or %s", catchUpOnce, catchUpSkip)
+	}
+	schedule, loc, err := parseSchedule(s.Cron, s.Timezone)
+	if err != nil {
+		return s, err
+	}
+	s.NextRun = schedule.Next(now.In(loc)).UTC()
+	if s.NextRun.IsZero() {
+		return s, fmt.Errorf("cron expression %q never fires", s.Cron)
+	}
+	return s, nil
+}
+
+// plan decides what to do about s, which is due at now: whether to reset
+// the counter, and when s runs next.
+func (s ResetSchedule) plan(now time.Time, grace time.Duration) (reset bool, next time.Time, err error) {
+	schedule, loc, err := parseSchedule(s.Cron, s.Timezone)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	reset = s.CatchUp != catchUpSkip || now.Sub(s.NextRun) <= grace
+	return reset, schedule.Next(now.In(loc)).UTC(), nil
+}
+
+// scheduler fires the reset schedules of a store.
+type scheduler struct {
+	runner   scheduleRunner
+	interval time.Duration
+	grace    time.Duration // how late a skip schedule may still fire
+
+	runs *prometheus.CounterVec
+}
+
+// newScheduler checks runner's schedules every interval. Runs of skip
+// schedules are dropped once they are a minute late, or two intervals if
+// that is longer.
+func newScheduler(runner scheduleRunner, interval time.Duration) *scheduler {
+	return &scheduler{
+		runner:   runner,
+		interval: interval,
+		grace:    max(time.Minute, 2*interval),
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "counter_schedule_runs_total",
+			Help: "Scheduled counter resets, by outcome (reset, skipped or failed).",
+		}, []string{"outcome"}),
+	}
+}
+
+// schedulerFromEnv reads the check interval from SCHEDULE_INTERVAL (default 10s).
+func schedulerFromEnv(runner scheduleRunner) (*scheduler, error) {
+	interval := 10 * time.Second
+	if raw := os.Getenv("SCHEDULE_INTERVAL"); raw != "" {
+		var err error
+		if interval, err = time.ParseDuration(raw); err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid SCHEDULE_INTERVAL %q, want a duration like 10s", raw)
+		}
+	}
+	return newScheduler(runner, interval), nil
+}
+
+// run fires due schedules every interval until ctx ends.
+func (sc *scheduler) run(ctx context.Context) {
+	ticker := time.NewTicker(sc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sc.fireDue(ctx, time.Now()); err != nil && ctx.Err() == nil {
+				log.Printf("Checking reset schedules failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// fireDue fires every schedule that is due at now.
+func (sc *scheduler) fireDue(ctx context.Context, now time.Time) error {
+	due, err := sc.runner.DueSchedules(ctx, now)
+	if err != nil {
+		return err
+	}
+	for _, s := range due {
+		reset, next, err := s.plan(now, sc.grace)
+		if err == nil {
+			var fired bool
+			fired, err = sc.runner.FireSchedule(ctx, s, reset, next)
+			if err == nil && !fired {
+				continue // another replica got there first
+			}
+		}
+		switch {
+		case err != nil:
+			sc.runs.WithLabelValues("failed").Inc()
+			log.Printf("Scheduled reset of counter %d failed: %v\n", s.ID, err)
+		case reset:
+			sc.runs.WithLabelValues("reset").Inc()
+		default:
+			sc.runs.WithLabelValues("skipped").Inc()
+			log.Printf("Skipping the reset of counter %d due at %v (catch_up=skip)\n", s.ID, s.NextRun)
+		}
+	}
+	return nil
+}
+
+// Describe and Collect export the scheduler metrics on /metrics.
+func (sc *scheduler) Describe(ch chan<- *prometheus.Desc) {
+	sc.runs.Describe(ch)
+}
+
+func (sc *scheduler) Collect(ch chan<- prometheus.Metric) {
+	sc.runs.Collect(ch)
+}
+
+// scheduleHandler handles /counter/schedule: GET reads a counter's reset
+// schedule, PUT creates or replaces it and DELETE removes it.
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed, use GET, PUT or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := counterIDParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	schedules, ok := capability[scheduleStore](store)
+	if !ok {
+		http.Error(w, errSchedulesUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		if err := schedules.DeleteSchedule(r.Context(), id); err != nil {
+			writeScheduleError(w, r, "DB delete failed", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPut:
+		var req ScheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		s, err := newResetSchedule(id, req, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := schedules.SetSchedule(r.Context(), s); err != nil {
+			writeScheduleError(w, r, "DB update failed", err)
+			return
+		}
+	}
+
+	s, err := schedules.Schedule(r.Context(), id)
+	if err != nil {
+		writeScheduleError(w, r, "DB query failed", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// writeScheduleError is writeStoreError plus 404 for counters without a
+// schedule and 501 for stores without schedules.
+func writeScheduleError(w http.ResponseWriter, r *http.Request, prefix string, err error) {
+	if errors.Is(err, errScheduleNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errSchedulesUnsupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	writeStoreError(w, r, prefix, err)
+}
+
+// createScheduleTable creates the table of reset schedules.
+func createScheduleTable(ctx context.Context) error {
+	_, err := db.Exec(ctx,
+		`CREATE TABLE IF NOT EXISTS counter_schedules (
+			counter_id INTEGER PRIMARY KEY,
+			cron       TEXT NOT NULL,
+			timezone   TEXT NOT NULL,
+			catch_up   TEXT NOT NULL,
+			next_run   TIMESTAMPTZ NOT NULL,
+			last_run   TIMESTAMPTZ
+		);
+		CREATE INDEX IF NOT EXISTS counter_schedules_next_run ON counter_schedules (next_run)`)
+	return err
+}
+
+// scanSchedule reads a counter_schedules row.
+func scanSchedule(row pgx.CollectableRow) (ResetSchedule, error) {
+	var s ResetSchedule
+	err := row.Scan(&s.ID, &s.Cron, &s.Timezone, &s.CatchUp, &s.NextRun, &s.LastRun)
+	s.NextRun = s.NextRun.UTC()
+	if s.LastRun != nil {
+		*s.LastRun = s.LastRun.UTC()
+	}
+	return s, err
+}
+
+func (postgresStore) Schedule(ctx context.Context, id int64) (ResetSchedule, error) {
+	rows, err := db.Query(ctx,
+		"SELECT counter_id, cron, timezone, catch_up, next_run, last_run FROM counter_schedules WHERE counter_id=$1", id)
+	if err != nil {
+		return ResetSchedule{}, err
+	}
+	s, err := pgx.CollectExactlyOneRow(rows, scanSchedule)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return s, errScheduleNotFound
+	}
+	return s, err
+}
+
+func (postgresStore) SetSchedule(ctx context.Context, s ResetSchedule) error {
+	tag, err := db.Exec(ctx,
+		`INSERT INTO counter_schedules (counter_id, cron, timezone, catch_up, next_run)
+		 SELECT id, $2, $3, $4, $5 FROM counters WHERE id=$1
+		 ON CONFLICT (counter_id) DO UPDATE SET cron = EXCLUDED.cron, timezone = EXCLUDED.timezone,
+			catch_up = EXCLUDED.catch_up, next_run = EXCLUDED.next_run`,
+		s.ID, s.Cron, s.Timezone, s.CatchUp, s.NextRun)
+	if err == nil && tag.RowsAffected() == 0 {
+		return errCounterNotFound
+	}
+	return err
+}
+
+func (postgresStore) DeleteSchedule(ctx context.Context, id int64) error {
+	tag, err := db.Exec(ctx, "DELETE FROM counter_schedules WHERE counter_id=$1", id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return errScheduleNotFound
+	}
+	return err
+}
+
+func (postgresStore) DueSchedules(ctx context.Context, now time.Time) ([]ResetSchedule, error) {
+	rows, err := db.Query(ctx,
+		`SELECT counter_id, cron, timezone, catch_up, next_run, last_run FROM counter_schedules
+		 WHERE next_run <= $1 ORDER BY next_run`, now)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanSchedule)
+}
+
+// FireSchedule holds an advisory lock on the counter's schedule while it
+// checks that the run is still due, archives and resets the counter, and
+// moves the schedule on, all in one transaction. A replica that does not
+// get the lock leaves the run to the one that did.
+func (postgresStore) FireSchedule(ctx context.Context, s ResetSchedule, reset bool, next time.Time) (bool, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1, $2::int)", scheduleLockClass, s.ID).Scan(&locked); err != nil || !locked {
+		return false, err
+	}
+	tag, err := tx.Exec(ctx,
+		"UPDATE counter_schedules SET next_run=$3, last_run=now() WHERE counter_id=$1 AND next_run=$2",
+		s.ID, s.NextRun, next)
+	if err != nil || tag.RowsAffected() == 0 {
+		return false, err
+	}
+
+	var resetErr error
+	if reset {
+		current, err := lockCounter(ctx, tx, s.ID)
+		if err != nil {
+			return false, err
+		}
+		value, err := current.bounds.set(0)
+		if err == nil {
+			_, err = tx.Exec(ctx,
+				"INSERT INTO counter_history (counter_id, op, delta, value) VALUES ($1, 'archive', 0, $2)",
+				s.ID, current.value)
+			if err != nil {
+				return false, err
+			}
+			if _, _, err := setVersioned(ctx, tx, s.ID, value, true); err != nil {
+				return false, err
+			}
+		}
+		resetErr = err // a counter whose bounds exclude 0 keeps its value, and the schedule moves on
+	}
+	return true, errors.Join(resetErr, tx.Commit(ctx))
+}
+
+func (m *memoryStore) Schedule(_ context.Context, id int64) (ResetSchedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.schedules[id]
+	if !ok {
+		return ResetSchedule{}, errScheduleNotFound
+	}
+	return s, nil
+}
+
+func (m *memoryStore) SetSchedule(_ context.Context, s ResetSchedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.values[s.ID]; !ok {
+		return errCounterNotFound
+	}
+	s.LastRun = m.schedules[s.ID].LastRun
+	m.schedules[s.ID] = s
+	return nil
+}
+
+func (m *memoryStore) DeleteSchedule(_ context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.schedules[id]; !ok {
+		return errScheduleNotFound
+	}
+	delete(m.schedules, id)
+	return nil
+}
+
+func (m *memoryStore) DueSchedules(_ context.Context, now time.Time) ([]ResetSchedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var due []ResetSchedule
+	for _, s := range m.schedules {
+		if !s.NextRun.After(now) {
+			due = append(due, s)
+		}
+	}
+	return due, nil
+}
+
+func (m *memoryStore) FireSchedule(_ context.Context, s ResetSchedule, reset bool, next time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.schedules[s.ID]
+	if !ok || !current.NextRun.Equal(s.NextRun) {
+		return false, nil
+	}
+	now := time.Now().UTC()
+	current.NextRun, current.LastRun = next, &now
+	m.schedules[s.ID] = current
+
+	if !reset {
+		return true, nil
+	}
+	old := m.values[s.ID]
+	value, err := m.bounds[s.ID].set(0)
+	if err != nil {
+		return true, err
+	}
+	m.history[s.ID] = append(m.history[s.ID], HistoryEntry{At: now, Op: "archive", Value: old})
+	m.values[s.ID] = value
+	m.record(s.ID, "set", value-old, value)
+	return true, nil
+}
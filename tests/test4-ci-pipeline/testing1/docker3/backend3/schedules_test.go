@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Test that cron fields are read in the schedule's timezone
+func TestNewResetScheduleTimezone(t *testing.T) {
+	// Arrange
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Act
+	s, err := newResetSchedule(7, ScheduleRequest{Cron: "0 0 * * *", Timezone: "Europe/Berlin"}, now)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 5, 1, 22, 0, 0, 0, time.UTC); !s.NextRun.Equal(want) || s.CatchUp != catchUpOnce {
+		t.Errorf("Expected midnight in Berlin (%v) with catch_up once, got %v %s", want, s.NextRun, s.CatchUp)
+	}
+	for _, req := range []ScheduleRequest{
+		{Cron: "0 0 * *"},
+		{Cron: "@daily", Timezone: "Mars/Olympus"},
+		{Cron: "@daily", CatchUp: "all"},
+	} {
+		if _, err := newResetSchedule(7, req, now); err == nil {
+			t.Errorf("Expected %+v to be rejected", req)
+		}
+	}
+}
+
+// Test that skip drops a run missed by more than the grace period, and once does not
+func TestResetSchedulePlan(t *testing.T) {
+	// Arrange
+	now := time.Date(2024, 5, 2, 9, 30, 0, 0, time.UTC)
+	missed := ResetSchedule{Cron: "0 0 * * *", Timezone: "UTC", NextRun: time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)}
+	once, skip := missed, missed
+	once.CatchUp, skip.CatchUp = catchUpOnce, catchUpSkip
+
+	// Act
+	resetOnce, next, _ := once.plan(now, time.Minute)
+	resetSkip, _, _ := skip.plan(now, time.Minute)
+	resetLate, _, _ := skip.plan(missed.NextRun.Add(30*time.Second), time.Minute)
+
+	// Assert
+	if !resetOnce || resetSkip || !resetLate {
+		t.Errorf("Expected once to reset, skip to drop the missed run and keep a late one, got %v %v %v", resetOnce, resetSkip, resetLate)
+	}
+	if want := time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC); !next.Equal(want) {
+		t.Errorf("Expected the next run at %v, got %v", want, next)
+	}
+}
+
+// failingRunner is a scheduleRunner whose resets fail like a lost database
+// connection: FireSchedule reports (false, err).
+type failingRunner struct{ due []ResetSchedule }
+
+func (f failingRunner) DueSchedules(context.Context, time.Time) ([]ResetSchedule, error) {
+	return f.due, nil
+}
+
+func (f failingRunner) FireSchedule(context.Context, ResetSchedule, bool, time.Time) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+// Test that a reset that failed is counted as failed, not as lost to
+// another replica
+func TestSchedulerCountsFailedResets(t *testing.T) {
+	// Arrange
+	now := time.Now()
+	s, _ := newResetSchedule(1, ScheduleRequest{Cron: "@hourly"}, now.Add(-2*time.Hour))
+	sc := newScheduler(failingRunner{due: []ResetSchedule{s}}, time.Second)
+
+	// Act
+	err := sc.fireDue(context.Background(), now)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(sc.runs.WithLabelValues("failed")); got != 1 {
+		t.Errorf("Expected 1 failed run, got %v", got)
+	}
+}
+
+// Test that a due schedule archives the value, resets the counter and
+// fires only once
+func TestSchedulerFiresOnce(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	m := newMemoryStore()
+	m.Set(ctx, 1, 42)
+	now := time.Now()
+	s, _ := newResetSchedule(1, ScheduleRequest{Cron: "@hourly"}, now.Add(-2*time.Hour))
+	m.SetSchedule(ctx, s)
+	sc := newScheduler(m, time.Second)
+
+	// Act
+	sc.fireDue(ctx, now)
+	sc.fireDue(ctx, now)
+	stale, _ := m.FireSchedule(ctx, s, true, now) // another replica with an old copy
+
+	// Assert
+	value, _ := m.Get(ctx, 1)
+	history, _ := m.History(ctx, 1, 2)
+	if value != 0 {
+		t.Errorf("Expected the counter to be reset, got %d", value)
+	}
+	if len(history) != 2 || history[1].Op != "archive" || history[1].Value != 42 {
+		t.Errorf("Expected an archive entry of 42 before the reset, got %+v", history)
+	}
+	if got := testutil.ToFloat64(sc.runs.WithLabelValues("reset")); got != 1 || stale {
+		t.Errorf("Expected exactly one reset, got %v (stale copy fired: %v)", got, stale)
+	}
+	if current, _ := m.Schedule(ctx, 1); !current.NextRun.After(now) || current.LastRun == nil {
+		t.Errorf("Expected the schedule to move past now, got %+v", current)
+	}
+}
+
+// Test PUT, GET and DELETE /counter/schedule
+func TestScheduleHTTP(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	put := sendWithHeader(t, "PUT", server.URL+"/counter/schedule", "", "", `{"cron": "0 0 * * *", "timezone": "America/New_York"}`)
+
+	// Act
+	resp, err := http.Get(server.URL + "/counter/schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var s ResetSchedule
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	deleted := sendWithHeader(t, "DELETE", server.URL+"/counter/schedule", "", "", "")
+	gone := sendWithHeader(t, "GET", server.URL+"/counter/schedule", "", "", "")
+
+	// Assert
+	if put.StatusCode != http.StatusOK || s.Timezone != "America/New_York" || s.NextRun.IsZero() {
+		t.Errorf("Expected the schedule back, got %d %+v", put.StatusCode, s)
+	}
+	if deleted.StatusCode != http.StatusNoContent || gone.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 204 then 404, got %d and %d", deleted.StatusCode, gone.StatusCode)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Increments are rolled up into per-minute, per-hour and per-day buckets
+// for charts such as "clicks per hour". Only adds count: a reset or PUT
+// moves the total but is not a click. Each resolution is kept for its own
+// retention, so old data survives only in the coarser buckets.
+//
+// The memory store fills the buckets as it writes. The Postgres store rolls
+// counter_history up in the background (see rollUp), so the write path and
+// sharded counters gain no hot rows; queries add the history rows that are
+// not rolled up yet, so the newest bucket is always current.
+
+// resolution is one bucket size rollups are kept at.
+type resolution struct {
+	name string // also the date_trunc field
+	step time.Duration
+}
+
+// resolutions from finest to coarsest.
+var resolutions = []resolution{
+	{"minute", time.Minute},
+	{"hour", time.Hour},
+	{"day", 24 * time.Hour},
+}
+
+// rollupRetention is how long buckets of each resolution are kept; 0 keeps
+// them forever. main overrides it from ROLLUP_<RESOLUTION>_RETENTION.
+var rollupRetention = map[string]time.Duration{
+	"minute": 48 * time.Hour,
+	"hour":   90 * 24 * time.Hour,
+	"day":    0,
+}
+
+// maxSeriesPoints bounds one /counter/series response.
+const maxSeriesPoints = 10000
+
+// errSeriesUnsupported is returned by stores without rollups.
+var errSeriesUnsupported = errors.New("time series are not available with STORE=raft")
+
+// seriesStore is implemented by stores that keep rollups.
+type seriesStore interface {
+	// Series returns the non-empty buckets of counter id at resolution res
+	// that start in [from, to), oldest first.
+	Series(ctx context.Context, id int64, res resolution, from, to time.Time) ([]SeriesPoint, error)
+}
+
+// SeriesPoint is the sum of the increments in one bucket.
+type SeriesPoint struct {
+	At    time.Time `json:"at"` // start of the bucket
+	Delta int64     `json:"delta"`
+}
+
+// SeriesResponse is the JSON response of GET /counter/series.
+type SeriesResponse struct {
+	ID          int64         `json:"id"`
+	StepSeconds int64         `json:"step_seconds"`
+	From        time.Time     `json:"from"`
+	To          time.Time     `json:"to"`
+	Points      []SeriesPoint `json:"points"`
+}
+
+// rollupRetentionFromEnv reads ROLLUP_MINUTE_RETENTION, ROLLUP_HOUR_RETENTION
+// and ROLLUP_DAY_RETENTION (durations, 0 for forever).
+func rollupRetentionFromEnv() error {
+	for _, res := range resolutions {
+		key := "ROLLUP_" + strings.ToUpper(res.name) + "_RETENTION"
+		raw := os.Getenv(key)
+		if raw == "" {
+			continue
+		}
+		retention, err := time.ParseDuration(raw)
+		if err != nil || retention < 0 || (retention > 0 && retention < res.step) {
+			return fmt.Errorf("invalid %s %q, want 0 or a duration of at least %v", key, raw, res.step)
+		}
+		rollupRetention[res.name] = retention
+	}
+	return nil
+}
+
+// parseStep reads the step parameter: minute, hour, day, or a duration
+// that is a whole number of minutes, such as 15m or 6h. It returns the step
+// and the coarsest resolution it can be summed from.
+func parseStep(raw string) (time.Duration, resolution, error) {
+	if raw == "" {
+		raw = "hour"
+	}
+	for _, res := range resolutions {
+		if raw == res.name {
+			return res.step, res, nil
+		}
+	}
+	step, err := time.ParseDuration(raw)
+	if err != nil || step < time.Minute || step%time.Minute != 0 {
+		return 0, resolution{}, fmt.Errorf("invalid step %q, want minute, hour, day or a whole number of minutes such as 15m", raw)
+	}
+	res := resolutions[0]
+	for _, r := range resolutions {
+		if step%r.step == 0 {
+			res = r
+		}
+	}
+	return step, res, nil
+}
+
+// parseSeriesRange reads from and to (RFC 3339). to defaults to now and
+// from to 60 steps before it; from is rounded down to a whole step.
+func parseSeriesRange(r *http.Request, step time.Duration) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+	to := time.Now().UTC()
+	if raw := q.Get("to"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to %q, want RFC 3339 such as 2024-05-01T00:00:00Z", raw)
+		}
+		to = t.UTC()
+	}
+	from := to.Add(-60 * step)
+	if raw := q.Get("from"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from %q, want RFC 3339 such as 2024-05-01T00:00:00Z", raw)
+		}
+		from = t.UTC()
+	}
+	from = from.Truncate(step)
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("from must be before to")
+	}
+	if to.Sub(from)/step > maxSeriesPoints {
+		return time.Time{}, time.Time{}, fmt.Errorf("too many points, at most %d per request; use a larger step", maxSeriesPoints)
+	}
+	return from, to, nil
+}
+
+// fillSeries sums buckets into steps starting at from, with a zero for
+// every step without increments.
+func fillSeries(buckets []SeriesPoint, from, to time.Time, step time.Duration) []SeriesPoint {
+	points := make([]SeriesPoint, 0, to.Sub(from)/step+1)
+	for at := from; at.Before(to); at = at.Add(step) {
+		points = append(points, SeriesPoint{At: at})
+	}
+	for _, b := range buckets {
+		i := int(b.At.Sub(from) / step)
+		if b.At.Before(from) || i >= len(points) {
+			continue
+		}
+		points[i].Delta += b.Delta
+	}
+	return points
+}
+
+// seriesHandler handles GET /counter/series: increments per step between
+// from and to, as JSON or, with ?format=csv or Accept: text/csv, as CSV.
+func seriesHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := counterIDParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	step, res, err := parseStep(r.URL.Query().Get("step"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseSeriesRange(r, step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, ok := capability[seriesStore](store)
+	if !ok {
+		http.Error(w, errSeriesUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	buckets, err := series.Series(r.Context(), id, res, from, to)
+	if errors.Is(err, errSeriesUnsupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, "DB query failed", err)
+		return
+	}
+	points := fillSeries(buckets, from, to, step)
+
+	if r.URL.Query().Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		w.Header().Set("Content-Type", "text/csv")
+		out := csv.NewWriter(w)
+		out.Write([]string{"at", "delta"})
+		for _, p := range points {
+			out.Write([]string{p.At.Format(time.RFC3339), strconv.FormatInt(p.Delta, 10)})
+		}
+		out.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SeriesResponse{
+		ID:          id,
+		StepSeconds: int64(step / time.Second),
+		From:        from,
+		To:          to,
+		Points:      points,
+	})
+}
+
+// recordRollup adds delta to the current bucket of every resolution of
+// counter id and drops buckets past their retention. The caller must hold m.mu.
+func (m *memoryStore) recordRollup(id, delta int64, at time.Time) {
+	for _, res := range resolutions {
+		byID := m.rollups[res.name]
+		if byID == nil {
+			byID = make(map[int64]map[time.Time]int64)
+			m.rollups[res.name] = byID
+		}
+		buckets := byID[id]
+		if buckets == nil {
+			buckets = make(map[time.Time]int64)
+			byID[id] = buckets
+		}
+		bucket := at.Truncate(res.step)
+		if _, ok := buckets[bucket]; !ok {
+			// A new bucket: a good moment to drop expired ones.
+			if retention := rollupRetention[res.name]; retention > 0 {
+				for b := range buckets {
+					if b.Before(at.Add(-retention)) {
+						delete(buckets, b)
+					}
+				}
+			}
+		}
+		buckets[bucket] += delta
+	}
+}
+
+func (m *memoryStore) Series(_ context.Context, id int64, res resolution, from, to time.Time) ([]SeriesPoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.values[id]; !ok {
+		return nil, errCounterNotFound
+	}
+	var points []SeriesPoint
+	for at, delta := range m.rollups[res.name][id] {
+		if !at.Before(from) && at.Before(to) {
+			points = append(points, SeriesPoint{At: at, Delta: delta})
+		}
+	}
+	return points, nil // fillSeries does not need them sorted
+}
+
+// createRollupTables adds the rollup buckets and the position of the
+// rollup job in counter_history.
+func createRollupTables(ctx context.Context) error {
+	_, err := db.Exec(ctx,
+		`CREATE TABLE IF NOT EXISTS counter_rollups (
+			counter_id INTEGER NOT NULL,
+			resolution TEXT NOT NULL,
+			bucket     TIMESTAMPTZ NOT NULL,
+			delta      BIGINT NOT NULL,
+			PRIMARY KEY (counter_id, resolution, bucket)
+		);
+		CREATE TABLE IF NOT EXISTS counter_rollup_state (
+			id       BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+			last_seq BIGINT NOT NULL
+		);
+		INSERT INTO counter_rollup_state (id, last_seq) VALUES (true, 0) ON CONFLICT DO NOTHING`)
+	return err
+}
+
+// rollupLag keeps the rollup job away from the newest history rows, whose
+// transactions may not all have committed yet (seq is assigned at insert,
+// not at commit). Queries read those rows straight from counter_history.
+const rollupLag = 10 * time.Second
+
+// rollUp moves history rows past the watermark into the rollup buckets and
+// drops expired buckets. Replicas take turns through an advisory lock; a
+// replica that does not get it skips this round.
+//
+// The watermark is a seq, so a batch is the run of rows after it up to the
+// first one that is still too new: at and seq are taken at slightly
+// different moments, and a row past that one with an older at would
+// otherwise be passed by the watermark before it was rolled up.
+func rollUp(ctx context.Context) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock(hashtext('counter_rollups'))").Scan(&locked); err != nil || !locked {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`WITH batch AS (
+			SELECT seq, counter_id, op, delta, at FROM (
+				SELECT h.*, bool_and(at < now() - make_interval(secs => $1)) OVER (ORDER BY seq) AS old_enough
+				FROM (
+					SELECT seq, counter_id, op, delta, at FROM counter_history
+					WHERE seq > (SELECT last_seq FROM counter_rollup_state)
+					ORDER BY seq LIMIT 100000
+				) h
+			) w WHERE old_enough
+		), rolled AS (
+			INSERT INTO counter_rollups (counter_id, resolution, bucket, delta)
+			SELECT b.counter_id, r.name, date_trunc(r.name, b.at, 'UTC'), SUM(b.delta)
+			FROM batch b CROSS JOIN (VALUES ('minute'), ('hour'), ('day')) AS r(name)
+			WHERE b.op = 'add'
+			GROUP BY 1, 2, 3
+			ON CONFLICT (counter_id, resolution, bucket) DO UPDATE
+				SET delta = counter_rollups.delta + EXCLUDED.delta
+		)
+		UPDATE counter_rollup_state SET last_seq = (SELECT max(seq) FROM batch)
+		WHERE EXISTS (SELECT 1 FROM batch)`, rollupLag.Seconds())
+	if err != nil {
+		return err
+	}
+	for _, res := range resolutions {
+		retention := rollupRetention[res.name]
+		if retention == 0 {
+			continue
+		}
+		_, err := tx.Exec(ctx,
+			"DELETE FROM counter_rollups WHERE resolution=$1 AND bucket < now() - make_interval(secs => $2)",
+			res.name, retention.Seconds())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// rollUpEvery runs rollUp every interval until ctx ends.
+func rollUpEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := rollUp(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Rolling up counter history failed: %v\n", err)
+			}
+		}
+	}
+}
+
+func (s postgresStore) Series(ctx context.Context, id int64, res resolution, from, to time.Time) ([]SeriesPoint, error) {
+	if _, err := s.Get(ctx, id); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(ctx,
+		`SELECT bucket, SUM(delta)::bigint FROM (
+			SELECT bucket, delta FROM counter_rollups
+			WHERE counter_id=$1 AND resolution=$2 AND bucket >= $3 AND bucket < $4
+			UNION ALL
+			SELECT date_trunc($2, at, 'UTC'), delta FROM counter_history
+			WHERE counter_id=$1 AND op='add' AND at >= $3 AND at < $4
+			  AND seq > (SELECT last_seq FROM counter_rollup_state)
+		) b GROUP BY bucket`, id, res.name, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (SeriesPoint, error) {
+		var p SeriesPoint
+		err := row.Scan(&p.At, &p.Delta)
+		p.At = p.At.UTC()
+		return p, err
+	})
+}
+
+// Series passes through to the wrapped store when it keeps rollups.
+func (b *breakerStore) Series(ctx context.Context, id int64, res resolution, from, to time.Time) ([]SeriesPoint, error) {
+	series, ok := b.counterStore.(seriesStore)
+	if !ok {
+		return nil, errSeriesUnsupported
+	}
+	return guard(b, func() ([]SeriesPoint, error) { return series.Series(ctx, id, res, from, to) })
+}
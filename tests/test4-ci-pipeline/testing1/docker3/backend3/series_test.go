@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that steps map to the coarsest resolution they can be summed from
+func TestParseStep(t *testing.T) {
+	cases := map[string]string{"minute": "minute", "15m": "minute", "hour": "hour", "6h": "hour", "48h": "day", "": "hour"}
+	for raw, want := range cases {
+		_, res, err := parseStep(raw)
+		if err != nil || res.name != want {
+			t.Errorf("Step %q: expected the %s resolution, got %q (err %v)", raw, want, res.name, err)
+		}
+	}
+	for _, raw := range []string{"30s", "90s", "week"} {
+		if _, _, err := parseStep(raw); err == nil {
+			t.Errorf("Expected step %q to be rejected", raw)
+		}
+	}
+}
+
+// Test that buckets are summed into steps and empty steps are zero
+func TestFillSeries(t *testing.T) {
+	// Arrange
+	from := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	buckets := []SeriesPoint{
+		{At: from.Add(time.Minute), Delta: 2},
+		{At: from.Add(14 * time.Minute), Delta: 3},
+		{At: from.Add(40 * time.Minute), Delta: 5},
+	}
+
+	// Act
+	points := fillSeries(buckets, from, from.Add(time.Hour), 15*time.Minute)
+
+	// Assert
+	want := []int64{5, 0, 5, 0}
+	if len(points) != len(want) {
+		t.Fatalf("Expected %d points, got %d", len(want), len(points))
+	}
+	for i, p := range points {
+		if p.Delta != want[i] || !p.At.Equal(from.Add(time.Duration(i)*15*time.Minute)) {
+			t.Errorf("Point %d: expected %d at %v, got %+v", i, want[i], from.Add(time.Duration(i)*15*time.Minute), p)
+		}
+	}
+}
+
+// Test that the memory store drops buckets past their retention
+func TestMemoryRollupRetention(t *testing.T) {
+	// Arrange
+	previous := rollupRetention["minute"]
+	rollupRetention["minute"] = 10 * time.Minute
+	t.Cleanup(func() { rollupRetention["minute"] = previous })
+	m := newMemoryStore()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	// Act
+	m.mu.Lock()
+	m.recordRollup(1, 1, start)
+	m.recordRollup(1, 1, start.Add(30*time.Minute))
+	m.mu.Unlock()
+
+	// Assert
+	minutes, _ := m.Series(context.Background(), 1, resolutions[0], start, start.Add(time.Hour))
+	hours, _ := m.Series(context.Background(), 1, resolutions[1], start, start.Add(time.Hour))
+	if len(minutes) != 1 || minutes[0].Delta != 1 {
+		t.Errorf("Expected only the newer minute bucket, got %+v", minutes)
+	}
+	if len(hours) != 1 || hours[0].Delta != 2 {
+		t.Errorf("Expected the hour bucket to keep both increments, got %+v", hours)
+	}
+}
+
+// Test GET /counter/series as JSON and CSV
+func TestSeriesHandler(t *testing.T) {
+	// Arrange: three increments and a reset, which does not count
+	server := newTestServer(t)
+	for range 3 {
+		sendWithHeader(t, "POST", server.URL+"/counter/increment", "", "", "")
+	}
+	sendWithHeader(t, "POST", server.URL+"/counter/reset", "", "", "")
+	to := time.Now().UTC().Truncate(time.Minute).Add(time.Minute)
+	from := to.Add(-time.Hour)
+
+	// Act
+	resp, err := http.Get(server.URL + "/counter/series?step=minute&from=" + from.Format(time.RFC3339) + "&to=" + to.Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var series SeriesResponse
+	json.NewDecoder(resp.Body).Decode(&series)
+	csvResp, err := http.Get(server.URL + "/counter/series?step=hour&format=csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer csvResp.Body.Close()
+	csvBody, _ := io.ReadAll(csvResp.Body)
+
+	// Assert
+	var total int64
+	for _, p := range series.Points {
+		total += p.Delta
+	}
+	if resp.StatusCode != http.StatusOK || len(series.Points) != 60 || total != 3 || series.StepSeconds != 60 {
+		t.Errorf("Expected 60 one-minute points adding up to 3, got %d points adding up to %d", len(series.Points), total)
+	}
+	lines := strings.Split(strings.TrimSpace(string(csvBody)), "\n")
+	if csvResp.Header.Get("Content-Type") != "text/csv" || lines[0] != "at,delta" || !strings.HasSuffix(lines[len(lines)-1], ",3") {
+		t.Errorf("Expected CSV ending in the current hour's 3 increments, got %q", csvBody)
+	}
+}
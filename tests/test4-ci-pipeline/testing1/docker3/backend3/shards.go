@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Sharded counters spread one hot counter's value over several rows.
+//
+// Shard 0 is the value column of the counters row itself; shards 1..N-1 live
+// in counter_shards. Each increment adds to one random shard and a read sums
+// them all. With the default of one shard this is exactly the old single-row
+// layout, so sharding is opt-in per counter through PUT /counter/shards.
+//
+// The version is not sharded: every write bumps it on the counters row (see
+// addVersioned), so each write gets its own version and its own value. That
+// means increments of one counter still queue on the counters row lock
+// whatever shard they picked; sharding keeps the shard rows' updates and
+// their WAL apart, but it no longer spreads the row lock.
+
+// maxShards bounds the shard count of one counter.
+const maxShards = 256
+
+// errShardingUnsupported is returned when the store cannot shard counters.
+var errShardingUnsupported = errors.New("sharding needs the Postgres store")
+
+// shardedStore is implemented by stores that can shard counters.
+// Only the Postgres store does: the memory store has no row locks to spread.
+type shardedStore interface {
+	// Shards returns the shard count of counter id.
+	Shards(ctx context.Context, id int64) (int, error)
+	// SetShards changes the shard count of counter id without changing its value.
+	SetShards(ctx context.Context, id int64, shards int) error
+}
+
+// createShardTable adds the shard count column and the table for shards 1..N-1.
+func createShardTable(ctx context.Context) error {
+	_, err := db.Exec(ctx,
+		`ALTER TABLE counters ADD COLUMN IF NOT EXISTS shards INTEGER NOT NULL DEFAULT 1;
+		CREATE TABLE IF NOT EXISTS counter_shards (
+			counter_id INTEGER NOT NULL,
+			shard      INTEGER NOT NULL,
+			value      BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (counter_id, shard)
+		)`)
+	return err
+}
+
+func (postgresStore) Shards(ctx context.Context, id int64) (int, error) {
+	var shards int
+	err := db.QueryRow(ctx, "SELECT shards FROM counters WHERE id=$1", id).Scan(&shards)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errCounterNotFound
+	}
+	return shards, err
+}
+
+// SetShards can run while the counter is being written. Shrinking folds the
+// removed shards' values into shard 0. An increment that
+// picked a removed shard just before the change may still recreate its row;
+// that is harmless because reads sum every shard row, and the next resize
+// folds it again. Growing creates the new shard rows right away, so
+// conditional writes can lock all of them (see writeIfVersion).
+func (postgresStore) SetShards(ctx context.Context, id int64, shards int) error {
+	tag, err := db.Exec(ctx,
+		`WITH folded AS (
+			DELETE FROM counter_shards WHERE counter_id=$1 AND shard >= $2 RETURNING value
+		), created AS (
+			INSERT INTO counter_shards (counter_id, shard)
+			SELECT id, g FROM counters, generate_series(1, $2 - 1) AS g WHERE id=$1
+			ON CONFLICT (counter_id, shard) DO NOTHING
+		)
+		UPDATE counters SET shards = $2,
+			value = value + COALESCE((SELECT SUM(value) FROM folded), 0)
+		WHERE id=$1`,
+		id, shards)
+	if err == nil && tag.RowsAffected() == 0 {
+		return errCounterNotFound
+	}
+	return err
+}
+
+// ShardsRequest is the body of PUT /counter/shards.
+type ShardsRequest struct {
+	Shards int `json:"shards"`
+}
+
+// ShardsResponse is the response of GET and PUT /counter/shards.
+type ShardsResponse struct {
+	ID     int64 `json:"id"`
+	Shards int   `json:"shards"`
+}
+
+// shardsHandler handles /counter/shards: GET reads a counter's shard count,
+// PUT changes it. Resharding is online; the counter's value is unchanged.
+func shardsHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed, use GET or PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := counterIDParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sharded, ok := capability[shardedStore](store)
+	if !ok {
+		http.Error(w, errShardingUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req ShardsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Shards < 1 || req.Shards > maxShards {
+			http.Error(w, fmt.Sprintf("shards must be between 1 and %d", maxShards), http.StatusBadRequest)
+			return
+		}
+		if err := sharded.SetShards(r.Context(), id, req.Shards); err != nil {
+			writeShardsError(w, r, "DB update failed", err)
+			return
+		}
+	}
+
+	shards, err := sharded.Shards(r.Context(), id)
+	if err != nil {
+		writeShardsError(w, r, "DB query failed", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ShardsResponse{ID: id, Shards: shards})
+}
+
+// writeShardsError is writeStoreError plus 501 for stores that cannot shard.
+func writeShardsError(w http.ResponseWriter, r *http.Request, prefix string, err error) {
+	if errors.Is(err, errShardingUnsupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	writeStoreError(w, r, prefix, err)
+}
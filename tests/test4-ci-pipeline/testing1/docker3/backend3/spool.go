@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// spool keeps increments that arrive while the store is down in a local
+// append-only file (SPOOL_FILE), so no click is lost. POST
+// /counter/increment answers 202 with "queued": true for them.
+//
+// A replayer applies the spooled increments in order once the store is
+// back. Each one carries an op ID that the store records in the same
+// transaction as the increment (opStore), so an increment that was applied
+// just before a crash, but not yet removed from the file, is skipped the
+// next time instead of counted twice.
+type spool struct {
+	path     string
+	store    opStore
+	interval time.Duration
+
+	mu      sync.Mutex // guards file, pending and the status fields
+	file    *os.File
+	pending []spooledOp // oldest first, same as the file
+
+	lastReplay time.Time
+	lastError  string
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	depth       prometheus.GaugeFunc
+	queued      prometheus.Counter
+	replayed    prometheus.Counter
+	dropped     prometheus.Counter
+	replayFails prometheus.Counter
+}
+
+// spooledOp is one line of the spool file.
+type spooledOp struct {
+	OpID  string    `json:"op_id"`
+	ID    int64     `json:"id"`
+	Delta int64     `json:"delta"`
+	At    time.Time `json:"at"`
+}
+
+// opStore is implemented by stores that can apply an increment at most once per op ID.
+type opStore interface {
+	counterStore
+	// AddOnce adds delta unless opID was applied before. applied reports
+	// whether this call did the write.
+	AddOnce(ctx context.Context, opID string, id, delta int64) (value int64, applied bool, err error)
+	// ForgetOps drops op IDs that can no longer be replayed.
+	ForgetOps(ctx context.Context, opIDs []string) error
+}
+
+// QueuedResponse is the 202 response for an increment that was spooled.
+type QueuedResponse struct {
+	ID     int64  `json:"id"`
+	Queued bool   `json:"queued"`
+	OpID   string `json:"op_id"`
+}
+
+// SpoolStatus is the response of GET /admin/spool.
+type SpoolStatus struct {
+	Depth      int        `json:"depth"`
+	Oldest     *time.Time `json:"oldest,omitempty"` // when the oldest spooled increment arrived
+	LastReplay *time.Time `json:"last_replay,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+// offline is the increment spool, or nil when SPOOL_FILE is not set.
+var offline *spool
+
+// openSpool loads the increments left in path by a previous run and starts
+// replaying them into s every interval.
+func openSpool(path string, s opStore, interval time.Duration) (*spool, error) {
+	pending, err := readSpoolFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	sp := &spool{
+		path:     path,
+		store:    s,
+		interval: interval,
+		file:     file,
+		pending:  pending,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		queued: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_spool_queued_total",
+			Help: "Increments written to the spool file because the store was down.",
+		}),
+		replayed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_spool_replayed_total",
+			Help: "Spooled increments applied to the store.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_spool_dropped_total",
+			Help: "Spooled increments discarded because their counter does not exist.",
+		}),
+		replayFails: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_spool_replay_errors_total",
+			Help: "Replay passes stopped early because the store was still failing.",
+		}),
+	}
+	sp.depth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "counter_spool_depth",
+		Help: "Increments in the spool file waiting to be replayed.",
+	}, func() float64 { return float64(sp.status().Depth) })
+	if len(pending) > 0 {
+		log.Printf("Spool: %d increment(s) left from the last run\n", len(pending))
+	}
+	go sp.run()
+	return sp, nil
+}
+
+// spoolFromEnv opens SPOOL_FILE, replaying every SPOOL_REPLAY_INTERVAL
+// (default 5s), or returns nil if SPOOL_FILE is not set.
+func spoolFromEnv(s counterStore) (*spool, error) {
+	path := os.Getenv("SPOOL_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	ops, ok := s.(opStore)
+	if !ok {
+		return nil, errors.New("SPOOL_FILE needs STORE=postgres or STORE=memory")
+	}
+	interval := 5 * time.Second
+	if raw := os.Getenv("SPOOL_REPLAY_INTERVAL"); raw != "" {
+		var err error
+		if interval, err = time.ParseDuration(raw); err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid SPOOL_REPLAY_INTERVAL %q, want a duration like 5s", raw)
+		}
+	}
+	return openSpool(path, ops, interval)
+}
+
+// readSpoolFile returns the ops in path. A torn last line (a crash in the
+// middle of a write, before it was acknowledged) is ignored.
+func readSpoolFile(path string) ([]spooledOp, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ops []spooledOp
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var op spooledOp
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			log.Printf("Spool: skipping unreadable line in %s: %v\n", path, err)
+			continue
+		}
+		ops = append(ops, op)
+	}
+	return ops, scanner.Err()
+}
+
+// enqueue durably records an increment of counter id by delta and returns its op ID.
+func (sp *spool) enqueue(id, delta int64) (string, error) {
+	op := spooledOp{OpID: rand.Text(), ID: id, Delta: delta, At: time.Now().UTC()}
+	line, err := json.Marshal(op)
+	if err != nil {
+		return "", err
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if _, err := sp.file.Write(append(line, '\n')); err != nil {
+		return "", err
+	}
+	// Only acknowledge the increment once it is on disk.
+	if err := sp.file.Sync(); err != nil {
+		return "", err
+	}
+	sp.pending = append(sp.pending, op)
+	sp.queued.Inc()
+	return op.OpID, nil
+}
+
+func (sp *spool) run() {
+	defer close(sp.done)
+	ticker := time.NewTicker(sp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sp.stop:
+			return
+		case <-ticker.C:
+			sp.replay(context.Background())
+		}
+	}
+}
+
+// replay applies spooled increments in order until one fails with a store
+// error, then rewrites the file without the ones that are done.
+func (sp *spool) replay(ctx context.Context) {
+	sp.mu.Lock()
+	ops := append([]spooledOp(nil), sp.pending...)
+	sp.mu.Unlock()
+	if len(ops) == 0 {
+		return
+	}
+
+	var done []string
+	var failure error
+	for _, op := range ops {
+		_, applied, err := sp.store.AddOnce(ctx, op.OpID, op.ID, op.Delta)
+		switch {
+		case errors.Is(err, errCounterNotFound):
+			log.Printf("Spool: dropping increment %s, counter %d does not exist\n", op.OpID, op.ID)
+			sp.dropped.Inc()
+		case errors.Is(err, errOutOfBounds):
+			log.Printf("Spool: dropping increment %s: %v\n", op.OpID, err)
+			sp.dropped.Inc()
+		case err != nil:
+			failure = err
+		case applied:
+			sp.replayed.Inc()
+		}
+		if failure != nil {
+			sp.replayFails.Inc()
+			break
+		}
+		done = append(done, op.OpID)
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.lastReplay = time.Now()
+	sp.lastError = ""
+	if failure != nil {
+		sp.lastError = failure.Error()
+	}
+	if len(done) == 0 {
+		return
+	}
+	// New increments may have been appended meanwhile; they stay.
+	sp.pending = sp.pending[len(done):]
+	if err := sp.rewrite(); err != nil {
+		// The ops may still be in the file on disk; their op IDs, which we
+		// keep, make replaying them again harmless.
+		log.Printf("Spool: rewriting %s failed: %v\n", sp.path, err)
+		return
+	}
+	log.Printf("Spool: replayed %d increment(s), %d left\n", len(done), len(sp.pending))
+	if err := sp.store.ForgetOps(ctx, done); err != nil {
+		log.Printf("Spool: forgetting replayed op IDs failed: %v\n", err)
+	}
+}
+
+// rewrite replaces the spool file with sp.pending. The caller must hold sp.mu.
+func (sp *spool) rewrite() error {
+	tmp, err := os.CreateTemp(filepath.Dir(sp.path), ".spool-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, op := range sp.pending {
+		if err := enc.Encode(op); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), sp.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(sp.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	sp.file.Close()
+	sp.file = file
+	// Until the directory is synced a power loss can bring the old file
+	// back, so replay must not forget the op IDs before this succeeds.
+	return syncDir(filepath.Dir(sp.path))
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// status reports the spool depth and the last replay.
+func (sp *spool) status() SpoolStatus {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	s := SpoolStatus{Depth: len(sp.pending), LastError: sp.lastError}
+	if len(sp.pending) > 0 {
+		s.Oldest = &sp.pending[0].At
+	}
+	if !sp.lastReplay.IsZero() {
+		last := sp.lastReplay.UTC()
+		s.LastReplay = &last
+	}
+	return s
+}
+
+// Close stops the replayer. Spooled increments stay in the file for the
+// next run. It is safe to call more than once.
+func (sp *spool) Close() error {
+	var err error
+	sp.closeOnce.Do(func() {
+		close(sp.stop)
+		<-sp.done
+		sp.mu.Lock()
+		defer sp.mu.Unlock()
+		err = sp.file.Close()
+	})
+	return err
+}
+
+// spoolFailed spools an increment of counter id that failed with err, if
+// the failure means the store is down. It returns the op ID, or "" if the
+// increment was not spooled.
+func spoolFailed(ctx context.Context, id int64, err error) string {
+	if offline == nil || !isStoreFailure(err) {
+		return ""
+	}
+	opID, spoolErr := offline.enqueue(id, 1)
+	if spoolErr != nil {
+		logf(ctx, "Spool: could not queue an increment of counter %d: %v\n", id, spoolErr)
+		return ""
+	}
+	return opID
+}
+
+// spoolIncrement answers an increment that failed with err by spooling it,
+// if the failure means the store is down. It reports whether it did.
+func spoolIncrement(w http.ResponseWriter, r *http.Request, id int64, err error) bool {
+	opID := spoolFailed(r.Context(), id, err)
+	if opID == "" {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(QueuedResponse{ID: id, Queued: true, OpID: opID})
+	return true
+}
+
+// spoolHandler handles GET /admin/spool: how many increments wait for replay.
+func spoolHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if offline == nil {
+		http.Error(w, errSpoolUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(offline.status())
+}
+
+// errSpoolUnsupported is returned by GET /admin/spool without SPOOL_FILE.
+var errSpoolUnsupported = errors.New("the increment spool is off, set SPOOL_FILE to enable it")
+
+// Describe and Collect export the spool metrics on /metrics.
+func (sp *spool) Describe(ch chan<- *prometheus.Desc) {
+	sp.depth.Describe(ch)
+	sp.queued.Describe(ch)
+	sp.replayed.Describe(ch)
+	sp.dropped.Describe(ch)
+	sp.replayFails.Describe(ch)
+}
+
+func (sp *spool) Collect(ch chan<- prometheus.Metric) {
+	sp.depth.Collect(ch)
+	sp.queued.Collect(ch)
+	sp.replayed.Collect(ch)
+	sp.dropped.Collect(ch)
+	sp.replayFails.Collect(ch)
+}
+
+// createAppliedOpsTable adds the table of op IDs already applied by AddOnce.
+func createAppliedOpsTable(ctx context.Context) error {
+	_, err := db.Exec(ctx,
+		`CREATE TABLE IF NOT EXISTS counter_applied_ops (
+			op_id      TEXT PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	return err
+}
+
+func (postgresStore) AddOnce(ctx context.Context, opID string, id, delta int64) (int64, bool, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx,
+		"INSERT INTO counter_applied_ops (op_id) VALUES ($1) ON CONFLICT (op_id) DO NOTHING", opID)
+	if err != nil {
+		return 0, false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return 0, false, nil // applied by an earlier replay
+	}
+	current, err := lockCounter(ctx, tx, id)
+	if err != nil {
+		return 0, false, err
+	}
+	value, err := current.bounds.add(current.value, delta)
+	if err != nil {
+		return 0, false, err
+	}
+	value, _, err = addVersioned(ctx, tx, id, value-current.value, true)
+	if err != nil {
+		return 0, false, err
+	}
+	return value, true, tx.Commit(ctx)
+}
+
+func (postgresStore) ForgetOps(ctx context.Context, opIDs []string) error {
+	_, err := db.Exec(ctx, "DELETE FROM counter_applied_ops WHERE op_id = ANY($1)", opIDs)
+	return err
+}
+
+func (m *memoryStore) AddOnce(_ context.Context, opID string, id, delta int64) (int64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.appliedOps[opID] {
+		return 0, false, nil
+	}
+	value, ok := m.values[id]
+	if !ok {
+		return 0, false, errCounterNotFound
+	}
+	next, err := m.bounds[id].add(value, delta)
+	if err != nil {
+		return 0, false, err
+	}
+	m.values[id] = next
+	m.record(id, "add", next-value, next)
+	m.appliedOps[opID] = true
+	return next, true, nil
+}
+
+func (m *memoryStore) ForgetOps(_ context.Context, opIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, opID := range opIDs {
+		delete(m.appliedOps, opID)
+	}
+	return nil
+}
+
+func (b *breakerStore) AddOnce(ctx context.Context, opID string, id, delta int64) (int64, bool, error) {
+	ops, ok := b.counterStore.(opStore)
+	if !ok {
+		return 0, false, errors.New("the wrapped store cannot apply increments once per op ID")
+	}
+	var applied bool
+	value, err := guard(b, func() (int64, error) {
+		value, a, err := ops.AddOnce(ctx, opID, id, delta)
+		applied = a
+		return value, err
+	})
+	if applied {
+		b.remember(id, value)
+	}
+	return value, applied, err
+}
+
+func (b *breakerStore) ForgetOps(ctx context.Context, opIDs []string) error {
+	ops, ok := b.counterStore.(opStore)
+	if !ok {
+		return nil
+	}
+	_, err := guard(b, func() (struct{}, error) { return struct{}{}, ops.ForgetOps(ctx, opIDs) })
+	return err
+}
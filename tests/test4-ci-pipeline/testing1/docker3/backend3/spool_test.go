@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestSpool opens a spool in a temporary directory. It never replays on
+// its own; tests call replay.
+func newTestSpool(t *testing.T, path string, s opStore) *spool {
+	t.Helper()
+	sp, err := openSpool(path, s, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp.Close() })
+	return sp
+}
+
+// Test that increments left in the file by a crash are applied exactly once
+func TestSpoolReplaysOnceAfterRestart(t *testing.T) {
+	// Arrange: three spooled increments, the first applied just before a
+	// crash, and a torn line at the end of the file
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	m := newMemoryStore()
+	first := newTestSpool(t, path, m)
+	opID, _ := first.enqueue(1, 1)
+	first.enqueue(1, 1)
+	first.enqueue(1, 1)
+	m.AddOnce(ctx, opID, 1, 1)
+	first.Close()
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	f.WriteString(`{"op_id": "torn`)
+	f.Close()
+
+	// Act
+	restarted := newTestSpool(t, path, m)
+	depthBefore := restarted.status().Depth
+	restarted.replay(ctx)
+
+	// Assert
+	if depthBefore != 3 {
+		t.Errorf("Expected 3 increments after the restart, got %d", depthBefore)
+	}
+	if value, _ := m.Get(ctx, 1); value != 3 {
+		t.Errorf("Expected 3 after the replay, got %d", value)
+	}
+	if got := testutil.ToFloat64(restarted.replayed); got != 2 {
+		t.Errorf("Expected 2 increments applied by the replay, got %v", got)
+	}
+	if ops, _ := readSpoolFile(path); len(ops) != 0 {
+		t.Errorf("Expected an empty spool file, got %d increments", len(ops))
+	}
+}
+
+// Test that a replay stops at the first store failure and keeps the rest
+func TestSpoolReplayStopsWhileDown(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	durable := &flakyStore{memoryStore: newMemoryStore()}
+	b := newBreakerStore(durable, 1, time.Minute, 1)
+	sp := newTestSpool(t, filepath.Join(t.TempDir(), "spool.jsonl"), b)
+	sp.enqueue(1, 1)
+	sp.enqueue(99, 1) // no such counter: dropped
+	durable.down.Store(true)
+	b.Get(ctx, 1) // opens the breaker
+
+	// Act
+	sp.replay(ctx)
+	whileDown := sp.status()
+
+	// Assert
+	if whileDown.Depth != 2 || whileDown.LastError == "" {
+		t.Errorf("Expected 2 increments kept with an error, got %+v", whileDown)
+	}
+}
+
+// Test that increments are spooled with 202 while the store is down and
+// applied once it is back
+func TestIncrementSpooledWhileDown(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	durable := &flakyStore{memoryStore: newMemoryStore()}
+	store = durable
+	offline = newTestSpool(t, filepath.Join(t.TempDir(), "spool.jsonl"), durable)
+	t.Cleanup(func() { offline = nil })
+	durable.down.Store(true)
+
+	// Act
+	resp, err := http.Post(server.URL+"/counter/increment", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var queued QueuedResponse
+	json.NewDecoder(resp.Body).Decode(&queued)
+	status, err := http.Get(server.URL + "/admin/spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer status.Body.Close()
+	var spooled SpoolStatus
+	json.NewDecoder(status.Body).Decode(&spooled)
+	durable.down.Store(false)
+	offline.replay(context.Background())
+
+	// Assert
+	if resp.StatusCode != http.StatusAccepted || !queued.Queued || queued.OpID == "" {
+		t.Errorf("Expected 202 with a queued marker, got %d %+v", resp.StatusCode, queued)
+	}
+	if spooled.Depth != 1 || spooled.Oldest == nil {
+		t.Errorf("Expected a spool depth of 1, got %+v", spooled)
+	}
+	if value, _ := durable.memoryStore.Get(context.Background(), 1); value != 1 {
+		t.Errorf("Expected the replayed increment to count, got %d", value)
+	}
+}
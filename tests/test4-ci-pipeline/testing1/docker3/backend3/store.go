@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// defaultCounterID is the counter behind GET /counter and POST /counter/increment.
+const defaultCounterID = 1
+
+// errCounterNotFound is returned when a counter id has no row yet.
+var errCounterNotFound = errors.New("counter not found")
+
+// counterStore is where counter values live. The HTTP handlers and the gRPC
+// service both go through it, so they always agree on the current value.
+type counterStore interface {
+	// Get returns the current value of counter id.
+	Get(ctx context.Context, id int64) (int64, error)
+	// Add adds delta (which may be negative) and returns the new value.
+	Add(ctx context.Context, id int64, delta int64) (int64, error)
+	// Set overwrites the value, creating the counter if needed.
+	Set(ctx context.Context, id int64, value int64) (int64, error)
+	// List returns every counter, ordered by id.
+	List(ctx context.Context) ([]CounterResponse, error)
+	// History returns the most recent writes to counter id, newest first.
+	History(ctx context.Context, id int64, limit int) ([]HistoryEntry, error)
+}
+
+// storeWrapper is implemented by the stores that decorate another one
+// (breakerStore, writeBehindStore, cachedStore).
+type storeWrapper interface {
+	// unwrap returns the decorated store.
+	unwrap() counterStore
+}
+
+// capability finds the optional interface T (shardedStore, boundedStore,
+// scheduleStore, seriesStore) on s or, failing that, on the stores s
+// decorates, outermost first. A decorator that changes how a capability
+// behaves, like breakerStore guarding the calls, implements T itself; the
+// others need no pass-through methods. versionedStore is not looked up this
+// way, because write-behind hides the durable store's versions on purpose.
+func capability[T any](s counterStore) (T, bool) {
+	for {
+		if c, ok := s.(T); ok {
+			return c, true
+		}
+		w, ok := s.(storeWrapper)
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		s = w.unwrap()
+	}
+}
+
+// HistoryEntry records one write to a counter.
+type HistoryEntry struct {
+	At    time.Time `json:"at"`
+	Op    string    `json:"op"`    // "add", "set", or "archive" for the value before a scheduled reset
+	Delta int64     `json:"delta"` // change applied by this write
+	Value int64     `json:"value"` // value after the write
+}
+
+// memoryHistoryLimit bounds how many history entries the memory store keeps per counter.
+const memoryHistoryLimit = 1000
+
+// store is the counterStore used by every handler.
+// main swaps in the in-memory store when STORE=memory.
+var store counterStore = postgresStore{}
+
+// counterChange is published every time a counter is written.
+type counterChange struct {
+	ID      int64
+	Value   int64
+	Version int64 // the counter's version after the write
+	Added   int64 // the delta of an add; 0 for a set
+}
+
+// changeHub fans counter changes out to watchers (gRPC Watch streams).
+// Each subscriber has a one-slot buffer that always holds the latest value:
+// a slow watcher skips intermediate values instead of blocking writers.
+type changeHub struct {
+	mu        sync.Mutex
+	subs      map[int64]map[chan counterChange]struct{}
+	observers []func(counterChange) // called for every change, e.g. to invalidate caches
+}
+
+// changes is the hub every store publishes to.
+var changes = newChangeHub()
+
+func newChangeHub() *changeHub {
+	return &changeHub{subs: make(map[int64]map[chan counterChange]struct{})}
+}
+
+// subscribe returns a channel of changes to counter id and a function
+// that must be called to stop watching.
+func (h *changeHub) subscribe(id int64) (<-chan counterChange, func()) {
+	ch := make(chan counterChange, 1)
+	h.mu.Lock()
+	if h.subs[id] == nil {
+		h.subs[id] = make(map[chan counterChange]struct{})
+	}
+	h.subs[id][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs[id], ch)
+		if len(h.subs[id]) == 0 {
+			delete(h.subs, id)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// observe calls fn synchronously for every change to any counter.
+// fn must be quick and must not publish.
+func (h *changeHub) observe(fn func(counterChange)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.observers = append(h.observers, fn)
+}
+
+// publish delivers c to every subscriber of c.ID without blocking.
+func (h *changeHub) publish(c counterChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, fn := range h.observers {
+		fn(c)
+	}
+	for ch := range h.subs[c.ID] {
+		select {
+		case <-ch: // drop the stale value nobody read yet
+		default:
+		}
+		ch <- c
+	}
+}
+
+// memoryStore keeps counters in process memory.
+// Values are lost on restart, but it needs no database.
+type memoryStore struct {
+	mu       sync.Mutex
+	values   map[int64]int64
+	versions map[int64]int64          // bumped by every write (see versions.go)
+	history  map[int64][]HistoryEntry // oldest first
+
+	bounds     map[int64]counterBounds // see bounds.go
+	schedules  map[int64]ResetSchedule // see schedules.go
+	appliedOps map[string]bool         // op IDs applied by AddOnce (see spool.go)
+	// rollups sums increments per resolution, counter and bucket (see series.go).
+	rollups map[string]map[int64]map[time.Time]int64
+	// outbox queues change events for the relay once queuing is on (see outbox.go).
+	queuing    bool
+	outbox     []outboxEvent
+	outboxSeq  map[int64]int64
+	outboxNext int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		values:   map[int64]int64{defaultCounterID: 0},
+		versions: make(map[int64]int64),
+		history:  make(map[int64][]HistoryEntry),
+
+		bounds:     make(map[int64]counterBounds),
+		schedules:  make(map[int64]ResetSchedule),
+		appliedOps: make(map[string]bool),
+		rollups:    make(map[string]map[int64]map[time.Time]int64),
+		outboxSeq:  make(map[int64]int64),
+	}
+}
+
+// record bumps the version, appends a history entry, rolls up adds,
+// queues an outbox event and publishes the change. The caller must hold m.mu.
+func (m *memoryStore) record(id int64, op string, delta, value int64) {
+	m.versions[id]++
+	at := time.Now().UTC()
+	if op == "add" {
+		m.recordRollup(id, delta, at)
+	}
+	h := append(m.history[id], HistoryEntry{At: at, Op: op, Delta: delta, Value: value})
+	if len(h) > memoryHistoryLimit {
+		h = h[len(h)-memoryHistoryLimit:]
+	}
+	m.history[id] = h
+	m.queueEvent(id, op, delta, value, at)
+	c := counterChange{ID: id, Value: value, Version: m.versions[id]}
+	if op == "add" {
+		c.Added = delta
+	}
+	changes.publish(c)
+}
+
+func (m *memoryStore) Get(_ context.Context, id int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.values[id]
+	if !ok {
+		return 0, errCounterNotFound
+	}
+	return value, nil
+}
+
+func (m *memoryStore) Add(ctx context.Context, id int64, delta int64) (int64, error) {
+	value, _, err := m.AddIfVersion(ctx, id, delta, anyVersion)
+	return value, err
+}
+
+func (m *memoryStore) Set(ctx context.Context, id int64, value int64) (int64, error) {
+	value, _, err := m.SetIfVersion(ctx, id, value, anyVersion)
+	return value, err
+}
+
+func (m *memoryStore) List(_ context.Context) ([]CounterResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]CounterResponse, 0, len(m.values))
+	for id, value := range m.values {
+		list = append(list, CounterResponse{ID: id, Value: value})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (m *memoryStore) History(_ context.Context, id int64, limit int) ([]HistoryEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.values[id]; !ok {
+		return nil, errCounterNotFound
+	}
+	h := m.history[id]
+	entries := make([]HistoryEntry, 0, min(limit, len(h)))
+	for i := len(h) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, h[i])
+	}
+	return entries, nil
+}
+
+// postgresStore keeps counters in the counters table.
+// Every write also sends a NOTIFY so watchers on all replicas hear about it
+// (see listenForChanges).
+type postgresStore struct{}
+
+func (postgresStore) Get(ctx context.Context, id int64) (int64, error) {
+	var value int64
+	// A sharded counter is the sum of its row and its shard rows (see shards.go).
+	err := db.QueryRow(ctx,
+		`SELECT value + (SELECT COALESCE(SUM(value), 0) FROM counter_shards WHERE counter_id=$1)::bigint
+		 FROM counters WHERE id=$1`, id).Scan(&value)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errCounterNotFound
+	}
+	return value, err
+}
+
+// createHistoryTable creates the table every write is logged to. at is
+// the time of the insert, not of the transaction's start, so it follows
+// seq closely (see rollUp).
+func createHistoryTable(ctx context.Context) error {
+	_, err := db.Exec(ctx,
+		`CREATE TABLE IF NOT EXISTS counter_history (
+			seq        BIGSERIAL PRIMARY KEY,
+			counter_id INTEGER NOT NULL,
+			op         TEXT NOT NULL,
+			delta      BIGINT NOT NULL,
+			value      BIGINT NOT NULL,
+			at         TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp()
+		);
+		ALTER TABLE counter_history ALTER COLUMN at SET DEFAULT clock_timestamp();
+		CREATE INDEX IF NOT EXISTS counter_history_counter_seq
+			ON counter_history (counter_id, seq DESC)`)
+	return err
+}
+
+func (s postgresStore) Add(ctx context.Context, id int64, delta int64) (int64, error) {
+	value, _, err := s.AddIfVersion(ctx, id, delta, anyVersion)
+	return value, err
+}
+
+// addVersioned adds delta to counter id and returns the new value and
+// version. Unless checked (the caller locked the counter and applied its
+// bounds, see writeLocked), bounded counters are left alone and reported as
+// not found.
+func addVersioned(ctx context.Context, tx pgx.Tx, id, delta int64, checked bool) (int64, int64, error) {
+	// 1. Bump the version on the counters row, which locks it until commit.
+	// Every write takes that lock first, so versions follow the commit order
+	// and each one names exactly one value, whichever shard is written.
+	var version int64
+	var shards int
+	err := tx.QueryRow(ctx,
+		`UPDATE counters SET version = version + 1 WHERE id=$1 AND ($2 OR NOT bounded) RETURNING version, shards`,
+		id, checked).Scan(&version, &shards)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, 0, errCounterNotFound
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// 2. The write, the history row, the outbox event (see outbox.go) and
+	// the notification happen in one statement. It goes to one random shard:
+	// shard 0 is the counters row, others are counter_shards rows. This
+	// statement's snapshot is taken under the lock, so the other shards it
+	// sums already hold every earlier write and no later one.
+	var value int64
+	err = tx.QueryRow(ctx,
+		`WITH main AS (
+			UPDATE counters SET value = value + $2 WHERE id = $1 AND $3 = 0
+			RETURNING value
+		), side AS (
+			INSERT INTO counter_shards (counter_id, shard, value)
+			SELECT $1, $3, $2 WHERE $3 > 0
+			ON CONFLICT (counter_id, shard) DO UPDATE SET value = counter_shards.value + EXCLUDED.value
+			RETURNING value
+		), updated AS (
+			SELECT $1::int AS id,
+				COALESCE((SELECT value FROM main), (SELECT value FROM counters WHERE id = $1))
+				+ COALESCE((SELECT value FROM side), 0)
+				+ (SELECT COALESCE(SUM(value), 0) FROM counter_shards WHERE counter_id = $1 AND shard <> $3)::bigint
+				AS value
+		), logged AS (
+			INSERT INTO counter_history (counter_id, op, delta, value)
+			SELECT id, 'add', $2, value FROM updated
+		), outbox_on AS (
+			SELECT EXISTS (SELECT 1 FROM counter_outbox_config WHERE enabled) AS enabled
+		), seq AS (
+			INSERT INTO counter_outbox_seq (counter_id, seq) SELECT id, 1 FROM updated WHERE (SELECT enabled FROM outbox_on)
+			ON CONFLICT (counter_id) DO UPDATE SET seq = counter_outbox_seq.seq + 1
+			RETURNING seq
+		), queued AS (
+			INSERT INTO counter_outbox (counter_id, seq, op, delta, value, version)
+			SELECT u.id, (SELECT seq FROM seq), 'add', $2, u.value, $4::bigint FROM updated u WHERE (SELECT enabled FROM outbox_on)
+		)
+		SELECT value, pg_notify('counter_changes', id || ':' || value || ':' || $4::bigint || ':' || $2) FROM updated`,
+		id, delta, rand.IntN(shards), version).Scan(&value, nil)
+	if isNumericOverflow(err) {
+		return 0, 0, fmt.Errorf("%w: adding %d overflows the counter", errOutOfBounds, delta)
+	}
+	return value, version, err
+}
+
+func (s postgresStore) Set(ctx context.Context, id int64, value int64) (int64, error) {
+	value, _, err := s.SetIfVersion(ctx, id, value, anyVersion)
+	return value, err
+}
+
+// setVersioned overwrites counter id and returns the new value and version.
+// Unless checked, like addVersioned, bounded counters are left alone and
+// reported as not found.
+func setVersioned(ctx context.Context, q queryRower, id, value int64, checked bool) (int64, int64, error) {
+	// Shard rows are folded away. The upsert locks the counters row, so the
+	// version is ordered with addVersioned's.
+	var version int64
+	err := q.QueryRow(ctx,
+		`WITH old AS (
+			SELECT value, bounded FROM counters WHERE id=$1 FOR UPDATE
+		), allowed AS (
+			SELECT $3 OR NOT COALESCE((SELECT bounded FROM old), false) AS ok
+		), cleared AS (
+			DELETE FROM counter_shards WHERE counter_id=$1 AND (SELECT ok FROM allowed) RETURNING value
+		), updated AS (
+			INSERT INTO counters (id, value, version) SELECT $1, $2, 1 WHERE (SELECT ok FROM allowed)
+			ON CONFLICT (id) DO UPDATE SET value = EXCLUDED.value,
+				version = counters.version + 1
+			RETURNING id, value, version
+		), change AS (
+			SELECT id, value, version,
+				value - COALESCE((SELECT value FROM old), 0) - COALESCE((SELECT SUM(value) FROM cleared), 0) AS delta
+			FROM updated
+		), logged AS (
+			INSERT INTO counter_history (counter_id, op, delta, value)
+			SELECT id, 'set', delta, value FROM change
+		), outbox_on AS (
+			SELECT EXISTS (SELECT 1 FROM counter_outbox_config WHERE enabled) AS enabled
+		), seq AS (
+			INSERT INTO counter_outbox_seq (counter_id, seq) SELECT id, 1 FROM change WHERE (SELECT enabled FROM outbox_on)
+			ON CONFLICT (counter_id) DO UPDATE SET seq = counter_outbox_seq.seq + 1
+			RETURNING seq
+		), queued AS (
+			INSERT INTO counter_outbox (counter_id, seq, op, delta, value, version)
+			SELECT c.id, (SELECT seq FROM seq), 'set', c.delta, c.value, c.version FROM change c WHERE (SELECT enabled FROM outbox_on)
+		)
+		SELECT value, version, pg_notify('counter_changes', id || ':' || value || ':' || version) FROM updated`,
+		id, value, checked).Scan(&value, &version, nil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, 0, errCounterNotFound
+	}
+	return value, version, err
+}
+
+func (postgresStore) List(ctx context.Context) ([]CounterResponse, error) {
+	rows, err := db.Query(ctx,
+		`SELECT c.id, c.value + COALESCE(s.total, 0)
+		 FROM counters c
+		 LEFT JOIN (
+			SELECT counter_id, SUM(value)::bigint AS total FROM counter_shards GROUP BY counter_id
+		 ) s ON s.counter_id = c.id
+		 ORDER BY c.id`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (CounterResponse, error) {
+		var c CounterResponse
+		err := row.Scan(&c.ID, &c.Value)
+		return c, err
+	})
+}
+
+func (s postgresStore) History(ctx context.Context, id int64, limit int) ([]HistoryEntry, error) {
+	if _, err := s.Get(ctx, id); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(ctx,
+		`SELECT at, op, delta, value FROM counter_history
+		 WHERE counter_id=$1 ORDER BY seq DESC LIMIT $2`, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (HistoryEntry, error) {
+		var e HistoryEntry
+		err := row.Scan(&e.At, &e.Op, &e.Delta, &e.Value)
+		e.At = e.At.UTC()
+		return e, err
+	})
+}
+
+// listenForChanges forwards Postgres notifications on the counter_changes
+// channel to the change hub. It holds one pool connection for as long as
+// ctx lives and reconnects after errors.
+func listenForChanges(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := listenOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Change listener stopped, retrying in 1s: %v\n", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func listenOnce(ctx context.Context) error {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN counter_changes"); err != nil {
+		return err
+	}
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		c, err := parseChangePayload(n.Payload)
+		if err != nil {
+			log.Printf("Ignoring malformed counter notification %q: %v\n", n.Payload, err)
+			continue
+		}
+		changes.publish(c)
+	}
+}
+
+// parseChangePayload parses the payload sent by postgresStore:
+// "id:value:version" for a set, "id:value:version:delta" for an add.
+func parseChangePayload(payload string) (counterChange, error) {
+	fields := strings.Split(payload, ":")
+	if len(fields) != 3 && len(fields) != 4 {
+		return counterChange{}, fmt.Errorf("want 3 or 4 fields, got %d", len(fields))
+	}
+	nums := make([]int64, len(fields))
+	for i, field := range fields {
+		n, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return counterChange{}, err
+		}
+		nums[i] = n
+	}
+	c := counterChange{ID: nums[0], Value: nums[1], Version: nums[2]}
+	if len(nums) == 4 {
+		c.Added = nums[3]
+	}
+	return c, nil
+}
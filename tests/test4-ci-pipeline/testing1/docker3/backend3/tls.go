@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves a certificate from disk and picks up new files
+// (e.g. renewed by cert-manager) without restarting the server.
+// It checks the files' modification times at most once per interval.
+type certReloader struct {
+	certFile, keyFile string
+	interval          time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, interval: 10 * time.Second}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the key pair from disk and swaps it in.
+func (c *certReloader) reload() error {
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+// GetCertificate is plugged into tls.Config and runs on every handshake.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := time.Now(); now.Sub(c.lastCheck) >= c.interval {
+		c.lastCheck = now
+		modTime, err := latestModTime(c.certFile, c.keyFile)
+		if err == nil && modTime.After(c.modTime) {
+			// Keep serving the old certificate if the new files are half-written
+			// or broken; we will try again on the next check.
+			if err := c.reload(); err != nil {
+				log.Printf("TLS certificate reload failed, keeping the old one: %v\n", err)
+			} else {
+				log.Println("TLS certificate reloaded")
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// selfSignedCertificate creates a throwaway certificate for localhost.
+// Browsers and clients will warn about it, so it is only meant for local development.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost", Organization: []string{"counter dev"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// tlsConfigFromEnv builds the server TLS configuration from:
+//
+//	TLS_CERT_FILE, TLS_KEY_FILE  serve HTTPS with this key pair (reloaded when the files change)
+//	TLS_SELF_SIGNED=true         serve HTTPS with a generated self-signed certificate (dev only)
+//	TLS_CLIENT_CA_FILE           require client certificates signed by these CAs (mTLS)
+//	TLS_CLIENT_AUTH              "require" (default) or "optional" when a client CA is set
+//
+// It returns nil when TLS is not configured, meaning plain HTTP.
+func tlsConfigFromEnv() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	switch {
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS key pair: %w", err)
+		}
+		cfg.GetCertificate = reloader.GetCertificate
+	case os.Getenv("TLS_SELF_SIGNED") == "true":
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return nil, fmt.Errorf("generate self-signed certificate: %w", err)
+		}
+		log.Println("⚠️  Serving a self-signed certificate, do not use this in production")
+		cfg.Certificates = []tls.Certificate{cert}
+	default:
+		if os.Getenv("TLS_CLIENT_CA_FILE") != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE needs a server certificate as well")
+		}
+		return nil, nil
+	}
+
+	if caFile := os.Getenv("TLS_CLIENT_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA bundle: %w", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		switch mode := os.Getenv("TLS_CLIENT_AUTH"); mode {
+		case "", "require":
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("unknown TLS_CLIENT_AUTH %q", mode)
+		}
+	}
+	return cfg, nil
+}
+
+// clientCertPrincipal is the principal name for a verified client certificate:
+// the subject's common name, or the full subject when there is no CN.
+func clientCertPrincipal(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.String()
+}
+
+// clientCertMiddleware records the verified client certificate's principal
+// on the request context so handlers and the rate limiter know who is calling.
+// Only certificates that passed chain verification are trusted.
+func clientCertMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			principal := clientCertPrincipal(r.TLS.VerifiedChains[0][0])
+			r = r.WithContext(withPrincipal(r.Context(), principal))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
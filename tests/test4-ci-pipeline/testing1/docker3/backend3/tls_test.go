@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issueCert creates a certificate for cn signed by parent (or self-signed when parent is nil).
+func issueCert(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// Test that a verified client certificate becomes the request principal
+func TestMutualTLSPrincipal(t *testing.T) {
+	// Arrange: a CA, a client certificate it signed, and a server that requires it
+	ca, caKey := issueCert(t, "test-ca", true, nil, nil)
+	client, clientKey := issueCert(t, "billing-service", false, ca, caKey)
+
+	server := httptest.NewUnstartedServer(clientCertMiddleware(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, principalFromContext(r.Context()))
+		})))
+	server.TLS = &tls.Config{ClientCAs: x509.NewCertPool(), ClientAuth: tls.RequireAndVerifyClientCert}
+	server.TLS.ClientCAs.AddCert(ca)
+	server.StartTLS()
+	defer server.Close()
+
+	httpClient := server.Client()
+	transport := httpClient.Transport.(*http.Transport)
+	transport.TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{client.Raw},
+		PrivateKey:  clientKey,
+	}}
+
+	// Act
+	resp, err := httpClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	// Assert
+	if string(body) != "billing-service" {
+		t.Errorf("Expected principal billing-service, got %q", body)
+	}
+}
+
+// Test that clients without a certificate are rejected when mTLS is required
+func TestMutualTLSRejectsMissingCert(t *testing.T) {
+	ca, _ := issueCert(t, "test-ca", true, nil, nil)
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{ClientCAs: x509.NewCertPool(), ClientAuth: tls.RequireAndVerifyClientCert}
+	server.TLS.ClientCAs.AddCert(ca)
+	server.StartTLS()
+	defer server.Close()
+
+	if _, err := server.Client().Get(server.URL); err == nil {
+		t.Error("Expected the handshake to fail without a client certificate")
+	}
+}
+
+// writeKeyPair writes cert and key as PEM files.
+func writeKeyPair(t *testing.T, certFile, keyFile string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that the reloader picks up a renewed certificate from disk
+func TestCertReloaderPicksUpNewFiles(t *testing.T) {
+	// Arrange: write a first certificate and load it
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	first, firstKey := issueCert(t, "first", false, nil, nil)
+	writeKeyPair(t, certFile, keyFile, first, firstKey)
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader.interval = 0 // check the files on every handshake
+
+	// Act: replace the files with a newer certificate
+	second, secondKey := issueCert(t, "second", false, nil, nil)
+	writeKeyPair(t, certFile, keyFile, second, secondKey)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	// Assert
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "second" {
+		t.Errorf("Expected reloaded certificate 'second', got %q", leaf.Subject.CommonName)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans this service creates.
+const tracerName = "backend2"
+
+// tracingFromEnv installs the global OpenTelemetry tracer provider.
+//
+//	TRACE_EXPORTER      stdout, file or otlp (default: none, tracing off)
+//	TRACE_FILE          where the file exporter writes (default: traces.jsonl)
+//	TRACE_SAMPLE_RATIO  share of new traces to record, 0 to 1 (default: 1).
+//	                    Requests with a sampled traceparent are always recorded.
+//
+// The otlp exporter sends OTLP/HTTP to a local collector on localhost:4318,
+// or wherever OTEL_EXPORTER_OTLP_ENDPOINT points.
+//
+// Even with tracing off, incoming traceparent headers are honoured so the
+// trace IDs in our logs match the caller's.
+// The returned function flushes buffered spans; call it before exiting.
+func tracingFromEnv(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	ratio := 1.0
+	if raw := os.Getenv("TRACE_SAMPLE_RATIO"); raw != "" {
+		var err error
+		ratio, err = strconv.ParseFloat(raw, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("TRACE_SAMPLE_RATIO must be between 0 and 1, got %q", raw)
+		}
+	}
+
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	switch name := os.Getenv("TRACE_EXPORTER"); name {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, err
+		}
+		exporter = exp
+	case "file":
+		path := os.Getenv("TRACE_FILE")
+		if path == "" {
+			path = "traces.jsonl"
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("open trace file: %w", err)
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		exporter, closer = exp, f
+	case "otlp":
+		// Without OTEL_EXPORTER_OTLP_ENDPOINT, default to a plain-HTTP local collector.
+		var opts []otlptracehttp.Option
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+			opts = append(opts, otlptracehttp.WithEndpoint("localhost:4318"), otlptracehttp.WithInsecure())
+		}
+		exp, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		exporter = exp
+	default:
+		return nil, fmt.Errorf("unknown TRACE_EXPORTER %q (want stdout, file, otlp or none)", name)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "counter-backend"))),
+	)
+	otel.SetTracerProvider(provider)
+	log.Printf("Tracing with the %s exporter, sampling %g of new traces\n", os.Getenv("TRACE_EXPORTER"), ratio)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+// statusWriter remembers the response status for the request span.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.NewResponseController reach Flush for watch streams.
+func (sw *statusWriter) Unwrap() http.ResponseWriter { return sw.ResponseWriter }
+
+// Hijack hands the connection over to /ws, whose WebSocket library asks
+// the ResponseWriter itself rather than going through Unwrap.
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	sw.status = http.StatusSwitchingProtocols
+	return http.NewResponseController(sw.ResponseWriter).Hijack()
+}
+
+// tracingMiddleware starts a server span for every request, continuing the
+// caller's trace when it sends a W3C traceparent header. Server errors are
+// logged with the trace ID so they can be looked up in the tracing backend.
+func tracingMiddleware(next http.Handler) http.Handler {
+	tracer := otel.Tracer(tracerName)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("url.query", r.URL.RawQuery),
+				attribute.String("client.address", r.RemoteAddr),
+			))
+		defer span.End()
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+			logf(ctx, "%s %s failed with %d after %v\n", r.Method, r.URL.Path, sw.status, time.Since(start))
+		}
+	})
+}
+
+// logf logs like log.Printf, prefixed with the trace and span IDs from ctx
+// when there are any.
+func logf(ctx context.Context, format string, args ...any) {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		format = "trace_id=" + sc.TraceID().String() + " span_id=" + sc.SpanID().String() + " " + format
+	}
+	log.Printf(format, args...)
+}
+
+// queryTracer gives every pgx query its own client span under the request
+// span, so slow Postgres calls show up in the trace.
+type queryTracer struct{}
+
+func (queryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	ctx, _ = otel.Tracer(tracerName).Start(ctx, "postgres "+sqlOperation(data.SQL),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system.name", "postgresql"),
+			attribute.String("db.query.text", data.SQL),
+		))
+	return ctx
+}
+
+func (queryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	span := trace.SpanFromContext(ctx)
+	// ErrNoRows is an answer, not a failure (e.g. an unknown counter id).
+	if data.Err != nil && !errors.Is(data.Err, pgx.ErrNoRows) {
+		span.RecordError(data.Err)
+		span.SetStatus(codes.Error, data.Err.Error())
+	}
+	span.SetAttributes(attribute.Int64("db.response.rows_affected", data.CommandTag.RowsAffected()))
+	span.End()
+}
+
+// sqlOperation returns the first keyword of a statement (SELECT, WITH, ...) for the span name.
+func sqlOperation(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return "query"
+	}
+	return strings.ToUpper(fields[0])
+}
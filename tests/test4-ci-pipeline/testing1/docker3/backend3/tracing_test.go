@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider that keeps finished spans in memory.
+// The previous global provider and propagator are restored when the test ends.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return recorder
+}
+
+// Test that a request span continues the caller's traceparent and a query span nests under it
+func TestTracingMiddlewareContinuesTrace(t *testing.T) {
+	// Arrange
+	recorder := recordSpans(t)
+	handler := tracingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := queryTracer{}.TraceQueryStart(r.Context(), nil, pgx.TraceQueryStartData{SQL: "SELECT value FROM counters"})
+		queryTracer{}.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{CommandTag: pgconn.NewCommandTag("SELECT 1")})
+		w.WriteHeader(http.StatusCreated)
+	}))
+	req := httptest.NewRequest("POST", "/counter/increment", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	// Act
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Assert
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected a query span and a request span, got %d spans", len(spans))
+	}
+	query, server := spans[0], spans[1]
+	if got := server.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the trace ID from traceparent, got %s", got)
+	}
+	if server.Parent().SpanID().String() != "00f067aa0ba902b7" || server.SpanKind() != trace.SpanKindServer {
+		t.Errorf("Expected a server span under the caller's span, got parent %s", server.Parent().SpanID())
+	}
+	if query.Parent().SpanID() != server.SpanContext().SpanID() || query.Name() != "postgres SELECT" {
+		t.Errorf("Expected the query span %q under the request span", query.Name())
+	}
+}
+
+// Test that server errors mark the span and are logged with the trace ID
+func TestTracingMiddlewareLogsServerErrors(t *testing.T) {
+	// Arrange
+	recorder := recordSpans(t)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	handler := tracingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+
+	// Act
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/counter", nil))
+
+	// Assert
+	span := recorder.Ended()[0]
+	if span.Status().Code != codes.Error {
+		t.Errorf("Expected an error status on the span, got %v", span.Status().Code)
+	}
+	want := "trace_id=" + span.SpanContext().TraceID().String()
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("Expected the log line to contain %q, got %q", want, logs.String())
+	}
+}
+
+// Test that the logger leaves lines without a trace untouched
+func TestLogfWithoutTrace(t *testing.T) {
+	// Arrange
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	// Act
+	logf(context.Background(), "hello %d", 1)
+
+	// Assert
+	if strings.Contains(logs.String(), "trace_id") || !strings.Contains(logs.String(), "hello 1") {
+		t.Errorf("Expected a plain log line, got %q", logs.String())
+	}
+}
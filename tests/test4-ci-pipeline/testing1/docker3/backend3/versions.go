@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Every write to a counter increments its version. Responses carry the
+// version as an ETag, so clients get optimistic concurrency for free:
+//
+//	GET /counter           -> ETag: "7"
+//	PUT /counter           If-Match: "7"   -> 200, ETag: "8"
+//	PUT /counter           If-Match: "7"   -> 412 (someone else wrote first)
+//	GET /counter           If-None-Match: "8" -> 304 Not Modified
+//
+// If-Match: * only requires that the counter exists.
+
+var (
+	// errVersionMismatch is returned when an If-Match precondition fails.
+	errVersionMismatch = errors.New("counter was changed since the given ETag (If-Match failed)")
+	// errVersionsUnsupported is returned for conditional writes on a store
+	// without versions (the write-behind buffer).
+	errVersionsUnsupported = errors.New("conditional requests are not supported with WRITE_BEHIND_INTERVAL")
+)
+
+const (
+	// anyVersion makes a write unconditional. A store that does not track
+	// versions also reports it as the version it read or wrote.
+	anyVersion int64 = -1
+	// anyExistingVersion only requires the counter to exist (If-Match: *).
+	anyExistingVersion int64 = -2
+)
+
+// versionedStore is implemented by stores that keep a version per counter.
+// The IfVersion methods fail with errVersionMismatch, without writing,
+// unless the counter's current version matches ifVersion.
+type versionedStore interface {
+	// GetVersion returns the value and version of counter id.
+	GetVersion(ctx context.Context, id int64) (value, version int64, err error)
+	// AddIfVersion adds delta and returns the new value and version.
+	AddIfVersion(ctx context.Context, id, delta, ifVersion int64) (value, version int64, err error)
+	// SetIfVersion overwrites the value, creating the counter if needed
+	// (unconditional writes only), and returns the new value and version.
+	SetIfVersion(ctx context.Context, id, value, ifVersion int64) (int64, int64, error)
+}
+
+// versionMatches evaluates ifVersion against a counter's current version.
+func versionMatches(ifVersion, current int64, exists bool) bool {
+	switch ifVersion {
+	case anyVersion:
+		return true
+	case anyExistingVersion:
+		return exists
+	}
+	return exists && current == ifVersion
+}
+
+// getCounter reads counter id and its version, or anyVersion if the store keeps none.
+func getCounter(ctx context.Context, id int64) (int64, int64, error) {
+	if vs, ok := store.(versionedStore); ok {
+		value, version, err := vs.GetVersion(ctx, id)
+		if !errors.Is(err, errVersionsUnsupported) {
+			return value, version, err
+		}
+	}
+	value, err := store.Get(ctx, id)
+	return value, anyVersion, err
+}
+
+// addCounter adds delta to counter id if its version matches ifVersion.
+func addCounter(ctx context.Context, id, delta, ifVersion int64) (int64, int64, error) {
+	if vs, ok := store.(versionedStore); ok {
+		value, version, err := vs.AddIfVersion(ctx, id, delta, ifVersion)
+		if !errors.Is(err, errVersionsUnsupported) {
+			return value, version, err
+		}
+	}
+	if ifVersion != anyVersion {
+		return 0, 0, errVersionsUnsupported
+	}
+	value, err := store.Add(ctx, id, delta)
+	return value, anyVersion, err
+}
+
+// setCounter overwrites counter id if its version matches ifVersion.
+func setCounter(ctx context.Context, id, value, ifVersion int64) (int64, int64, error) {
+	if vs, ok := store.(versionedStore); ok {
+		value, version, err := vs.SetIfVersion(ctx, id, value, ifVersion)
+		if !errors.Is(err, errVersionsUnsupported) {
+			return value, version, err
+		}
+	}
+	if ifVersion != anyVersion {
+		return 0, 0, errVersionsUnsupported
+	}
+	value, err := store.Set(ctx, id, value)
+	return value, anyVersion, err
+}
+
+// formatETag turns a version into a strong ETag.
+func formatETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// parseETag reads a strong ETag made by formatETag.
+func parseETag(tag string) (int64, bool) {
+	raw, ok := strings.CutPrefix(tag, `"`)
+	if !ok {
+		return 0, false
+	}
+	raw, ok = strings.CutSuffix(raw, `"`)
+	if !ok {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(raw, 10, 64)
+	return version, err == nil && version >= 0
+}
+
+// setETag sets the ETag header, if the store reported a version.
+func setETag(w http.ResponseWriter, version int64) {
+	if version >= 0 {
+		w.Header().Set("ETag", formatETag(version))
+	}
+}
+
+// ifMatchVersion turns the If-Match header into the ifVersion argument of
+// the write helpers. Only * and a single strong ETag are accepted.
+func ifMatchVersion(r *http.Request) (int64, error) {
+	return parseIfMatch(r.Header.Get("If-Match"))
+}
+
+// parseIfMatch reads an If-Match value, from HTTP or gRPC metadata.
+func parseIfMatch(header string) (int64, error) {
+	header = strings.TrimSpace(header)
+	switch header {
+	case "":
+		return anyVersion, nil
+	case "*":
+		return anyExistingVersion, nil
+	}
+	version, ok := parseETag(header)
+	if !ok {
+		return 0, errors.New(`If-Match must be * or a single ETag such as "3"`)
+	}
+	return version, nil
+}
+
+// notModified answers 304 if If-None-Match lists the current ETag (weak
+// comparison, as RFC 9110 requires for GET). It reports whether it did.
+func notModified(w http.ResponseWriter, r *http.Request, version int64) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" || version < 0 {
+		return false
+	}
+	current := formatETag(version)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == current {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// createVersionColumns adds the version column. A sharded counter's version
+// lives on its counters row only (see addVersioned). Shard rows used to
+// count their own writes; those counts are folded into the counters row
+// once, so no version goes backwards.
+func createVersionColumns(ctx context.Context) error {
+	_, err := db.Exec(ctx,
+		`ALTER TABLE counters ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;
+		ALTER TABLE counter_shards ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;
+		UPDATE counters c SET version = c.version + s.version
+		FROM (SELECT counter_id, SUM(version)::bigint AS version FROM counter_shards GROUP BY counter_id) s
+		WHERE c.id = s.counter_id AND s.version <> 0;
+		UPDATE counter_shards SET version = 0 WHERE version <> 0`)
+	return err
+}
+
+// queryRower is a pool or a transaction.
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func (postgresStore) GetVersion(ctx context.Context, id int64) (int64, int64, error) {
+	var value, version int64
+	err := db.QueryRow(ctx,
+		`SELECT c.value + COALESCE(s.value, 0), c.version
+		 FROM counters c, LATERAL (
+			SELECT SUM(value)::bigint AS value FROM counter_shards WHERE counter_id = c.id
+		 ) s
+		 WHERE c.id=$1`, id).Scan(&value, &version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, 0, errCounterNotFound
+	}
+	return value, version, err
+}
+
+func (s postgresStore) AddIfVersion(ctx context.Context, id, delta, ifVersion int64) (int64, int64, error) {
+	if ifVersion == anyVersion {
+		value, version, err := s.writeTx(ctx, func(tx pgx.Tx) (int64, int64, error) {
+			return addVersioned(ctx, tx, id, delta, false)
+		})
+		if !errors.Is(err, errCounterNotFound) {
+			return value, version, err
+		}
+		// The counter is missing or bounded; writeLocked tells which.
+	}
+	return s.writeLocked(ctx, id, ifVersion, func(tx pgx.Tx, current lockedCounter) (int64, int64, error) {
+		value, err := current.bounds.add(current.value, delta)
+		if err != nil {
+			return 0, 0, err
+		}
+		return addVersioned(ctx, tx, id, value-current.value, true)
+	})
+}
+
+func (s postgresStore) SetIfVersion(ctx context.Context, id, value, ifVersion int64) (int64, int64, error) {
+	if ifVersion == anyVersion {
+		value, version, err := setVersioned(ctx, db, id, value, false)
+		if !errors.Is(err, errCounterNotFound) {
+			return value, version, err
+		}
+		// The counter is bounded.
+	}
+	return s.writeLocked(ctx, id, ifVersion, func(tx pgx.Tx, current lockedCounter) (int64, int64, error) {
+		value, err := current.bounds.set(value)
+		if err != nil {
+			return 0, 0, err
+		}
+		return setVersioned(ctx, tx, id, value, true)
+	})
+}
+
+// writeLocked runs write in a transaction that first locks the counter
+// (see lockCounter), so no other write can land between the version check
+// or the bounds check and ours.
+func (s postgresStore) writeLocked(ctx context.Context, id, ifVersion int64,
+	write func(tx pgx.Tx, current lockedCounter) (int64, int64, error)) (int64, int64, error) {
+	return s.writeTx(ctx, func(tx pgx.Tx) (int64, int64, error) {
+		current, err := lockCounter(ctx, tx, id)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !versionMatches(ifVersion, current.version, current.exists) {
+			return 0, 0, errVersionMismatch
+		}
+		return write(tx, current)
+	})
+}
+
+// writeTx runs write in a transaction and commits it if write succeeds.
+func (postgresStore) writeTx(ctx context.Context, write func(tx pgx.Tx) (int64, int64, error)) (int64, int64, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	value, version, err := write(tx)
+	if err != nil {
+		return 0, 0, err
+	}
+	return value, version, tx.Commit(ctx)
+}
+
+func (m *memoryStore) GetVersion(_ context.Context, id int64) (int64, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.values[id]
+	if !ok {
+		return 0, 0, errCounterNotFound
+	}
+	return value, m.versions[id], nil
+}
+
+func (m *memoryStore) AddIfVersion(_ context.Context, id, delta, ifVersion int64) (int64, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.values[id]
+	if !versionMatches(ifVersion, m.versions[id], ok) {
+		return 0, 0, errVersionMismatch
+	}
+	if !ok {
+		return 0, 0, errCounterNotFound
+	}
+	next, err := m.bounds[id].add(value, delta)
+	if err != nil {
+		return 0, 0, err
+	}
+	m.values[id] = next
+	m.record(id, "add", next-value, next)
+	return next, m.versions[id], nil
+}
+
+func (m *memoryStore) SetIfVersion(_ context.Context, id, value, ifVersion int64) (int64, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.values[id]
+	if !versionMatches(ifVersion, m.versions[id], ok) {
+		return 0, 0, errVersionMismatch
+	}
+	value, err := m.bounds[id].set(value)
+	if err != nil {
+		return 0, 0, err
+	}
+	m.values[id] = value
+	m.record(id, "set", value-old, value)
+	return value, m.versions[id], nil
+}
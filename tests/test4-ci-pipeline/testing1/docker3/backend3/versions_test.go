@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"backend2/counterclient"
+)
+
+// sendWithHeader sends a request with one extra header to the test server.
+func sendWithHeader(t *testing.T, method, url, header, value, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// Test that every write bumps the version reported by the memory store
+func TestMemoryStoreVersions(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	m := newMemoryStore()
+
+	// Act
+	m.Add(ctx, 1, 1)
+	m.Set(ctx, 1, 10)
+	_, version, err := m.GetVersion(ctx, 1)
+	_, _, stale := m.SetIfVersion(ctx, 1, 0, version-1)
+	_, missing, missingErr := m.AddIfVersion(ctx, 7, 1, anyExistingVersion)
+
+	// Assert
+	if err != nil || version != 2 {
+		t.Errorf("Expected version 2 after two writes, got %d (err %v)", version, err)
+	}
+	if stale != errVersionMismatch {
+		t.Errorf("Expected errVersionMismatch for a stale version, got %v", stale)
+	}
+	if missingErr != errVersionMismatch || missing != 0 {
+		t.Errorf("Expected errVersionMismatch for * on a missing counter, got %v", missingErr)
+	}
+}
+
+// Test that a GET with the current ETag in If-None-Match gets 304
+func TestGetCounterNotModified(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	first := sendWithHeader(t, "GET", server.URL+"/counter", "", "", "")
+	etag := first.Header.Get("ETag")
+
+	// Act
+	same := sendWithHeader(t, "GET", server.URL+"/counter", "If-None-Match", "W/"+etag, "")
+	sendWithHeader(t, "POST", server.URL+"/counter/increment", "", "", "")
+	changed := sendWithHeader(t, "GET", server.URL+"/counter", "If-None-Match", etag, "")
+
+	// Assert
+	if etag != `"0"` {
+		t.Errorf(`Expected ETag "0" on a new counter, got %q`, etag)
+	}
+	if same.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for the current ETag, got %d", same.StatusCode)
+	}
+	if changed.StatusCode != http.StatusOK || changed.Header.Get("ETag") != `"1"` {
+		t.Errorf(`Expected 200 with ETag "1" after a write, got %d %q`, changed.StatusCode, changed.Header.Get("ETag"))
+	}
+}
+
+// Test that writes with a stale or malformed If-Match are refused
+func TestConditionalWrites(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	body := `{"value": 5}`
+
+	// Act
+	current := sendWithHeader(t, "PUT", server.URL+"/counter", "If-Match", `"0"`, body)
+	stale := sendWithHeader(t, "PUT", server.URL+"/counter", "If-Match", `"0"`, body)
+	malformed := sendWithHeader(t, "POST", server.URL+"/counter/reset", "If-Match", "0", "")
+	missing := sendWithHeader(t, "POST", server.URL+"/counter/add?id=9", "If-Match", "*", `{"delta": 1}`)
+
+	// Assert
+	if current.StatusCode != http.StatusOK || current.Header.Get("ETag") != `"1"` {
+		t.Errorf(`Expected 200 with ETag "1", got %d %q`, current.StatusCode, current.Header.Get("ETag"))
+	}
+	if stale.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale ETag, got %d", stale.StatusCode)
+	}
+	if malformed.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unquoted ETag, got %d", malformed.StatusCode)
+	}
+	if missing.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for If-Match: * on a missing counter, got %d", missing.StatusCode)
+	}
+}
+
+// Test that conditional writes are refused when writes are buffered
+func TestConditionalWritesNeedVersions(t *testing.T) {
+	// Arrange
+	server := newTestServer(t)
+	w := newWriteBehindStore(store, time.Hour)
+	defer w.Close(context.Background())
+	store = w
+
+	// Act
+	conditional := sendWithHeader(t, "POST", server.URL+"/counter/increment", "If-Match", `"0"`, "")
+	plain := sendWithHeader(t, "POST", server.URL+"/counter/increment", "", "", "")
+
+	// Assert
+	if conditional.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected 501 for If-Match with write-behind, got %d", conditional.StatusCode)
+	}
+	if plain.StatusCode != http.StatusOK || plain.Header.Get("ETag") != "" {
+		t.Errorf("Expected 200 without an ETag, got %d %q", plain.StatusCode, plain.Header.Get("ETag"))
+	}
+}
+
+// Test the client's conditional writes
+func TestCounterClientIfMatch(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	client, err := counterclient.New(newTestServer(t).URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := client.Get(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	first, firstErr := client.SetIfMatch(ctx, 1, 3, read.ETag)
+	_, secondErr := client.AddIfMatch(ctx, 1, 1, read.ETag)
+
+	// Assert
+	if firstErr != nil || first.Value != 3 || first.ETag != `"1"` {
+		t.Errorf(`Expected value 3 with ETag "1", got %+v (err %v)`, first, firstErr)
+	}
+	if !counterclient.IsPreconditionFailed(secondErr) {
+		t.Errorf("Expected a precondition failure for the stale ETag, got %v", secondErr)
+	}
+}
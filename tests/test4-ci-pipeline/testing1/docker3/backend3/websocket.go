@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// /ws lets one connection both watch counters and increment them, for
+// clients that would otherwise open a watch stream and send a POST per
+// click. Every message is a JSON WSMessage:
+//
+//	client: {"type": "subscribe", "id": 1, "ref": "a"}
+//	server: {"type": "ack", "ref": "a", "id": 1, "value": 41}
+//	client: {"type": "increment", "id": 1, "delta": 1, "ref": "b"}
+//	server: {"type": "ack", "ref": "b", "id": 1, "value": 42}
+//	server: {"type": "counter", "id": 1, "value": 42}
+//	client: {"type": "unsubscribe", "id": 1}
+//
+// A failed request is answered with {"type": "error", "ref": ..., "status":
+// 404, "error": "..."}, using the status the HTTP API would have answered.
+// Increments spend tokens from the rate limit buckets of POST
+// /counter/increment (delta 1) or /counter/add, keyed by whoever opened
+// the connection, so they get 429 errors once those are empty.
+// Values come from the change hub, like /counter/watch: a subscriber that
+// reads slowly skips intermediate values. Outgoing messages wait in a
+// per-connection buffer; a client that stops reading is disconnected after
+// wsWriteWait.
+
+// WebSocket timing, as in the gorilla/websocket examples.
+const (
+	wsWriteWait  = 10 * time.Second // for one message to be written
+	wsPongWait   = 60 * time.Second // for the pong, or any message, before the client is gone
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// wsMaxMessage bounds one client message in bytes.
+const wsMaxMessage = 4096
+
+// wsMaxSubscriptions bounds the counters one connection watches.
+const wsMaxSubscriptions = 100
+
+// Message types.
+const (
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+	wsIncrement   = "increment"
+	wsAck         = "ack"
+	wsError       = "error"
+	wsCounter     = "counter" // a pushed value
+)
+
+// WSMessage is a /ws message in either direction.
+type WSMessage struct {
+	Type   string `json:"type"`
+	Ref    string `json:"ref,omitempty"`    // set by the client, echoed in the ack or error
+	ID     int64  `json:"id,omitempty"`     // the counter (default 1)
+	Delta  int64  `json:"delta,omitempty"`  // increment only (default 1)
+	Value  *int64 `json:"value,omitempty"`  // the counter value, in acks and pushes
+	Status int    `json:"status,omitempty"` // errors only: the matching HTTP status
+	Error  string `json:"error,omitempty"`
+}
+
+// wsServer accepts /ws connections.
+type wsServer struct {
+	origins  map[string]bool // WS_ORIGINS
+	buffer   int             // outgoing messages per connection
+	upgrader websocket.Upgrader
+	limits   *rateLimiterConfig // charged for increments; nil with RATE_LIMITS=off
+
+	connections prometheus.Gauge
+	messages    *prometheus.CounterVec
+}
+
+// websockets serves /ws.
+var websockets *wsServer
+
+// newWSServer accepts connections from origins (any with "*"), from the
+// server's own origin, and from clients that send no Origin (native apps).
+func newWSServer(origins []string, buffer int) *wsServer {
+	s := &wsServer{
+		origins: make(map[string]bool),
+		buffer:  buffer,
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "counter_websocket_connections",
+			Help: "Open /ws connections.",
+		}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "counter_websocket_messages_total",
+			Help: "Messages received on /ws, by type.",
+		}, []string{"type"}),
+	}
+	for _, o := range origins {
+		s.origins[strings.ToLower(o)] = true
+	}
+	s.upgrader = websocket.Upgrader{CheckOrigin: s.checkOrigin}
+	return s
+}
+
+// wsServerFromEnv reads the allowed browser origins from WS_ORIGINS, a
+// comma-separated list like https://app.example.com ("*" allows any), and
+// the per-connection write buffer from WS_BUFFER (default 64 messages).
+func wsServerFromEnv() (*wsServer, error) {
+	var origins []string
+	for _, o := range strings.Split(os.Getenv("WS_ORIGINS"), ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		if u, err := url.Parse(o); o != "*" && (err != nil || u.Scheme == "" || u.Host == "") {
+			return nil, fmt.Errorf("invalid WS_ORIGINS entry %q, want an origin like https://app.example.com", o)
+		}
+		origins = append(origins, o)
+	}
+	buffer := 64
+	if raw := os.Getenv("WS_BUFFER"); raw != "" {
+		var err error
+		if buffer, err = strconv.Atoi(raw); err != nil || buffer < 1 {
+			return nil, fmt.Errorf("invalid WS_BUFFER %q, want a count like 64", raw)
+		}
+	}
+	return newWSServer(origins, buffer), nil
+}
+
+// checkOrigin keeps other web pages from using a visitor's browser to
+// talk to /ws.
+func (s *wsServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || s.origins["*"] || s.origins[strings.ToLower(origin)] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// wsHandler handles GET /ws.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	s := websockets
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has answered with an error
+	}
+	s.connections.Inc()
+	defer s.connections.Dec()
+
+	c := &wsConn{
+		server: s,
+		limits: s.limits,
+		conn:   conn,
+		send:   make(chan WSMessage, s.buffer),
+		done:   make(chan struct{}),
+		subs:   make(map[int64]func()),
+	}
+	if c.limits != nil {
+		// The request's identity is gone once it is hijacked, so take it now.
+		c.client = c.limits.clientKey(r)
+	}
+	go c.writeLoop()
+	c.readLoop()
+}
+
+// wsConn is one /ws connection. readLoop runs the client's requests in
+// order; writeLoop is the only writer of the connection.
+type wsConn struct {
+	server *wsServer
+	limits *rateLimiterConfig // nil with RATE_LIMITS=off
+	client string             // the upgrade request's clientKey
+	conn   *websocket.Conn
+	send   chan WSMessage
+	done   chan struct{} // closed when either loop ends
+	once   sync.Once
+
+	subs map[int64]func() // stops the forwarding of a counter; readLoop only
+}
+
+// close ends both loops and every subscription.
+func (c *wsConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// queue hands msg to writeLoop, waiting while the buffer is full. It
+// reports false once the connection is closed.
+func (c *wsConn) queue(msg WSMessage) bool {
+	select {
+	case c.send <- msg:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *wsConn) writeLoop() {
+	defer c.close()
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-closingStreams:
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(wsWriteWait))
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wsConn) readLoop() {
+	defer func() {
+		c.close()
+		for _, stop := range c.subs {
+			stop()
+		}
+	}()
+	c.conn.SetReadLimit(wsMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		var msg WSMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.server.messages.WithLabelValues("invalid").Inc()
+			if !c.queue(WSMessage{Type: wsError, Status: http.StatusBadRequest, Error: "Invalid JSON message: " + err.Error()}) {
+				return
+			}
+			continue
+		}
+		if !c.handle(msg) {
+			return
+		}
+	}
+}
+
+// handle runs one client request and queues its ack or error. It reports
+// false once the connection is closed.
+func (c *wsConn) handle(msg WSMessage) bool {
+	switch msg.Type {
+	case wsSubscribe, wsUnsubscribe, wsIncrement:
+		c.server.messages.WithLabelValues(msg.Type).Inc()
+	default:
+		c.server.messages.WithLabelValues("invalid").Inc()
+		return c.queue(WSMessage{Type: wsError, Ref: msg.Ref, Status: http.StatusBadRequest,
+			Error: fmt.Sprintf("unknown message type %q, want subscribe, unsubscribe or increment", msg.Type)})
+	}
+	id := msg.ID
+	if id == 0 {
+		id = defaultCounterID
+	}
+	if id < 0 {
+		return c.queue(WSMessage{Type: wsError, Ref: msg.Ref, ID: id, Status: http.StatusBadRequest,
+			Error: fmt.Sprintf("invalid counter id %d", id)})
+	}
+	ack := WSMessage{Type: wsAck, Ref: msg.Ref, ID: id}
+
+	ctx, cancel := context.WithTimeout(context.Background(), wsWriteWait)
+	defer cancel()
+	switch msg.Type {
+	case wsUnsubscribe:
+		if stop, ok := c.subs[id]; ok {
+			stop()
+			delete(c.subs, id)
+		}
+		return c.queue(ack)
+
+	case wsIncrement:
+		delta := msg.Delta
+		if delta == 0 {
+			delta = 1
+		}
+		// Charge the bucket of the matching HTTP route, as if the client
+		// had sent the write as a request.
+		route := "POST /counter/add"
+		if delta == 1 {
+			route = "POST /counter/increment"
+		}
+		if d := c.limits.allow(ctx, route, c.client); !d.Allowed {
+			return c.queue(WSMessage{Type: wsError, Ref: msg.Ref, ID: id, Status: http.StatusTooManyRequests,
+				Error: fmt.Sprintf("Too many requests, slow down (retry in %ds)", ceilSeconds(d.RetryAfter))})
+		}
+		value, _, err := addCounter(ctx, id, delta, anyVersion)
+		if err != nil {
+			return c.queue(wsStoreError(msg.Ref, id, err))
+		}
+		ack.Value = &value
+		return c.queue(ack)
+	}
+
+	// subscribe
+	if _, ok := c.subs[id]; !ok && len(c.subs) >= wsMaxSubscriptions {
+		return c.queue(WSMessage{Type: wsError, Ref: msg.Ref, ID: id, Status: http.StatusBadRequest,
+			Error: fmt.Sprintf("too many subscriptions, at most %d per connection", wsMaxSubscriptions)})
+	}
+	// Subscribe before reading so no change can slip in between.
+	updates, unsubscribe := changes.subscribe(id)
+	value, err := store.Get(ctx, id)
+	if err != nil {
+		unsubscribe()
+		return c.queue(wsStoreError(msg.Ref, id, err))
+	}
+	if stop, ok := c.subs[id]; ok {
+		stop() // subscribing again restarts the subscription
+	}
+	stopped := make(chan struct{})
+	c.subs[id] = func() {
+		close(stopped)
+		unsubscribe()
+	}
+	ack.Value = &value
+	// The ack is queued before any push, so the client sees the value first.
+	if !c.queue(ack) {
+		return false // readLoop stops the subscription
+	}
+	go c.forward(id, updates, stopped)
+	return true
+}
+
+// forward pushes the changes of counter id until stopped.
+func (c *wsConn) forward(id int64, updates <-chan counterChange, stopped <-chan struct{}) {
+	for {
+		select {
+		case ch := <-updates:
+			value := ch.Value
+			select {
+			case c.send <- WSMessage{Type: wsCounter, ID: id, Value: &value}:
+			case <-stopped:
+				return
+			case <-c.done:
+				return
+			}
+		case <-stopped:
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// wsStoreError turns a store error into an error message, with the status
+// writeStoreError would have answered.
+func wsStoreError(ref string, id int64, err error) WSMessage {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errCounterNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errOutOfBounds):
+		status = http.StatusConflict
+	case errors.Is(err, errCircuitOpen), errors.Is(err, errNoLeader):
+		status = http.StatusServiceUnavailable
+	}
+	return WSMessage{Type: wsError, Ref: ref, ID: id, Status: status, Error: err.Error()}
+}
+
+// Describe and Collect export the connection metrics on /metrics.
+func (s *wsServer) Describe(ch chan<- *prometheus.Desc) {
+	s.connections.Describe(ch)
+	s.messages.Describe(ch)
+}
+
+func (s *wsServer) Collect(ch chan<- prometheus.Metric) {
+	s.connections.Collect(ch)
+	s.messages.Collect(ch)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newWSTestServer serves the routes behind the tracing middleware, whose
+// ResponseWriter the upgrade has to get through, with a fresh memory store.
+func newWSTestServer(t *testing.T, origins ...string) *httptest.Server {
+	t.Helper()
+	previous := store
+	store = newMemoryStore()
+	websockets = newWSServer(origins, 8)
+	t.Cleanup(func() { store, websockets = previous, nil })
+
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	server := httptest.NewServer(tracingMiddleware(mux))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// dialWS opens /ws, sending origin unless it is empty.
+func dialWS(t *testing.T, server *httptest.Server, origin string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", header)
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+// exchange sends msg and returns the next message from the server.
+func exchange(t *testing.T, conn *websocket.Conn, msg WSMessage) WSMessage {
+	t.Helper()
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	return readWS(t, conn)
+}
+
+func readWS(t *testing.T, conn *websocket.Conn) WSMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// Test subscribing, incrementing over the socket and over HTTP, and unsubscribing
+func TestWebSocketSubscribeAndIncrement(t *testing.T) {
+	// Arrange
+	server := newWSTestServer(t)
+	conn, _, err := dialWS(t, server, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribed := exchange(t, conn, WSMessage{Type: wsSubscribe, Ref: "s"})
+
+	// Act
+	incremented := exchange(t, conn, WSMessage{Type: wsIncrement, Ref: "i", Delta: 2})
+	pushed := readWS(t, conn)
+	if incremented.Type == wsCounter { // the push may overtake the ack
+		incremented, pushed = pushed, incremented
+	}
+	sendWithHeader(t, "POST", server.URL+"/counter/increment", "", "", "")
+	fromHTTP := readWS(t, conn)
+	unsubscribed := exchange(t, conn, WSMessage{Type: wsUnsubscribe, Ref: "u"})
+	afterwards := exchange(t, conn, WSMessage{Type: wsIncrement, Ref: "j"})
+
+	// Assert
+	if subscribed.Type != wsAck || subscribed.Ref != "s" || subscribed.Value == nil || *subscribed.Value != 0 {
+		t.Errorf("Expected an ack with value 0, got %+v", subscribed)
+	}
+	if incremented.Type != wsAck || incremented.Ref != "i" || *incremented.Value != 2 {
+		t.Errorf("Expected an ack with value 2, got %+v", incremented)
+	}
+	if pushed.Type != wsCounter || *pushed.Value != 2 || fromHTTP.Type != wsCounter || *fromHTTP.Value != 3 {
+		t.Errorf("Expected pushes of 2 and 3, got %+v and %+v", pushed, fromHTTP)
+	}
+	if unsubscribed.Type != wsAck || afterwards.Type != wsAck || *afterwards.Value != 4 {
+		t.Errorf("Expected acks without pushes after unsubscribing, got %+v and %+v", unsubscribed, afterwards)
+	}
+}
+
+// Test that bad requests are answered with errors and keep the connection open
+func TestWebSocketErrors(t *testing.T) {
+	// Arrange
+	server := newWSTestServer(t)
+	conn, _, err := dialWS(t, server, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("{not json")); err != nil {
+		t.Fatal(err)
+	}
+	invalid := readWS(t, conn)
+	unknown := exchange(t, conn, WSMessage{Type: "decrement", Ref: "d"})
+	missing := exchange(t, conn, WSMessage{Type: wsSubscribe, Ref: "m", ID: 99})
+	still := exchange(t, conn, WSMessage{Type: wsIncrement})
+
+	// Assert
+	if invalid.Type != wsError || invalid.Status != http.StatusBadRequest {
+		t.Errorf("Expected a 400 error for invalid JSON, got %+v", invalid)
+	}
+	if unknown.Type != wsError || unknown.Ref != "d" || unknown.Status != http.StatusBadRequest {
+		t.Errorf("Expected a 400 error for an unknown type, got %+v", unknown)
+	}
+	if missing.Type != wsError || missing.Ref != "m" || missing.Status != http.StatusNotFound {
+		t.Errorf("Expected a 404 error for a missing counter, got %+v", missing)
+	}
+	if still.Type != wsAck || *still.Value != 1 {
+		t.Errorf("Expected the connection to keep working, got %+v", still)
+	}
+}
+
+// Test that browsers from other origins are turned away
+func TestWebSocketOrigins(t *testing.T) {
+	server := newWSTestServer(t, "https://app.example")
+	if _, resp, err := dialWS(t, server, "https://evil.example"); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for another origin, got %v", err)
+	}
+	for _, origin := range []string{"https://app.example", server.URL, ""} {
+		if _, _, err := dialWS(t, server, origin); err != nil {
+			t.Errorf("Expected origin %q to be accepted, got %v", origin, err)
+		}
+	}
+}
+
+// Test that increments over the socket spend the client's HTTP rate limit
+func TestWebSocketRateLimit(t *testing.T) {
+	// Arrange: one increment and one add per client, and no refill
+	server := newWSTestServer(t)
+	routes, _ := parseRateLimits("/counter/increment=0.001:1,/counter/add=0.001:1")
+	websockets.limits = &rateLimiterConfig{limiter: newMemoryRateLimiter(), routes: routes}
+	conn, _, err := dialWS(t, server, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	first := exchange(t, conn, WSMessage{Type: wsIncrement})
+	second := exchange(t, conn, WSMessage{Type: wsIncrement})
+	add := exchange(t, conn, WSMessage{Type: wsIncrement, Delta: 100})
+	bigger := exchange(t, conn, WSMessage{Type: wsIncrement, Delta: 100})
+
+	// Assert
+	if first.Type != wsAck || add.Type != wsAck || *add.Value != 101 {
+		t.Errorf("Expected the first increment and add to go through, got %+v and %+v", first, add)
+	}
+	if second.Status != http.StatusTooManyRequests || bigger.Status != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 errors once the buckets are empty, got %+v and %+v", second, bigger)
+	}
+}
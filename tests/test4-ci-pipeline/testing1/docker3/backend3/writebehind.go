@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writeBehindStore buffers increments in memory and applies them to the
+// durable store in the background, one Add per counter per interval.
+// It trades a short delay (and losing the buffer if the process is killed)
+// for far fewer database writes, which suits analytics-style counters.
+//
+// Reads return the durable value plus the pending delta, so a client
+// always sees its own increments. Other replicas, and watchers, only see
+// them once a batch is written.
+//
+// Increments of a counter with bounds are not buffered but written through:
+// whether one is rejected, clamped or wrapped depends on the value it meets,
+// which a batch summed at flush time would get wrong.
+type writeBehindStore struct {
+	counterStore // the durable store; History is served from it directly
+	interval     time.Duration
+
+	mu      sync.Mutex      // guards pending, writing, started and startedAll
+	pending map[int64]int64 // counter id -> delta not yet written
+
+	// writing holds the counters whose delta has left pending and is being
+	// written to the durable store; the channel is closed when it lands.
+	// Until then a durable read may or may not include that delta, so a
+	// read of such a counter waits for it (see read) instead of counting it
+	// twice or not at all. Other counters are not held up.
+	writing map[int64]chan struct{}
+	// started counts the writes started per counter, and startedAll those
+	// of every counter, so a read can tell that one began under it.
+	started    map[int64]uint64
+	startedAll uint64
+
+	stop chan struct{}
+	done chan struct{}
+
+	flushes       prometheus.Counter
+	flushErrors   prometheus.Counter
+	pendingDesc   *prometheus.Desc
+	flushDuration prometheus.Histogram
+}
+
+// newWriteBehindStore wraps durable and starts the flusher.
+// Call Close to stop it and write out what is left.
+func newWriteBehindStore(durable counterStore, interval time.Duration) *writeBehindStore {
+	w := &writeBehindStore{
+		counterStore: durable,
+		interval:     interval,
+		pending:      make(map[int64]int64),
+		writing:      make(map[int64]chan struct{}),
+		started:      make(map[int64]uint64),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+		flushes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_write_behind_flushes_total",
+			Help: "Buffered deltas written to the database (one per counter per flush).",
+		}),
+		flushErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "counter_write_behind_flush_errors_total",
+			Help: "Buffered deltas that failed to write and were kept for the next flush.",
+		}),
+		flushDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "counter_write_behind_flush_duration_seconds",
+			Help:    "Time taken by one flush of every pending counter.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		pendingDesc: prometheus.NewDesc("counter_write_behind_pending_delta",
+			"Increments accepted but not yet written to the database.", []string{"id"}, nil),
+	}
+	go w.run()
+	return w
+}
+
+func (w *writeBehindStore) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.flush(context.Background())
+		}
+	}
+}
+
+// Close stops the flusher and writes every pending delta. It returns an
+// error if some could not be written before ctx ended.
+func (w *writeBehindStore) Close(ctx context.Context) error {
+	close(w.stop)
+	<-w.done
+	w.flush(ctx)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) > 0 {
+		return errors.New("some buffered increments could not be written")
+	}
+	return nil
+}
+
+// flush writes every pending delta, one Add per counter. Each Add gets at
+// most one interval, so a stuck database cannot hold a counter's readers
+// (see read) for longer. Failed deltas go back into pending and are retried
+// on the next flush.
+func (w *writeBehindStore) flush(ctx context.Context) {
+	start := time.Now()
+	w.mu.Lock()
+	ids := make([]int64, 0, len(w.pending))
+	for id := range w.pending {
+		ids = append(ids, id)
+	}
+	w.mu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	for _, id := range ids {
+		delta, landed, err := w.take(ctx, id)
+		if err != nil {
+			return // ctx ended; what is left stays pending
+		}
+		writeCtx, cancel := context.WithTimeout(ctx, w.interval)
+		w.writePending(writeCtx, id, delta)
+		cancel()
+		landed()
+	}
+	w.flushDuration.Observe(time.Since(start).Seconds())
+}
+
+// take waits until no write of counter id is in flight, then moves its
+// pending delta out of pending and marks it as being written. Call landed
+// once it is written or put back.
+func (w *writeBehindStore) take(ctx context.Context, id int64) (delta int64, landed func(), err error) {
+	w.mu.Lock()
+	if err := w.awaitLocked(ctx, w.writingOf(id)); err != nil {
+		return 0, nil, err
+	}
+	delta = w.pending[id]
+	delete(w.pending, id)
+	done := make(chan struct{})
+	w.writing[id] = done
+	w.started[id]++
+	w.startedAll++
+	w.mu.Unlock()
+	return delta, func() {
+		w.mu.Lock()
+		delete(w.writing, id)
+		close(done)
+		w.mu.Unlock()
+	}, nil
+}
+
+// awaitLocked waits, with w.mu held, until busy reports no write to wait
+// for. It returns with w.mu held, or unlocked if ctx ends first.
+func (w *writeBehindStore) awaitLocked(ctx context.Context, busy func() (chan struct{}, bool)) error {
+	for {
+		done, ok := busy()
+		if !ok {
+			return nil
+		}
+		w.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		w.mu.Lock()
+	}
+}
+
+// writePending writes delta, taken out of pending, to the durable store.
+// A delta that failed to write goes back into pending and the error is
+// returned; one for a counter that is gone, or that its bounds (set after
+// it was buffered) reject, is dropped.
+func (w *writeBehindStore) writePending(ctx context.Context, id, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	_, err := w.counterStore.Add(ctx, id, delta)
+	switch {
+	case err == nil:
+		w.flushes.Inc()
+	case errors.Is(err, errCounterNotFound), errors.Is(err, errOutOfBounds):
+		logf(ctx, "Dropping buffered delta %d for counter %d: %v\n", delta, id, err)
+	default:
+		w.flushErrors.Inc()
+		logf(ctx, "Write-behind flush of counter %d failed, retrying later: %v\n", id, err)
+		w.mu.Lock()
+		w.pending[id] += delta
+		w.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// pendingDelta returns the buffered delta of counter id.
+func (w *writeBehindStore) pendingDelta(id int64) int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pending[id]
+}
+
+// read returns counter id's durable value plus its pending delta, after
+// adding delta to pending. The durable read does not overlap a write of
+// the counter's buffered delta: it waits for one in flight and is redone
+// if one started under it.
+func (w *writeBehindStore) read(ctx context.Context, id, delta int64) (int64, error) {
+	for {
+		w.mu.Lock()
+		if err := w.awaitLocked(ctx, w.writingOf(id)); err != nil {
+			return 0, err
+		}
+		started := w.started[id]
+		w.mu.Unlock()
+
+		value, err := w.counterStore.Get(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+
+		w.mu.Lock()
+		if w.started[id] == started {
+			if delta != 0 {
+				w.pending[id] += delta
+			}
+			pending := w.pending[id]
+			w.mu.Unlock()
+			return value + pending, nil
+		}
+		w.mu.Unlock()
+	}
+}
+
+func (w *writeBehindStore) Get(ctx context.Context, id int64) (int64, error) {
+	return w.read(ctx, id, 0)
+}
+
+// Add buffers delta. The durable read checks that the counter exists and
+// gives the value to return; it does not take any row lock. A bounded
+// counter's delta is written through, so one its bounds reject fails here
+// with errOutOfBounds (409) instead of being dropped by a later flush.
+func (w *writeBehindStore) Add(ctx context.Context, id int64, delta int64) (int64, error) {
+	if bounded, ok := capability[boundedStore](w.counterStore); ok {
+		bounds, err := bounded.Bounds(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		if !bounds.isZero() {
+			return w.writeThrough(ctx, id, func() (int64, error) {
+				return w.counterStore.Add(ctx, id, delta)
+			})
+		}
+	}
+	return w.read(ctx, id, delta)
+}
+
+// Set overwrites the value through writeThrough.
+func (w *writeBehindStore) Set(ctx context.Context, id int64, value int64) (int64, error) {
+	return w.writeThrough(ctx, id, func() (int64, error) {
+		return w.counterStore.Set(ctx, id, value)
+	})
+}
+
+// writeThrough writes counter id's buffered delta first, so the history
+// stays in order, then runs write against the durable store. Both count as
+// one write in flight (see take).
+func (w *writeBehindStore) writeThrough(ctx context.Context, id int64, write func() (int64, error)) (int64, error) {
+	delta, landed, err := w.take(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	defer landed()
+	if err := w.writePending(ctx, id, delta); err != nil {
+		return 0, err
+	}
+	return write()
+}
+
+// List is read for every counter: it waits until no write is in flight and
+// is redone if one started under it.
+func (w *writeBehindStore) List(ctx context.Context) ([]CounterResponse, error) {
+	for {
+		w.mu.Lock()
+		if err := w.awaitLocked(ctx, w.anyWriting); err != nil {
+			return nil, err
+		}
+		started := w.startedAll
+		w.mu.Unlock()
+
+		counters, err := w.counterStore.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		w.mu.Lock()
+		if w.startedAll == started {
+			for i := range counters {
+				counters[i].Value += w.pending[counters[i].ID]
+			}
+			w.mu.Unlock()
+			return counters, nil
+		}
+		w.mu.Unlock()
+	}
+}
+
+// writingOf returns a func reporting the write of counter id in flight, if
+// there is one.
+func (w *writeBehindStore) writingOf(id int64) func() (chan struct{}, bool) {
+	return func() (chan struct{}, bool) {
+		done, ok := w.writing[id]
+		return done, ok
+	}
+}
+
+// anyWriting returns the channel of some write in flight, if there is one.
+func (w *writeBehindStore) anyWriting() (chan struct{}, bool) {
+	for _, done := range w.writing {
+		return done, true
+	}
+	return nil, false
+}
+
+// unwrap lets shards, bounds, schedules and series pass through to the
+// durable store (see capability).
+func (w *writeBehindStore) unwrap() counterStore { return w.counterStore }
+
+// Describe and Collect export the write-behind metrics on /metrics.
+func (w *writeBehindStore) Describe(ch chan<- *prometheus.Desc) {
+	w.flushes.Describe(ch)
+	w.flushErrors.Describe(ch)
+	w.flushDuration.Describe(ch)
+	ch <- w.pendingDesc
+}
+
+func (w *writeBehindStore) Collect(ch chan<- prometheus.Metric) {
+	w.flushes.Collect(ch)
+	w.flushErrors.Collect(ch)
+	w.flushDuration.Collect(ch)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for id, delta := range w.pending {
+		ch <- prometheus.MustNewConstMetric(w.pendingDesc, prometheus.GaugeValue, float64(delta), strconv.FormatInt(id, 10))
+	}
+}
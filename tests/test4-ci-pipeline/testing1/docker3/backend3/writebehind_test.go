@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Test that increments are buffered, visible to reads, and written as one Add per flush
+func TestWriteBehindBatchesIncrements(t *testing.T) {
+	// Arrange: an interval long enough that only explicit flushes run
+	ctx := context.Background()
+	durable := newMemoryStore()
+	w := newWriteBehindStore(durable, time.Hour)
+	defer w.Close(ctx)
+
+	// Act
+	for range 5 {
+		w.Add(ctx, 1, 1)
+	}
+	value, _ := w.Get(ctx, 1)
+	stored, _ := durable.Get(ctx, 1)
+	pending := testutil.CollectAndCount(w, "counter_write_behind_pending_delta")
+	w.flush(ctx)
+
+	// Assert
+	if value != 5 || stored != 0 {
+		t.Errorf("Expected reads to see 5 while the database has 0, got %d and %d", value, stored)
+	}
+	if pending != 1 {
+		t.Errorf("Expected one pending counter in the metrics, got %d", pending)
+	}
+	history, _ := durable.History(ctx, 1, 10)
+	if len(history) != 1 || history[0].Delta != 5 {
+		t.Errorf("Expected a single write of +5, got %v", history)
+	}
+	if got := testutil.ToFloat64(w.flushes); got != 1 {
+		t.Errorf("Expected 1 flush, got %v", got)
+	}
+	if value, _ := w.Get(ctx, 1); value != 5 {
+		t.Errorf("Expected 5 after the flush, got %d", value)
+	}
+}
+
+// Test that a missing counter is rejected instead of buffered
+func TestWriteBehindUnknownCounter(t *testing.T) {
+	// Arrange
+	w := newWriteBehindStore(newMemoryStore(), time.Hour)
+	defer w.Close(context.Background())
+
+	// Act
+	_, err := w.Add(context.Background(), 42, 1)
+
+	// Assert
+	if err != errCounterNotFound {
+		t.Errorf("Expected errCounterNotFound, got %v", err)
+	}
+}
+
+// Test that Set writes the buffered delta before overwriting, and Close flushes the rest
+func TestWriteBehindSetAndClose(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	durable := newMemoryStore()
+	w := newWriteBehindStore(durable, time.Hour)
+
+	// Act
+	w.Add(ctx, 1, 3)
+	w.Set(ctx, 1, 10)
+	w.Add(ctx, 1, 2)
+	err := w.Close(ctx)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := durable.Get(ctx, 1); value != 12 {
+		t.Errorf("Expected 12 in the database after Close, got %d", value)
+	}
+	history, _ := durable.History(ctx, 1, 10)
+	if len(history) != 3 || history[2].Op != "add" || history[1].Op != "set" {
+		t.Errorf("Expected add, set, add in order, got %v", history)
+	}
+}
+
+// Test that an increment past a reject bound fails at once instead of being dropped at flush
+func TestWriteBehindBoundedCounter(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	durable := newMemoryStore()
+	w := newWriteBehindStore(durable, time.Hour)
+	defer w.Close(ctx)
+	max := int64(5)
+	if err := durable.SetBounds(ctx, 1, counterBounds{Max: &max}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	value, err := w.Add(ctx, 1, 4)
+	_, rejected := w.Add(ctx, 1, 4)
+
+	// Assert
+	if err != nil || value != 4 {
+		t.Errorf("Expected 4, got %d (%v)", value, err)
+	}
+	if !errors.Is(rejected, errOutOfBounds) {
+		t.Errorf("Expected errOutOfBounds, got %v", rejected)
+	}
+	if stored, _ := durable.Get(ctx, 1); stored != 4 {
+		t.Errorf("Expected the accepted increment in the database without a flush, got %d", stored)
+	}
+	if pending := w.pendingDelta(1); pending != 0 {
+		t.Errorf("Expected nothing buffered, got %d", pending)
+	}
+}
+
+// stuckStore is a memory store whose Add hangs until its context ends.
+type stuckStore struct {
+	*memoryStore
+	adding chan struct{} // closed when an Add is waiting
+}
+
+func (s *stuckStore) Add(ctx context.Context, id int64, delta int64) (int64, error) {
+	close(s.adding)
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+// Test that a flush gives up on a hung write when its context ends, keeps
+// the delta, and does not hold up reads of other counters meanwhile
+func TestWriteBehindFlushDoesNotBlockOtherCounters(t *testing.T) {
+	// Arrange
+	ctx := context.Background()
+	durable := &stuckStore{memoryStore: newMemoryStore(), adding: make(chan struct{})}
+	durable.Set(ctx, 2, 7)
+	w := newWriteBehindStore(durable, time.Hour)
+	w.Add(ctx, 1, 3)
+
+	// Act
+	flushed := make(chan struct{})
+	go func() {
+		flushCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		w.flush(flushCtx)
+		close(flushed)
+	}()
+	<-durable.adding
+	other, err := w.Get(ctx, 2)
+	<-flushed
+
+	// Assert
+	if err != nil || other != 7 {
+		t.Errorf("Expected 7 for the other counter during the flush, got %d (%v)", other, err)
+	}
+	if pending := w.pendingDelta(1); pending != 3 {
+		t.Errorf("Expected the delta kept after the timeout, got %d", pending)
+	}
+	if got := testutil.ToFloat64(w.flushErrors); got != 1 {
+		t.Errorf("Expected 1 flush error, got %v", got)
+	}
+}